@@ -0,0 +1,282 @@
+// Package bot answers Telegram commands with results from the index, so the
+// index can be searched and watched from a phone.
+package bot
+
+import (
+	"dhtc/config"
+	"dhtc/db"
+	"dhtc/downloader"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leekchan/gtf"
+	"github.com/rs/zerolog/log"
+	telegram "gopkg.in/telebot.v3"
+)
+
+// results is the number of torrents listed by /search and /latest.
+const results = 5
+
+// downloadLabels are the names of the downloaders shown on buttons.
+var downloadLabels = map[string]string{
+	downloader.Transmission: "Transmission",
+	downloader.Aria2:        "Aria2",
+	downloader.Deluge:       "Deluge",
+	downloader.QBittorrent:  "qBittorrent",
+}
+
+// downloadButton is the callback of the download buttons. Its data is the
+// downloader and the info hash, separated by "|".
+var downloadButton = &telegram.InlineButton{Unique: "download"}
+
+// Bot handles the commands of the chats allowed by the configuration.
+type Bot struct {
+	bot      *telegram.Bot
+	config   *config.Configuration
+	database db.Repository
+	watches  *db.WatchEngine
+	// newClient returns the client of a downloader.
+	newClient func(name string) (downloader.Client, error)
+}
+
+// New creates a bot with the Telegram token of cfg. The bot answers nothing
+// until it is started.
+func New(cfg *config.Configuration, database db.Repository, watches *db.WatchEngine) (*Bot, error) {
+	tb, err := telegram.NewBot(telegram.Settings{
+		Token:  cfg.TelegramToken,
+		Poller: &telegram.LongPoller{Timeout: 10 * time.Second},
+		OnError: func(err error, c telegram.Context) {
+			log.Error().Err(err).Msg("telegram bot command failed")
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newBot(tb, cfg, database, watches), nil
+}
+
+func newBot(tb *telegram.Bot, cfg *config.Configuration, database db.Repository, watches *db.WatchEngine) *Bot {
+	b := &Bot{
+		bot:      tb,
+		config:   cfg,
+		database: database,
+		watches:  watches,
+		newClient: func(name string) (downloader.Client, error) {
+			return downloader.New(name, cfg)
+		},
+	}
+	tb.Use(b.restrict)
+	tb.Handle("/start", b.help)
+	tb.Handle("/help", b.help)
+	tb.Handle("/search", b.search)
+	tb.Handle("/latest", b.latest)
+	tb.Handle("/stats", b.stats)
+	tb.Handle("/watch", b.watch)
+	tb.Handle(downloadButton, b.download)
+	return b
+}
+
+// Start polls the updates of the bot until it is stopped.
+func (b *Bot) Start() {
+	b.bot.Start()
+}
+
+func (b *Bot) Stop() {
+	b.bot.Stop()
+}
+
+// restrict ignores updates of chats which are not allow-listed.
+func (b *Bot) restrict(next telegram.HandlerFunc) telegram.HandlerFunc {
+	return func(c telegram.Context) error {
+		chat := c.Chat()
+		if chat == nil || !slices.Contains(ParseChatIDs(b.config.TelegramChatIDs), chat.ID) {
+			return nil
+		}
+		return next(c)
+	}
+}
+
+// ParseChatIDs returns the comma separated chat ids of value. Invalid ids are
+// skipped.
+func ParseChatIDs(value string) []int64 {
+	var ids []int64
+	for _, field := range strings.Split(value, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (b *Bot) help(c telegram.Context) error {
+	return c.Send(strings.Join([]string{
+		"/search <query> - search the index",
+		"/latest - newest torrents",
+		"/stats - size of the index",
+		"/watch add <query> - watch for new torrents",
+		"/watch list - list the watches",
+		"/watch rm <id> - delete a watch",
+	}, "\n"))
+}
+
+func (b *Bot) search(c telegram.Context) error {
+	query := strings.TrimSpace(c.Message().Payload)
+	if query == "" {
+		return c.Send("Usage: /search <query>")
+	}
+	res, total, err := b.database.Search(db.QueryKey, "", query, results, 0, db.SearchFilters{Collapse: true})
+	if err != nil {
+		return c.Send("Search failed: " + err.Error())
+	}
+	return b.sendTorrents(c, fmt.Sprintf("%d results for '%s'", total, query), res)
+}
+
+func (b *Bot) latest(c telegram.Context) error {
+	res, _, err := b.database.GetLatest(results, 0, db.SearchFilters{Collapse: true})
+	if err != nil {
+		return c.Send("Could not read the latest torrents: " + err.Error())
+	}
+	return b.sendTorrents(c, "Latest torrents", res)
+}
+
+// sendTorrents sends a numbered list of torrents with buttons to send them to
+// the configured downloaders.
+func (b *Bot) sendTorrents(c telegram.Context, title string, torrents []db.MetaData) error {
+	lines := []string{"<b>" + html.EscapeString(title) + "</b>"}
+	var keyboard [][]telegram.InlineButton
+	clients := b.downloaders()
+	publicURL := strings.TrimSuffix(b.config.PublicURL, "/")
+	for i, t := range torrents {
+		name := html.EscapeString(t.Name)
+		if publicURL != "" {
+			name = fmt.Sprintf(`<a href="%s/torrent/%s">%s</a>`, publicURL, t.InfoHash, name)
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s (%s)", i+1, name, formatSize(t.TotalSize)))
+		var row []telegram.InlineButton
+		for _, client := range clients {
+			row = append(row, telegram.InlineButton{
+				Unique: downloadButton.Unique,
+				Text:   fmt.Sprintf("%d: %s", i+1, downloadLabels[client]),
+				Data:   client + "|" + t.InfoHash,
+			})
+		}
+		if row != nil {
+			keyboard = append(keyboard, row)
+		}
+	}
+	opts := &telegram.SendOptions{ParseMode: telegram.ModeHTML, DisableWebPagePreview: true}
+	if keyboard != nil {
+		opts.ReplyMarkup = &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+	}
+	return c.Send(strings.Join(lines, "\n"), opts)
+}
+
+// downloaders returns the names of the configured downloaders.
+func (b *Bot) downloaders() []string {
+	var names []string
+	for _, name := range downloader.Names {
+		if _, err := b.newClient(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// download sends the torrent of a download button to its downloader.
+func (b *Bot) download(c telegram.Context) error {
+	args := c.Args()
+	if len(args) != 2 {
+		return c.Respond(&telegram.CallbackResponse{Text: "Invalid button"})
+	}
+	name, infoHash := args[0], args[1]
+	client, err := b.newClient(name)
+	if err != nil {
+		return c.Respond(&telegram.CallbackResponse{Text: err.Error(), ShowAlert: true})
+	}
+	t, err := b.database.GetTorrent(infoHash)
+	if err != nil {
+		return c.Respond(&telegram.CallbackResponse{Text: err.Error(), ShowAlert: true})
+	}
+	if err = client.AddMagnet(downloader.MagnetLink(t.InfoHash, t.Name), downloader.Options{}); err != nil {
+		return c.Respond(&telegram.CallbackResponse{Text: "Failed: " + err.Error(), ShowAlert: true})
+	}
+	return c.Respond(&telegram.CallbackResponse{Text: fmt.Sprintf("Sent '%s' to %s", t.Name, downloadLabels[name])})
+}
+
+func (b *Bot) stats(c telegram.Context) error {
+	lines := []string{fmt.Sprintf("%d torrents", b.database.GetInfoHashCount())}
+	if dist, err := b.database.GetCategoryDistribution(); err == nil {
+		for _, category := range slices.Sorted(maps.Keys(dist)) {
+			lines = append(lines, fmt.Sprintf("%s: %d", category, dist[category]))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%d watches", len(b.database.GetWatchEntries())))
+	return c.Send(strings.Join(lines, "\n"))
+}
+
+func (b *Bot) watch(c telegram.Context) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Send("Usage: /watch add <query>, /watch list or /watch rm <id>")
+	}
+	switch args[0] {
+	case "add":
+		entry := db.WatchEntry{
+			Key:     db.QueryKey,
+			Content: strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(c.Message().Payload), "add")),
+		}
+		if entry.Content == "" {
+			return c.Send("Usage: /watch add <query>")
+		}
+		if err := entry.Validate(); err != nil {
+			return c.Send("Invalid watch: " + err.Error())
+		}
+		if !b.database.InsertWatchEntry(entry) {
+			return c.Send("Could not add the watch.")
+		}
+		b.reload()
+		return c.Send(fmt.Sprintf("Watching '%s'.", entry.Content))
+	case "list":
+		entries := b.database.GetWatchEntries()
+		if len(entries) == 0 {
+			return c.Send("No watches.")
+		}
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			description := strings.TrimSpace(entry.Key + " " + entry.MatchType + " " + entry.Content)
+			lines[i] = fmt.Sprintf("<code>%s</code> %s", html.EscapeString(entry.Id), html.EscapeString(description))
+		}
+		return c.Send(strings.Join(lines, "\n"), telegram.ModeHTML)
+	case "rm":
+		if len(args) != 2 {
+			return c.Send("Usage: /watch rm <id>")
+		}
+		err := b.database.DeleteWatchEntry(args[1])
+		if errors.Is(err, db.ErrNotFound) {
+			return c.Send("No such watch.")
+		}
+		if err != nil {
+			return c.Send("Could not delete the watch: " + err.Error())
+		}
+		b.reload()
+		return c.Send("Watch deleted.")
+	}
+	return c.Send("Usage: /watch add <query>, /watch list or /watch rm <id>")
+}
+
+func (b *Bot) reload() {
+	if b.watches != nil {
+		b.watches.Reload()
+	}
+}
+
+// formatSize formats a size like the web interface.
+func formatSize(size uint64) string {
+	return gtf.GtfTextFuncMap["filesizeformat"].(func(any) string)(size)
+}
@@ -0,0 +1,173 @@
+package bot
+
+import (
+	"dhtc/config"
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"dhtc/downloader"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	telegram "gopkg.in/telebot.v3"
+)
+
+// apiRecorder stands in for the Telegram Bot API and records the calls.
+type apiRecorder struct {
+	mu    sync.Mutex
+	calls []apiCall
+}
+
+type apiCall struct {
+	Method  string
+	Payload map[string]any
+}
+
+func (a *apiRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	a.mu.Lock()
+	a.calls = append(a.calls, apiCall{Method: method, Payload: payload})
+	a.mu.Unlock()
+	if method == "sendMessage" {
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":42}}}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+}
+
+func (a *apiRecorder) take() []apiCall {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	calls := a.calls
+	a.calls = nil
+	return calls
+}
+
+type fakeClient struct {
+	magnets []string
+}
+
+func (c *fakeClient) AddMagnet(magnet string, opts downloader.Options) error {
+	c.magnets = append(c.magnets, magnet)
+	return nil
+}
+
+func newTestBot(t *testing.T) (*Bot, *apiRecorder, *fakeClient, db.Repository) {
+	repo := dbtest.NewRepository(t, "sqlite")
+
+	api := &apiRecorder{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	tb, err := telegram.NewBot(telegram.Settings{Token: "token", URL: srv.URL, Offline: true, Synchronous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Configuration{TelegramChatIDs: "7, 42"}
+	b := newBot(tb, cfg, repo, nil)
+	client := &fakeClient{}
+	b.newClient = func(name string) (downloader.Client, error) {
+		if name == downloader.QBittorrent {
+			return client, nil
+		}
+		return nil, errors.New("not configured")
+	}
+	return b, api, client, repo
+}
+
+func command(chat int64, text string) telegram.Update {
+	return telegram.Update{Message: &telegram.Message{Chat: &telegram.Chat{ID: chat}, Sender: &telegram.User{ID: chat}, Text: text}}
+}
+
+func TestParseChatIDs(t *testing.T) {
+	ids := ParseChatIDs(" 7, -100123,x,")
+	if len(ids) != 2 || ids[0] != 7 || ids[1] != -100123 {
+		t.Errorf("unexpected ids %v", ids)
+	}
+}
+
+func TestBot_Restrict(t *testing.T) {
+	b, api, _, _ := newTestBot(t)
+	b.bot.ProcessUpdate(command(13, "/stats"))
+	if calls := api.take(); len(calls) != 0 {
+		t.Errorf("expected no answer to a foreign chat, got %+v", calls)
+	}
+	b.bot.ProcessUpdate(command(42, "/stats"))
+	if calls := api.take(); len(calls) != 1 || !strings.Contains(calls[0].Payload["text"].(string), "0 watches") {
+		t.Errorf("expected statistics, got %+v", calls)
+	}
+}
+
+func TestBot_SearchAndDownload(t *testing.T) {
+	b, api, client, repo := newTestBot(t)
+	repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{1, 2}, Name: "Ubuntu 24.04 <desktop>", TotalSize: 6 << 30})
+	repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{3}, Name: "Debian 12", TotalSize: 1 << 30})
+
+	b.bot.ProcessUpdate(command(42, "/search ubuntu"))
+	calls := api.take()
+	if len(calls) != 1 {
+		t.Fatalf("expected one message, got %+v", calls)
+	}
+	text := calls[0].Payload["text"].(string)
+	if !strings.Contains(text, "1. Ubuntu 24.04 &lt;desktop&gt;") || strings.Contains(text, "Debian") {
+		t.Errorf("unexpected results %q", text)
+	}
+	var markup telegram.ReplyMarkup
+	if err := json.Unmarshal([]byte(calls[0].Payload["reply_markup"].(string)), &markup); err != nil {
+		t.Fatal(err)
+	}
+	if len(markup.InlineKeyboard) != 1 || len(markup.InlineKeyboard[0]) != 1 {
+		t.Fatalf("expected one download button, got %+v", markup.InlineKeyboard)
+	}
+	button := markup.InlineKeyboard[0][0]
+	if button.Text != "1: qBittorrent" {
+		t.Errorf("unexpected button %+v", button)
+	}
+
+	b.bot.ProcessUpdate(telegram.Update{Callback: &telegram.Callback{
+		ID:      "1",
+		Data:    button.Data,
+		Sender:  &telegram.User{ID: 42},
+		Message: &telegram.Message{Chat: &telegram.Chat{ID: 42}},
+	}})
+	if len(client.magnets) != 1 || !strings.HasPrefix(client.magnets[0], "magnet:?xt=urn:btih:0102") {
+		t.Errorf("expected the magnet to be sent, got %v", client.magnets)
+	}
+	if calls = api.take(); len(calls) != 1 || calls[0].Method != "answerCallbackQuery" {
+		t.Errorf("expected a callback answer, got %+v", calls)
+	}
+}
+
+func TestBot_Watch(t *testing.T) {
+	b, api, _, repo := newTestBot(t)
+	b.bot.ProcessUpdate(command(42, "/watch add ubuntu size:>1GB"))
+	entries := repo.GetWatchEntries()
+	if len(entries) != 1 || entries[0].Key != db.QueryKey || entries[0].Content != "ubuntu size:>1GB" {
+		t.Fatalf("unexpected watches %+v", entries)
+	}
+
+	b.bot.ProcessUpdate(command(42, "/watch list"))
+	// Ids are not SQL conditions.
+	b.bot.ProcessUpdate(command(42, "/watch rm 1=1"))
+	b.bot.ProcessUpdate(command(42, "/watch rm "+entries[0].Id))
+	b.bot.ProcessUpdate(command(42, "/watch rm "+entries[0].Id))
+	calls := api.take()
+	if len(calls) != 5 || !strings.Contains(calls[1].Payload["text"].(string), "ubuntu size:&gt;1GB") {
+		t.Fatalf("unexpected answers %+v", calls)
+	}
+	for i, want := range []string{"No such watch.", "Watch deleted.", "No such watch."} {
+		if text := calls[i+2].Payload["text"]; text != want {
+			t.Errorf("expected %q, got %q", want, text)
+		}
+	}
+	if entries = repo.GetWatchEntries(); len(entries) != 0 {
+		t.Errorf("expected the watch to be deleted, got %+v", entries)
+	}
+}
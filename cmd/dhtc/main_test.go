@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -13,7 +14,10 @@ func TestSystemStartup(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	os.Args = []string{"dhtc", "-OnlyWebServer", "-address", "127.0.0.1:4201"}
+	// The database and its search index are created next to the database
+	// name, so keep them out of the package directory.
+	database := filepath.Join(t.TempDir(), "dhtdb")
+	os.Args = []string{"dhtc", "-OnlyWebServer", "-address", "127.0.0.1:4201", "-database", database}
 
 	go main()
 
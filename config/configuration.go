@@ -9,6 +9,7 @@ type Configuration struct {
 	DbName       string
 	DatabaseType string
 	DatabaseUrl  string
+	SchemaDryRun bool
 	Address      string
 	MaxNeighbors uint          `form:"MaxNeighbors"`
 	MaxLeeches   int           `form:"MaxLeeches"`
@@ -16,6 +17,7 @@ type Configuration struct {
 
 	TelegramToken    string `form:"TelegramToken"`
 	TelegramUsername string `form:"TelegramUsername"`
+	TelegramChatIDs  string `form:"TelegramChatIDs"`
 
 	DiscordWebhook string `form:"DiscordWebhook"`
 
@@ -24,6 +26,14 @@ type Configuration struct {
 	GotifyURL   string `form:"GotifyURL"`
 	GotifyToken string `form:"GotifyToken"`
 
+	NotifierURLs    string `form:"NotifierURLs"`
+	NotifyTemplates string
+	NotifyFilters   string `form:"NotifyFilters"`
+	CrawlerAlert    time.Duration
+	NotifyInterval  time.Duration
+	PublicURL       string
+	DigestTime      string
+
 	SafeMode bool `form:"SafeMode"`
 
 	CrawlerThreads         int `form:"CrawlerThreads"`
@@ -56,21 +66,30 @@ type Configuration struct {
 	QBittorrentURL  string `form:"QBittorrentURL"`
 	QBittorrentUser string `form:"QBittorrentUser"`
 	QBittorrentPass string `form:"QBittorrentPass"`
+
+	ReplicationToken string
+	ReplicationPeers string
+
+	ClusterInterval time.Duration
+
+	FeedTorrentURL string
+
+	TorznabAPIKey string
 }
 
 func ParseArguments() *Configuration {
 	config := Configuration{}
 
-	flag.StringVar(&config.DbName, "database", "dhtdb", "database name (for CloverDB)")
-	flag.StringVar(&config.DatabaseType, "database-type", "clover", "database type (clover, sqlite, postgres, mysql)")
-	flag.StringVar(&config.DatabaseUrl, "database-url", "", "database URL (for GORM backends)")
+	addDatabaseFlags(flag.CommandLine, &config)
+	flag.BoolVar(&config.SchemaDryRun, "schema-dry-run", false, "print pending schema migrations and exit")
 	flag.StringVar(&config.Address, "address", ":4200", "address to run on")
 	flag.UintVar(&config.MaxNeighbors, "MaxNeighbors", 500, "max. indexer neighbors")
 	flag.IntVar(&config.MaxLeeches, "MaxLeeches", 128, "max. leeches")
 	flag.DurationVar(&config.DrainTimeout, "DrainTimeout", 5*time.Second, "drain timeout")
 
 	flag.StringVar(&config.TelegramToken, "TelegramToken", "", "bot token for notifications")
-	flag.StringVar(&config.TelegramUsername, "TelegramUsername", "", "username to send notifications to")
+	flag.StringVar(&config.TelegramUsername, "TelegramUsername", "", "username (@name) or chat id to send notifications to")
+	flag.StringVar(&config.TelegramChatIDs, "telegram-chat-ids", "", "comma separated ids of the chats allowed to use the commands of the Telegram bot")
 
 	flag.StringVar(&config.DiscordWebhook, "DiscordWebhook", "", "Discord webhook URL")
 
@@ -79,6 +98,14 @@ func ParseArguments() *Configuration {
 	flag.StringVar(&config.GotifyURL, "GotifyURL", "", "Gotify URL")
 	flag.StringVar(&config.GotifyToken, "GotifyToken", "", "Gotify token")
 
+	flag.StringVar(&config.NotifierURLs, "notifier-urls", "", "space separated URLs of webhook, ntfy, matrix, smtp and apprise notifiers")
+	flag.StringVar(&config.NotifyTemplates, "notify-templates", "", "file of Go templates overriding the text of notifications")
+	flag.DurationVar(&config.NotifyInterval, "notify-interval", time.Second, "min. time between two notifications of a notifier")
+	flag.StringVar(&config.NotifyFilters, "notify-filters", "", "events sent to each notifier, e.g. 'discord?min-severity=warning phone?events=watch,crawler mail?digest=1h'")
+	flag.DurationVar(&config.CrawlerAlert, "crawler-alert", 30*time.Minute, "alert the notifiers if the crawlers found no new torrents for this long (0 disables)")
+	flag.StringVar(&config.PublicURL, "public-url", "", "URL of the web interface, linked by notifications (e.g. https://dhtc.example.org)")
+	flag.StringVar(&config.DigestTime, "digest-time", "08:00", "time of day (15:04) at which daily digests of watches are sent")
+
 	flag.BoolVar(&config.SafeMode, "SafeMode", false, "start with safe mode enabled")
 	flag.IntVar(&config.CrawlerThreads, "CrawlerThreads", 2, "dht crawler threads")
 	flag.IntVar(&config.MaxConcurrentDownloads, "MaxConcurrentDownloads", 10, "max. concurrent metadata downloads")
@@ -111,7 +138,31 @@ func ParseArguments() *Configuration {
 	flag.StringVar(&config.QBittorrentUser, "qbittorrent-user", "", "qBittorrent username")
 	flag.StringVar(&config.QBittorrentPass, "qbittorrent-pass", "", "qBittorrent password")
 
+	flag.StringVar(&config.ReplicationToken, "replication-token", "", "shared secret of the replication feed (the feed is disabled if empty)")
+	flag.StringVar(&config.ReplicationPeers, "replication-peers", "", "comma separated URLs of dhtc peers to replicate from")
+
+	flag.DurationVar(&config.ClusterInterval, "cluster-interval", 10*time.Minute, "interval of grouping near-duplicate torrents (0 disables it)")
+
+	flag.StringVar(&config.FeedTorrentURL, "feed-torrent-url", "", "URL of .torrent files linked by feeds, {infohash} is replaced (magnet links if empty)")
+
+	flag.StringVar(&config.TorznabAPIKey, "torznab-apikey", "", "API key of the Torznab indexer API (the API is disabled if empty)")
+
 	flag.Parse()
 
 	return &config
 }
+
+func addDatabaseFlags(fs *flag.FlagSet, config *Configuration) {
+	fs.StringVar(&config.DbName, "database", "dhtdb", "database name (for CloverDB)")
+	fs.StringVar(&config.DatabaseType, "database-type", "clover", "database type (clover, sqlite, postgres, mysql)")
+	fs.StringVar(&config.DatabaseUrl, "database-url", "", "database URL (for GORM backends)")
+}
+
+// NewCommandFlagSet creates the flag set of a sub command, which already
+// contains the database flags.
+func NewCommandFlagSet(name string) (*flag.FlagSet, *Configuration) {
+	config := &Configuration{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	addDatabaseFlags(fs, config)
+	return fs, config
+}
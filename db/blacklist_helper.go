@@ -23,3 +23,13 @@ func GetBlacklistTypeFromStrInt(entryType string) string {
 	}
 	return "Unknown"
 }
+
+func GetBlacklistStrIntFromType(entryType string) string {
+	switch entryType {
+	case "Name":
+		return "0"
+	case "File name":
+		return "1"
+	}
+	return entryType
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestGormChangesWithConcurrentInserts(t *testing.T) {
+	r := newTestGormRepository(t).(*GormRepository)
+
+	// The first insert stalls before its commit, so that the second one would
+	// commit first if inserts were not serialized.
+	stalled, release := make(chan struct{}), make(chan struct{})
+	err := r.db.Callback().Create().After("gorm:create").Register("test:stall", func(db *gorm.DB) {
+		if torrent, ok := db.Statement.Dest.(*GormTorrent); ok && torrent.Name == "slow" {
+			close(stalled)
+			<-release
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "slow"})
+	}()
+	<-stalled
+	go func() {
+		defer wg.Done()
+		r.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{2}, Name: "fast"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var after int64
+	changes, err := r.GetChanges(after, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		after = changes[len(changes)-1].Seq
+	}
+	close(release)
+	wg.Wait()
+
+	rest, err := r.GetChanges(after, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = append(changes, rest...)
+	if len(changes) != 2 || changes[0].Name != "slow" || changes[1].Name != "fast" || changes[0].Seq >= changes[1].Seq {
+		t.Errorf("expected both torrents in commit order, got %+v", changes)
+	}
+}
@@ -1,12 +1,16 @@
 package db
 
 import (
+	"cmp"
 	"dhtc/config"
 	dhtcclient "dhtc/dhtc-client"
-	"encoding/hex"
+	"dhtc/notifier"
 	"math/rand"
 	"os"
 	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ostafen/clover/v2"
@@ -18,6 +22,18 @@ import (
 type CloverRepository struct {
 	db     *clover.DB
 	config *config.Configuration
+
+	// insertMu serializes inserts, so that torrents become visible in the
+	// order of their sequence numbers and the change feed never skips one.
+	insertMu sync.Mutex
+	seq      int64
+
+	// clusterSeq is a sequence number up to which all torrents are clustered,
+	// see GetUnclusteredTorrents.
+	clusterMu  sync.Mutex
+	clusterSeq int64
+
+	index *cloverIndex
 }
 
 func NewCloverRepository(config *config.Configuration) (Repository, error) {
@@ -31,57 +47,253 @@ func NewCloverRepository(config *config.Configuration) (Repository, error) {
 		return nil, err
 	}
 
-	_ = db.CreateCollection(TorrentTable)
-	_ = db.CreateCollection(WatchTable)
-	_ = db.CreateCollection(BlacklistTable)
-	_ = db.CreateCollection(StatsTable)
-
-	return &CloverRepository{
+	repo := &CloverRepository{
 		db:     db,
 		config: config,
-	}, nil
+	}
+
+	if _, err = repo.Migrate(config.SchemaDryRun); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if config.SchemaDryRun {
+		return repo, nil
+	}
+	if repo.seq, err = lastCloverSeq(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if repo.index, err = openCloverIndex(cloverIndexPath(config.DbName)); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err = repo.index.sync(db); err != nil {
+		_ = repo.Close()
+		return nil, err
+	}
+
+	return repo, nil
 }
 
 func (r *CloverRepository) GetInfoHashCount() int {
-	vals, _ := r.db.FindAll(query.NewQuery(TorrentTable))
-	return len(vals)
+	count, _ := r.db.Count(query.NewQuery(TorrentTable))
+	return count
 }
 
 func (r *CloverRepository) FindBy(key string, searchType string, searchInput string) []MetaData {
-	values, _ := r.db.FindAll(query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
-		return Matches(doc, key, searchType, searchInput)
-	}))
+	matches, err := documentMatcher(key, searchType, searchInput)
+	if err != nil {
+		return nil
+	}
+	values, _ := r.db.FindAll(query.NewQuery(TorrentTable).MatchFunc(matches))
 	return Documents2MetaData(values)
 }
 
+func (r *CloverRepository) GetTorrent(infoHash string) (Torrent, error) {
+	doc, err := r.db.FindFirst(query.NewQuery(TorrentTable).Where(query.Field("InfoHash").Eq(infoHash)))
+	if err != nil {
+		return Torrent{}, err
+	}
+	if doc == nil {
+		return Torrent{}, ErrNotFound
+	}
+	return Document2Torrent(doc), nil
+}
+
 func (r *CloverRepository) Search(key string, searchType string, searchInput string, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
-	q := query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
-		if !Matches(doc, key, searchType, searchInput) {
-			return false
-		}
-		totalSize, _ := doc.Get("TotalSize").(uint64)
-		if filters.MinSize > 0 && totalSize < filters.MinSize {
-			return false
+	if r.index != nil && canSearchIndex(key, searchType) {
+		return r.searchIndex(key, searchInput, limit, offset, filters)
+	}
+
+	matches, err := documentMatcher(key, searchType, searchInput)
+	if err != nil {
+		return nil, 0, err
+	}
+	matchesSearch := func(doc *document.Document) bool {
+		return matches(doc) && MatchesFilters(doc, filters)
+	}
+
+	// Without index there is no rank, so relevance is only computed on request,
+	// or by default for fuzzy searches.
+	relevance := Relevance
+	if searchType == MatchFuzzy {
+		relevance = FuzzyScore
+	}
+	if filters.SortField(searchType == MatchFuzzy) == SortRelevance || filters.Sort == SortRelevance {
+		if filters.Cursor.isKeyset() {
+			return nil, 0, ErrInvalidCursor
 		}
-		if filters.MaxSize > 0 && totalSize > filters.MaxSize {
-			return false
+		q := query.NewQuery(TorrentTable).MatchFunc(matchesSearch)
+		return r.searchByRelevance(q, searchInput, relevance, limit, pageStart(offset, filters.Cursor), filters)
+	}
+	return r.findPage(matchesSearch, limit, offset, filters)
+}
+
+// findPage returns a page of the torrents matched by matches, sorted by filters.
+func (r *CloverRepository) findPage(matches func(doc *document.Document) bool, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	q := query.NewQuery(TorrentTable).MatchFunc(matches)
+	var total int
+	if !filters.SkipTotal {
+		total, _ = r.db.Count(q)
+	}
+
+	field := filters.SortField(false)
+	// Clusters can only be collapsed after sorting all matches, so collapsed
+	// pages use offset cursors.
+	keyset := field == SortDiscovered && !filters.Collapse
+	afterCursor, err := cloverCursorMatcher(filters, keyset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if afterCursor != nil {
+		q = query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
+			return afterCursor(doc) && matches(doc)
+		})
+	}
+
+	direction := -1
+	if filters.SortAscending {
+		direction = 1
+	}
+	sort := []query.SortOption{{Field: cloverSortFields[field], Direction: direction}}
+	// The id breaks ties, so that keyset cursors continue at a well-defined position.
+	if keyset {
+		sort = append(sort, query.SortOption{Field: "_id", Direction: direction})
+	} else {
+		sort = append(sort, query.SortOption{Field: "DiscoveredOn", Direction: -1}, query.SortOption{Field: "_id", Direction: -1})
+	}
+
+	start := pageStart(offset, filters.Cursor)
+	if filters.Collapse {
+		values, err := r.db.FindAll(q.Sort(sort...))
+		if err != nil {
+			return nil, 0, err
 		}
+		mds := collapseClusters(Documents2MetaData(values))
+		return offsetPage(mds, limit, start), int64(len(mds)), nil
+	}
+	values, err := r.db.FindAll(q.Sort(sort...).Limit(limit).Skip(start))
+	if err != nil {
+		return nil, 0, err
+	}
+	mds := Documents2MetaData(values)
+	for i, doc := range values {
 		discoveredOn, _ := doc.Get("DiscoveredOn").(int64)
-		if filters.StartDate > 0 && discoveredOn < filters.StartDate {
-			return false
+		mds[i].Cursor = resultCursor(keyset, discoveredOn, doc.ObjectId(), start, i)
+	}
+	return mds, int64(total), nil
+}
+
+// cloverCursorMatcher matches the documents after a keyset cursor, which is
+// only valid for documents ordered by discovery date. It returns nil without
+// keyset cursor.
+func cloverCursorMatcher(filters SearchFilters, keyset bool) (func(doc *document.Document) bool, error) {
+	cursor := filters.Cursor
+	if !cursor.isKeyset() {
+		return nil, nil
+	}
+	if !keyset {
+		return nil, ErrInvalidCursor
+	}
+	return func(doc *document.Document) bool {
+		discoveredOn, _ := doc.Get("DiscoveredOn").(int64)
+		c := cmp.Compare(discoveredOn, cursor.DiscoveredOn)
+		if c == 0 {
+			c = strings.Compare(doc.ObjectId(), cursor.Id)
 		}
-		if filters.EndDate > 0 && discoveredOn > filters.EndDate {
-			return false
+		if filters.SortAscending {
+			return c > 0
 		}
+		return c < 0
+	}, nil
+}
+
+func (r *CloverRepository) Facets(key string, searchType string, searchInput string, filters SearchFilters) (Facets, error) {
+	if r.index != nil && canSearchIndex(key, searchType) {
+		return r.index.facets(key, searchInput, filters)
+	}
+
+	matches, err := documentMatcher(key, searchType, searchInput)
+	if err != nil {
+		return Facets{}, err
+	}
+	q := query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
+		return matches(doc) && MatchesFilters(doc, filters)
+	})
+	collector := newFacetCollector()
+	err = r.db.ForEach(q, func(doc *document.Document) bool {
+		totalSize, _ := doc.Get("TotalSize").(uint64)
+		discoveredOn, _ := doc.Get("DiscoveredOn").(int64)
+		collector.add(stringList(doc.Get("Categories")), stringList(doc.Get("Extensions")), totalSize, discoveredOn)
 		return true
 	})
+	if err != nil {
+		return Facets{}, err
+	}
+	return collector.facets(), nil
+}
+
+var cloverSortFields = map[string]string{
+	SortRelevance:  "Relevance",
+	SortDiscovered: "DiscoveredOn",
+	SortSize:       "TotalSize",
+	SortFiles:      "FileCount",
+}
 
-	total, _ := r.db.Count(q)
-	values, err := r.db.FindAll(q.Sort(query.SortOption{Field: "DiscoveredOn", Direction: -1}).Limit(limit).Skip(offset))
+func (r *CloverRepository) searchByRelevance(q *query.Query, searchInput string, relevance func(name string, searchInput string) float64, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	values, err := r.db.FindAll(q)
 	if err != nil {
 		return nil, 0, err
 	}
-	return Documents2MetaData(values), int64(total), nil
+	mds := Documents2MetaData(values)
+	discoveredOn := make(map[string]int64, len(values))
+	for i, md := range mds {
+		mds[i].Relevance = relevance(md.Name, searchInput)
+		discoveredOn[md.InfoHash], _ = values[i].Get("DiscoveredOn").(int64)
+	}
+	slices.SortStableFunc(mds, func(a, b MetaData) int {
+		c := cmp.Compare(b.Relevance, a.Relevance)
+		if filters.SortAscending {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Compare(discoveredOn[b.InfoHash], discoveredOn[a.InfoHash])
+		}
+		return c
+	})
+
+	if filters.Collapse {
+		mds = collapseClusters(mds)
+	}
+	return offsetPage(mds, limit, offset), int64(len(mds)), nil
+}
+
+// searchIndex pages with offset cursors only, the index has no stable keyset.
+func (r *CloverRepository) searchIndex(key string, searchInput string, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	if filters.Cursor.isKeyset() {
+		return nil, 0, ErrInvalidCursor
+	}
+	start := pageStart(offset, filters.Cursor)
+	hits, total, err := r.index.search(key, searchInput, limit, start, filters)
+	if err != nil {
+		return nil, 0, err
+	}
+	mds := make([]MetaData, 0, len(hits))
+	for i, hit := range hits {
+		doc, err := r.db.FindFirst(query.NewQuery(TorrentTable).Where(query.Field("InfoHash").Eq(hit.InfoHash)))
+		if err != nil {
+			return nil, 0, err
+		}
+		if doc != nil {
+			md := Document2MetaData(doc)
+			md.Relevance = hit.Score
+			md.Variants = hit.Variants
+			md.Cursor = Cursor{Offset: start + i + 1}
+			mds = append(mds, md)
+		}
+	}
+	return mds, total, nil
 }
 
 func (r *CloverRepository) GetNRandomEntries(N int) []MetaData {
@@ -98,14 +310,11 @@ func (r *CloverRepository) GetNRandomEntries(N int) []MetaData {
 	return Documents2MetaData(rVal)
 }
 
-func (r *CloverRepository) GetLatest(limit int, offset int) ([]MetaData, int64, error) {
-	q := query.NewQuery(TorrentTable)
-	total, _ := r.db.Count(q)
-	values, err := r.db.FindAll(q.Sort(query.SortOption{Field: "DiscoveredOn", Direction: -1}).Limit(limit).Skip(offset))
-	if err != nil {
-		return nil, 0, err
-	}
-	return Documents2MetaData(values), int64(total), nil
+func (r *CloverRepository) GetLatest(limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	filters.Sort, filters.SortAscending = SortDiscovered, false
+	return r.findPage(func(doc *document.Document) bool {
+		return MatchesFilters(doc, filters)
+	}, limit, offset, filters)
 }
 
 func (r *CloverRepository) InsertMetadata(md dhtcclient.Metadata) bool {
@@ -114,39 +323,246 @@ func (r *CloverRepository) InsertMetadata(md dhtcclient.Metadata) bool {
 		return false
 	}
 
+	t := NewTorrent(md)
 	doc := document.NewDocument()
-	doc.Set("Name", md.Name)
-	doc.Set("InfoHash", hex.EncodeToString(md.InfoHash))
-	doc.Set("Files", md.Files)
-	doc.Set("DiscoveredOn", md.DiscoveredOn)
-	doc.Set("TotalSize", md.TotalSize)
-	doc.Set("Categories", Categorize(md))
-	_, err := r.db.InsertOne(TorrentTable, doc)
-	return err == nil
+	setTorrentFields(doc, t)
+
+	r.insertMu.Lock()
+	defer r.insertMu.Unlock()
+	doc.Set("Seq", r.seq+1)
+	if _, err := r.db.InsertOne(TorrentTable, doc); err != nil {
+		return false
+	}
+	r.seq++
+
+	if r.index != nil {
+		if err := r.index.add(t); err != nil {
+			log.Error().Err(err).Msgf("could not index %s", md.Name)
+		}
+	}
+	return true
+}
+
+func lastCloverSeq(db *clover.DB) (int64, error) {
+	doc, err := db.FindFirst(query.NewQuery(TorrentTable).Sort(query.SortOption{Field: "Seq", Direction: -1}))
+	if err != nil || doc == nil {
+		return 0, err
+	}
+	seq, _ := doc.Get("Seq").(int64)
+	return seq, nil
+}
+
+func setTorrentFields(doc *document.Document, t Torrent) {
+	doc.Set("Name", t.Name)
+	doc.Set("InfoHash", t.InfoHash)
+	doc.Set("Files", t.Files)
+	doc.Set("DiscoveredOn", t.DiscoveredOn)
+	doc.Set("TotalSize", t.TotalSize)
+	doc.Set("FileCount", len(t.Files))
+	doc.Set("Extensions", fileExtensions(t.Files))
+	doc.Set("Categories", torrentCategories(t))
+	// Changed torrents are fingerprinted and clustered again.
+	doc.Set("ClusterId", "")
+}
+
+func (r *CloverRepository) MergeTorrents(torrents []Torrent) (MergeResult, error) {
+	var res MergeResult
+	var inserts []*document.Document
+	var indexed []Torrent
+	for _, t := range DeduplicateTorrents(torrents) {
+		doc, err := r.db.FindFirst(query.NewQuery(TorrentTable).Where(query.Field("InfoHash").Eq(t.InfoHash)))
+		if err != nil {
+			return res, err
+		}
+
+		if doc != nil {
+			merged, changed := MergeTorrent(Document2Torrent(doc), t)
+			if !changed {
+				res.Skipped++
+				continue
+			}
+			err = r.db.UpdateById(TorrentTable, doc.ObjectId(), func(doc *document.Document) *document.Document {
+				newDoc := doc.Copy()
+				setTorrentFields(newDoc, merged)
+				return newDoc
+			})
+			if err != nil {
+				return res, err
+			}
+			seq, _ := doc.Get("Seq").(int64)
+			r.unclusterSeq(seq)
+			res.Merged++
+			indexed = append(indexed, merged)
+			continue
+		}
+
+		if r.config.EnableBlacklist && r.IsBlacklisted(t.Metadata()) {
+			res.Skipped++
+			continue
+		}
+		doc = document.NewDocument()
+		setTorrentFields(doc, t)
+		inserts = append(inserts, doc)
+		indexed = append(indexed, t)
+	}
+
+	if len(inserts) > 0 {
+		r.insertMu.Lock()
+		defer r.insertMu.Unlock()
+		for i, doc := range inserts {
+			doc.Set("Seq", r.seq+int64(i)+1)
+		}
+		if err := r.db.Insert(TorrentTable, inserts...); err != nil {
+			return res, err
+		}
+		r.seq += int64(len(inserts))
+	}
+	res.Inserted = len(inserts)
+
+	if r.index != nil && len(indexed) > 0 {
+		return res, r.index.add(indexed...)
+	}
+	return res, nil
+}
+
+// GetUnclusteredTorrents walks the torrents on the Seq index from clusterSeq,
+// so a batch only reads the torrents of the previous batch again instead of
+// scanning and sorting all torrents.
+func (r *CloverRepository) GetUnclusteredTorrents(limit int) ([]Torrent, error) {
+	r.clusterMu.Lock()
+	defer r.clusterMu.Unlock()
+
+	var torrents []Torrent
+	first, last := int64(0), r.clusterSeq
+	q := query.NewQuery(TorrentTable).Where(query.Field("Seq").Gt(r.clusterSeq)).Sort(query.SortOption{Field: "Seq", Direction: 1})
+	err := r.db.ForEach(q, func(doc *document.Document) bool {
+		last, _ = doc.Get("Seq").(int64)
+		if clusterId, _ := doc.Get("ClusterId").(string); clusterId != "" {
+			return true
+		}
+		if len(torrents) == 0 {
+			first = last
+		}
+		torrents = append(torrents, Document2Torrent(doc))
+		return len(torrents) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The torrents before the first unclustered one are clustered. The returned
+	// ones are skipped cheaply by the next batch once they are clustered.
+	if len(torrents) > 0 {
+		r.clusterSeq = first - 1
+	} else {
+		r.clusterSeq = last
+	}
+	return torrents, nil
+}
+
+// unclusterSeq moves clusterSeq before seq, whose torrent lost its cluster.
+func (r *CloverRepository) unclusterSeq(seq int64) {
+	r.clusterMu.Lock()
+	r.clusterSeq = min(r.clusterSeq, seq-1)
+	r.clusterMu.Unlock()
+}
+
+func (r *CloverRepository) FindCluster(fp Fingerprint) (string, error) {
+	var clusterId string
+	var oldest int64
+	for field, key := range map[string]string{"NameKey": fp.NameKey, "FilesKey": fp.FilesKey} {
+		if key == "" {
+			continue
+		}
+		docs, err := r.db.FindAll(query.NewQuery(TorrentTable).Where(query.Field(field).Eq(key)))
+		if err != nil {
+			return "", err
+		}
+		for _, doc := range docs {
+			id, _ := doc.Get("ClusterId").(string)
+			discoveredOn, _ := doc.Get("DiscoveredOn").(int64)
+			if id != "" && (clusterId == "" || discoveredOn < oldest) {
+				clusterId, oldest = id, discoveredOn
+			}
+		}
+	}
+	return clusterId, nil
+}
+
+func (r *CloverRepository) SetCluster(infoHash string, fp Fingerprint, clusterId string) error {
+	q := query.NewQuery(TorrentTable).Where(query.Field("InfoHash").Eq(infoHash))
+	err := r.db.Update(q, map[string]any{"NameKey": fp.NameKey, "FilesKey": fp.FilesKey, "ClusterId": clusterId})
+	if err != nil || r.index == nil {
+		return err
+	}
+	doc, err := r.db.FindFirst(q)
+	if err != nil || doc == nil {
+		return err
+	}
+	return r.index.addClustered(Document2Torrent(doc), clusterId)
+}
+
+func (r *CloverRepository) GetChanges(after int64, limit int) ([]Change, error) {
+	q := query.NewQuery(TorrentTable).Where(query.Field("Seq").Gt(after)).Sort(query.SortOption{Field: "Seq", Direction: 1}).Limit(limit)
+	docs, err := r.db.FindAll(q)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, len(docs))
+	for i, doc := range docs {
+		seq, _ := doc.Get("Seq").(int64)
+		changes[i] = Change{Seq: seq, Torrent: Document2Torrent(doc)}
+	}
+	return changes, nil
+}
+
+func (r *CloverRepository) ForEachTorrent(filters SearchFilters, fn func(Change) error) error {
+	q := query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
+		seq, _ := doc.Get("Seq").(int64)
+		return seq > filters.AfterSeq && MatchesFilters(doc, filters)
+	}).Sort(query.SortOption{Field: "Seq", Direction: 1})
+
+	var fnErr error
+	err := r.db.ForEach(q, func(doc *document.Document) bool {
+		seq, _ := doc.Get("Seq").(int64)
+		fnErr = fn(Change{Seq: seq, Torrent: Document2Torrent(doc)})
+		return fnErr == nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
 }
 
 func (r *CloverRepository) GetWatchEntries() []WatchEntry {
 	all, _ := r.db.FindAll(query.NewQuery(WatchTable))
 	rVal := make([]WatchEntry, len(all))
 	for i, value := range all {
-		k, _ := value.Get("Key").(string)
-		mt, _ := value.Get("MatchType").(string)
-		c, _ := value.Get("Content").(string)
-		rVal[i] = WatchEntry{
-			Id:        value.ObjectId(),
-			Key:       k,
-			MatchType: mt,
-			Content:   c,
-		}
+		rVal[i] = document2WatchEntry(value)
 	}
 	return rVal
 }
 
-func (r *CloverRepository) InsertWatchEntry(key string, searchType string, searchInput string) bool {
+func (r *CloverRepository) InsertWatchEntry(entry WatchEntry) bool {
 	doc := document.NewDocument()
-	doc.Set("Key", key)
-	doc.Set("MatchType", searchType)
-	doc.Set("Content", searchInput)
+	doc.Set("Key", entry.Key)
+	doc.Set("MatchType", entry.MatchType)
+	doc.Set("Content", entry.Content)
+	doc.Set("MinSize", entry.MinSize)
+	doc.Set("MaxSize", entry.MaxSize)
+	doc.Set("Categories", entry.Categories)
+	doc.Set("MinFiles", entry.MinFiles)
+	doc.Set("Exclude", entry.Exclude)
+	doc.Set("QuietStart", entry.QuietStart)
+	doc.Set("QuietEnd", entry.QuietEnd)
+	doc.Set("Notifiers", entry.Notifiers)
+	doc.Set("Downloader", entry.Downloader)
+	doc.Set("SavePath", entry.SavePath)
+	doc.Set("Label", entry.Label)
+	doc.Set("DailyCap", entry.DailyCap)
+	doc.Set("FirstMatchOnly", entry.FirstMatchOnly)
+	doc.Set("Digest", entry.Digest)
+	doc.Set("DigestInterval", entry.DigestInterval)
 	_, err := r.db.InsertOne(WatchTable, doc)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not insert watch entry")
@@ -156,9 +572,175 @@ func (r *CloverRepository) InsertWatchEntry(key string, searchType string, searc
 }
 
 func (r *CloverRepository) DeleteWatchEntry(entryId string) error {
+	if doc, err := r.db.FindById(WatchTable, entryId); err != nil || doc == nil {
+		return ErrNotFound
+	}
+	if err := r.db.Delete(query.NewQuery(WatchHitTable).Where(query.Field("WatchId").Eq(entryId))); err != nil {
+		return err
+	}
 	return r.db.DeleteById(WatchTable, entryId)
 }
 
+func (r *CloverRepository) InsertWatchHit(hit WatchHit) (string, error) {
+	doc := document.NewDocument()
+	doc.Set("WatchId", hit.WatchId)
+	doc.Set("InfoHash", hit.InfoHash)
+	doc.Set("Name", hit.Name)
+	doc.Set("Time", hit.Time)
+	doc.Set("Quiet", hit.Quiet)
+	doc.Set("Digest", hit.Digest)
+	doc.Set("Deliveries", encodeDeliveries(hit.Deliveries))
+	doc.Set("Downloader", hit.Downloader)
+	doc.Set("DownloadStatus", hit.DownloadStatus)
+	doc.Set("DownloadError", hit.DownloadError)
+	return r.db.InsertOne(WatchHitTable, doc)
+}
+
+func (r *CloverRepository) SetWatchHitDelivery(id string, d notifier.Delivery) error {
+	return r.db.UpdateById(WatchHitTable, id, func(doc *document.Document) *document.Document {
+		deliveries, _ := doc.Get("Deliveries").(string)
+		doc.Set("Deliveries", encodeDeliveries(setDelivery(decodeDeliveries(deliveries), d)))
+		return doc
+	})
+}
+
+func (r *CloverRepository) GetWatchHits(watchId string, limit int) ([]WatchHit, error) {
+	q := query.NewQuery(WatchHitTable)
+	if watchId != "" {
+		q = q.Where(query.Field("WatchId").Eq(watchId))
+	}
+	docs, err := r.db.FindAll(q.Sort(query.SortOption{Field: "Time", Direction: -1}).Limit(limit))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]WatchHit, len(docs))
+	for i, doc := range docs {
+		res[i] = document2WatchHit(doc)
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) GetWatchHitsSince(watchId string, since int64) ([]WatchHit, error) {
+	q := query.NewQuery(WatchHitTable).Where(query.Field("WatchId").Eq(watchId).And(query.Field("Time").GtEq(since)))
+	docs, err := r.db.FindAll(q.Sort(query.SortOption{Field: "Time", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]WatchHit, len(docs))
+	for i, doc := range docs {
+		res[i] = document2WatchHit(doc)
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) GetWatchDownloads(watchId string, since int64) ([]WatchHit, error) {
+	q := query.NewQuery(WatchHitTable).Where(query.Field("WatchId").Eq(watchId).
+		And(query.Field("DownloadStatus").Eq(DownloadSent)).
+		And(query.Field("Time").GtEq(since)))
+	docs, err := r.db.FindAll(q.Sort(query.SortOption{Field: "Time", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]WatchHit, len(docs))
+	for i, doc := range docs {
+		res[i] = document2WatchHit(doc)
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) GetWatchHitStats() (map[string]WatchHitStats, error) {
+	res := make(map[string]WatchHitStats)
+	err := r.db.ForEach(query.NewQuery(WatchHitTable), func(doc *document.Document) bool {
+		watchId, _ := doc.Get("WatchId").(string)
+		t, _ := doc.Get("Time").(int64)
+		stats := res[watchId]
+		stats.Count++
+		stats.LastHit = max(stats.LastHit, t)
+		res[watchId] = stats
+		return true
+	})
+	return res, err
+}
+
+func (r *CloverRepository) InsertOutboxItem(item notifier.OutboxItem) (string, error) {
+	doc := document.NewDocument()
+	doc.Set("Notifier", item.Notifier)
+	doc.Set("Event", encodeEvent(item.Event))
+	doc.Set("Ref", item.Ref)
+	doc.Set("Created", item.Created)
+	doc.Set("Attempts", item.Attempts)
+	doc.Set("NextAttempt", item.NextAttempt)
+	doc.Set("LastError", item.LastError)
+	return r.db.InsertOne(OutboxTable, doc)
+}
+
+func (r *CloverRepository) GetOutboxItems() ([]notifier.OutboxItem, error) {
+	docs, err := r.db.FindAll(query.NewQuery(OutboxTable).Sort(query.SortOption{Field: "Created", Direction: 1}))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]notifier.OutboxItem, len(docs))
+	for i, doc := range docs {
+		res[i] = document2OutboxItem(doc)
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) UpdateOutboxItem(item notifier.OutboxItem) error {
+	return r.db.UpdateById(OutboxTable, item.Id, func(doc *document.Document) *document.Document {
+		doc.Set("Attempts", item.Attempts)
+		doc.Set("NextAttempt", item.NextAttempt)
+		doc.Set("LastError", item.LastError)
+		return doc
+	})
+}
+
+func (r *CloverRepository) DeleteOutboxItem(id string) error {
+	return r.db.DeleteById(OutboxTable, id)
+}
+
+func (r *CloverRepository) GetSavedSearches() ([]SavedSearch, error) {
+	docs, err := r.db.FindAll(query.NewQuery(SavedSearchTable).Sort(query.SortOption{Field: "Name", Direction: 1}))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]SavedSearch, len(docs))
+	for i, doc := range docs {
+		res[i] = document2SavedSearch(doc)
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) GetSavedSearch(id string) (SavedSearch, error) {
+	doc, err := r.db.FindById(SavedSearchTable, id)
+	if err != nil {
+		return SavedSearch{}, err
+	}
+	if doc == nil {
+		return SavedSearch{}, ErrNotFound
+	}
+	return document2SavedSearch(doc), nil
+}
+
+func (r *CloverRepository) InsertSavedSearch(s SavedSearch) (string, error) {
+	doc := document.NewDocument()
+	doc.Set("Name", s.Name)
+	doc.Set("Key", s.Key)
+	doc.Set("MatchType", s.MatchType)
+	doc.Set("SearchInput", s.SearchInput)
+	doc.Set("Filters", encodeFilters(s.Filters))
+	doc.Set("Token", s.Token)
+	doc.Set("CreatedOn", s.CreatedOn)
+	return r.db.InsertOne(SavedSearchTable, doc)
+}
+
+func (r *CloverRepository) DeleteSavedSearch(id string) error {
+	if doc, err := r.db.FindById(SavedSearchTable, id); err != nil || doc == nil {
+		return ErrNotFound
+	}
+	return r.db.DeleteById(SavedSearchTable, id)
+}
+
 func (r *CloverRepository) GetBlacklistEntries() []BlacklistEntry {
 	all, _ := r.db.FindAll(query.NewQuery(BlacklistTable))
 	rVal := make([]BlacklistEntry, len(all))
@@ -272,6 +854,48 @@ func (r *CloverRepository) InsertStats(stats Stats) error {
 	return err
 }
 
+func (r *CloverRepository) GetStats() ([]Stats, error) {
+	docs, err := r.db.FindAll(query.NewQuery(StatsTable).Sort(query.SortOption{Field: "Timestamp", Direction: 1}))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Stats, len(docs))
+	for i, doc := range docs {
+		ts, _ := doc.Get("Timestamp").(time.Time)
+		count, _ := doc.Get("TorrentCount").(int64)
+		res[i] = Stats{
+			Timestamp:    ts,
+			TorrentCount: count,
+		}
+	}
+	return res, nil
+}
+
+func (r *CloverRepository) GetValue(key string) (string, error) {
+	doc, err := r.db.FindFirst(query.NewQuery(KeyValueTable).Where(query.Field("Key").Eq(key)))
+	if err != nil || doc == nil {
+		return "", err
+	}
+	value, _ := doc.Get("Value").(string)
+	return value, nil
+}
+
+func (r *CloverRepository) SetValue(key string, value string) error {
+	q := query.NewQuery(KeyValueTable).Where(query.Field("Key").Eq(key))
+	exists, err := r.db.Exists(q)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return r.db.Update(q, map[string]any{"Value": value})
+	}
+	doc := document.NewDocument()
+	doc.Set("Key", key)
+	doc.Set("Value", value)
+	_, err = r.db.InsertOne(KeyValueTable, doc)
+	return err
+}
+
 func (r *CloverRepository) GetCategoryDistribution() (map[string]int64, error) {
 	docs, err := r.db.FindAll(query.NewQuery(TorrentTable))
 	if err != nil {
@@ -281,20 +905,15 @@ func (r *CloverRepository) GetCategoryDistribution() (map[string]int64, error) {
 	dist := make(map[string]int64)
 	for _, doc := range docs {
 		var categories []string
-		if doc.Has("Categories") {
-			switch v := doc.Get("Categories").(type) {
-			case []string:
-				categories = v
-			case []any:
-				for _, item := range v {
-					if s, ok := item.(string); ok {
-						categories = append(categories, s)
-					}
+		switch v := doc.Get("Categories").(type) {
+		case []string:
+			categories = v
+		case []any:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					categories = append(categories, s)
 				}
 			}
-		} else if doc.Has("Category") {
-			cat, _ := doc.Get("Category").(string)
-			categories = []string{cat}
 		}
 
 		if len(categories) == 0 {
@@ -309,5 +928,8 @@ func (r *CloverRepository) GetCategoryDistribution() (map[string]int64, error) {
 }
 
 func (r *CloverRepository) Close() error {
+	if r.index != nil {
+		_ = r.index.close()
+	}
 	return r.db.Close()
 }
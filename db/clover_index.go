@@ -0,0 +1,439 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/numeric"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/ostafen/clover/v2"
+	"github.com/ostafen/clover/v2/document"
+	cloverquery "github.com/ostafen/clover/v2/query"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	torrentAnalyzer = "torrent"
+	indexBatchSize  = 1000
+	// maxCollapsedHits limits the matches collapsed into clusters per search.
+	maxCollapsedHits = 10000
+	// indexVersion has to be increased whenever indexedTorrent or the mapping
+	// changes. Indexes of another version are rebuilt.
+	indexVersion = "4"
+)
+
+// cloverIndex is an inverted index of torrent names and file paths, kept in
+// its own directory next to the CloverDB directory. Torrents are indexed by info hash.
+type cloverIndex struct {
+	index bleve.Index
+}
+
+type indexedTorrent struct {
+	Name         string
+	Files        string
+	TotalSize    float64
+	DiscoveredOn float64
+	FileCount    float64
+	Categories   []string
+	Extensions   []string
+	ClusterId    string
+}
+
+func newIndexedTorrent(t Torrent, clusterId string) indexedTorrent {
+	paths := make([]string, len(t.Files))
+	for i, f := range t.Files {
+		paths[i] = f.Path
+	}
+	return indexedTorrent{
+		Name:         t.Name,
+		Files:        strings.Join(paths, "\n"),
+		TotalSize:    float64(t.TotalSize),
+		DiscoveredOn: float64(t.DiscoveredOn),
+		FileCount:    float64(len(t.Files)),
+		Categories:   torrentCategories(t),
+		Extensions:   fileExtensions(t.Files),
+		ClusterId:    clusterId,
+	}
+}
+
+func newIndexMapping() (mapping.IndexMapping, error) {
+	m := bleve.NewIndexMapping()
+	// Unlike the standard analyzer, no stop words are removed, so that every
+	// word of a name can be searched.
+	err := m.AddCustomAnalyzer(torrentAnalyzer, map[string]any{
+		"type":          custom.Name,
+		"tokenizer":     unicode.Name,
+		"token_filters": []string{lowercase.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.DefaultAnalyzer = torrentAnalyzer
+
+	text := bleve.NewTextFieldMapping()
+	text.Store = false
+	text.IncludeInAll = false
+	number := bleve.NewNumericFieldMapping()
+	number.Store = false
+	number.IncludeInAll = false
+
+	keyword := bleve.NewKeywordFieldMapping()
+	keyword.Store = false
+	keyword.IncludeInAll = false
+	// Cluster ids are stored to collapse search results.
+	stored := bleve.NewKeywordFieldMapping()
+	stored.IncludeInAll = false
+
+	torrent := bleve.NewDocumentMapping()
+	torrent.AddFieldMappingsAt("Name", text)
+	torrent.AddFieldMappingsAt("Files", text)
+	torrent.AddFieldMappingsAt("TotalSize", number)
+	torrent.AddFieldMappingsAt("DiscoveredOn", number)
+	torrent.AddFieldMappingsAt("FileCount", number)
+	torrent.AddFieldMappingsAt("Categories", keyword)
+	torrent.AddFieldMappingsAt("Extensions", keyword)
+	torrent.AddFieldMappingsAt("ClusterId", stored)
+	m.DefaultMapping = torrent
+	return m, nil
+}
+
+func openCloverIndex(path string) (*cloverIndex, error) {
+	index, err := bleve.Open(path)
+	if err == nil {
+		version, vErr := index.GetInternal([]byte("version"))
+		if vErr == nil && string(version) == indexVersion {
+			return &cloverIndex{index: index}, nil
+		}
+		log.Info().Msg("search index is outdated and will be rebuilt")
+		_ = index.Close()
+		if err = os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		return nil, err
+	}
+
+	m, err := newIndexMapping()
+	if err != nil {
+		return nil, err
+	}
+	if index, err = bleve.New(path, m); err != nil {
+		return nil, err
+	}
+	if err = index.SetInternal([]byte("version"), []byte(indexVersion)); err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	return &cloverIndex{index: index}, nil
+}
+
+// sync indexes all torrents if the index does not contain as many torrents as
+// the database, e.g. when it was just created or an insert was interrupted.
+func (i *cloverIndex) sync(db *clover.DB) error {
+	indexed, err := i.index.DocCount()
+	if err != nil {
+		return err
+	}
+	count, err := db.Count(cloverquery.NewQuery(TorrentTable))
+	if err != nil || indexed == uint64(count) {
+		return err
+	}
+
+	log.Info().Msgf("building search index for %d torrents", count)
+	batch := i.index.NewBatch()
+	err = db.ForEach(cloverquery.NewQuery(TorrentTable), func(doc *document.Document) bool {
+		t := Document2Torrent(doc)
+		clusterId, _ := doc.Get("ClusterId").(string)
+		if err = batch.Index(t.InfoHash, newIndexedTorrent(t, clusterId)); err != nil {
+			return false
+		}
+		if batch.Size() >= indexBatchSize {
+			if err = i.index.Batch(batch); err != nil {
+				return false
+			}
+			batch.Reset()
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return i.index.Batch(batch)
+}
+
+// add indexes new or changed torrents, which are not clustered yet.
+func (i *cloverIndex) add(torrents ...Torrent) error {
+	batch := i.index.NewBatch()
+	for _, t := range torrents {
+		if err := batch.Index(t.InfoHash, newIndexedTorrent(t, "")); err != nil {
+			return err
+		}
+	}
+	return i.index.Batch(batch)
+}
+
+// addClustered indexes a torrent of the cluster clusterId.
+func (i *cloverIndex) addClustered(t Torrent, clusterId string) error {
+	return i.index.Index(t.InfoHash, newIndexedTorrent(t, clusterId))
+}
+
+// canSearchIndex reports whether a search can be answered by the index.
+func canSearchIndex(key string, searchType string) bool {
+	return searchType == "contains" && (key == "Name" || key == "Files" || key == "All")
+}
+
+// search returns the info hashes of the best matching torrents and the total
+// number of matches. Every word of searchInput has to match a word of the
+// searched fields or its beginning; exact matches rank higher. Collapsed
+// searches return the best match of every cluster among the first
+// maxCollapsedHits matches.
+func (i *cloverIndex) search(key string, searchInput string, limit int, offset int, filters SearchFilters) ([]indexHit, int64, error) {
+	q := i.searchQuery(key, searchInput, filters)
+	if q == nil {
+		return nil, 0, nil
+	}
+
+	field := cloverSortFields[filters.SortField(true)]
+	if field == "Relevance" {
+		field = "_score"
+	}
+	if !filters.SortAscending {
+		field = "-" + field
+	}
+
+	req := bleve.NewSearchRequestOptions(q, limit, offset, false)
+	if filters.Collapse {
+		req = bleve.NewSearchRequestOptions(q, maxCollapsedHits, 0, false)
+		req.Fields = []string{"ClusterId"}
+	}
+	req.SortBy([]string{field, "-DiscoveredOn"})
+	res, err := i.index.Search(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if filters.Collapse {
+		hits := collapseHits(res.Hits)
+		start := min(offset, len(hits))
+		return hits[start:min(start+limit, len(hits))], int64(len(hits)), nil
+	}
+	hits := make([]indexHit, len(res.Hits))
+	for n, hit := range res.Hits {
+		hits[n] = indexHit{InfoHash: hit.ID, Score: hit.Score}
+	}
+	return hits, int64(res.Total), nil //nolint:gosec // hit counts fit into int64
+}
+
+// collapseHits keeps the first hit of every cluster, see collapseClusters.
+func collapseHits(matches search.DocumentMatchCollection) []indexHit {
+	var hits []indexHit
+	first := make(map[string]int)
+	for _, match := range matches {
+		hit := indexHit{InfoHash: match.ID, Score: match.Score}
+		clusterId, _ := match.Fields["ClusterId"].(string)
+		if clusterId == "" {
+			hits = append(hits, hit)
+			continue
+		}
+		if n, ok := first[clusterId]; ok {
+			hits[n].Variants++
+			continue
+		}
+		first[clusterId] = len(hits)
+		hit.Variants = 1
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+// searchQuery returns the index query for a search, or nil if searchInput has no words.
+func (i *cloverIndex) searchQuery(key string, searchInput string, filters SearchFilters) query.Query {
+	fields := []string{key}
+	if key == "All" {
+		fields = []string{"Name", "Files"}
+	}
+
+	analyzer := i.index.Mapping().AnalyzerNamed(torrentAnalyzer)
+	var words []query.Query
+	for _, token := range analyzer.Analyze([]byte(searchInput)) {
+		term := string(token.Term)
+		var alternatives []query.Query
+		for _, field := range fields {
+			exact := bleve.NewTermQuery(term)
+			exact.SetField(field)
+			exact.SetBoost(2)
+			prefix := bleve.NewPrefixQuery(term)
+			prefix.SetField(field)
+			alternatives = append(alternatives, exact, prefix)
+		}
+		words = append(words, bleve.NewDisjunctionQuery(alternatives...))
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	return bleve.NewConjunctionQuery(append(words, filterQueries(filters)...)...)
+}
+
+// facets counts the matches of a search with the facets of the index. Date
+// buckets depend on the first and last match, so they are requested in a
+// second search.
+func (i *cloverIndex) facets(key string, searchInput string, filters SearchFilters) (Facets, error) {
+	q := i.searchQuery(key, searchInput, filters)
+	if q == nil {
+		return newFacetCollector().facets(), nil
+	}
+
+	req := bleve.NewSearchRequestOptions(q, 1, 0, false)
+	req.SortBy([]string{"DiscoveredOn"})
+	req.AddFacet("Categories", bleve.NewFacetRequest("Categories", maxCategoryFacets))
+	req.AddFacet("Extensions", bleve.NewFacetRequest("Extensions", maxExtensionFacets))
+	sizes := bleve.NewFacetRequest("TotalSize", len(sizeBuckets))
+	for _, b := range sizeBuckets {
+		sizes.AddNumericRange(b.Value, facetBound(b.Min), facetBound(b.Max+1))
+	}
+	req.AddFacet("Sizes", sizes)
+	res, err := i.index.Search(req)
+	if err != nil {
+		return Facets{}, err
+	}
+	facets := newFacetCollector().facets()
+	if len(res.Hits) == 0 {
+		return facets, nil
+	}
+	for _, term := range res.Facets["Categories"].Terms.Terms() {
+		facets.Categories = append(facets.Categories, FacetCount{Value: term.Term, Count: int64(term.Count)})
+	}
+	for _, term := range res.Facets["Extensions"].Terms.Terms() {
+		facets.Extensions = append(facets.Extensions, FacetCount{Value: term.Term, Count: int64(term.Count)})
+	}
+	facets.Sizes = rangeFacets(sizeBuckets, res.Facets["Sizes"].NumericRanges)
+
+	first := res.Hits[0].Sort[0]
+	req = bleve.NewSearchRequestOptions(q, 1, 0, false)
+	req.SortBy([]string{"-DiscoveredOn"})
+	last, err := i.index.Search(req)
+	if err != nil || len(last.Hits) == 0 {
+		return facets, err
+	}
+	firstOn, lastOn := sortValue(first), sortValue(last.Hits[0].Sort[0])
+
+	buckets := dateBuckets(firstOn, lastOn)
+	dates := bleve.NewFacetRequest("DiscoveredOn", len(buckets))
+	for _, b := range buckets {
+		dates.AddNumericRange(b.Value, facetBound(b.Min), facetBound(b.Max+1))
+	}
+	req = bleve.NewSearchRequestOptions(q, 0, 0, false)
+	req.AddFacet("Discovered", dates)
+	res, err = i.index.Search(req)
+	if err != nil {
+		return facets, err
+	}
+	facets.Discovered = rangeFacets(buckets, res.Facets["Discovered"].NumericRanges)
+	return facets, nil
+}
+
+// facetBound returns a numeric range bound, where zero is open.
+func facetBound(value int64) *float64 {
+	if value <= 0 {
+		return nil
+	}
+	f := float64(value)
+	return &f
+}
+
+// rangeFacets copies the counts of numeric range facets to buckets with a count.
+func rangeFacets(buckets []FacetCount, ranges search.NumericRangeFacets) []FacetCount {
+	counts := make(map[string]int64, len(ranges))
+	for _, r := range ranges {
+		counts[r.Name] = int64(r.Count)
+	}
+	facets := []FacetCount{}
+	for _, b := range buckets {
+		if counts[b.Value] > 0 {
+			b.Count = counts[b.Value]
+			facets = append(facets, b)
+		}
+	}
+	return facets
+}
+
+// sortValue decodes a numeric sort value of a search hit.
+func sortValue(value string) int64 {
+	i, err := numeric.PrefixCoded(value).Int64()
+	if err != nil {
+		return 0
+	}
+	return int64(numeric.Int64ToFloat64(i))
+}
+
+type indexHit struct {
+	InfoHash string
+	Score    float64
+	// Variants is the number of matches in the cluster of collapsed hits.
+	Variants int
+}
+
+func filterQueries(filters SearchFilters) []query.Query {
+	var queries []query.Query
+	// Bounds of zero are open, like in the other backends.
+	numericRange := func(field string, lo float64, hi float64, inclusiveLo bool) {
+		var min, max *float64
+		if lo > 0 {
+			min = &lo
+		}
+		if hi > 0 {
+			max = &hi
+		}
+		inclusiveHi := true
+		q := bleve.NewNumericRangeInclusiveQuery(min, max, &inclusiveLo, &inclusiveHi)
+		q.SetField(field)
+		queries = append(queries, q)
+	}
+	if filters.MinSize > 0 || filters.MaxSize > 0 {
+		numericRange("TotalSize", float64(filters.MinSize), float64(filters.MaxSize), true)
+	}
+	if filters.StartDate > 0 || filters.EndDate > 0 {
+		numericRange("DiscoveredOn", float64(filters.StartDate), float64(filters.EndDate), true)
+	}
+	if filters.Since > 0 {
+		numericRange("DiscoveredOn", float64(filters.Since), 0, false)
+	}
+	anyTerm := func(field string, values []string) {
+		var terms []query.Query
+		for _, v := range values {
+			q := bleve.NewTermQuery(v)
+			q.SetField(field)
+			terms = append(terms, q)
+		}
+		queries = append(queries, bleve.NewDisjunctionQuery(terms...))
+	}
+	if len(filters.Categories) > 0 {
+		anyTerm("Categories", filters.Categories)
+	}
+	if len(filters.Extensions) > 0 {
+		exts := make([]string, len(filters.Extensions))
+		for i, ext := range filters.Extensions {
+			exts[i] = strings.ToLower(strings.TrimPrefix(ext, "."))
+		}
+		anyTerm("Extensions", exts)
+	}
+	if filters.Cluster != "" {
+		anyTerm("ClusterId", []string{filters.Cluster})
+	}
+	return queries
+}
+
+func (i *cloverIndex) close() error {
+	return i.index.Close()
+}
+
+// cloverIndexPath returns the directory of the search index next to dbName.
+func cloverIndexPath(dbName string) string {
+	return strings.TrimSuffix(dbName, string(os.PathSeparator)) + "-index"
+}
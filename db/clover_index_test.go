@@ -0,0 +1,63 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloverIndexSearch(t *testing.T) {
+	cfg := &config.Configuration{DbName: filepath.Join(t.TempDir(), "dhtdb")}
+	repo, err := NewCloverRepository(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"The Ubuntuish Collection", "ubuntu 24.04", "debian"} {
+		repo.InsertMetadata(dhtcclient.Metadata{
+			InfoHash:     []byte{byte(i)},
+			Name:         name,
+			TotalSize:    uint64(100 * (i + 1)),
+			DiscoveredOn: int64(i + 1),
+			Files:        []dhtcclient.File{{Path: "disc/" + name + ".iso"}},
+		})
+	}
+
+	search := func(repo Repository, key string, input string, filters SearchFilters) ([]MetaData, int64) {
+		t.Helper()
+		results, total, err := repo.Search(key, "contains", input, 10, 0, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results, total
+	}
+
+	results, total := search(repo, "Name", "ubuntu", SearchFilters{})
+	if total != 2 || results[0].Name != "ubuntu 24.04" {
+		t.Errorf("expected exact match ranked first, got %d %v", total, results)
+	}
+	if _, total = search(repo, "Name", "the collection", SearchFilters{}); total != 1 {
+		t.Errorf("expected stop words to be searchable, got %d", total)
+	}
+	if _, total = search(repo, "Name", "ubuntu", SearchFilters{MinSize: 150}); total != 1 {
+		t.Errorf("expected size filter to apply, got %d", total)
+	}
+	if _, total = search(repo, "All", "disc deb", SearchFilters{Since: 2}); total != 1 {
+		t.Errorf("expected file paths to be searched, got %d", total)
+	}
+	_ = repo.Close()
+
+	// A missing index is rebuilt from the database.
+	if err = os.RemoveAll(cloverIndexPath(cfg.DbName)); err != nil {
+		t.Fatal(err)
+	}
+	repo, err = NewCloverRepository(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if _, total = search(repo, "Name", "ubu", SearchFilters{}); total != 2 {
+		t.Errorf("expected rebuilt index to find 2 torrents, got %d", total)
+	}
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ostafen/clover/v2"
+	"github.com/ostafen/clover/v2/document"
+	"github.com/ostafen/clover/v2/query"
+)
+
+type cloverMigration struct {
+	Migration
+	Up func(db *clover.DB) error
+}
+
+var cloverMigrations = []cloverMigration{
+	{
+		Migration: Migration{Version: 1, Name: "create torrent, watch, blacklist and stats collections"},
+		Up: func(db *clover.DB) error {
+			for _, collection := range []string{TorrentTable, WatchTable, BlacklistTable, StatsTable} {
+				if err := db.CreateCollection(collection); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 2, Name: "convert legacy torrent field Category to Categories"},
+		Up: func(db *clover.DB) error {
+			q := query.NewQuery(TorrentTable).MatchFunc(func(doc *document.Document) bool {
+				return doc.Has("Category") && !doc.Has("Categories")
+			})
+			return db.UpdateFunc(q, func(doc *document.Document) *document.Document {
+				fields := doc.AsMap()
+				category, _ := fields["Category"].(string)
+				delete(fields, "Category")
+				fields["Categories"] = []string{category}
+				return document.NewDocumentOf(fields)
+			})
+		},
+	},
+	{
+		Migration: Migration{Version: 3, Name: "index torrents by info hash"},
+		Up: func(db *clover.DB) error {
+			if exists, err := db.HasIndex(TorrentTable, "InfoHash"); err != nil || exists {
+				return err
+			}
+			return db.CreateIndex(TorrentTable, "InfoHash")
+		},
+	},
+	{
+		Migration: Migration{Version: 4, Name: "create key value collection"},
+		Up: func(db *clover.DB) error {
+			if err := db.CreateCollection(KeyValueTable); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 5, Name: "number torrents for the replication change feed"},
+		Up: func(db *clover.DB) error {
+			var seq int64
+			err := db.UpdateFunc(query.NewQuery(TorrentTable), func(doc *document.Document) *document.Document {
+				seq++
+				newDoc := doc.Copy()
+				newDoc.Set("Seq", seq)
+				return newDoc
+			})
+			if err != nil {
+				return err
+			}
+			if exists, err := db.HasIndex(TorrentTable, "Seq"); err != nil || exists {
+				return err
+			}
+			return db.CreateIndex(TorrentTable, "Seq")
+		},
+	},
+	{
+		Migration: Migration{Version: 6, Name: "store torrent file count"},
+		Up: func(db *clover.DB) error {
+			return db.UpdateFunc(query.NewQuery(TorrentTable), func(doc *document.Document) *document.Document {
+				files, _ := doc.Get("Files").([]any)
+				newDoc := doc.Copy()
+				newDoc.Set("FileCount", len(files))
+				return newDoc
+			})
+		},
+	},
+	{
+		Migration: Migration{Version: 7, Name: "store torrent file extensions"},
+		Up: func(db *clover.DB) error {
+			return db.UpdateFunc(query.NewQuery(TorrentTable), func(doc *document.Document) *document.Document {
+				files, _ := doc.Get("Files").([]any)
+				newDoc := doc.Copy()
+				newDoc.Set("Extensions", fileExtensions(Files(files)))
+				return newDoc
+			})
+		},
+	},
+	{
+		Migration: Migration{Version: 8, Name: "index torrent fingerprints"},
+		Up: func(db *clover.DB) error {
+			// Existing torrents are clustered by the background job.
+			for _, field := range []string{"NameKey", "FilesKey"} {
+				exists, err := db.HasIndex(TorrentTable, field)
+				if err != nil {
+					return err
+				}
+				if !exists {
+					if err = db.CreateIndex(TorrentTable, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 9, Name: "create saved search collection"},
+		Up: func(db *clover.DB) error {
+			if err := db.CreateCollection(SavedSearchTable); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 10, Name: "create watch hit collection"},
+		Up: func(db *clover.DB) error {
+			if err := db.CreateCollection(WatchHitTable); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+				return err
+			}
+			if exists, err := db.HasIndex(WatchHitTable, "WatchId"); err != nil || exists {
+				return err
+			}
+			return db.CreateIndex(WatchHitTable, "WatchId")
+		},
+	},
+	{
+		Migration: Migration{Version: 11, Name: "create notification outbox collection"},
+		Up: func(db *clover.DB) error {
+			if err := db.CreateCollection(OutboxTable); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+				return err
+			}
+			return nil
+		},
+	},
+}
+
+func (r *CloverRepository) SchemaVersion() (int, error) {
+	exists, err := r.db.HasCollection(SchemaTable)
+	if err != nil || !exists {
+		return 0, err
+	}
+	doc, err := r.db.FindFirst(query.NewQuery(SchemaTable).Sort(query.SortOption{Field: "Version", Direction: -1}))
+	if err != nil || doc == nil {
+		return 0, err
+	}
+	version, _ := doc.Get("Version").(int64)
+	return int(version), nil
+}
+
+func (r *CloverRepository) Migrate(dryRun bool) ([]Migration, error) {
+	current, err := r.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err = validateSchemaVersion(current, cloverMigrations[len(cloverMigrations)-1].Version); err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range cloverMigrations {
+		if m.Version <= current {
+			continue
+		}
+		pending = append(pending, m.Migration)
+		logMigration("clover", m.Migration, dryRun)
+		if dryRun {
+			continue
+		}
+
+		if err = r.db.CreateCollection(SchemaTable); err != nil && !errors.Is(err, clover.ErrCollectionExist) {
+			return pending, err
+		}
+		if err = m.Up(r.db); err != nil {
+			return pending, err
+		}
+		doc := document.NewDocument()
+		doc.Set("Version", m.Version)
+		doc.Set("Name", m.Name)
+		doc.Set("AppliedAt", time.Now())
+		if _, err = r.db.InsertOne(SchemaTable, doc); err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
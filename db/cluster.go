@@ -0,0 +1,191 @@
+package db
+
+import (
+	"crypto/sha256"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Names shorter than this after normalisation are too generic to cluster by.
+	minClusterNameLength = 8
+	// Files smaller than this (samples, nfo files, ...) are left out of the file
+	// fingerprint, unless a torrent only has small files.
+	minClusterFileSize = 1 << 20
+	clusterBatchSize   = 1000
+)
+
+// Fingerprint identifies near-duplicate torrents. Torrents with the same
+// NameKey or the same FilesKey belong to the same cluster. Empty keys match nothing.
+type Fingerprint struct {
+	NameKey  string
+	FilesKey string
+}
+
+var (
+	bracketedName = regexp.MustCompile(`\[[^\]]*\]|\{[^}]*\}`)
+	releaseGroup  = regexp.MustCompile(`-[\pL\pN]+$`)
+	releaseTags   = map[string]bool{
+		"480p": true, "576p": true, "720p": true, "1080p": true, "1080i": true, "2160p": true, "4k": true, "uhd": true,
+		"hdr": true, "hdr10": true, "dv": true, "sdr": true, "10bit": true, "8bit": true,
+		"x264": true, "x265": true, "h264": true, "h265": true, "hevc": true, "avc": true, "xvid": true, "divx": true, "av1": true,
+		"bluray": true, "bdrip": true, "brrip": true, "webrip": true, "web": true, "webdl": true, "dl": true, "hdtv": true,
+		"dvdrip": true, "dvd": true, "remux": true, "proper": true, "repack": true, "internal": true, "extended": true, "unrated": true,
+		"aac": true, "ac3": true, "dts": true, "ddp5": true, "dd5": true, "atmos": true, "flac": true, "mp3": true, "320kbps": true,
+	}
+)
+
+// NormalizeName reduces a torrent name to its content: bracketed tags, release
+// tags like resolution or codec, a trailing release group, the file extension
+// and separators are removed. "The.Matrix.1999.1080p.BluRay.x264-GROUP" and
+// "[tracker] The Matrix (1999) 720p" both become "the matrix 1999".
+func NormalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if ext := path.Ext(name); len(ext) > 1 && len(ext) <= 5 && !isNumber(ext[1:]) {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = bracketedName.ReplaceAllString(name, " ")
+
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	}
+	// A trailing "-word" is only a release group in names with release tags,
+	// otherwise it is part of the title ("spider-man").
+	if group := releaseGroup.FindString(name); group != "" && slices.ContainsFunc(split(name), isReleaseTag) {
+		name = strings.TrimSuffix(name, group)
+	}
+
+	var words []string
+	for _, word := range split(name) {
+		if !isReleaseTag(word) {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func isReleaseTag(word string) bool {
+	return releaseTags[word]
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// NewFingerprint fingerprints a torrent by its normalised name and by the
+// multiset of (file size, file name) of its files, ignoring directories.
+func NewFingerprint(t Torrent) Fingerprint {
+	var fp Fingerprint
+	if name := NormalizeName(t.Name); len([]rune(name)) >= minClusterNameLength {
+		fp.NameKey = fingerprintHash(name)
+	}
+	fp.FilesKey = filesKey(t.Files)
+	return fp
+}
+
+func filesKey(files []dhtcclient.File) string {
+	var entries []string
+	for _, f := range significantFiles(files) {
+		entries = append(entries, strconv.FormatInt(f.Size, 10)+":"+strings.ToLower(path.Base(f.Path)))
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	slices.Sort(entries)
+	return fingerprintHash(strings.Join(entries, "\n"))
+}
+
+// significantFiles returns the files of at least minClusterFileSize, or all
+// files if there are none.
+func significantFiles(files []dhtcclient.File) []dhtcclient.File {
+	var res []dhtcclient.File
+	for _, minSize := range []int64{minClusterFileSize, 0} {
+		for _, f := range files {
+			if f.Size >= minSize {
+				res = append(res, f)
+			}
+		}
+		if len(res) > 0 {
+			break
+		}
+	}
+	return res
+}
+
+func fingerprintHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ClusterTorrents fingerprints all torrents without cluster and
+// adds each to the cluster of a torrent with the same fingerprint. Torrents
+// without near-duplicate start their own cluster, identified by their info hash.
+func ClusterTorrents(repo Repository) (int, error) {
+	var clustered int
+	for {
+		torrents, err := repo.GetUnclusteredTorrents(clusterBatchSize)
+		if err != nil || len(torrents) == 0 {
+			return clustered, err
+		}
+		for _, t := range torrents {
+			fp := NewFingerprint(t)
+			clusterId, err := repo.FindCluster(fp)
+			if err != nil {
+				return clustered, err
+			}
+			if clusterId == "" {
+				clusterId = t.InfoHash
+			}
+			if err = repo.SetCluster(t.InfoHash, fp, clusterId); err != nil {
+				return clustered, err
+			}
+			clustered++
+		}
+	}
+}
+
+// RunClustering clusters new torrents every interval.
+func RunClustering(repo Repository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		if n, err := ClusterTorrents(repo); err != nil {
+			log.Error().Err(err).Msg("could not cluster torrents")
+		} else if n > 0 {
+			log.Info().Msgf("clustered %d torrents", n)
+		}
+		<-ticker.C
+	}
+}
+
+// collapseClusters keeps the first torrent of every cluster in mds and counts
+// the variants of each cluster. Torrents without cluster are kept as they are.
+func collapseClusters(mds []MetaData) []MetaData {
+	var res []MetaData
+	first := make(map[string]int)
+	for _, md := range mds {
+		if md.ClusterId == "" {
+			res = append(res, md)
+			continue
+		}
+		if i, ok := first[md.ClusterId]; ok {
+			res[i].Variants++
+			continue
+		}
+		first[md.ClusterId] = len(res)
+		md.Variants = 1
+		res = append(res, md)
+	}
+	return res
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := map[string]string{
+		"The.Matrix.1999.1080p.BluRay.x264-GROUP": "the matrix 1999",
+		"[tracker] The Matrix (1999) 720p":        "the matrix 1999",
+		"the_matrix_1999.mkv":                     "the matrix 1999",
+		"Spider-Man 2002":                         "spider man 2002",
+		"Spider-Man":                              "spider man",
+		"debian-12.5.0-amd64-netinst.iso":         "debian 12 5 0 amd64 netinst",
+	}
+	for name, expected := range tests {
+		if actual := NormalizeName(name); actual != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestNewFingerprint(t *testing.T) {
+	movie := []dhtcclient.File{{Path: "Movie/movie.mkv", Size: 2 << 30}, {Path: "Movie/sample.mkv", Size: 1 << 10}}
+	a := NewFingerprint(Torrent{Name: "The.Matrix.1999.1080p-GROUP", Files: movie})
+	b := NewFingerprint(Torrent{Name: "The Matrix (1999)", Files: []dhtcclient.File{{Path: "other/MOVIE.mkv", Size: 2 << 30}}})
+	if a != b {
+		t.Errorf("expected equal fingerprints, got %+v and %+v", a, b)
+	}
+	if short := NewFingerprint(Torrent{Name: "[x] 1080p"}); short.NameKey != "" || short.FilesKey != "" {
+		t.Errorf("expected generic names and empty file lists not to be fingerprinted, got %+v", short)
+	}
+}
+
+func TestClusterTorrents(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	movie := []dhtcclient.File{{Path: "movie.mkv", Size: 2 << 30}}
+	torrents := []dhtcclient.Metadata{
+		{InfoHash: []byte{1}, Name: "The Matrix 1999 1080p BluRay x264-GROUP", DiscoveredOn: 1, Files: movie},
+		{InfoHash: []byte{2}, Name: "[tracker] The Matrix (1999) 720p", DiscoveredOn: 2,
+			Files: []dhtcclient.File{{Path: "matrix.avi", Size: 700 << 20}}},
+		{InfoHash: []byte{3}, Name: "Matrix reupload", DiscoveredOn: 3, Files: movie},
+		{InfoHash: []byte{4}, Name: "Debian 12 netinst", DiscoveredOn: 4,
+			Files: []dhtcclient.File{{Path: "debian.iso", Size: 600 << 20}}},
+	}
+	for _, md := range torrents {
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		if n, err := ClusterTorrents(repo); err != nil || n != 4 {
+			t.Fatalf("%s: expected 4 clustered torrents, got %d, %v", name, n, err)
+		}
+		if n, _ := ClusterTorrents(repo); n != 0 {
+			t.Errorf("%s: expected clustered torrents to be skipped, got %d", name, n)
+		}
+
+		results, total, err := repo.Search("Name", "contains", "matrix", 10, 0, SearchFilters{Collapse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(results) != 1 || results[0].Variants != 3 || results[0].ClusterId != "01" {
+			t.Errorf("%s: expected one result with 3 variants, got %d %+v", name, total, results)
+		}
+
+		latest, total, err := repo.GetLatest(10, 0, SearchFilters{Collapse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || len(latest) != 2 || latest[0].Name != "Debian 12 netinst" || latest[0].Variants != 1 {
+			t.Errorf("%s: expected 2 collapsed torrents, got %d %+v", name, total, latest)
+		}
+
+		variants, total, err := repo.GetLatest(10, 0, SearchFilters{Cluster: "01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 || len(variants) != 3 {
+			t.Errorf("%s: expected 3 variants, got %d %+v", name, total, variants)
+		}
+
+		// Changed and new torrents are clustered as well.
+		merge := []Torrent{{InfoHash: "04", DiscoveredOn: 3}, {InfoHash: "05", Name: "The Matrix (1999)", DiscoveredOn: 5}}
+		if _, err = repo.MergeTorrents(merge); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := ClusterTorrents(repo); err != nil || n != 2 {
+			t.Errorf("%s: expected 2 changed torrents to be clustered, got %d, %v", name, n, err)
+		}
+		if _, total, _ = repo.GetLatest(10, 0, SearchFilters{Cluster: "01"}); total != 4 {
+			t.Errorf("%s: expected the new torrent to join the cluster, got %d variants", name, total)
+		}
+	}
+}
+
+func TestCloverUnclusteredTorrentsInBatches(t *testing.T) {
+	repo := newTestCloverRepository(t)
+	for i := range 5 {
+		repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{byte(i)}, Name: "torrent", DiscoveredOn: int64(10 - i)})
+	}
+
+	var seen []string
+	for {
+		torrents, err := repo.GetUnclusteredTorrents(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(torrents) == 0 {
+			break
+		}
+		for _, torrent := range torrents {
+			seen = append(seen, torrent.InfoHash)
+			if err = repo.SetCluster(torrent.InfoHash, Fingerprint{}, torrent.InfoHash); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !slices.Equal(seen, []string{"00", "01", "02", "03", "04"}) {
+		t.Errorf("expected every torrent once in insertion order, got %v", seen)
+	}
+
+	// A merged torrent loses its cluster and is returned again.
+	if _, err := repo.MergeTorrents([]Torrent{{InfoHash: "01", DiscoveredOn: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if torrents, _ := repo.GetUnclusteredTorrents(2); len(torrents) != 1 || torrents[0].InfoHash != "01" {
+		t.Errorf("expected the merged torrent, got %+v", torrents)
+	}
+}
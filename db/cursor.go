@@ -0,0 +1,106 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is the position after the last result of a page. Results ordered by
+// discovery date continue after DiscoveredOn and Id (keyset pagination), all
+// other orders continue at Offset.
+type Cursor struct {
+	DiscoveredOn int64
+	Id           string
+	Offset       int
+}
+
+func (c Cursor) IsZero() bool {
+	return c == Cursor{}
+}
+
+func (c Cursor) isKeyset() bool {
+	return c.Id != ""
+}
+
+// String encodes the cursor as an opaque token for API clients.
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	value := "o:" + strconv.Itoa(c.Offset)
+	if c.isKeyset() {
+		value = "d:" + strconv.FormatInt(c.DiscoveredOn, 10) + ":" + c.Id
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func ParseCursor(token string) (Cursor, error) {
+	if token == "" {
+		return Cursor{}, nil
+	}
+	value, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(value), ":", 3)
+	switch {
+	case parts[0] == "o" && len(parts) == 2:
+		offset, err := strconv.Atoi(parts[1])
+		if err != nil || offset < 0 {
+			return Cursor{}, ErrInvalidCursor
+		}
+		return Cursor{Offset: offset}, nil
+	case parts[0] == "d" && len(parts) == 3 && parts[2] != "":
+		discoveredOn, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return Cursor{}, ErrInvalidCursor
+		}
+		return Cursor{DiscoveredOn: discoveredOn, Id: parts[2]}, nil
+	}
+	return Cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, value)
+}
+
+// pageStart returns the offset of a page. A keyset cursor starts at the
+// beginning of the remaining results, an offset cursor replaces offset.
+func pageStart(offset int, cursor Cursor) int {
+	switch {
+	case cursor.isKeyset():
+		return 0
+	case !cursor.IsZero():
+		return cursor.Offset
+	}
+	return offset
+}
+
+// NextCursor returns the cursor of the page after results, or an empty string
+// on the last page.
+func NextCursor(results []MetaData, limit int) string {
+	if len(results) == 0 || len(results) < limit {
+		return ""
+	}
+	return results[len(results)-1].Cursor.String()
+}
+
+// resultCursor returns the cursor after the result at index i of a page which
+// starts at offset start.
+func resultCursor(keyset bool, discoveredOn int64, id string, start int, i int) Cursor {
+	if keyset {
+		return Cursor{DiscoveredOn: discoveredOn, Id: id}
+	}
+	return Cursor{Offset: start + i + 1}
+}
+
+// offsetPage returns the page of mds starting at start, with offset cursors.
+func offsetPage(mds []MetaData, limit int, start int) []MetaData {
+	start = min(start, len(mds))
+	end := min(start+limit, len(mds))
+	for i := start; i < end; i++ {
+		mds[i].Cursor = Cursor{Offset: i + 1}
+	}
+	return mds[start:end]
+}
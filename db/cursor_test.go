@@ -0,0 +1,96 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestCursorPagination(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	// Several torrents share a discovery date, so pages have to break ties.
+	var expected []string
+	for i := range 7 {
+		md := dhtcclient.Metadata{
+			InfoHash:     []byte{byte(i)},
+			Name:         fmt.Sprintf("linux %d", i),
+			TotalSize:    uint64(100 * (i + 1)),
+			DiscoveredOn: int64(i / 3),
+			Files:        []dhtcclient.File{{Path: "a"}},
+		}
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+		expected = append(expected, md.Name)
+	}
+	slices.Sort(expected)
+
+	type page func(filters SearchFilters) ([]MetaData, int64, error)
+	collect := func(t *testing.T, next page, filters SearchFilters) []string {
+		t.Helper()
+		var names []string
+		for range 10 {
+			results, total, err := next(filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 7 {
+				t.Errorf("expected total of 7, got %d", total)
+			}
+			for _, r := range results {
+				names = append(names, r.Name)
+			}
+			cursor := NextCursor(results, 3)
+			if cursor == "" {
+				break
+			}
+			if filters.Cursor, err = ParseCursor(cursor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		pages := map[string]page{
+			"latest": func(filters SearchFilters) ([]MetaData, int64, error) {
+				return repo.GetLatest(3, 0, filters)
+			},
+			"search": func(filters SearchFilters) ([]MetaData, int64, error) {
+				return repo.Search("Name", "startswith", "linux", 3, 0, filters)
+			},
+			"index": func(filters SearchFilters) ([]MetaData, int64, error) {
+				return repo.Search("Name", "contains", "linux", 3, 0, filters)
+			},
+		}
+		for pageName, next := range pages {
+			for _, filters := range []SearchFilters{{}, {SortAscending: true}, {Sort: SortSize}, {ApproximateTotal: true}} {
+				if names := collect(t, next, filters); !slices.Equal(names, expected) {
+					t.Errorf("%s %s %+v: expected every torrent once, got %v", name, pageName, filters, names)
+				}
+			}
+		}
+
+		keyset := Cursor{DiscoveredOn: 1, Id: "1"}
+		if _, _, err := repo.Search("Name", "startswith", "linux", 3, 0, SearchFilters{Sort: SortSize, Cursor: keyset}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: expected keyset cursor to be rejected for size order, got %v", name, err)
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	for _, c := range []Cursor{{Offset: 42}, {DiscoveredOn: 1700000000, Id: "a:b"}} {
+		parsed, err := ParseCursor(c.String())
+		if err != nil || parsed != c {
+			t.Errorf("expected %+v, got %+v %v", c, parsed, err)
+		}
+	}
+	for _, token := range []string{"!", "eDox", "bzotMQ"} {
+		if _, err := ParseCursor(token); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("expected %q to be invalid, got %v", token, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Package dbtest provides repositories for the tests of the packages using
+// the database.
+package dbtest
+
+import (
+	"dhtc/config"
+	"dhtc/db"
+	"path/filepath"
+	"testing"
+)
+
+// NewRepository opens an empty repository of dbType ("clover" or "sqlite") in
+// a temporary directory, which is closed at the end of the test.
+func NewRepository(t testing.TB, dbType string) db.Repository {
+	t.Helper()
+	repo, err := db.OpenRepository(&config.Configuration{
+		DatabaseType: dbType,
+		DbName:       filepath.Join(t.TempDir(), "dhtdb"),
+		DatabaseUrl:  filepath.Join(t.TempDir(), "dhtc.sqlite"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
+}
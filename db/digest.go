@@ -0,0 +1,184 @@
+package db
+
+import (
+	"dhtc/downloader"
+	"dhtc/notifier"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Digest modes of watches. Without a digest mode every match is notified
+// immediately.
+const (
+	DigestBatch = "batch"
+	DigestDaily = "daily"
+)
+
+// digestItems is the number of matches listed per watch in a digest.
+const digestItems = 5
+
+// digestKey is the key of the time of the last digest of a watch.
+func digestKey(id string) string {
+	return "digest." + id
+}
+
+// RunDigests sends the digests of the watches when they are due.
+func (e *WatchEngine) RunDigests() {
+	ticker := time.NewTicker(time.Minute)
+	for now := range ticker.C {
+		e.SendDigests(now)
+	}
+}
+
+// SendDigests queues a digest of the matches of all watches whose digest is
+// due at now. Watches with the same notifiers share a message.
+func (e *WatchEngine) SendDigests(now time.Time) {
+	if e.nManager == nil {
+		return
+	}
+	e.mu.RLock()
+	matchers := e.matchers
+	e.mu.RUnlock()
+
+	var groups []string
+	digests := make(map[string][]notifier.DigestEntry)
+	notifiers := make(map[string][]string)
+	for _, m := range matchers {
+		entry := m.entry
+		if entry.Digest == "" || entry.Quiet(now) {
+			continue
+		}
+		last, err := e.lastDigest(entry, now)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not read the last digest of watch '%s'", entry.Id)
+			continue
+		}
+		if !e.digestDue(entry, last, now) {
+			continue
+		}
+		hits, err := e.database.GetWatchHitsSince(entry.Id, last)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not read the hits of watch '%s'", entry.Id)
+			continue
+		}
+		if err = e.database.SetValue(digestKey(entry.Id), strconv.FormatInt(now.Unix(), 10)); err != nil {
+			log.Error().Err(err).Msgf("could not store the digest of watch '%s'", entry.Id)
+			continue
+		}
+		digest := e.digestEntry(entry, hits, last, now)
+		if digest.Count == 0 {
+			continue
+		}
+		group := strings.Join(entry.Notifiers, ",")
+		if _, ok := digests[group]; !ok {
+			groups = append(groups, group)
+			notifiers[group] = entry.Notifiers
+		}
+		digests[group] = append(digests[group], digest)
+	}
+
+	for _, group := range groups {
+		count := 0
+		for _, d := range digests[group] {
+			count += d.Count
+		}
+		e.nManager.Enqueue(notifiers[group], notifier.Event{
+			Title:    fmt.Sprintf("Digest: %d matches of %d watches", count, len(digests[group])),
+			Type:     notifier.EventWatch,
+			Severity: notifier.SeverityInfo,
+			Digest:   digests[group],
+		}, "")
+	}
+}
+
+// lastDigest returns the time of the last digest of the watch entry. Before
+// the first digest, the matches of one period are included.
+func (e *WatchEngine) lastDigest(entry WatchEntry, now time.Time) (int64, error) {
+	value, err := e.database.GetValue(digestKey(entry.Id))
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		if entry.Digest == DigestBatch {
+			return now.Add(-time.Duration(entry.DigestInterval) * time.Minute).Unix(), nil
+		}
+		return now.Add(-24 * time.Hour).Unix(), nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// digestDue reports whether the digest of the watch entry, last sent at the
+// unix timestamp last, is due at now. Daily digests are due once the digest
+// time passed since the last one.
+func (e *WatchEngine) digestDue(entry WatchEntry, last int64, now time.Time) bool {
+	switch entry.Digest {
+	case DigestBatch:
+		return now.Unix()-last >= int64(entry.DigestInterval)*60
+	case DigestDaily:
+		at, err := time.Parse("15:04", e.digestTime)
+		if err != nil {
+			at = time.Date(0, 1, 1, 8, 0, 0, 0, time.UTC)
+		}
+		scheduled := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+		if scheduled.After(now) {
+			scheduled = scheduled.AddDate(0, 0, -1)
+		}
+		return last < scheduled.Unix()
+	}
+	return false
+}
+
+// digestEntry summarises the hits of the watch entry between last and now
+// which were held back for the digest.
+func (e *WatchEngine) digestEntry(entry WatchEntry, hits []WatchHit, last int64, now time.Time) notifier.DigestEntry {
+	digest := notifier.DigestEntry{Watch: describeWatch(entry), URL: e.searchURL(entry, last)}
+	for _, hit := range hits {
+		if !hit.Digest || hit.Time >= now.Unix() {
+			continue
+		}
+		digest.Count++
+		if len(digest.Items) == digestItems {
+			digest.More++
+			continue
+		}
+		item := notifier.DigestItem{
+			Name:     hit.Name,
+			InfoHash: hit.InfoHash,
+			Magnet:   downloader.MagnetLink(hit.InfoHash, hit.Name),
+		}
+		if e.publicURL != "" {
+			item.URL = e.publicURL + "/torrent/" + hit.InfoHash
+		}
+		digest.Items = append(digest.Items, item)
+	}
+	return digest
+}
+
+// searchURL returns the link to a search for the matches of the watch entry
+// since the unix timestamp, or an empty string if the watch can not be
+// searched.
+func (e *WatchEngine) searchURL(entry WatchEntry, since int64) string {
+	if e.publicURL == "" || entry.Content == "" || entry.MatchType == MatchRegex {
+		return ""
+	}
+	params := url.Values{}
+	params.Add("key", entry.Key)
+	params.Add("match-type", entry.MatchType)
+	params.Add("search-input", entry.Content)
+	params.Add("since", strconv.FormatInt(since-1, 10))
+	if entry.MinSize > 0 {
+		params.Add("min-size", strconv.FormatUint(entry.MinSize, 10))
+	}
+	if entry.MaxSize > 0 {
+		params.Add("max-size", strconv.FormatUint(entry.MaxSize, 10))
+	}
+	for _, category := range entry.Categories {
+		params.Add("category", category)
+	}
+	return e.publicURL + "/search?" + params.Encode()
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"dhtc/notifier"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestDue(t *testing.T) {
+	engine := &WatchEngine{digestTime: "08:00"}
+	now := time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local)
+	batch := WatchEntry{Digest: DigestBatch, DigestInterval: 30}
+	daily := WatchEntry{Digest: DigestDaily}
+	cases := []struct {
+		entry WatchEntry
+		last  time.Time
+		now   time.Time
+		want  bool
+	}{
+		{batch, now.Add(-29 * time.Minute), now, false},
+		{batch, now.Add(-30 * time.Minute), now, true},
+		{daily, now.Add(-2 * time.Hour), now, true},
+		{daily, now.Add(-time.Hour), now, false},
+		{daily, now.Add(-2 * time.Hour), now.Add(-2 * time.Hour).Add(time.Minute), false},
+		{daily, now.Add(-27 * time.Hour), now.Add(-2 * time.Hour), true},
+		{WatchEntry{}, now.Add(-48 * time.Hour), now, false},
+	}
+	for i, c := range cases {
+		if got := engine.digestDue(c.entry, c.last.Unix(), c.now); got != c.want {
+			t.Errorf("case %d: expected %v, got %v", i, c.want, got)
+		}
+	}
+}
+
+func TestDigestValidate(t *testing.T) {
+	entry := WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu", Digest: DigestBatch}
+	if entry.Validate() == nil {
+		t.Error("expected an error for a batch without interval")
+	}
+	entry.DigestInterval = 10
+	if err := entry.Validate(); err != nil {
+		t.Error(err)
+	}
+	entry.Digest = "weekly"
+	if entry.Validate() == nil {
+		t.Error("expected an error for an unknown digest mode")
+	}
+}
+
+func TestSendDigests(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	received := make(chan notifier.Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Event notifier.Event }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload.Event
+	}))
+	defer srv.Close()
+
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu", Digest: DigestBatch, DigestInterval: 1})
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "debian", Digest: DigestDaily})
+	manager := notifier.NewManager(nil)
+	engine := NewWatchEngine(repo, manager, &config.Configuration{PublicURL: "https://dhtc.example.org/", DigestTime: "00:00"})
+	manager.Setup(&config.Configuration{NotifierURLs: "webhook+" + srv.URL + "/hook"})
+	defer manager.Close()
+
+	now := time.Now()
+	for i := range 7 {
+		engine.Check(dhtcclient.Metadata{InfoHash: []byte{byte(i)}, Name: fmt.Sprintf("Ubuntu %d", i)})
+	}
+	engine.Check(dhtcclient.Metadata{InfoHash: []byte{9}, Name: "Debian 12"})
+	hits, err := repo.GetWatchHits("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hit := range hits {
+		if !hit.Digest || len(hit.Deliveries) > 0 {
+			t.Errorf("expected a hit held back for the digest, got %+v", hit)
+		}
+	}
+
+	engine.SendDigests(now.Add(time.Minute))
+	var event notifier.Event
+	select {
+	case event = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("digest was not sent")
+	}
+	if event.Title != "Digest: 8 matches of 2 watches" || len(event.Digest) != 2 {
+		t.Fatalf("unexpected digest %+v", event)
+	}
+	counts := map[string]int{}
+	for _, d := range event.Digest {
+		counts[d.Watch] = d.Count
+		if !strings.HasPrefix(d.URL, "https://dhtc.example.org/search?") {
+			t.Errorf("expected a search link, got %q", d.URL)
+		}
+	}
+	if counts["Name contains 'ubuntu'"] != 7 || counts["Name contains 'debian'"] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+	for _, d := range event.Digest {
+		if d.Count == 7 && (len(d.Items) != digestItems || d.More != 2 || d.Items[0].URL == "") {
+			t.Errorf("expected %d items and 2 more, got %+v", digestItems, d)
+		}
+	}
+
+	engine.SendDigests(now.Add(time.Minute + 2*time.Second))
+	select {
+	case event = <-received:
+		t.Errorf("expected no second digest, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDigestIncludesQuietHits(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	received := make(chan notifier.Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Event notifier.Event }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload.Event
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu", Digest: DigestDaily,
+		QuietStart: now.Add(-time.Hour).Format("15:04"), QuietEnd: now.Add(time.Hour).Format("15:04")})
+	manager := notifier.NewManager(nil)
+	engine := NewWatchEngine(repo, manager, &config.Configuration{DigestTime: "00:00"})
+	manager.Setup(&config.Configuration{NotifierURLs: "webhook+" + srv.URL + "/hook"})
+	defer manager.Close()
+
+	engine.Check(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "Ubuntu 24.04"})
+	engine.SendDigests(now.Add(time.Minute))
+	select {
+	case event := <-received:
+		t.Fatalf("expected no digest in the quiet hours, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	engine.SendDigests(now.Add(2 * time.Hour))
+	select {
+	case event := <-received:
+		if len(event.Digest) != 1 || event.Digest[0].Count != 1 {
+			t.Errorf("expected the quiet match in the digest, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("digest was not sent after the quiet hours")
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"cmp"
+	dhtcclient "dhtc/dhtc-client"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	maxCategoryFacets  = 20
+	maxExtensionFacets = 10
+	maxExtensionLength = 10
+	daySeconds         = 24 * 60 * 60
+	// Histograms spanning more days than this are grouped by month instead of day.
+	maxDayBuckets = 62
+)
+
+// FacetCount is the number of search results with a value. Size and date buckets
+// also carry their inclusive bounds, where zero is open.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+	Min   int64  `json:"min,omitempty"`
+	Max   int64  `json:"max,omitempty"`
+}
+
+type Facets struct {
+	Categories []FacetCount `json:"categories"`
+	Extensions []FacetCount `json:"extensions"`
+	Sizes      []FacetCount `json:"sizes"`
+	Discovered []FacetCount `json:"discovered"`
+}
+
+var sizeBuckets = []FacetCount{
+	{Value: "< 100 MB", Max: 100<<20 - 1},
+	{Value: "100 MB - 1 GB", Min: 100 << 20, Max: 1<<30 - 1},
+	{Value: "1 GB - 10 GB", Min: 1 << 30, Max: 10<<30 - 1},
+	{Value: "10 GB - 100 GB", Min: 10 << 30, Max: 100<<30 - 1},
+	{Value: "> 100 GB", Min: 100 << 30},
+}
+
+func sizeBucket(size uint64) int {
+	for i, b := range sizeBuckets {
+		if b.Max == 0 || size <= uint64(b.Max) {
+			return i
+		}
+	}
+	return len(sizeBuckets) - 1
+}
+
+// fileExtensions returns the distinct lower case extensions (without dot) of files.
+func fileExtensions(files []dhtcclient.File) []string {
+	var exts []string
+	for _, f := range files {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(f.Path), "."))
+		if ext != "" && len(ext) <= maxExtensionLength && !slices.Contains(exts, ext) {
+			exts = append(exts, ext)
+		}
+	}
+	slices.Sort(exts)
+	return exts
+}
+
+// facetCollector counts facet values, either per torrent or from grouped counts.
+type facetCollector struct {
+	categories map[string]int64
+	extensions map[string]int64
+	sizes      []int64
+	// days counts torrents by days since the unix epoch.
+	days map[int64]int64
+}
+
+func newFacetCollector() *facetCollector {
+	return &facetCollector{
+		categories: make(map[string]int64),
+		extensions: make(map[string]int64),
+		sizes:      make([]int64, len(sizeBuckets)),
+		days:       make(map[int64]int64),
+	}
+}
+
+func (c *facetCollector) add(categories []string, extensions []string, totalSize uint64, discoveredOn int64) {
+	for _, category := range categories {
+		c.categories[category]++
+	}
+	for _, ext := range extensions {
+		c.extensions[ext]++
+	}
+	c.sizes[sizeBucket(totalSize)]++
+	c.days[discoveredOn/daySeconds]++
+}
+
+func (c *facetCollector) facets() Facets {
+	facets := Facets{
+		Categories: topFacets(c.categories, maxCategoryFacets),
+		Extensions: topFacets(c.extensions, maxExtensionFacets),
+		Sizes:      []FacetCount{},
+		Discovered: []FacetCount{},
+	}
+	for i, b := range sizeBuckets {
+		if c.sizes[i] > 0 {
+			b.Count = c.sizes[i]
+			facets.Sizes = append(facets.Sizes, b)
+		}
+	}
+
+	if len(c.days) == 0 {
+		return facets
+	}
+	first, last := int64(-1), int64(0)
+	for day := range c.days {
+		if first < 0 || day < first {
+			first = day
+		}
+		last = max(last, day)
+	}
+	buckets := dateBuckets(first*daySeconds, last*daySeconds)
+	for day, count := range c.days {
+		at := day * daySeconds
+		i, _ := slices.BinarySearchFunc(buckets, at, func(b FacetCount, at int64) int {
+			return cmp.Compare(b.Min, at)
+		})
+		if i == len(buckets) || buckets[i].Min > at {
+			i--
+		}
+		buckets[i].Count += count
+	}
+	for _, b := range buckets {
+		if b.Count > 0 {
+			facets.Discovered = append(facets.Discovered, b)
+		}
+	}
+	return facets
+}
+
+func topFacets(counts map[string]int64, n int) []FacetCount {
+	facets := make([]FacetCount, 0, len(counts))
+	for value, count := range counts {
+		facets = append(facets, FacetCount{Value: value, Count: count})
+	}
+	slices.SortFunc(facets, func(a, b FacetCount) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	return facets[:min(n, len(facets))]
+}
+
+// dateBuckets divides the time from first to last into days or, for longer
+// periods, months.
+func dateBuckets(first int64, last int64) []FacetCount {
+	start := time.Unix(first, 0).UTC()
+	end := time.Unix(last, 0).UTC()
+	layout, step := "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	if end.Sub(start) > maxDayBuckets*daySeconds*time.Second {
+		layout, step = "2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+		start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var buckets []FacetCount
+	for t := start; !t.After(end); t = step(t) {
+		buckets = append(buckets, FacetCount{Value: t.Format(layout), Min: t.Unix(), Max: step(t).Unix() - 1})
+	}
+	return buckets
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"slices"
+	"testing"
+)
+
+func TestFacets(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	const day = 24 * 60 * 60
+	torrents := []dhtcclient.Metadata{
+		{InfoHash: []byte{1}, Name: "linux iso", TotalSize: 2 << 30, DiscoveredOn: 10 * day,
+			Files: []dhtcclient.File{{Path: "linux.ISO"}, {Path: "readme.txt"}}},
+		{InfoHash: []byte{2}, Name: "linux music", TotalSize: 50 << 20, DiscoveredOn: 10*day + 60,
+			Files: []dhtcclient.File{{Path: "a.mp3"}, {Path: "b.mp3"}}},
+		{InfoHash: []byte{3}, Name: "linux video", TotalSize: 3 << 30, DiscoveredOn: 12 * day,
+			Files: []dhtcclient.File{{Path: "a.mkv"}}},
+		{InfoHash: []byte{4}, Name: "debian", TotalSize: 1 << 20, DiscoveredOn: 12 * day,
+			Files: []dhtcclient.File{{Path: "debian.iso"}}},
+	}
+	for _, md := range torrents {
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+
+	values := func(counts []FacetCount) []string {
+		var res []string
+		for _, c := range counts {
+			res = append(res, c.Value+":"+string(rune('0'+c.Count)))
+		}
+		return res
+	}
+
+	tests := []struct {
+		searchType string
+		filters    SearchFilters
+		categories []string
+		extensions []string
+		sizes      []string
+		discovered []string
+	}{
+		{"contains", SearchFilters{},
+			[]string{"Audio:1", "Document:1", "Software:1", "Video:1"},
+			[]string{"iso:1", "mkv:1", "mp3:1", "txt:1"},
+			[]string{"< 100 MB:1", "1 GB - 10 GB:2"},
+			[]string{"1970-01-11:2", "1970-01-13:1"}},
+		{"startswith", SearchFilters{Categories: []string{"Software"}},
+			[]string{"Document:1", "Software:1"},
+			[]string{"iso:1", "txt:1"},
+			[]string{"1 GB - 10 GB:1"},
+			[]string{"1970-01-11:1"}},
+		{"contains", SearchFilters{Extensions: []string{".mp3", "mkv"}},
+			[]string{"Audio:1", "Video:1"},
+			[]string{"mkv:1", "mp3:1"},
+			[]string{"< 100 MB:1", "1 GB - 10 GB:1"},
+			[]string{"1970-01-11:1", "1970-01-13:1"}},
+	}
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		for _, test := range tests {
+			facets, err := repo.Facets("Name", test.searchType, "linux", test.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for field, got := range map[string][]FacetCount{
+				"categories": facets.Categories, "extensions": facets.Extensions, "sizes": facets.Sizes, "discovered": facets.Discovered,
+			} {
+				expected := map[string][]string{
+					"categories": test.categories, "extensions": test.extensions, "sizes": test.sizes, "discovered": test.discovered,
+				}[field]
+				if !slices.Equal(values(got), expected) {
+					t.Errorf("%s %s %+v: expected %s %v, got %v", name, test.searchType, test.filters, field, expected, values(got))
+				}
+			}
+
+			results, total, err := repo.Search("Name", test.searchType, "linux", 10, 0, test.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sum int64
+			for _, c := range facets.Sizes {
+				sum += c.Count
+			}
+			if sum != total || len(results) != int(total) {
+				t.Errorf("%s %+v: expected size facets to add up to %d results, got %d", name, test.filters, total, sum)
+			}
+		}
+	}
+}
+
+func TestDateBuckets(t *testing.T) {
+	buckets := dateBuckets(0, 100*daySeconds)
+	if len(buckets) != 4 || buckets[0].Value != "1970-01" || buckets[3].Max != 120*daySeconds-1 {
+		t.Errorf("expected month buckets, got %+v", buckets)
+	}
+	if exts := fileExtensions([]dhtcclient.File{{Path: "a.TAR.GZ"}, {Path: "b.gz"}, {Path: "noext"}}); !slices.Equal(exts, []string{"gz"}) {
+		t.Errorf("expected distinct lower case extensions, got %v", exts)
+	}
+}
@@ -1,12 +1,17 @@
 package db
 
 import (
+	"context"
 	"dhtc/config"
 	dhtcclient "dhtc/dhtc-client"
+	"dhtc/notifier"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -23,15 +28,72 @@ type GormTorrent struct {
 	InfoHash     string `gorm:"uniqueIndex"`
 	Files        string `gorm:"type:text"`
 	DiscoveredOn int64  `gorm:"index"`
-	TotalSize    uint64
-	Categories   string `gorm:"column:category;index"`
+	TotalSize    uint64 `gorm:"index"`
+	FileCount    int    `gorm:"index"`
+	Categories   string `gorm:"index"`
+	Extensions   string `gorm:"index"`
+	NameKey      string `gorm:"index;size:32"`
+	FilesKey     string `gorm:"index;size:32"`
+	ClusterId    string `gorm:"index;size:64"`
+	Seq          int64  `gorm:"index"`
 }
 
 type GormWatch struct {
-	ID        uint `gorm:"primaryKey"`
-	Key       string
-	MatchType string
-	Content   string
+	ID             uint `gorm:"primaryKey"`
+	Key            string
+	MatchType      string
+	Content        string
+	MinSize        uint64
+	MaxSize        uint64
+	Categories     string
+	MinFiles       int
+	Exclude        string `gorm:"type:text"`
+	QuietStart     string `gorm:"size:5"`
+	QuietEnd       string `gorm:"size:5"`
+	Notifiers      string
+	Downloader     string
+	SavePath       string
+	Label          string
+	DailyCap       int
+	FirstMatchOnly bool
+	Digest         string `gorm:"size:16"`
+	DigestInterval int
+}
+
+type GormWatchHit struct {
+	ID             uint   `gorm:"primaryKey"`
+	WatchId        string `gorm:"index;size:64"`
+	InfoHash       string `gorm:"size:64"`
+	Name           string
+	Time           int64 `gorm:"index"`
+	Quiet          bool
+	Digest         bool
+	Deliveries     string `gorm:"type:text"`
+	Downloader     string
+	DownloadStatus string `gorm:"size:16"`
+	DownloadError  string `gorm:"type:text"`
+}
+
+type GormOutboxItem struct {
+	ID          uint   `gorm:"primaryKey"`
+	Notifier    string `gorm:"size:64"`
+	Event       string `gorm:"type:text"`
+	Ref         string `gorm:"size:64"`
+	Created     int64
+	Attempts    int
+	NextAttempt int64
+	LastError   string `gorm:"type:text"`
+}
+
+type GormSavedSearch struct {
+	ID          uint `gorm:"primaryKey"`
+	Name        string
+	Key         string
+	MatchType   string
+	SearchInput string `gorm:"type:text"`
+	Filters     string `gorm:"type:text"`
+	Token       string `gorm:"size:64"`
+	CreatedOn   int64
 }
 
 type GormBlacklist struct {
@@ -45,10 +107,23 @@ type GormStats struct {
 	TorrentCount int64
 }
 
+type GormKeyValue struct {
+	Key   string `gorm:"primaryKey;size:191"`
+	Value string `gorm:"type:text"`
+}
+
 type GormRepository struct {
-	db         *gorm.DB
-	config     *config.Configuration
-	ftsEnabled bool
+	db              *gorm.DB
+	config          *config.Configuration
+	ftsEnabled      bool
+	trigramsEnabled bool
+
+	// insertMu serializes inserts until they are committed, so that torrents
+	// become visible in the order of their sequence numbers and the change
+	// feed never skips one. Auto increment ids are assigned on insert but
+	// become visible on commit, so they can not be used instead.
+	insertMu sync.Mutex
+	seq      int64
 }
 
 func NewGormRepository(config *config.Configuration, dbType, dbUrl string) (Repository, error) {
@@ -72,17 +147,21 @@ func NewGormRepository(config *config.Configuration, dbType, dbUrl string) (Repo
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&GormTorrent{}, &GormWatch{}, &GormBlacklist{}, &GormStats{})
-	if err != nil {
-		return nil, err
-	}
-
 	repo := &GormRepository{
 		db:     db,
 		config: config,
 	}
 
-	repo.initFTS()
+	if _, err = repo.Migrate(config.SchemaDryRun); err != nil {
+		return nil, err
+	}
+	if !config.SchemaDryRun {
+		if err = db.Model(&GormTorrent{}).Select("COALESCE(MAX(seq), 0)").Scan(&repo.seq).Error; err != nil {
+			return nil, err
+		}
+		repo.initFTS()
+		repo.initTrigrams()
+	}
 
 	return repo, nil
 }
@@ -141,31 +220,33 @@ func (r *GormRepository) GetInfoHashCount() int {
 func (r *GormRepository) applyNameSearch(query *gorm.DB, searchType string, searchInput string) *gorm.DB {
 	switch searchType {
 	case "contains":
-		if r.ftsEnabled {
-			dialector := r.db.Dialector.Name()
-			switch dialector {
-			case "mysql":
-				return query.Where("MATCH(name) AGAINST(? IN BOOLEAN MODE)", searchInput+"*")
-			case "postgres":
-				return query.Where("to_tsvector('simple', name) @@ plainto_tsquery('simple', ?)", searchInput)
-			case "sqlite":
-				return query.Where("id IN (SELECT rowid FROM gorm_torrents_fts WHERE name MATCH ?)", searchInput+"*")
-			}
-		}
-		return query.Where("name LIKE ?", "%"+searchInput+"%")
+		sql, args := r.nameContainsSQL(searchInput)
+		return query.Where(sql, args...)
 	case "equals":
 		return query.Where("name = ?", searchInput)
 	case "startswith":
 		return query.Where("name LIKE ?", searchInput+"%")
 	case "endswith":
 		return query.Where("name LIKE ?", "%"+searchInput)
+	case MatchFuzzy:
+		sql, args := r.fuzzyNameSQL(searchInput)
+		return query.Where(sql, args...)
 	}
 	return query
 }
 
 func (r *GormRepository) FindBy(key string, searchType string, searchInput string) []MetaData {
 	var torrents []GormTorrent
-	query := r.db.Model(&GormTorrent{})
+	_ = r.fuzzySession(searchType, func(db *gorm.DB) error {
+		torrents = r.findBy(db, key, searchType, searchInput)
+		return nil
+	})
+	return r.toMetaDataSlice(torrents)
+}
+
+func (r *GormRepository) findBy(db *gorm.DB, key string, searchType string, searchInput string) []GormTorrent {
+	var torrents []GormTorrent
+	query := db.Model(&GormTorrent{})
 
 	switch key {
 	case "Name":
@@ -174,16 +255,173 @@ func (r *GormRepository) FindBy(key string, searchType string, searchInput strin
 		query = query.Where("info_hash = ?", searchInput)
 	case "Files":
 		query = query.Where("files LIKE ?", "%"+searchInput+"%")
+	case QueryKey:
+		q, err := ParseQuery(searchInput)
+		if err != nil {
+			return nil
+		}
+		query = r.applyQuery(query, q)
 	}
 
 	query.Find(&torrents)
+	return torrents
+}
 
-	return r.toMetaDataSlice(torrents)
+func (r *GormRepository) GetTorrent(infoHash string) (Torrent, error) {
+	var t GormTorrent
+	err := r.db.Where("info_hash = ?", infoHash).First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Torrent{}, ErrNotFound
+	}
+	return t.toTorrent(), err
 }
 
-func (r *GormRepository) Search(key string, searchType string, searchInput string, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
-	var torrents []GormTorrent
-	query := r.db.Model(&GormTorrent{})
+func (r *GormRepository) Search(key string, searchType string, searchInput string, limit int, offset int, filters SearchFilters) (mds []MetaData, total int64, err error) {
+	err = r.fuzzySession(searchType, func(db *gorm.DB) error {
+		mds, total, err = r.search(db, key, searchType, searchInput, limit, offset, filters)
+		return err
+	})
+	return mds, total, err
+}
+
+func (r *GormRepository) search(db *gorm.DB, key string, searchType string, searchInput string, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	query, err := r.searchQuery(db, key, searchType, searchInput, filters)
+	if err != nil {
+		return nil, 0, err
+	}
+	matching := query.Session(&gorm.Session{})
+	if filters.Collapse {
+		query = collapseGormClusters(query)
+	}
+
+	var total int64
+	if !filters.SkipTotal {
+		if total, err = r.count(query, filters.ApproximateTotal); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var rank string
+	var rankArgs []any
+	switch {
+	case key == "Name" && searchType == "contains":
+		rank, rankArgs = r.nameRankSQL(searchInput)
+	case key == "Name" && searchType == MatchFuzzy:
+		rank, rankArgs = r.fuzzyRankSQL(searchInput)
+	}
+	ranked := rank != ""
+	if !ranked {
+		rank = "0"
+	}
+	keyset := filters.SortField(ranked) == SortDiscovered
+	if query, err = applyCursor(query, filters, keyset); err != nil {
+		return nil, 0, err
+	}
+	query = query.Select("gorm_torrents.*, "+rank+" AS relevance", rankArgs...)
+
+	var results []gormSearchResult
+	start := pageStart(offset, filters.Cursor)
+	if err := query.Order(gormSortOrder(filters, ranked)).Limit(limit).Offset(start).Find(&results).Error; err != nil {
+		return nil, 0, err
+	}
+
+	torrents := make([]GormTorrent, len(results))
+	for i, res := range results {
+		torrents[i] = res.GormTorrent
+	}
+	mds := r.toMetaDataSlice(torrents)
+	for i, res := range results {
+		mds[i].Relevance = res.Relevance
+		mds[i].Cursor = resultCursor(keyset, res.DiscoveredOn, fmt.Sprint(res.ID), start, i)
+	}
+	if filters.Collapse {
+		err = countVariants(matching, mds)
+	}
+	return mds, total, err
+}
+
+// collapseGormClusters restricts query to the first torrent of every cluster.
+// Torrents without cluster are their own cluster.
+func collapseGormClusters(query *gorm.DB) *gorm.DB {
+	first := query.Session(&gorm.Session{}).Select("MIN(id)").Group("COALESCE(NULLIF(cluster_id, ''), info_hash)")
+	return query.Session(&gorm.Session{}).Where("id IN (?)", first)
+}
+
+// countVariants sets the number of torrents matched by query for the clusters of mds.
+func countVariants(query *gorm.DB, mds []MetaData) error {
+	var clusters []string
+	for i, md := range mds {
+		mds[i].Variants = 1
+		if md.ClusterId != "" {
+			clusters = append(clusters, md.ClusterId)
+		}
+	}
+	if len(clusters) == 0 {
+		return nil
+	}
+	var counts []struct {
+		ClusterId string
+		Count     int
+	}
+	err := query.Select("cluster_id, count(*) AS count").Where("cluster_id IN ?", clusters).Group("cluster_id").Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+	for _, c := range counts {
+		for i := range mds {
+			if mds[i].ClusterId == c.ClusterId {
+				mds[i].Variants = c.Count
+			}
+		}
+	}
+	return nil
+}
+
+// count counts the rows matched by query. PostgreSQL can estimate the count
+// from the query plan instead, which avoids a scan of large tables. The other
+// databases always count.
+func (r *GormRepository) count(query *gorm.DB, approximate bool) (int64, error) {
+	if approximate && r.db.Dialector.Name() == "postgres" {
+		stmt := query.Session(&gorm.Session{DryRun: true}).Find(&[]GormTorrent{}).Statement
+		var plan string
+		err := query.Statement.ConnPool.QueryRowContext(context.Background(), "EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...).Scan(&plan)
+		var plans []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			}
+		}
+		if err == nil && json.Unmarshal([]byte(plan), &plans) == nil && len(plans) > 0 {
+			return int64(plans[0].Plan.Rows), nil
+		}
+		log.Warn().Err(err).Msg("failed to estimate the result count, counting instead")
+	}
+
+	var total int64
+	err := query.Session(&gorm.Session{}).Count(&total).Error
+	return total, err
+}
+
+// applyCursor continues query after a keyset cursor, which is only valid for
+// results ordered by discovery date. Offset cursors are applied as offset.
+func applyCursor(query *gorm.DB, filters SearchFilters, keyset bool) (*gorm.DB, error) {
+	if !filters.Cursor.isKeyset() {
+		return query, nil
+	}
+	id, err := strconv.ParseUint(filters.Cursor.Id, 10, 64)
+	if !keyset || err != nil {
+		return nil, ErrInvalidCursor
+	}
+	op := "<"
+	if filters.SortAscending {
+		op = ">"
+	}
+	discoveredOn := filters.Cursor.DiscoveredOn
+	return query.Where("(discovered_on "+op+" ? OR (discovered_on = ? AND id "+op+" ?))", discoveredOn, discoveredOn, id), nil
+}
+
+// searchQuery restricts the torrents of db to the results of a search.
+func (r *GormRepository) searchQuery(db *gorm.DB, key string, searchType string, searchInput string, filters SearchFilters) (*gorm.DB, error) {
+	query := db.Model(&GormTorrent{})
 
 	switch key {
 	case "Name":
@@ -194,8 +432,42 @@ func (r *GormRepository) Search(key string, searchType string, searchInput strin
 		query = query.Where("files LIKE ?", "%"+searchInput+"%")
 	case "DiscoveredOn":
 		query = query.Where("discovered_on LIKE ?", "%"+searchInput+"%")
+	case QueryKey:
+		q, err := ParseQuery(searchInput)
+		if err != nil {
+			return nil, err
+		}
+		query = r.applyQuery(query, q)
 	}
+	return applyFilters(query, filters), nil
+}
 
+type gormSearchResult struct {
+	GormTorrent `gorm:"embedded"`
+	Relevance   float64
+}
+
+var gormSortColumns = map[string]string{
+	SortRelevance:  "relevance",
+	SortDiscovered: "discovered_on",
+	SortSize:       "total_size",
+	SortFiles:      "file_count",
+}
+
+func gormSortOrder(filters SearchFilters, ranked bool) string {
+	field := filters.SortField(ranked)
+	direction := " DESC"
+	if filters.SortAscending {
+		direction = " ASC"
+	}
+	// The id breaks ties, so that keyset cursors continue at a well-defined position.
+	if field == SortDiscovered {
+		return "discovered_on" + direction + ", id" + direction
+	}
+	return gormSortColumns[field] + direction + ", discovered_on DESC, id DESC"
+}
+
+func applyFilters(query *gorm.DB, filters SearchFilters) *gorm.DB {
 	if filters.MinSize > 0 {
 		query = query.Where("total_size >= ?", filters.MinSize)
 	}
@@ -208,17 +480,25 @@ func (r *GormRepository) Search(key string, searchType string, searchInput strin
 	if filters.EndDate > 0 {
 		query = query.Where("discovered_on <= ?", filters.EndDate)
 	}
-
-	var total int64
-	if err := query.Count(&total).Error; err != nil {
-		return nil, 0, err
+	if filters.Since > 0 {
+		query = query.Where("discovered_on > ?", filters.Since)
 	}
-
-	if err := query.Order("discovered_on DESC").Limit(limit).Offset(offset).Find(&torrents).Error; err != nil {
-		return nil, 0, err
+	if len(filters.Categories) > 0 {
+		sql, args := anyListValueSQL("categories", filters.Categories)
+		query = query.Where(sql, args...)
 	}
-
-	return r.toMetaDataSlice(torrents), total, nil
+	if len(filters.Extensions) > 0 {
+		exts := make([]string, len(filters.Extensions))
+		for i, ext := range filters.Extensions {
+			exts[i] = strings.ToLower(strings.TrimPrefix(ext, "."))
+		}
+		sql, args := anyListValueSQL("extensions", exts)
+		query = query.Where(sql, args...)
+	}
+	if filters.Cluster != "" {
+		query = query.Where("cluster_id = ?", filters.Cluster)
+	}
+	return query
 }
 
 func (r *GormRepository) GetNRandomEntries(n int) []MetaData {
@@ -231,19 +511,35 @@ func (r *GormRepository) GetNRandomEntries(n int) []MetaData {
 	return r.toMetaDataSlice(torrents)
 }
 
-func (r *GormRepository) GetLatest(limit int, offset int) ([]MetaData, int64, error) {
-	var torrents []GormTorrent
-	var total int64
-
-	if err := r.db.Model(&GormTorrent{}).Count(&total).Error; err != nil {
+func (r *GormRepository) GetLatest(limit int, offset int, filters SearchFilters) ([]MetaData, int64, error) {
+	filters.Sort, filters.SortAscending = SortDiscovered, false
+	query := applyFilters(r.db.Model(&GormTorrent{}), filters)
+	matching := query.Session(&gorm.Session{})
+	if filters.Collapse {
+		query = collapseGormClusters(query)
+	}
+	total, err := r.count(query, filters.ApproximateTotal)
+	if err != nil {
+		return nil, 0, err
+	}
+	if query, err = applyCursor(query, filters, true); err != nil {
 		return nil, 0, err
 	}
 
-	if err := r.db.Model(&GormTorrent{}).Order("discovered_on DESC").Limit(limit).Offset(offset).Find(&torrents).Error; err != nil {
+	var torrents []GormTorrent
+	start := pageStart(offset, filters.Cursor)
+	if err := query.Order(gormSortOrder(filters, false)).Limit(limit).Offset(start).Find(&torrents).Error; err != nil {
 		return nil, 0, err
 	}
 
-	return r.toMetaDataSlice(torrents), total, nil
+	mds := r.toMetaDataSlice(torrents)
+	for i, t := range torrents {
+		mds[i].Cursor = resultCursor(true, t.DiscoveredOn, fmt.Sprint(t.ID), start, i)
+	}
+	if filters.Collapse {
+		err = countVariants(matching, mds)
+	}
+	return mds, total, err
 }
 
 func (r *GormRepository) InsertMetadata(md dhtcclient.Metadata) bool {
@@ -252,18 +548,175 @@ func (r *GormRepository) InsertMetadata(md dhtcclient.Metadata) bool {
 		return false
 	}
 
-	filesJson, _ := json.Marshal(md.Files)
-	torrent := GormTorrent{
-		Name:         md.Name,
-		InfoHash:     fmt.Sprintf("%x", md.InfoHash),
+	torrent := newGormTorrent(NewTorrent(md))
+	r.insertMu.Lock()
+	defer r.insertMu.Unlock()
+	torrent.Seq = r.seq + 1
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&torrent).Error; err != nil {
+			return err
+		}
+		return indexTrigrams(tx, []GormTorrent{torrent})
+	})
+	if err != nil {
+		return false
+	}
+	r.seq++
+	return true
+}
+
+func newGormTorrent(t Torrent) GormTorrent {
+	filesJson, _ := json.Marshal(t.Files)
+	return GormTorrent{
+		Name:         t.Name,
+		InfoHash:     t.InfoHash,
 		Files:        string(filesJson),
-		DiscoveredOn: md.DiscoveredOn,
-		TotalSize:    md.TotalSize,
-		Categories:   strings.Join(Categorize(md), ","),
+		DiscoveredOn: t.DiscoveredOn,
+		TotalSize:    t.TotalSize,
+		FileCount:    len(t.Files),
+		Categories:   strings.Join(torrentCategories(t), ","),
+		Extensions:   strings.Join(fileExtensions(t.Files), ","),
 	}
+}
+
+func (r *GormRepository) MergeTorrents(torrents []Torrent) (MergeResult, error) {
+	var res MergeResult
+	torrents = DeduplicateTorrents(torrents)
+	hashes := make([]string, len(torrents))
+	for i, t := range torrents {
+		hashes[i] = t.InfoHash
+	}
+
+	r.insertMu.Lock()
+	defer r.insertMu.Unlock()
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var existing []GormTorrent
+		if err := tx.Where("info_hash IN ?", hashes).Find(&existing).Error; err != nil {
+			return err
+		}
+		byHash := make(map[string]GormTorrent, len(existing))
+		for _, e := range existing {
+			byHash[e.InfoHash] = e
+		}
 
-	err := r.db.Create(&torrent).Error
-	return err == nil
+		var inserts, updates []GormTorrent
+		for _, t := range torrents {
+			if e, ok := byHash[t.InfoHash]; ok {
+				merged, changed := MergeTorrent(e.toTorrent(), t)
+				if !changed {
+					res.Skipped++
+					continue
+				}
+				row := newGormTorrent(merged)
+				row.ID, row.Seq = e.ID, e.Seq
+				if err := tx.Save(&row).Error; err != nil {
+					return err
+				}
+				updates = append(updates, row)
+				res.Merged++
+				continue
+			}
+			if r.config.EnableBlacklist && r.IsBlacklisted(t.Metadata()) {
+				res.Skipped++
+				continue
+			}
+			row := newGormTorrent(t)
+			row.Seq = r.seq + int64(len(inserts)) + 1
+			inserts = append(inserts, row)
+		}
+
+		if len(inserts) > 0 {
+			if err := tx.CreateInBatches(inserts, 500).Error; err != nil {
+				return err
+			}
+		}
+		res.Inserted = len(inserts)
+		return indexTrigrams(tx, append(updates, inserts...))
+	})
+	if err == nil {
+		r.seq += int64(res.Inserted)
+	}
+	return res, err
+}
+
+func (r *GormRepository) ForEachTorrent(filters SearchFilters, fn func(Change) error) error {
+	const batchSize = 1000
+	lastSeq := filters.AfterSeq
+	for {
+		var torrents []GormTorrent
+		query := applyFilters(r.db.Model(&GormTorrent{}), filters).Where("seq > ?", lastSeq)
+		if err := query.Order("seq ASC").Limit(batchSize).Find(&torrents).Error; err != nil {
+			return err
+		}
+		for _, t := range torrents {
+			if err := fn(Change{Seq: t.Seq, Torrent: t.toTorrent()}); err != nil {
+				return err
+			}
+		}
+		if len(torrents) < batchSize {
+			return nil
+		}
+		lastSeq = torrents[len(torrents)-1].Seq
+	}
+}
+
+func (r *GormRepository) GetUnclusteredTorrents(limit int) ([]Torrent, error) {
+	var torrents []GormTorrent
+	err := r.db.Where("cluster_id IS NULL OR cluster_id = ''").Order("discovered_on ASC, id ASC").Limit(limit).Find(&torrents).Error
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Torrent, len(torrents))
+	for i, t := range torrents {
+		res[i] = t.toTorrent()
+	}
+	return res, nil
+}
+
+func (r *GormRepository) FindCluster(fp Fingerprint) (string, error) {
+	var conditions []string
+	var args []any
+	if fp.NameKey != "" {
+		conditions = append(conditions, "name_key = ?")
+		args = append(args, fp.NameKey)
+	}
+	if fp.FilesKey != "" {
+		conditions = append(conditions, "files_key = ?")
+		args = append(args, fp.FilesKey)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	var clusters []string
+	err := r.db.Model(&GormTorrent{}).Where("cluster_id <> ''").Where("("+strings.Join(conditions, " OR ")+")", args...).
+		Order("discovered_on ASC, id ASC").Limit(1).Pluck("cluster_id", &clusters).Error
+	if err != nil || len(clusters) == 0 {
+		return "", err
+	}
+	return clusters[0], nil
+}
+
+func (r *GormRepository) SetCluster(infoHash string, fp Fingerprint, clusterId string) error {
+	return r.db.Model(&GormTorrent{}).Where("info_hash = ?", infoHash).Updates(map[string]any{
+		"name_key":   fp.NameKey,
+		"files_key":  fp.FilesKey,
+		"cluster_id": clusterId,
+	}).Error
+}
+
+// GetChanges pages on the sequence numbers assigned by inserts. Merged torrents
+// keep their sequence number, so only newly inserted torrents show up in the
+// change feed.
+func (r *GormRepository) GetChanges(after int64, limit int) ([]Change, error) {
+	var torrents []GormTorrent
+	if err := r.db.Where("seq > ?", after).Order("seq ASC").Limit(limit).Find(&torrents).Error; err != nil {
+		return nil, err
+	}
+	changes := make([]Change, len(torrents))
+	for i, t := range torrents {
+		changes[i] = Change{Seq: t.Seq, Torrent: t.toTorrent()}
+	}
+	return changes, nil
 }
 
 func (r *GormRepository) GetWatchEntries() []WatchEntry {
@@ -272,26 +725,282 @@ func (r *GormRepository) GetWatchEntries() []WatchEntry {
 	res := make([]WatchEntry, len(entries))
 	for i, e := range entries {
 		res[i] = WatchEntry{
-			Id:        fmt.Sprint(e.ID),
-			Key:       e.Key,
-			MatchType: e.MatchType,
-			Content:   e.Content,
+			Id:             fmt.Sprint(e.ID),
+			Key:            e.Key,
+			MatchType:      e.MatchType,
+			Content:        e.Content,
+			MinSize:        e.MinSize,
+			MaxSize:        e.MaxSize,
+			Categories:     splitList(e.Categories),
+			MinFiles:       e.MinFiles,
+			Exclude:        splitList(e.Exclude),
+			QuietStart:     e.QuietStart,
+			QuietEnd:       e.QuietEnd,
+			Notifiers:      splitList(e.Notifiers),
+			Downloader:     e.Downloader,
+			SavePath:       e.SavePath,
+			Label:          e.Label,
+			DailyCap:       e.DailyCap,
+			FirstMatchOnly: e.FirstMatchOnly,
+			Digest:         e.Digest,
+			DigestInterval: e.DigestInterval,
 		}
 	}
 	return res
 }
 
-func (r *GormRepository) InsertWatchEntry(key string, searchType string, searchInput string) bool {
-	entry := GormWatch{
-		Key:       key,
-		MatchType: searchType,
-		Content:   searchInput,
+func (r *GormRepository) InsertWatchEntry(entry WatchEntry) bool {
+	row := GormWatch{
+		Key:            entry.Key,
+		MatchType:      entry.MatchType,
+		Content:        entry.Content,
+		MinSize:        entry.MinSize,
+		MaxSize:        entry.MaxSize,
+		Categories:     strings.Join(entry.Categories, ","),
+		MinFiles:       entry.MinFiles,
+		Exclude:        strings.Join(entry.Exclude, ","),
+		QuietStart:     entry.QuietStart,
+		QuietEnd:       entry.QuietEnd,
+		Notifiers:      strings.Join(entry.Notifiers, ","),
+		Downloader:     entry.Downloader,
+		SavePath:       entry.SavePath,
+		Label:          entry.Label,
+		DailyCap:       entry.DailyCap,
+		FirstMatchOnly: entry.FirstMatchOnly,
+		Digest:         entry.Digest,
+		DigestInterval: entry.DigestInterval,
 	}
-	return r.db.Create(&entry).Error == nil
+	return r.db.Create(&row).Error == nil
 }
 
 func (r *GormRepository) DeleteWatchEntry(id string) error {
-	return r.db.Delete(&GormWatch{}, id).Error
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&GormWatch{}, n)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Where("watch_id = ?", id).Delete(&GormWatchHit{}).Error
+	})
+}
+
+func (r *GormRepository) InsertWatchHit(hit WatchHit) (string, error) {
+	row := GormWatchHit{
+		WatchId:        hit.WatchId,
+		InfoHash:       hit.InfoHash,
+		Name:           hit.Name,
+		Time:           hit.Time,
+		Quiet:          hit.Quiet,
+		Digest:         hit.Digest,
+		Deliveries:     encodeDeliveries(hit.Deliveries),
+		Downloader:     hit.Downloader,
+		DownloadStatus: hit.DownloadStatus,
+		DownloadError:  hit.DownloadError,
+	}
+	if err := r.db.Create(&row).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprint(row.ID), nil
+}
+
+func (r *GormRepository) SetWatchHitDelivery(id string, d notifier.Delivery) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var row GormWatchHit
+		if err := tx.First(&row, id).Error; err != nil {
+			return err
+		}
+		deliveries := encodeDeliveries(setDelivery(decodeDeliveries(row.Deliveries), d))
+		return tx.Model(&row).Update("deliveries", deliveries).Error
+	})
+}
+
+func (r *GormRepository) GetWatchHits(watchId string, limit int) ([]WatchHit, error) {
+	query := r.db.Model(&GormWatchHit{})
+	if watchId != "" {
+		query = query.Where("watch_id = ?", watchId)
+	}
+	var rows []GormWatchHit
+	if err := query.Order("time DESC, id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return toWatchHits(rows), nil
+}
+
+func (r *GormRepository) GetWatchHitsSince(watchId string, since int64) ([]WatchHit, error) {
+	var rows []GormWatchHit
+	err := r.db.Where("watch_id = ? AND time >= ?", watchId, since).Order("time DESC, id DESC").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return toWatchHits(rows), nil
+}
+
+func (r *GormRepository) GetWatchDownloads(watchId string, since int64) ([]WatchHit, error) {
+	var rows []GormWatchHit
+	err := r.db.Where("watch_id = ? AND download_status = ? AND time >= ?", watchId, DownloadSent, since).
+		Order("time DESC, id DESC").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return toWatchHits(rows), nil
+}
+
+func toWatchHits(rows []GormWatchHit) []WatchHit {
+	res := make([]WatchHit, len(rows))
+	for i, row := range rows {
+		res[i] = WatchHit{
+			Id:             fmt.Sprint(row.ID),
+			WatchId:        row.WatchId,
+			InfoHash:       row.InfoHash,
+			Name:           row.Name,
+			Time:           row.Time,
+			Quiet:          row.Quiet,
+			Digest:         row.Digest,
+			Deliveries:     decodeDeliveries(row.Deliveries),
+			Downloader:     row.Downloader,
+			DownloadStatus: row.DownloadStatus,
+			DownloadError:  row.DownloadError,
+		}
+	}
+	return res
+}
+
+func (r *GormRepository) GetWatchHitStats() (map[string]WatchHitStats, error) {
+	var rows []struct {
+		WatchId string
+		Count   int64
+		LastHit int64
+	}
+	err := r.db.Model(&GormWatchHit{}).Select("watch_id, COUNT(*) AS count, MAX(time) AS last_hit").Group("watch_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]WatchHitStats, len(rows))
+	for _, row := range rows {
+		res[row.WatchId] = WatchHitStats{Count: row.Count, LastHit: row.LastHit}
+	}
+	return res, nil
+}
+
+func (r *GormRepository) InsertOutboxItem(item notifier.OutboxItem) (string, error) {
+	row := GormOutboxItem{
+		Notifier:    item.Notifier,
+		Event:       encodeEvent(item.Event),
+		Ref:         item.Ref,
+		Created:     item.Created,
+		Attempts:    item.Attempts,
+		NextAttempt: item.NextAttempt,
+		LastError:   item.LastError,
+	}
+	if err := r.db.Create(&row).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprint(row.ID), nil
+}
+
+func (r *GormRepository) GetOutboxItems() ([]notifier.OutboxItem, error) {
+	var rows []GormOutboxItem
+	if err := r.db.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make([]notifier.OutboxItem, len(rows))
+	for i, row := range rows {
+		res[i] = notifier.OutboxItem{
+			Id:          fmt.Sprint(row.ID),
+			Notifier:    row.Notifier,
+			Event:       decodeEvent(row.Event),
+			Ref:         row.Ref,
+			Created:     row.Created,
+			Attempts:    row.Attempts,
+			NextAttempt: row.NextAttempt,
+			LastError:   row.LastError,
+		}
+	}
+	return res, nil
+}
+
+func (r *GormRepository) UpdateOutboxItem(item notifier.OutboxItem) error {
+	return r.db.Model(&GormOutboxItem{}).Where("id = ?", item.Id).Updates(map[string]any{
+		"attempts":     item.Attempts,
+		"next_attempt": item.NextAttempt,
+		"last_error":   item.LastError,
+	}).Error
+}
+
+func (r *GormRepository) DeleteOutboxItem(id string) error {
+	return r.db.Delete(&GormOutboxItem{}, id).Error
+}
+
+func (r *GormRepository) GetSavedSearches() ([]SavedSearch, error) {
+	var rows []GormSavedSearch
+	if err := r.db.Order("name, id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make([]SavedSearch, len(rows))
+	for i, row := range rows {
+		res[i] = row.toSavedSearch()
+	}
+	return res, nil
+}
+
+func (r *GormRepository) GetSavedSearch(id string) (SavedSearch, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return SavedSearch{}, ErrNotFound
+	}
+	var row GormSavedSearch
+	err = r.db.First(&row, n).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return SavedSearch{}, ErrNotFound
+	}
+	return row.toSavedSearch(), err
+}
+
+func (r *GormRepository) InsertSavedSearch(s SavedSearch) (string, error) {
+	row := GormSavedSearch{
+		Name:        s.Name,
+		Key:         s.Key,
+		MatchType:   s.MatchType,
+		SearchInput: s.SearchInput,
+		Filters:     encodeFilters(s.Filters),
+		Token:       s.Token,
+		CreatedOn:   s.CreatedOn,
+	}
+	if err := r.db.Create(&row).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprint(row.ID), nil
+}
+
+func (r *GormRepository) DeleteSavedSearch(id string) error {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	res := r.db.Delete(&GormSavedSearch{}, n)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return res.Error
+}
+
+func (s GormSavedSearch) toSavedSearch() SavedSearch {
+	return SavedSearch{
+		Id:          fmt.Sprint(s.ID),
+		Name:        s.Name,
+		Key:         s.Key,
+		MatchType:   s.MatchType,
+		SearchInput: s.SearchInput,
+		Filters:     decodeFilters(s.Filters),
+		Token:       s.Token,
+		CreatedOn:   s.CreatedOn,
+	}
 }
 
 func (r *GormRepository) GetBlacklistEntries() []BlacklistEntry {
@@ -359,11 +1068,29 @@ func (r *GormRepository) toMetaDataSlice(torrents []GormTorrent) []MetaData {
 			TotalSize:    t.TotalSize,
 			Files:        files,
 			Categories:   strings.Split(t.Categories, ","),
+			ClusterId:    t.ClusterId,
 		}
 	}
 	return res
 }
 
+func (t GormTorrent) toTorrent() Torrent {
+	var files []dhtcclient.File
+	_ = json.Unmarshal([]byte(t.Files), &files)
+	var categories []string
+	if t.Categories != "" {
+		categories = strings.Split(t.Categories, ",")
+	}
+	return Torrent{
+		InfoHash:     t.InfoHash,
+		Name:         t.Name,
+		TotalSize:    t.TotalSize,
+		DiscoveredOn: t.DiscoveredOn,
+		Files:        files,
+		Categories:   categories,
+	}
+}
+
 func (r *GormRepository) GetAllInfoHashes() ([]string, error) {
 	var hashes []string
 	err := r.db.Model(&GormTorrent{}).Pluck("info_hash", &hashes).Error
@@ -422,20 +1149,48 @@ func (r *GormRepository) InsertStats(stats Stats) error {
 	}).Error
 }
 
+func (r *GormRepository) GetStats() ([]Stats, error) {
+	var rows []GormStats
+	if err := r.db.Order("timestamp ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make([]Stats, len(rows))
+	for i, row := range rows {
+		res[i] = Stats{
+			Timestamp:    row.Timestamp,
+			TorrentCount: row.TorrentCount,
+		}
+	}
+	return res, nil
+}
+
+func (r *GormRepository) GetValue(key string) (string, error) {
+	var rows []GormKeyValue
+	err := r.db.Where(&GormKeyValue{Key: key}).Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	return rows[0].Value, nil
+}
+
+func (r *GormRepository) SetValue(key string, value string) error {
+	return r.db.Save(&GormKeyValue{Key: key, Value: value}).Error
+}
+
 func (r *GormRepository) GetCategoryDistribution() (map[string]int64, error) {
 	type Result struct {
-		Category string
-		Count    int64
+		Categories string
+		Count      int64
 	}
 	var results []Result
-	err := r.db.Model(&GormTorrent{}).Select("category, count(*) as count").Group("category").Scan(&results).Error
+	err := r.db.Model(&GormTorrent{}).Select("categories, count(*) as count").Group("categories").Scan(&results).Error
 	if err != nil {
 		return nil, err
 	}
 
 	dist := make(map[string]int64)
 	for _, res := range results {
-		cats := strings.Split(res.Category, ",")
+		cats := strings.Split(res.Categories, ",")
 		for _, cat := range cats {
 			if cat == "" {
 				cat = "unknown"
@@ -446,6 +1201,71 @@ func (r *GormRepository) GetCategoryDistribution() (map[string]int64, error) {
 	return dist, nil
 }
 
+func (r *GormRepository) Facets(key string, searchType string, searchInput string, filters SearchFilters) (facets Facets, err error) {
+	err = r.fuzzySession(searchType, func(db *gorm.DB) error {
+		facets, err = r.facets(db, key, searchType, searchInput, filters)
+		return err
+	})
+	return facets, err
+}
+
+func (r *GormRepository) facets(db *gorm.DB, key string, searchType string, searchInput string, filters SearchFilters) (Facets, error) {
+	query, err := r.searchQuery(db, key, searchType, searchInput, filters)
+	if err != nil {
+		return Facets{}, err
+	}
+
+	type Result struct {
+		Value string
+		Count int64
+	}
+	collector := newFacetCollector()
+	for column, counts := range map[string]map[string]int64{"categories": collector.categories, "extensions": collector.extensions} {
+		var results []Result
+		err = query.Session(&gorm.Session{}).Select(column + " AS value, count(*) AS count").Group(column).Scan(&results).Error
+		if err != nil {
+			return Facets{}, err
+		}
+		for _, res := range results {
+			for _, value := range strings.Split(res.Value, ",") {
+				if value != "" {
+					counts[value] += res.Count
+				}
+			}
+		}
+	}
+
+	type BucketResult struct {
+		Bucket int64
+		Count  int64
+	}
+	var sizeCase strings.Builder
+	sizeCase.WriteString("CASE")
+	for i, b := range sizeBuckets[:len(sizeBuckets)-1] {
+		fmt.Fprintf(&sizeCase, " WHEN total_size <= %d THEN %d", b.Max, i)
+	}
+	fmt.Fprintf(&sizeCase, " ELSE %d END", len(sizeBuckets)-1)
+	day := fmt.Sprintf("discovered_on / %d", daySeconds)
+	if r.db.Dialector.Name() == "mysql" {
+		day = fmt.Sprintf("discovered_on DIV %d", daySeconds)
+	}
+
+	for expr, add := range map[string]func(BucketResult){
+		sizeCase.String(): func(res BucketResult) { collector.sizes[res.Bucket] += res.Count },
+		day:               func(res BucketResult) { collector.days[res.Bucket] += res.Count },
+	} {
+		var results []BucketResult
+		err = query.Session(&gorm.Session{}).Select(expr + " AS bucket, count(*) AS count").Group("bucket").Scan(&results).Error
+		if err != nil {
+			return Facets{}, err
+		}
+		for _, res := range results {
+			add(res)
+		}
+	}
+	return collector.facets(), nil
+}
+
 func (r *GormRepository) Close() error {
 	sqlDB, err := r.db.DB()
 	if err != nil {
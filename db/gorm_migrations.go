@@ -0,0 +1,521 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type GormSchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (GormSchemaVersion) TableName() string {
+	return SchemaTable
+}
+
+type gormMigration struct {
+	Migration
+	Up func(tx *gorm.DB) error
+}
+
+// The structs below are frozen snapshots of the tables as they were before
+// schema versioning was introduced, and of the tables and columns added by
+// later migrations, named after their version. Never change them, add a
+// migration instead.
+
+type gormTorrentV1 struct {
+	ID           uint   `gorm:"primaryKey"`
+	Name         string `gorm:"index"`
+	InfoHash     string `gorm:"uniqueIndex"`
+	Files        string `gorm:"type:text"`
+	DiscoveredOn int64  `gorm:"index"`
+	TotalSize    uint64
+	Categories   string `gorm:"column:category;index"`
+}
+
+func (gormTorrentV1) TableName() string {
+	return "gorm_torrents"
+}
+
+type gormWatchV1 struct {
+	ID        uint `gorm:"primaryKey"`
+	Key       string
+	MatchType string
+	Content   string
+}
+
+func (gormWatchV1) TableName() string {
+	return "gorm_watches"
+}
+
+type gormBlacklistV1 struct {
+	ID     uint `gorm:"primaryKey"`
+	Filter string
+	Type   string
+}
+
+func (gormBlacklistV1) TableName() string {
+	return "gorm_blacklists"
+}
+
+type gormStatsV1 struct {
+	Timestamp    time.Time `gorm:"primaryKey"`
+	TorrentCount int64
+}
+
+func (gormStatsV1) TableName() string {
+	return "gorm_stats"
+}
+
+type gormKeyValueV3 struct {
+	Key   string `gorm:"primaryKey;size:191"`
+	Value string `gorm:"type:text"`
+}
+
+func (gormKeyValueV3) TableName() string {
+	return "gorm_key_values"
+}
+
+type gormTorrentV4 struct {
+	TotalSize uint64 `gorm:"index"`
+	FileCount int    `gorm:"index"`
+}
+
+func (gormTorrentV4) TableName() string {
+	return "gorm_torrents"
+}
+
+type gormTorrentV5 struct {
+	Extensions string `gorm:"index"`
+}
+
+func (gormTorrentV5) TableName() string {
+	return "gorm_torrents"
+}
+
+type gormTrigramV6 struct {
+	Trigram   string `gorm:"primaryKey;size:16"`
+	TorrentID uint   `gorm:"primaryKey;index"`
+}
+
+func (gormTrigramV6) TableName() string {
+	return "gorm_trigrams"
+}
+
+type gormTorrentV7 struct {
+	NameKey   string `gorm:"index;size:32"`
+	FilesKey  string `gorm:"index;size:32"`
+	ClusterId string `gorm:"index;size:64"`
+}
+
+func (gormTorrentV7) TableName() string {
+	return "gorm_torrents"
+}
+
+type gormSavedSearchV8 struct {
+	ID          uint `gorm:"primaryKey"`
+	Name        string
+	Key         string
+	MatchType   string
+	SearchInput string `gorm:"type:text"`
+	Filters     string `gorm:"type:text"`
+	Token       string `gorm:"size:64"`
+	CreatedOn   int64
+}
+
+func (gormSavedSearchV8) TableName() string {
+	return "gorm_saved_searches"
+}
+
+type gormWatchV9 struct {
+	MinSize    uint64
+	MaxSize    uint64
+	Categories string
+	MinFiles   int
+	Exclude    string `gorm:"type:text"`
+	QuietStart string `gorm:"size:5"`
+	QuietEnd   string `gorm:"size:5"`
+	Notifiers  string
+}
+
+func (gormWatchV9) TableName() string {
+	return "gorm_watches"
+}
+
+type gormWatchHitV10 struct {
+	ID         uint   `gorm:"primaryKey"`
+	WatchId    string `gorm:"index;size:64"`
+	InfoHash   string `gorm:"size:64"`
+	Name       string
+	Time       int64 `gorm:"index"`
+	Quiet      bool
+	Deliveries string `gorm:"type:text"`
+}
+
+func (gormWatchHitV10) TableName() string {
+	return "gorm_watch_hits"
+}
+
+type gormWatchV11 struct {
+	Downloader     string
+	SavePath       string
+	Label          string
+	DailyCap       int
+	FirstMatchOnly bool
+}
+
+func (gormWatchV11) TableName() string {
+	return "gorm_watches"
+}
+
+type gormWatchHitV11 struct {
+	Downloader     string
+	DownloadStatus string `gorm:"size:16"`
+	DownloadError  string `gorm:"type:text"`
+}
+
+func (gormWatchHitV11) TableName() string {
+	return "gorm_watch_hits"
+}
+
+type gormOutboxItemV12 struct {
+	ID          uint   `gorm:"primaryKey"`
+	Notifier    string `gorm:"size:64"`
+	Event       string `gorm:"type:text"`
+	Ref         string `gorm:"size:64"`
+	Created     int64
+	Attempts    int
+	NextAttempt int64
+	LastError   string `gorm:"type:text"`
+}
+
+func (gormOutboxItemV12) TableName() string {
+	return "gorm_outbox_items"
+}
+
+type gormWatchV13 struct {
+	Digest         string `gorm:"size:16"`
+	DigestInterval int
+}
+
+func (gormWatchV13) TableName() string {
+	return "gorm_watches"
+}
+
+type gormWatchHitV13 struct {
+	Digest bool
+}
+
+func (gormWatchHitV13) TableName() string {
+	return "gorm_watch_hits"
+}
+
+type gormTorrentV14 struct {
+	Seq int64 `gorm:"index"`
+}
+
+func (gormTorrentV14) TableName() string {
+	return "gorm_torrents"
+}
+
+var gormMigrations = []gormMigration{
+	{
+		Migration: Migration{Version: 1, Name: "create torrent, watch, blacklist and stats tables"},
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gormTorrentV1{}, &gormWatchV1{}, &gormBlacklistV1{}, &gormStatsV1{})
+		},
+	},
+	{
+		Migration: Migration{Version: 2, Name: "rename torrent column category to categories"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&gormTorrentV1{}, "category") {
+				return nil
+			}
+			if err := m.RenameColumn(&gormTorrentV1{}, "category", "categories"); err != nil {
+				return err
+			}
+			if m.HasIndex(&gormTorrentV1{}, "idx_gorm_torrents_category") {
+				return m.RenameIndex(&gormTorrentV1{}, "idx_gorm_torrents_category", "idx_gorm_torrents_categories")
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 3, Name: "create key value table"},
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gormKeyValueV3{})
+		},
+	},
+	{
+		Migration: Migration{Version: 4, Name: "add torrent file count and sort indexes"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&gormTorrentV4{}, "FileCount") {
+				if err := m.AddColumn(&gormTorrentV4{}, "FileCount"); err != nil {
+					return err
+				}
+			}
+			for _, field := range []string{"TotalSize", "FileCount"} {
+				if m.HasIndex(&gormTorrentV4{}, field) {
+					continue
+				}
+				if err := m.CreateIndex(&gormTorrentV4{}, field); err != nil {
+					return err
+				}
+			}
+
+			return updateGormTorrents(tx, func(files []dhtcclient.File) map[string]any {
+				return map[string]any{"file_count": len(files)}
+			})
+		},
+	},
+	{
+		Migration: Migration{Version: 5, Name: "add torrent file extensions"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&gormTorrentV5{}, "Extensions") {
+				if err := m.AddColumn(&gormTorrentV5{}, "Extensions"); err != nil {
+					return err
+				}
+			}
+			if !m.HasIndex(&gormTorrentV5{}, "Extensions") {
+				if err := m.CreateIndex(&gormTorrentV5{}, "Extensions"); err != nil {
+					return err
+				}
+			}
+			return updateGormTorrents(tx, func(files []dhtcclient.File) map[string]any {
+				return map[string]any{"extensions": strings.Join(fileExtensions(files), ",")}
+			})
+		},
+	},
+	{
+		Migration: Migration{Version: 6, Name: "add torrent name trigrams for fuzzy search"},
+		Up: func(tx *gorm.DB) error {
+			if !usesTrigramTable(tx) {
+				return nil
+			}
+			if err := tx.AutoMigrate(&gormTrigramV6{}); err != nil {
+				return err
+			}
+			var lastId uint
+			for {
+				var rows []gormTorrentV1
+				if err := tx.Select("id", "name").Where("id > ?", lastId).Order("id").Limit(1000).Find(&rows).Error; err != nil {
+					return err
+				}
+				if len(rows) == 0 {
+					return nil
+				}
+				var trigramRows []gormTrigramV6
+				for _, row := range rows {
+					for _, trigram := range trigrams(row.Name) {
+						trigramRows = append(trigramRows, gormTrigramV6{Trigram: trigram, TorrentID: row.ID})
+					}
+				}
+				if len(trigramRows) > 0 {
+					if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(trigramRows, 500).Error; err != nil {
+						return err
+					}
+				}
+				lastId = rows[len(rows)-1].ID
+			}
+		},
+	},
+	{
+		Migration: Migration{Version: 7, Name: "add torrent fingerprints and clusters"},
+		Up: func(tx *gorm.DB) error {
+			// Existing torrents are clustered by the background job.
+			m := tx.Migrator()
+			for _, field := range []string{"NameKey", "FilesKey", "ClusterId"} {
+				if !m.HasColumn(&gormTorrentV7{}, field) {
+					if err := m.AddColumn(&gormTorrentV7{}, field); err != nil {
+						return err
+					}
+				}
+				if !m.HasIndex(&gormTorrentV7{}, field) {
+					if err := m.CreateIndex(&gormTorrentV7{}, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 8, Name: "create saved search table"},
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gormSavedSearchV8{})
+		},
+	},
+	{
+		Migration: Migration{Version: 9, Name: "add watch rules"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			for _, field := range []string{"MinSize", "MaxSize", "Categories", "MinFiles", "Exclude", "QuietStart", "QuietEnd", "Notifiers"} {
+				if m.HasColumn(&gormWatchV9{}, field) {
+					continue
+				}
+				if err := m.AddColumn(&gormWatchV9{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 10, Name: "create watch hit table"},
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gormWatchHitV10{})
+		},
+	},
+	{
+		Migration: Migration{Version: 11, Name: "add watch downloads"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			for _, table := range []struct {
+				model  any
+				fields []string
+			}{
+				{&gormWatchV11{}, []string{"Downloader", "SavePath", "Label", "DailyCap", "FirstMatchOnly"}},
+				{&gormWatchHitV11{}, []string{"Downloader", "DownloadStatus", "DownloadError"}},
+			} {
+				for _, field := range table.fields {
+					if m.HasColumn(table.model, field) {
+						continue
+					}
+					if err := m.AddColumn(table.model, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 12, Name: "create notification outbox table"},
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&gormOutboxItemV12{})
+		},
+	},
+	{
+		Migration: Migration{Version: 13, Name: "add watch digests"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			for _, table := range []struct {
+				model  any
+				fields []string
+			}{
+				{&gormWatchV13{}, []string{"Digest", "DigestInterval"}},
+				{&gormWatchHitV13{}, []string{"Digest"}},
+			} {
+				for _, field := range table.fields {
+					if m.HasColumn(table.model, field) {
+						continue
+					}
+					if err := m.AddColumn(table.model, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Migration: Migration{Version: 14, Name: "number torrents for the change feed"},
+		Up: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if !m.HasColumn(&gormTorrentV14{}, "Seq") {
+				if err := m.AddColumn(&gormTorrentV14{}, "Seq"); err != nil {
+					return err
+				}
+			}
+			if !m.HasIndex(&gormTorrentV14{}, "Seq") {
+				if err := m.CreateIndex(&gormTorrentV14{}, "Seq"); err != nil {
+					return err
+				}
+			}
+			// The ids were the sequence numbers before.
+			return tx.Table("gorm_torrents").Where("seq IS NULL OR seq = 0").Update("seq", gorm.Expr("id")).Error
+		},
+	},
+}
+
+// updateGormTorrents updates the columns returned by fn, derived from the file
+// list, of all torrents in batches.
+func updateGormTorrents(tx *gorm.DB, fn func(files []dhtcclient.File) map[string]any) error {
+	var lastId uint
+	for {
+		var rows []gormTorrentV1
+		if err := tx.Select("id", "files").Where("id > ?", lastId).Order("id").Limit(1000).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, row := range rows {
+			var files []dhtcclient.File
+			_ = json.Unmarshal([]byte(row.Files), &files)
+			if err := tx.Table("gorm_torrents").Where("id = ?", row.ID).Updates(fn(files)).Error; err != nil {
+				return err
+			}
+		}
+		lastId = rows[len(rows)-1].ID
+	}
+}
+
+func (r *GormRepository) SchemaVersion() (int, error) {
+	if !r.db.Migrator().HasTable(&GormSchemaVersion{}) {
+		return 0, nil
+	}
+	var version int
+	err := r.db.Model(&GormSchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+func (r *GormRepository) Migrate(dryRun bool) ([]Migration, error) {
+	current, err := r.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err = validateSchemaVersion(current, gormMigrations[len(gormMigrations)-1].Version); err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range gormMigrations {
+		if m.Version <= current {
+			continue
+		}
+		pending = append(pending, m.Migration)
+		logMigration(r.db.Dialector.Name(), m.Migration, dryRun)
+		if dryRun {
+			continue
+		}
+
+		err = r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&GormSchemaVersion{}); err != nil {
+				return err
+			}
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&GormSchemaVersion{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
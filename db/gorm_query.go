@@ -0,0 +1,174 @@
+package db
+
+import (
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// applyQuery restricts query to the torrents matching q.
+func (r *GormRepository) applyQuery(query *gorm.DB, q Query) *gorm.DB {
+	sql, args := r.querySQL(q)
+	return query.Where(sql, args...)
+}
+
+func (r *GormRepository) querySQL(q Query) (string, []any) {
+	switch q := q.(type) {
+	case AndQuery:
+		return r.joinQuerySQL(q.Clauses, " AND ")
+	case OrQuery:
+		return r.joinQuerySQL(q.Clauses, " OR ")
+	case NotQuery:
+		sql, args := r.querySQL(q.Clause)
+		return "NOT " + sql, args
+	case TermQuery:
+		return r.termSQL(q)
+	case RangeQuery:
+		column := "total_size"
+		if q.Field == FieldDiscovered {
+			column = "discovered_on"
+		}
+		switch {
+		case q.Max == math.MaxInt64:
+			return "(" + column + " >= ?)", []any{q.Min}
+		case q.Min == 0:
+			return "(" + column + " <= ?)", []any{q.Max}
+		}
+		return "(" + column + " BETWEEN ? AND ?)", []any{q.Min, q.Max}
+	}
+	return "(1 = 1)", nil
+}
+
+func (r *GormRepository) joinQuerySQL(clauses []Query, op string) (string, []any) {
+	parts := make([]string, len(clauses))
+	var args []any
+	for i, c := range clauses {
+		sql, a := r.querySQL(c)
+		parts[i] = sql
+		args = append(args, a...)
+	}
+	return "(" + strings.Join(parts, op) + ")", args
+}
+
+// likeEscaper escapes the wildcards of LIKE, see likeSQL.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func containsLike(value string) string {
+	return "%" + likeEscaper.Replace(value) + "%"
+}
+
+func globToLike(glob string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(likeEscaper.Replace(glob))
+}
+
+// likeSQL matches expr against a LIKE pattern with backslash as escape
+// character, ignoring the case like Query.Match.
+func (r *GormRepository) likeSQL(expr string) string {
+	switch r.db.Dialector.Name() {
+	case "postgres":
+		return expr + ` ILIKE ? ESCAPE '\'`
+	case "mysql":
+		// The backslash is the default escape character of MySQL, so the ESCAPE
+		// clause, which would need it escaped in the literal, is left out.
+		return "LOWER(" + expr + ") LIKE LOWER(?)"
+	}
+	// LIKE of SQLite ignores the case of ASCII characters.
+	return expr + ` LIKE ? ESCAPE '\'`
+}
+
+// filePathSQL matches the path of any file of a torrent against a LIKE
+// pattern. The file list is stored as JSON, so the paths are extracted to not
+// match the keys, sizes or several files at once.
+func (r *GormRepository) filePathSQL(pattern string) (string, []any) {
+	switch r.db.Dialector.Name() {
+	case "postgres":
+		return "EXISTS (SELECT 1 FROM jsonb_array_elements(CASE WHEN jsonb_typeof(NULLIF(files, '')::jsonb) = 'array' THEN files::jsonb ELSE '[]'::jsonb END) AS f WHERE " +
+			r.likeSQL("f->>'path'") + ")", []any{pattern}
+	case "mysql":
+		return "EXISTS (SELECT 1 FROM JSON_TABLE(IF(JSON_VALID(files), files, '[]'), '$[*]' COLUMNS (path TEXT PATH '$.path')) AS f WHERE " +
+			r.likeSQL("f.path") + ")", []any{pattern}
+	}
+	return "EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid(files) THEN files ELSE '[]' END) AS f WHERE " +
+		r.likeSQL("json_extract(f.value, '$.path')") + ")", []any{pattern}
+}
+
+// termSQL matches the same torrents as q.Match. Names are matched with LIKE
+// instead of the full text index, which only finds word prefixes.
+func (r *GormRepository) termSQL(q TermQuery) (string, []any) {
+	switch q.Field {
+	case FieldName:
+		if q.IsGlob() {
+			return "(" + r.likeSQL("name") + ")", []any{globToLike(q.Value)}
+		}
+		return "(" + r.likeSQL("name") + ")", []any{containsLike(q.Value)}
+	case FieldFile:
+		if q.IsGlob() {
+			return r.filePathSQL(globToLike(q.Value))
+		}
+		return r.filePathSQL(containsLike(q.Value))
+	case FieldExt:
+		suffix := "%." + likeEscaper.Replace(q.Value)
+		files, args := r.filePathSQL(suffix)
+		return "(" + r.likeSQL("name") + " OR " + files + ")", append([]any{suffix}, args...)
+	case FieldHash:
+		return "(info_hash = ?)", []any{q.Value}
+	case FieldCategory:
+		value := likeEscaper.Replace(q.Value)
+		like := r.likeSQL("categories")
+		return "(" + like + " OR " + like + " OR " + like + " OR " + like + ")",
+			[]any{value, value + ",%", "%," + value, "%," + value + ",%"}
+	}
+	return "(1 = 0)", nil
+}
+
+// listValueSQL matches value in a comma separated list column.
+func listValueSQL(column string, value string) (string, []any) {
+	return "(" + column + " = ? OR " + column + " LIKE ? OR " + column + " LIKE ? OR " + column + " LIKE ?)",
+		[]any{value, value + ",%", "%," + value, "%," + value + ",%"}
+}
+
+// anyListValueSQL matches any of values in a comma separated list column.
+func anyListValueSQL(column string, values []string) (string, []any) {
+	parts := make([]string, len(values))
+	var args []any
+	for i, v := range values {
+		sql, a := listValueSQL(column, v)
+		parts[i] = sql
+		args = append(args, a...)
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
+
+// nameContainsSQL searches the name with the full text index if available.
+func (r *GormRepository) nameContainsSQL(searchInput string) (string, []any) {
+	if r.ftsEnabled {
+		switch r.db.Dialector.Name() {
+		case "mysql":
+			return "MATCH(name) AGAINST(? IN BOOLEAN MODE)", []any{searchInput + "*"}
+		case "postgres":
+			return "to_tsvector('simple', name) @@ plainto_tsquery('simple', ?)", []any{searchInput}
+		case "sqlite":
+			return "id IN (SELECT rowid FROM gorm_torrents_fts WHERE name MATCH ?)", []any{searchInput + "*"}
+		}
+	}
+	return "name LIKE ?", []any{"%" + searchInput + "%"}
+}
+
+// nameRankSQL returns an expression for the full text rank of the name, higher
+// is better. Without full text index there is no rank and the expression is empty.
+func (r *GormRepository) nameRankSQL(searchInput string) (string, []any) {
+	if !r.ftsEnabled {
+		return "", nil
+	}
+	switch r.db.Dialector.Name() {
+	case "mysql":
+		return "MATCH(name) AGAINST(? IN BOOLEAN MODE)", []any{searchInput + "*"}
+	case "postgres":
+		return "ts_rank(to_tsvector('simple', name), plainto_tsquery('simple', ?))", []any{searchInput}
+	case "sqlite":
+		// bm25 is negative, the best matches have the lowest values.
+		return "(SELECT -bm25(gorm_torrents_fts) FROM gorm_torrents_fts WHERE gorm_torrents_fts.rowid = gorm_torrents.id AND name MATCH ?)", []any{searchInput + "*"}
+	}
+	return "", nil
+}
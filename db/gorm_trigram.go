@@ -0,0 +1,114 @@
+package db
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GormTrigram is a trigram of a torrent name. The trigram table backs fuzzy
+// search on SQLite and MySQL, PostgreSQL uses the pg_trgm extension instead.
+type GormTrigram struct {
+	Trigram   string `gorm:"primaryKey;size:16"`
+	TorrentID uint   `gorm:"primaryKey;index"`
+}
+
+// initTrigrams enables pg_trgm on PostgreSQL. Without it, fuzzy search falls
+// back to substring matching.
+func (r *GormRepository) initTrigrams() {
+	if r.db.Dialector.Name() != "postgres" {
+		r.trigramsEnabled = true
+		return
+	}
+	if err := r.db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Error().Err(err).Msg("failed to create pg_trgm extension for postgres, fuzzy search will be disabled")
+		return
+	}
+	if err := r.db.Exec("CREATE INDEX IF NOT EXISTS idx_name_trgm ON gorm_torrents USING gin(name gin_trgm_ops)").Error; err != nil {
+		log.Error().Err(err).Msg("failed to create trigram index for postgres, fuzzy search will be disabled")
+		return
+	}
+	r.trigramsEnabled = true
+}
+
+// usesTrigramTable reports whether torrent names are split into the trigram table.
+func usesTrigramTable(db *gorm.DB) bool {
+	return db.Dialector.Name() != "postgres"
+}
+
+// indexTrigrams replaces the trigrams of torrents in the trigram table.
+func indexTrigrams(tx *gorm.DB, torrents []GormTorrent) error {
+	if !usesTrigramTable(tx) || len(torrents) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(torrents))
+	var rows []GormTrigram
+	for i, t := range torrents {
+		ids[i] = t.ID
+		for _, trigram := range trigrams(t.Name) {
+			rows = append(rows, GormTrigram{Trigram: trigram, TorrentID: t.ID})
+		}
+	}
+	if err := tx.Where("torrent_id IN ?", ids).Delete(&GormTrigram{}).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	// Collations of MySQL may consider different trigrams equal.
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rows, 500).Error
+}
+
+// fuzzyNameSQL matches names similar to searchInput, see FuzzyScore.
+func (r *GormRepository) fuzzyNameSQL(searchInput string) (string, []any) {
+	if !r.trigramsEnabled {
+		return r.nameContainsSQL(searchInput)
+	}
+	if !usesTrigramTable(r.db) {
+		// Unlike a comparison of word_similarity, the <% operator can use the
+		// trigram index. Its threshold is set by fuzzySession.
+		return "? <% name", []any{searchInput}
+	}
+	wanted := trigrams(searchInput)
+	if len(wanted) == 0 {
+		return "1 = 0", nil
+	}
+	needed := int(math.Ceil(FuzzyThreshold * float64(len(wanted))))
+	return "id IN (SELECT torrent_id FROM gorm_trigrams WHERE trigram IN ? GROUP BY torrent_id HAVING COUNT(*) >= ?)",
+		[]any{wanted, needed}
+}
+
+// fuzzySession runs fn with the database for a search of searchType. Fuzzy
+// searches on PostgreSQL run in a transaction which sets the threshold of the
+// <% operator, pg_trgm.word_similarity_threshold, to FuzzyThreshold.
+func (r *GormRepository) fuzzySession(searchType string, fn func(db *gorm.DB) error) error {
+	if searchType != MatchFuzzy || !r.trigramsEnabled || usesTrigramTable(r.db) {
+		return fn(r.db)
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		threshold := strconv.FormatFloat(FuzzyThreshold, 'f', -1, 64)
+		if err := tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)", threshold).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// fuzzyRankSQL returns an expression for the similarity of the name to searchInput.
+func (r *GormRepository) fuzzyRankSQL(searchInput string) (string, []any) {
+	if !r.trigramsEnabled {
+		return "", nil
+	}
+	if !usesTrigramTable(r.db) {
+		return "word_similarity(?, name)", []any{searchInput}
+	}
+	wanted := trigrams(searchInput)
+	if len(wanted) == 0 {
+		return "", nil
+	}
+	return "(SELECT COUNT(*) FROM gorm_trigrams WHERE gorm_trigrams.torrent_id = gorm_torrents.id AND trigram IN ?) * 1.0 / ?",
+		[]any{wanted, len(wanted)}
+}
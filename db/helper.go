@@ -1,39 +1,53 @@
 package db
 
 import (
+	dhtcclient "dhtc/dhtc-client"
+	"dhtc/notifier"
 	"fmt"
+	"math"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/ostafen/clover/v2/document"
 )
 
-func Document2MetaData(value *document.Document) MetaData {
-	var categories []string
-	if value.Has("Categories") {
-		switch v := value.Get("Categories").(type) {
-		case []string:
-			categories = v
-		case []any:
-			for _, item := range v {
-				if s, ok := item.(string); ok {
-					categories = append(categories, s)
-				}
+// stringList converts a list stored by CloverDB, or a comma separated string, to strings.
+func stringList(value any) []string {
+	var list []string
+	switch v := value.(type) {
+	case []string:
+		list = v
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
 			}
-		case string:
-			categories = strings.Split(v, ",")
 		}
-	} else if value.Has("Category") {
-		// Migration path from old "Category" field
-		cat, _ := value.Get("Category").(string)
-		categories = []string{cat}
+	case string:
+		list = strings.Split(v, ",")
 	}
+	return list
+}
+
+// splitList splits a comma separated list, the empty string is the empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func Document2MetaData(value *document.Document) MetaData {
+	categories := stringList(value.Get("Categories"))
 
 	name, _ := value.Get("Name").(string)
 	infoHash, _ := value.Get("InfoHash").(string)
 	discoveredOn, _ := value.Get("DiscoveredOn").(int64)
 	totalSize, _ := value.Get("TotalSize").(uint64)
 	files, _ := value.Get("Files").([]any)
+	clusterId, _ := value.Get("ClusterId").(string)
 
 	return MetaData{
 		Name:         name,
@@ -42,7 +56,199 @@ func Document2MetaData(value *document.Document) MetaData {
 		TotalSize:    totalSize,
 		Files:        files,
 		Categories:   categories,
+		ClusterId:    clusterId,
+	}
+}
+
+func document2WatchEntry(doc *document.Document) WatchEntry {
+	key, _ := doc.Get("Key").(string)
+	matchType, _ := doc.Get("MatchType").(string)
+	content, _ := doc.Get("Content").(string)
+	minSize, _ := doc.Get("MinSize").(uint64)
+	maxSize, _ := doc.Get("MaxSize").(uint64)
+	minFiles, _ := doc.Get("MinFiles").(int64)
+	quietStart, _ := doc.Get("QuietStart").(string)
+	quietEnd, _ := doc.Get("QuietEnd").(string)
+	downloader, _ := doc.Get("Downloader").(string)
+	savePath, _ := doc.Get("SavePath").(string)
+	label, _ := doc.Get("Label").(string)
+	dailyCap, _ := doc.Get("DailyCap").(int64)
+	firstMatchOnly, _ := doc.Get("FirstMatchOnly").(bool)
+	digest, _ := doc.Get("Digest").(string)
+	digestInterval, _ := doc.Get("DigestInterval").(int64)
+	return WatchEntry{
+		Id:             doc.ObjectId(),
+		Key:            key,
+		MatchType:      matchType,
+		Content:        content,
+		MinSize:        minSize,
+		MaxSize:        maxSize,
+		Categories:     stringList(doc.Get("Categories")),
+		MinFiles:       int(minFiles),
+		Exclude:        stringList(doc.Get("Exclude")),
+		QuietStart:     quietStart,
+		QuietEnd:       quietEnd,
+		Notifiers:      stringList(doc.Get("Notifiers")),
+		Downloader:     downloader,
+		SavePath:       savePath,
+		Label:          label,
+		DailyCap:       int(dailyCap),
+		FirstMatchOnly: firstMatchOnly,
+		Digest:         digest,
+		DigestInterval: int(digestInterval),
+	}
+}
+
+func document2WatchHit(doc *document.Document) WatchHit {
+	watchId, _ := doc.Get("WatchId").(string)
+	infoHash, _ := doc.Get("InfoHash").(string)
+	name, _ := doc.Get("Name").(string)
+	t, _ := doc.Get("Time").(int64)
+	quiet, _ := doc.Get("Quiet").(bool)
+	digest, _ := doc.Get("Digest").(bool)
+	deliveries, _ := doc.Get("Deliveries").(string)
+	downloader, _ := doc.Get("Downloader").(string)
+	downloadStatus, _ := doc.Get("DownloadStatus").(string)
+	downloadError, _ := doc.Get("DownloadError").(string)
+	return WatchHit{
+		Id:             doc.ObjectId(),
+		WatchId:        watchId,
+		InfoHash:       infoHash,
+		Name:           name,
+		Time:           t,
+		Quiet:          quiet,
+		Digest:         digest,
+		Deliveries:     decodeDeliveries(deliveries),
+		Downloader:     downloader,
+		DownloadStatus: downloadStatus,
+		DownloadError:  downloadError,
+	}
+}
+
+func document2OutboxItem(doc *document.Document) notifier.OutboxItem {
+	name, _ := doc.Get("Notifier").(string)
+	event, _ := doc.Get("Event").(string)
+	ref, _ := doc.Get("Ref").(string)
+	created, _ := doc.Get("Created").(int64)
+	attempts, _ := doc.Get("Attempts").(int64)
+	nextAttempt, _ := doc.Get("NextAttempt").(int64)
+	lastError, _ := doc.Get("LastError").(string)
+	return notifier.OutboxItem{
+		Id:          doc.ObjectId(),
+		Notifier:    name,
+		Event:       decodeEvent(event),
+		Ref:         ref,
+		Created:     created,
+		Attempts:    int(attempts),
+		NextAttempt: nextAttempt,
+		LastError:   lastError,
+	}
+}
+
+func document2SavedSearch(doc *document.Document) SavedSearch {
+	name, _ := doc.Get("Name").(string)
+	key, _ := doc.Get("Key").(string)
+	matchType, _ := doc.Get("MatchType").(string)
+	searchInput, _ := doc.Get("SearchInput").(string)
+	filters, _ := doc.Get("Filters").(string)
+	token, _ := doc.Get("Token").(string)
+	createdOn, _ := doc.Get("CreatedOn").(int64)
+	return SavedSearch{
+		Id:          doc.ObjectId(),
+		Name:        name,
+		Key:         key,
+		MatchType:   matchType,
+		SearchInput: searchInput,
+		Filters:     decodeFilters(filters),
+		Token:       token,
+		CreatedOn:   createdOn,
+	}
+}
+
+func Document2Torrent(value *document.Document) Torrent {
+	md := Document2MetaData(value)
+	discoveredOn, _ := value.Get("DiscoveredOn").(int64)
+	return Torrent{
+		InfoHash:     md.InfoHash,
+		Name:         md.Name,
+		TotalSize:    md.TotalSize,
+		DiscoveredOn: discoveredOn,
+		Files:        Files(md.Files),
+		Categories:   md.Categories,
+	}
+}
+
+// Files converts a loosely typed file list, as stored by CloverDB (Path, Size)
+// or decoded from JSON (path, size), into typed files.
+func Files(fileList []any) []dhtcclient.File {
+	files := make([]dhtcclient.File, 0, len(fileList))
+	for _, item := range fileList {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		var f dhtcclient.File
+		for key, value := range m {
+			switch strings.ToLower(key) {
+			case "path":
+				f.Path, _ = value.(string)
+			case "size":
+				switch v := value.(type) {
+				case int64:
+					f.Size = v
+				case uint64:
+					f.Size = int64(v) //nolint:gosec // file sizes fit into int64
+				case float64:
+					f.Size = int64(v)
+				}
+			}
+		}
+		files = append(files, f)
 	}
+	return files
+}
+
+// MatchesFilters reports whether a torrent document satisfies the size and date filters.
+func MatchesFilters(doc *document.Document, filters SearchFilters) bool {
+	totalSize, _ := doc.Get("TotalSize").(uint64)
+	if filters.MinSize > 0 && totalSize < filters.MinSize {
+		return false
+	}
+	if filters.MaxSize > 0 && totalSize > filters.MaxSize {
+		return false
+	}
+	discoveredOn, _ := doc.Get("DiscoveredOn").(int64)
+	if filters.StartDate > 0 && discoveredOn < filters.StartDate {
+		return false
+	}
+	if filters.EndDate > 0 && discoveredOn > filters.EndDate {
+		return false
+	}
+	if filters.Since > 0 && discoveredOn <= filters.Since {
+		return false
+	}
+	if len(filters.Categories) > 0 && !containsAny(stringList(doc.Get("Categories")), filters.Categories) {
+		return false
+	}
+	if len(filters.Extensions) > 0 && !containsAny(stringList(doc.Get("Extensions")), filters.Extensions) {
+		return false
+	}
+	if clusterId, _ := doc.Get("ClusterId").(string); filters.Cluster != "" && clusterId != filters.Cluster {
+		return false
+	}
+	return true
+}
+
+// containsAny reports whether values contains any of wanted, ignoring case.
+func containsAny(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, strings.TrimPrefix(w, ".")) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func Documents2MetaData(values []*document.Document) []MetaData {
@@ -53,6 +259,30 @@ func Documents2MetaData(values []*document.Document) []MetaData {
 	return rVal
 }
 
+// Relevance scores how well name matches the words of searchInput. Every word
+// contained in the name counts, whole words and matches at the start count more
+// and shorter names rank higher than longer ones with the same matches.
+func Relevance(name string, searchInput string) float64 {
+	name = strings.ToLower(name)
+	nameWords := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var score float64
+	for _, word := range strings.Fields(strings.ToLower(searchInput)) {
+		if !strings.Contains(name, word) {
+			continue
+		}
+		score++
+		if slices.Contains(nameWords, word) {
+			score++
+		}
+		if strings.HasPrefix(name, word) {
+			score += 0.5
+		}
+	}
+	return score / math.Sqrt(float64(len(nameWords)+1))
+}
+
 func MatchString(searchType string, x string, y string) bool {
 	rVal := false
 	switch searchType {
@@ -64,6 +294,8 @@ func MatchString(searchType string, x string, y string) bool {
 		rVal = strings.HasPrefix(strings.ToLower(x), strings.ToLower(y))
 	case "endswith":
 		rVal = strings.HasSuffix(strings.ToLower(x), strings.ToLower(y))
+	case MatchFuzzy:
+		rVal = MatchesFuzzy(x, y)
 	default:
 		rVal = false
 	}
@@ -101,6 +333,23 @@ func FoundOnDate(date time.Time, searchInput string) bool {
 	return date.After(parsedInput) && date.Before(endDate)
 }
 
+// documentMatcher returns a function matching documents against a search. For
+// QueryKey the query is parsed once and matched against the decoded torrent.
+func documentMatcher(key string, searchType string, searchInput string) (func(doc *document.Document) bool, error) {
+	if key != QueryKey {
+		return func(doc *document.Document) bool {
+			return Matches(doc, key, searchType, searchInput)
+		}, nil
+	}
+	q, err := ParseQuery(searchInput)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc *document.Document) bool {
+		return q.Match(Document2Torrent(doc))
+	}, nil
+}
+
 func Matches(doc *document.Document, key string, searchType string, searchInput string) bool {
 	if key == "All" {
 		return Matches(doc, "Name", searchType, searchInput) || Matches(doc, "Files", searchType, searchInput)
@@ -0,0 +1,85 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"slices"
+)
+
+// MergeResult counts what happened to a batch passed to Repository.MergeTorrents.
+type MergeResult struct {
+	Inserted int
+	Merged   int
+	Skipped  int
+}
+
+func (r *MergeResult) Add(other MergeResult) {
+	r.Inserted += other.Inserted
+	r.Merged += other.Merged
+	r.Skipped += other.Skipped
+}
+
+// MergeFiles returns the union of both file lists, keyed by path.
+func MergeFiles(a []dhtcclient.File, b []dhtcclient.File) []dhtcclient.File {
+	res := slices.Clone(a)
+	seen := make(map[string]bool, len(a))
+	for _, f := range a {
+		seen[f.Path] = true
+	}
+	for _, f := range b {
+		if !seen[f.Path] {
+			seen[f.Path] = true
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// MergeTorrent merges incoming into existing. It keeps the earliest discovery
+// date and the union of both file lists. The second return value reports
+// whether existing had to be changed.
+func MergeTorrent(existing Torrent, incoming Torrent) (Torrent, bool) {
+	changed := false
+	if incoming.DiscoveredOn > 0 && (existing.DiscoveredOn == 0 || incoming.DiscoveredOn < existing.DiscoveredOn) {
+		existing.DiscoveredOn = incoming.DiscoveredOn
+		changed = true
+	}
+	if existing.Name == "" && incoming.Name != "" {
+		existing.Name = incoming.Name
+		changed = true
+	}
+
+	files := MergeFiles(existing.Files, incoming.Files)
+	if len(files) != len(existing.Files) {
+		existing.Files = files
+		existing.Categories = Categorize(existing.Metadata())
+		changed = true
+	}
+
+	if incoming.TotalSize > existing.TotalSize {
+		existing.TotalSize = incoming.TotalSize
+		changed = true
+	}
+	return existing, changed
+}
+
+// DeduplicateTorrents merges torrents sharing an info hash, keeping the order of first appearance.
+func DeduplicateTorrents(torrents []Torrent) []Torrent {
+	index := make(map[string]int, len(torrents))
+	res := make([]Torrent, 0, len(torrents))
+	for _, t := range torrents {
+		if i, ok := index[t.InfoHash]; ok {
+			res[i], _ = MergeTorrent(res[i], t)
+			continue
+		}
+		index[t.InfoHash] = len(res)
+		res = append(res, t)
+	}
+	return res
+}
+
+func torrentCategories(t Torrent) []string {
+	if len(t.Files) > 0 || len(t.Categories) == 0 {
+		return Categorize(t.Metadata())
+	}
+	return t.Categories
+}
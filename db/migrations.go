@@ -0,0 +1,34 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+const SchemaTable = "schema_versions"
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer build of dhtc.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build of dhtc")
+
+// Migration describes a single, ordered schema change of a repository.
+type Migration struct {
+	Version int
+	Name    string
+}
+
+func validateSchemaVersion(current int, latest int) error {
+	if current > latest {
+		return fmt.Errorf("%w: database is at version %d, latest known version is %d", ErrSchemaTooNew, current, latest)
+	}
+	return nil
+}
+
+func logMigration(backend string, m Migration, dryRun bool) {
+	if dryRun {
+		log.Info().Msgf("[%s] pending schema migration %d: %s", backend, m.Version, m.Name)
+	} else {
+		log.Info().Msgf("[%s] applying schema migration %d: %s", backend, m.Version, m.Name)
+	}
+}
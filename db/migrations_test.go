@@ -0,0 +1,149 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ostafen/clover/v2/document"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMigrationVersionsAreOrdered(t *testing.T) {
+	for i := 1; i < len(gormMigrations); i++ {
+		if gormMigrations[i].Version <= gormMigrations[i-1].Version {
+			t.Errorf("gorm migration %d is not ordered after %d", gormMigrations[i].Version, gormMigrations[i-1].Version)
+		}
+	}
+	for i := 1; i < len(cloverMigrations); i++ {
+		if cloverMigrations[i].Version <= cloverMigrations[i-1].Version {
+			t.Errorf("clover migration %d is not ordered after %d", cloverMigrations[i].Version, cloverMigrations[i-1].Version)
+		}
+	}
+}
+
+func TestCloverMigrate(t *testing.T) {
+	cfg := &config.Configuration{DbName: filepath.Join(t.TempDir(), "dhtdb"), SchemaDryRun: true}
+	repo, err := NewCloverRepository(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := repo.(*CloverRepository)
+
+	if version, _ := r.SchemaVersion(); version != 0 {
+		t.Errorf("dry run changed schema version to %d", version)
+	}
+
+	pending, err := r.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(cloverMigrations) {
+		t.Errorf("expected %d migrations to be applied, got %d", len(cloverMigrations), len(pending))
+	}
+
+	legacy := document.NewDocument()
+	legacy.Set("Name", "legacy")
+	legacy.Set("Category", "Video")
+	if _, err = r.db.InsertOne(TorrentTable, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err = cloverMigrations[1].Up(r.db); err != nil {
+		t.Fatal(err)
+	}
+	dist, _ := r.GetCategoryDistribution()
+	if dist["Video"] != 1 {
+		t.Errorf("legacy category was not converted, got %v", dist)
+	}
+
+	if pending, _ = r.Migrate(false); len(pending) != 0 {
+		t.Errorf("expected no pending migrations, got %v", pending)
+	}
+
+	doc := document.NewDocument()
+	doc.Set("Version", cloverMigrations[len(cloverMigrations)-1].Version+1)
+	_, _ = r.db.InsertOne(SchemaTable, doc)
+	if _, err = r.Migrate(false); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	_ = r.Close()
+}
+
+func TestCloverMigrateNumbersExistingTorrents(t *testing.T) {
+	repo, err := NewCloverRepository(&config.Configuration{DbName: filepath.Join(t.TempDir(), "dhtdb")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := repo.(*CloverRepository)
+	defer r.Close()
+
+	for _, name := range []string{"first", "second"} {
+		legacy := document.NewDocument()
+		legacy.Set("Name", name)
+		if _, err = r.db.InsertOne(TorrentTable, legacy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cloverMigrations[4].Up(r.db); err != nil {
+		t.Fatal(err)
+	}
+	if r.seq, err = lastCloverSeq(r.db); err != nil || r.seq != 2 {
+		t.Fatalf("expected last sequence number 2, got %d (%v)", r.seq, err)
+	}
+
+	r.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "third"})
+	changes, err := r.GetChanges(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[1].Seq != 3 || changes[1].Name != "third" {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
+
+func TestGormMigrateLegacyDatabase(t *testing.T) {
+	dbUrl := filepath.Join(t.TempDir(), "dhtc.sqlite")
+	legacy, err := gorm.Open(sqlite.Open(dbUrl), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = legacy.AutoMigrate(&gormTorrentV1{}, &gormWatchV1{}, &gormBlacklistV1{}, &gormStatsV1{}); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Create(&gormTorrentV1{Name: "legacy", InfoHash: "00", Categories: "Video,Audio"})
+	sqlDB, _ := legacy.DB()
+	_ = sqlDB.Close()
+
+	repo, err := NewGormRepository(&config.Configuration{}, "sqlite", dbUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	if version, _ := repo.SchemaVersion(); version != gormMigrations[len(gormMigrations)-1].Version {
+		t.Errorf("expected schema version %d, got %d", gormMigrations[len(gormMigrations)-1].Version, version)
+	}
+	dist, err := repo.GetCategoryDistribution()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist["Video"] != 1 || dist["Audio"] != 1 {
+		t.Errorf("categories were lost while migrating, got %v", dist)
+	}
+	if found := repo.FindBy("Name", MatchFuzzy, "legacy"); len(found) != 1 {
+		t.Errorf("expected existing names to be split into trigrams, got %v", found)
+	}
+
+	repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "new"})
+	changes, err := repo.GetChanges(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Seq != 1 || changes[1].Seq != 2 || changes[1].Name != "new" {
+		t.Errorf("expected existing torrents to be numbered, got %+v", changes)
+	}
+}
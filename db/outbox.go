@@ -0,0 +1,32 @@
+package db
+
+import (
+	"dhtc/notifier"
+	"encoding/json"
+)
+
+// OutboxTable holds the notifications waiting for their delivery, see
+// notifier.Outbox.
+const OutboxTable = "notification_outbox"
+
+func encodeEvent(event notifier.Event) string {
+	b, _ := json.Marshal(event)
+	return string(b)
+}
+
+func decodeEvent(s string) notifier.Event {
+	var event notifier.Event
+	_ = json.Unmarshal([]byte(s), &event)
+	return event
+}
+
+// setDelivery replaces the delivery to d.Notifier in deliveries by d.
+func setDelivery(deliveries []notifier.Delivery, d notifier.Delivery) []notifier.Delivery {
+	for i := range deliveries {
+		if deliveries[i].Notifier == d.Notifier {
+			deliveries[i] = d
+			return deliveries
+		}
+	}
+	return append(deliveries, d)
+}
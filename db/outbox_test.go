@@ -0,0 +1,89 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"dhtc/notifier"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNotificationOutbox(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		first := notifier.OutboxItem{
+			Notifier:    "ntfy",
+			Event:       notifier.Event{Title: "Match found", InfoHash: "ab", Size: 3, Categories: []string{"Video"}},
+			Ref:         "1",
+			Created:     100,
+			NextAttempt: 100000,
+		}
+		second := notifier.OutboxItem{Notifier: "slack", Event: notifier.Event{Title: "hello"}, Created: 200}
+		for _, item := range []*notifier.OutboxItem{&first, &second} {
+			id, err := repo.InsertOutboxItem(*item)
+			if err != nil || id == "" {
+				t.Fatalf("%s: could not insert outbox item: %v", name, err)
+			}
+			item.Id = id
+		}
+
+		first.Attempts, first.NextAttempt, first.LastError = 2, 200000, "timeout"
+		if err := repo.UpdateOutboxItem(first); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteOutboxItem(second.Id); err != nil {
+			t.Fatal(err)
+		}
+		items, err := repo.GetOutboxItems()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || !reflect.DeepEqual(items[0], first) {
+			t.Errorf("%s: expected %+v, got %+v", name, first, items)
+		}
+	}
+}
+
+func TestWatchNotificationDelivery(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	received := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu"})
+	manager := notifier.NewManager(repo)
+	engine := NewWatchEngine(repo, manager, &config.Configuration{})
+	manager.Setup(&config.Configuration{NotifierURLs: "webhook+" + srv.URL + "/hook#ci"})
+	defer manager.Close()
+
+	engine.Check(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "Ubuntu 24.04"})
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	var hits []WatchHit
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if hits, err = repo.GetWatchHits("", 10); err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) == 1 && len(hits[0].Deliveries) == 1 && !hits[0].Deliveries[0].Pending {
+			break
+		}
+	}
+	if len(hits) != 1 || !reflect.DeepEqual(hits[0].Deliveries, []notifier.Delivery{{Notifier: "ci"}}) {
+		t.Errorf("expected a delivered hit, got %+v", hits)
+	}
+	if items, _ := repo.GetOutboxItems(); len(items) != 0 {
+		t.Errorf("expected an empty outbox, got %+v", items)
+	}
+}
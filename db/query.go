@@ -0,0 +1,465 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// QueryKey selects the query language as search key, e.g.
+//
+//	name:"ubuntu" AND ext:iso -file:*.exe size:>1GB cat:Software discovered:2026-01..2026-03
+//
+// Terms are combined with AND (also implicit), OR, NOT (or a leading "-") and parentheses.
+// A term without field prefix searches the name.
+const QueryKey = "Query"
+
+const (
+	FieldName       = "name"
+	FieldFile       = "file"
+	FieldExt        = "ext"
+	FieldHash       = "hash"
+	FieldCategory   = "cat"
+	FieldSize       = "size"
+	FieldDiscovered = "discovered"
+)
+
+var fieldAliases = map[string]string{
+	"name":       FieldName,
+	"file":       FieldFile,
+	"files":      FieldFile,
+	"path":       FieldFile,
+	"ext":        FieldExt,
+	"hash":       FieldHash,
+	"infohash":   FieldHash,
+	"cat":        FieldCategory,
+	"category":   FieldCategory,
+	"size":       FieldSize,
+	"discovered": FieldDiscovered,
+	"date":       FieldDiscovered,
+}
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// Query is the parsed form of a search query. Match evaluates it in process,
+// the GORM repository translates it to SQL instead.
+type Query interface {
+	Match(t Torrent) bool
+}
+
+type AndQuery struct {
+	Clauses []Query
+}
+
+type OrQuery struct {
+	Clauses []Query
+}
+
+type NotQuery struct {
+	Clause Query
+}
+
+// TermQuery matches a text field. Values containing * or ? are globs which have
+// to match the whole name or path, all other values match a part of it.
+type TermQuery struct {
+	Field string
+	Value string
+	glob  *regexp.Regexp
+}
+
+// RangeQuery matches a number field (size in bytes, discovered as unix timestamp)
+// within the inclusive bounds Min and Max.
+type RangeQuery struct {
+	Field string
+	Min   int64
+	Max   int64
+}
+
+func (q AndQuery) Match(t Torrent) bool {
+	for _, c := range q.Clauses {
+		if !c.Match(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q OrQuery) Match(t Torrent) bool {
+	for _, c := range q.Clauses {
+		if c.Match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q NotQuery) Match(t Torrent) bool {
+	return !q.Clause.Match(t)
+}
+
+func (q TermQuery) IsGlob() bool {
+	return q.glob != nil
+}
+
+func (q TermQuery) matchText(s string) bool {
+	if q.glob != nil {
+		return q.glob.MatchString(s)
+	}
+	return strings.Contains(strings.ToLower(s), strings.ToLower(q.Value))
+}
+
+func (q TermQuery) Match(t Torrent) bool {
+	switch q.Field {
+	case FieldName:
+		return q.matchText(t.Name)
+	case FieldFile:
+		for _, f := range t.Files {
+			if q.matchText(f.Path) {
+				return true
+			}
+		}
+	case FieldExt:
+		suffix := "." + strings.ToLower(q.Value)
+		if strings.HasSuffix(strings.ToLower(t.Name), suffix) {
+			return true
+		}
+		for _, f := range t.Files {
+			if strings.HasSuffix(strings.ToLower(f.Path), suffix) {
+				return true
+			}
+		}
+	case FieldHash:
+		return strings.EqualFold(t.InfoHash, q.Value)
+	case FieldCategory:
+		for _, c := range torrentCategories(t) {
+			if strings.EqualFold(c, q.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q RangeQuery) Match(t Torrent) bool {
+	var v int64
+	switch q.Field {
+	case FieldSize:
+		v = int64(min(t.TotalSize, math.MaxInt64)) //nolint:gosec // clamped to int64
+	case FieldDiscovered:
+		v = t.DiscoveredOn
+	}
+	return v >= q.Min && v <= q.Max
+}
+
+// MatchesQuery parses input and matches it against a torrent. Invalid queries never match.
+func MatchesQuery(t Torrent, input string) bool {
+	q, err := ParseQuery(input)
+	return err == nil && q.Match(t)
+}
+
+type queryTokenKind int
+
+const (
+	tokenTerm queryTokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	field string
+	value string
+}
+
+func tokenizeQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen})
+			i++
+			continue
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose})
+			i++
+			continue
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: tokenNot})
+			i++
+			continue
+		}
+
+		var word strings.Builder
+		quoted, wasQuoted := false, false
+		field := ""
+		for ; i < len(runes); i++ {
+			r = runes[i]
+			if r == '"' {
+				quoted = !quoted
+				wasQuoted = true
+				continue
+			}
+			if !quoted && (unicode.IsSpace(r) || r == '(' || r == ')') {
+				break
+			}
+			if !quoted && !wasQuoted && r == ':' && field == "" {
+				name, ok := fieldAliases[strings.ToLower(word.String())]
+				if !ok {
+					return nil, fmt.Errorf("%w: unknown field '%s'", ErrInvalidQuery, word.String())
+				}
+				field = name
+				word.Reset()
+				continue
+			}
+			word.WriteRune(r)
+		}
+		if quoted {
+			return nil, fmt.Errorf("%w: missing closing quote", ErrInvalidQuery)
+		}
+
+		value := word.String()
+		if field == "" && !wasQuoted {
+			switch value {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: tokenAnd})
+				continue
+			case "OR":
+				tokens = append(tokens, queryToken{kind: tokenOr})
+				continue
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: tokenNot})
+				continue
+			}
+		}
+		if field == "" {
+			field = FieldName
+		}
+		if value == "" {
+			return nil, fmt.Errorf("%w: empty value for field '%s'", ErrInvalidQuery, field)
+		}
+		tokens = append(tokens, queryToken{kind: tokenTerm, field: field, value: value})
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// ParseQuery parses the search query language, see QueryKey.
+func ParseQuery(input string) (Query, error) {
+	tokens, err := tokenizeQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidQuery)
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected ')'", ErrInvalidQuery)
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	var clauses []Query
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, q)
+		if t, ok := p.peek(); !ok || t.kind != tokenOr {
+			break
+		}
+		p.pos++
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	return OrQuery{Clauses: clauses}, nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	var clauses []Query
+	for {
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, q)
+
+		t, ok := p.peek()
+		if !ok || t.kind == tokenOr || t.kind == tokenClose {
+			break
+		}
+		if t.kind == tokenAnd {
+			p.pos++
+		}
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	return AndQuery{Clauses: clauses}, nil
+}
+
+func (p *queryParser) parseUnary() (Query, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected end of query", ErrInvalidQuery)
+	}
+	p.pos++
+	switch t.kind {
+	case tokenNot:
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotQuery{Clause: q}, nil
+	case tokenOpen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok = p.peek(); !ok || t.kind != tokenClose {
+			return nil, fmt.Errorf("%w: missing ')'", ErrInvalidQuery)
+		}
+		p.pos++
+		return q, nil
+	case tokenTerm:
+		return newFieldQuery(t.field, t.value)
+	case tokenClose:
+		return nil, fmt.Errorf("%w: unexpected ')'", ErrInvalidQuery)
+	}
+	return nil, fmt.Errorf("%w: unexpected operator", ErrInvalidQuery)
+}
+
+func newFieldQuery(field string, value string) (Query, error) {
+	switch field {
+	case FieldSize:
+		lo, hi, err := parseRange(value, parseSize)
+		if err != nil {
+			return nil, err
+		}
+		return RangeQuery{Field: field, Min: lo, Max: hi}, nil
+	case FieldDiscovered:
+		lo, hi, err := parseRange(value, parseDatePeriod)
+		if err != nil {
+			return nil, err
+		}
+		return RangeQuery{Field: field, Min: lo, Max: hi}, nil
+	case FieldExt:
+		return TermQuery{Field: field, Value: strings.TrimPrefix(value, ".")}, nil
+	case FieldHash:
+		return TermQuery{Field: field, Value: strings.ToLower(value)}, nil
+	}
+
+	q := TermQuery{Field: field, Value: value}
+	if (field == FieldName || field == FieldFile) && strings.ContainsAny(value, "*?") {
+		pattern := regexp.QuoteMeta(value)
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		q.glob = regexp.MustCompile("(?is)^" + pattern + "$")
+	}
+	return q, nil
+}
+
+// parseRange parses "X", ">X", ">=X", "<X", "<=X", "X..Y", "X.." and "..Y", where
+// parse returns the first and last value of the period described by X.
+func parseRange(value string, parse func(string) (int64, int64, error)) (int64, int64, error) {
+	lo, hi := int64(0), int64(math.MaxInt64)
+	var err error
+	switch {
+	case strings.HasPrefix(value, ">="):
+		lo, _, err = parse(value[2:])
+	case strings.HasPrefix(value, "<="):
+		_, hi, err = parse(value[2:])
+	case strings.HasPrefix(value, ">"):
+		_, hi, err = parse(value[1:])
+		lo, hi = hi+1, math.MaxInt64
+	case strings.HasPrefix(value, "<"):
+		lo, _, err = parse(value[1:])
+		lo, hi = 0, lo-1
+	case strings.Contains(value, ".."):
+		from, to, _ := strings.Cut(value, "..")
+		if from != "" {
+			if lo, _, err = parse(from); err != nil {
+				return 0, 0, err
+			}
+		}
+		if to != "" {
+			_, hi, err = parse(to)
+		}
+	default:
+		lo, hi, err = parse(value)
+	}
+	return lo, hi, err
+}
+
+var sizePattern = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmgt]?)i?b?$`)
+
+// ParseSize parses a size like "700MB" or "2 GiB" to bytes.
+func ParseSize(value string) (uint64, error) {
+	size, _, err := parseSize(value)
+	return uint64(size), err
+}
+
+func parseSize(value string) (int64, int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, 0, fmt.Errorf("%w: invalid size '%s'", ErrInvalidQuery, value)
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	exp := strings.Index("kmgt", strings.ToLower(m[2])) + 1
+	if m[2] == "" {
+		exp = 0
+	}
+	size := int64(n * math.Pow(1024, float64(exp)))
+	return size, size, nil
+}
+
+func parseDatePeriod(value string) (int64, int64, error) {
+	value = strings.ReplaceAll(strings.TrimSpace(value), ".", "-")
+	for _, f := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006-01-02", 0, 0, 1},
+		{"2006-01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		start, err := time.Parse(f.layout, value)
+		if err == nil {
+			return start.Unix(), start.AddDate(f.years, f.months, f.days).Unix() - 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: invalid date '%s'", ErrInvalidQuery, value)
+}
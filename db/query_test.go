@@ -0,0 +1,136 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+var queryTestTorrents = []dhtcclient.Metadata{
+	{
+		InfoHash:     []byte{1},
+		Name:         "ubuntu-24.04-desktop-amd64.iso",
+		TotalSize:    6 << 30,
+		DiscoveredOn: time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC).Unix(),
+		Files:        []dhtcclient.File{{Path: "ubuntu-24.04-desktop-amd64.iso", Size: 6 << 30}},
+	},
+	{
+		InfoHash:     []byte{2},
+		Name:         "Ubuntu Tools",
+		TotalSize:    2 << 30,
+		DiscoveredOn: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		Files:        []dhtcclient.File{{Path: "tools/ubuntu.iso", Size: 1 << 30}, {Path: "tools/setup.exe", Size: 1 << 30}},
+	},
+	{
+		InfoHash:     []byte{3},
+		Name:         "debian-12.iso",
+		TotalSize:    500 << 20,
+		DiscoveredOn: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC).Unix(),
+		Files:        []dhtcclient.File{{Path: "debian-12.iso", Size: 500 << 20}},
+	},
+}
+
+var queryTests = []struct {
+	query    string
+	expected []string
+}{
+	{`ubuntu`, []string{"ubuntu-24.04-desktop-amd64.iso", "Ubuntu Tools"}},
+	{`name:"ubuntu" AND ext:iso -file:*.exe size:>1GB`, []string{"ubuntu-24.04-desktop-amd64.iso"}},
+	{`discovered:2026-01..2026-03 NOT name:*.iso`, []string{"Ubuntu Tools"}},
+	{`(debian OR tools) size:<1GB`, []string{"debian-12.iso"}},
+	{`hash:03 OR file:tools/*`, []string{"Ubuntu Tools", "debian-12.iso"}},
+	{`discovered:>=2026-02 size:500MB..3GB`, []string{"Ubuntu Tools", "debian-12.iso"}},
+	{`name:"desktop-amd64"`, []string{"ubuntu-24.04-desktop-amd64.iso"}},
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, input := range []string{"", "foo:bar", `name:"open`, "(ubuntu", "ubuntu)", "size:>big", "discovered:yesterday", "ubuntu OR"} {
+		if _, err := ParseQuery(input); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("expected ErrInvalidQuery for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestQueryMatchesBackends(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	for _, md := range queryTestTorrents {
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+
+	for _, test := range queryTests {
+		for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+			results, _, err := repo.Search(QueryKey, "", test.query, 10, 0, SearchFilters{})
+			if err != nil {
+				t.Fatalf("%s: %q: %v", name, test.query, err)
+			}
+			var names []string
+			for _, r := range results {
+				names = append(names, r.Name)
+			}
+			slices.Sort(names)
+			expected := slices.Clone(test.expected)
+			slices.Sort(expected)
+			if !slices.Equal(names, expected) {
+				t.Errorf("%s: %q: expected %v, got %v", name, test.query, expected, names)
+			}
+		}
+	}
+}
+
+func TestGormQueryMatchesQueryMatch(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	torrents := append(slices.Clone(queryTestTorrents),
+		dhtcclient.Metadata{InfoHash: []byte{4}, Name: "100% Pure_Love.mkv", TotalSize: 700 << 20,
+			Files: []dhtcclient.File{{Path: "100% Pure_Love.mkv", Size: 12345}}},
+		dhtcclient.Metadata{InfoHash: []byte{5}, Name: "XUBUNTU server", TotalSize: 1 << 30,
+			Files: []dhtcclient.File{{Path: `Season 1\Ep_01.MKV`, Size: 1 << 20}, {Path: "notes.txt", Size: 10}}},
+		dhtcclient.Metadata{InfoHash: []byte{6}, Name: "100 Pure Love"},
+	)
+	var all []Torrent
+	for _, md := range torrents {
+		repo.InsertMetadata(md)
+		all = append(all, NewTorrent(md))
+	}
+
+	for _, input := range []string{
+		`buntu`, `UBUNTU`, `name:100%`, `name:pure_love`, `name:"100% pure"`, `name:*_*`, `name:*pure?love*`,
+		`file:ep_01`, `file:123`, `file:size`, `file:path`, `file:"s.txt"`, `file:*.mkv`, `file:season*`, `file:\`,
+		`ext:MKV`, `ext:txt`, `cat:video`, `cat:VIDEO`, `cat:%`, `hash:05`,
+	} {
+		q, err := ParseQuery(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		var expected []string
+		for _, torrent := range all {
+			if q.Match(torrent) {
+				expected = append(expected, torrent.Name)
+			}
+		}
+		results, _, err := repo.Search(QueryKey, "", input, 100, 0, SearchFilters{})
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		slices.Sort(expected)
+		slices.Sort(names)
+		if !slices.Equal(names, expected) {
+			t.Errorf("%q: Match found %v, SQL found %v", input, expected, names)
+		}
+	}
+}
+
+func TestMatchesQueryUsesCategories(t *testing.T) {
+	torrent := NewTorrent(queryTestTorrents[1])
+	if !MatchesQuery(torrent, "cat:Software") || MatchesQuery(torrent, "cat:Video") {
+		t.Errorf("unexpected category match for %v", torrentCategories(torrent))
+	}
+}
@@ -2,19 +2,71 @@ package db
 
 import (
 	dhtcclient "dhtc/dhtc-client"
+	"dhtc/notifier"
 )
 
 type Repository interface {
 	GetInfoHashCount() int
 	FindBy(key string, searchType string, searchInput string) []MetaData
+	// GetTorrent returns the torrent with infoHash or ErrNotFound.
+	GetTorrent(infoHash string) (Torrent, error)
 	Search(key string, searchType string, searchInput string, limit int, offset int, filters SearchFilters) ([]MetaData, int64, error)
+	// Facets counts the results of a search by category, file extension, size and discovery date.
+	Facets(key string, searchType string, searchInput string, filters SearchFilters) (Facets, error)
 	GetNRandomEntries(n int) []MetaData
-	GetLatest(limit int, offset int) ([]MetaData, int64, error)
+	// GetLatest returns the newest torrents matching filters.
+	GetLatest(limit int, offset int, filters SearchFilters) ([]MetaData, int64, error)
 	InsertMetadata(md dhtcclient.Metadata) bool
+	// MergeTorrents inserts torrents in bulk. Torrents which already exist are
+	// merged, keeping the earliest discovery date and the union of the file lists.
+	MergeTorrents(torrents []Torrent) (MergeResult, error)
+	// ForEachTorrent calls fn for every torrent matching filters, in the order
+	// they were inserted, with their change sequence number.
+	ForEachTorrent(filters SearchFilters, fn func(Change) error) error
+	// GetChanges returns up to limit torrents inserted after the sequence number after.
+	GetChanges(after int64, limit int) ([]Change, error)
+
+	// GetUnclusteredTorrents returns up to limit torrents without cluster, in
+	// the order they were discovered on SQL databases and inserted on CloverDB.
+	GetUnclusteredTorrents(limit int) ([]Torrent, error)
+	// FindCluster returns the cluster of the oldest clustered torrent with a
+	// matching fingerprint, or an empty string.
+	FindCluster(fp Fingerprint) (string, error)
+	SetCluster(infoHash string, fp Fingerprint, clusterId string) error
 
 	GetWatchEntries() []WatchEntry
-	InsertWatchEntry(key string, searchType string, searchInput string) bool
+	InsertWatchEntry(entry WatchEntry) bool
+	// DeleteWatchEntry deletes the watch entry and its hits, or returns
+	// ErrNotFound.
 	DeleteWatchEntry(id string) error
+	// InsertWatchHit stores hit and returns its id.
+	InsertWatchHit(hit WatchHit) (string, error)
+	// SetWatchHitDelivery replaces the delivery of a hit to d.Notifier by d.
+	SetWatchHitDelivery(id string, d notifier.Delivery) error
+	// GetWatchHits returns the latest hits of a watch, or of all watches if
+	// watchId is empty, newest first.
+	GetWatchHits(watchId string, limit int) ([]WatchHit, error)
+	// GetWatchHitStats returns the hit statistics by watch id.
+	GetWatchHitStats() (map[string]WatchHitStats, error)
+	// GetWatchHitsSince returns the hits of a watch since the unix timestamp,
+	// newest first.
+	GetWatchHitsSince(watchId string, since int64) ([]WatchHit, error)
+	// GetWatchDownloads returns the hits of a watch sent to its downloader
+	// since the unix timestamp.
+	GetWatchDownloads(watchId string, since int64) ([]WatchHit, error)
+
+	// GetSavedSearches returns all saved searches ordered by name.
+	GetSavedSearches() ([]SavedSearch, error)
+	// GetSavedSearch returns the saved search with id or ErrNotFound.
+	GetSavedSearch(id string) (SavedSearch, error)
+	// InsertSavedSearch stores s and returns its id.
+	InsertSavedSearch(s SavedSearch) (string, error)
+	// DeleteSavedSearch deletes the saved search with id or returns
+	// ErrNotFound.
+	DeleteSavedSearch(id string) error
+
+	// Outbox stores the notifications which are not delivered yet.
+	notifier.Outbox
 
 	GetBlacklistEntries() []BlacklistEntry
 	AddToBlacklist(filters []string, entryType string) bool
@@ -25,8 +77,16 @@ type Repository interface {
 
 	GetStatsByInterval(interval string, limit int) ([]Stats, error)
 	InsertStats(stats Stats) error
+	GetStats() ([]Stats, error)
 
 	GetCategoryDistribution() (map[string]int64, error)
 
+	// GetValue returns the value stored for key or an empty string.
+	GetValue(key string) (string, error)
+	SetValue(key string, value string) error
+
+	SchemaVersion() (int, error)
+	Migrate(dryRun bool) ([]Migration, error)
+
 	Close() error
 }
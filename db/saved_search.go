@@ -0,0 +1,57 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const SavedSearchTable = "saved_searches"
+
+// ErrNotFound is returned when an entry requested by id does not exist.
+var ErrNotFound = errors.New("not found")
+
+// SavedSearch is a named search which is served as a feed. Feed readers
+// authenticate with Token instead of the credentials of the web interface.
+type SavedSearch struct {
+	Id          string
+	Name        string
+	Key         string
+	MatchType   string
+	SearchInput string
+	Filters     SearchFilters
+	Token       string
+	CreatedOn   int64
+}
+
+// NewSavedSearch creates a saved search with a random feed token.
+func NewSavedSearch(name string, key string, matchType string, searchInput string, filters SearchFilters) (SavedSearch, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return SavedSearch{}, err
+	}
+	// A position in the results is not part of the search.
+	filters.Cursor = Cursor{}
+	return SavedSearch{
+		Name:        name,
+		Key:         key,
+		MatchType:   matchType,
+		SearchInput: searchInput,
+		Filters:     filters,
+		Token:       hex.EncodeToString(token),
+		CreatedOn:   time.Now().Unix(),
+	}, nil
+}
+
+func encodeFilters(filters SearchFilters) string {
+	b, _ := json.Marshal(filters)
+	return string(b)
+}
+
+func decodeFilters(s string) SearchFilters {
+	var filters SearchFilters
+	_ = json.Unmarshal([]byte(s), &filters)
+	return filters
+}
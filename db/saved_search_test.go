@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSavedSearches(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		filters := SearchFilters{MinSize: 1 << 30, Extensions: []string{"mkv"}, Cursor: Cursor{Offset: 50}}
+		s, err := NewSavedSearch("linux", "Name", "contains", "linux", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _ := NewSavedSearch("other", "Name", "contains", "other", SearchFilters{})
+		if s.Token == "" || s.Token == other.Token {
+			t.Errorf("expected random feed tokens, got %q and %q", s.Token, other.Token)
+		}
+
+		id, err := repo.InsertSavedSearch(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = repo.InsertSavedSearch(other); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := repo.GetSavedSearch(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Id != id || saved.Token != s.Token || saved.SearchInput != "linux" || saved.Filters.MinSize != 1<<30 ||
+			!slices.Equal(saved.Filters.Extensions, []string{"mkv"}) || !saved.Filters.Cursor.IsZero() {
+			t.Errorf("%s: expected the saved search without cursor, got %+v", name, saved)
+		}
+
+		if all, _ := repo.GetSavedSearches(); len(all) != 2 || all[0].Name != "linux" {
+			t.Errorf("%s: expected 2 saved searches, ordered by name, got %+v", name, all)
+		}
+		for _, unknown := range []string{"1=1", "abc", "999999"} {
+			if err = repo.DeleteSavedSearch(unknown); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: expected unknown saved search %q not to be found, got %v", name, unknown, err)
+			}
+		}
+		if all, _ := repo.GetSavedSearches(); len(all) != 2 {
+			t.Errorf("%s: expected no saved search to be deleted by an unknown id, got %+v", name, all)
+		}
+		if err = repo.DeleteSavedSearch(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = repo.GetSavedSearch(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected deleted saved search not to be found, got %v", name, err)
+		}
+		if _, err = repo.GetSavedSearch("unknown"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected unknown id not to be found, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestRepositories opens an empty clover and sqlite repository in a
+// temporary directory, which are closed at the end of the test.
+func newTestRepositories(t *testing.T) (Repository, Repository) {
+	t.Helper()
+	return newTestCloverRepository(t), newTestGormRepository(t)
+}
+
+// newTestCloverRepository opens an empty clover repository in a temporary
+// directory, which is closed at the end of the test.
+func newTestCloverRepository(t *testing.T) Repository {
+	t.Helper()
+	repo, err := NewCloverRepository(&config.Configuration{DbName: filepath.Join(t.TempDir(), "dhtdb")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
+}
+
+// newTestGormRepository opens an empty sqlite repository in a temporary
+// directory, which is closed at the end of the test.
+func newTestGormRepository(t *testing.T) Repository {
+	t.Helper()
+	repo, err := NewGormRepository(&config.Configuration{}, "sqlite", filepath.Join(t.TempDir(), "dhtc.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
+}
+
+func newSortTestRepositories(t *testing.T) map[string]Repository {
+	t.Helper()
+	clover, gorm := newTestRepositories(t)
+
+	torrents := []dhtcclient.Metadata{
+		{InfoHash: []byte{1}, Name: "linux collection of linux isos", TotalSize: 300, DiscoveredOn: 1, Files: []dhtcclient.File{{Path: "a"}, {Path: "b"}, {Path: "c"}}},
+		{InfoHash: []byte{2}, Name: "linux", TotalSize: 100, DiscoveredOn: 2, Files: []dhtcclient.File{{Path: "a"}}},
+		{InfoHash: []byte{3}, Name: "my linux backup", TotalSize: 200, DiscoveredOn: 3, Files: []dhtcclient.File{{Path: "a"}, {Path: "b"}}},
+	}
+	for _, md := range torrents {
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+	return map[string]Repository{"clover": clover, "gorm": gorm}
+}
+
+func TestSearchSort(t *testing.T) {
+	tests := []struct {
+		matchType string
+		filters   SearchFilters
+		expected  []string
+	}{
+		{"contains", SearchFilters{Sort: SortDiscovered}, []string{"my linux backup", "linux", "linux collection of linux isos"}},
+		{"contains", SearchFilters{Sort: SortSize}, []string{"linux collection of linux isos", "my linux backup", "linux"}},
+		{"contains", SearchFilters{Sort: SortFiles, SortAscending: true}, []string{"linux", "my linux backup", "linux collection of linux isos"}},
+		{"startswith", SearchFilters{Sort: SortRelevance}, []string{"linux", "linux collection of linux isos"}},
+	}
+
+	for name, repo := range newSortTestRepositories(t) {
+		for _, test := range tests {
+			results, _, err := repo.Search("Name", test.matchType, "linux", 10, 0, test.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, r := range results {
+				names = append(names, r.Name)
+			}
+			if !slices.Equal(names, test.expected) {
+				t.Errorf("%s: %+v: expected %v, got %v", name, test.filters, test.expected, names)
+			}
+		}
+	}
+}
+
+func TestSearchRelevance(t *testing.T) {
+	repo := newSortTestRepositories(t)["clover"]
+	results, _, err := repo.Search("Name", "contains", "linux", 10, 0, SearchFilters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Name != "linux" || results[0].Relevance <= results[2].Relevance {
+		t.Errorf("expected the closest match first, got %+v", results)
+	}
+
+	if Relevance("linux", "linux") <= Relevance("my linux backup", "linux") || Relevance("debian", "linux") != 0 {
+		t.Error("unexpected relevance scores")
+	}
+}
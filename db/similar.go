@@ -0,0 +1,121 @@
+package db
+
+import (
+	"cmp"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxSimilarCandidates = 500
+	// maxSimilarNameTerms limits the terms of the candidate search to the
+	// longest name words.
+	maxSimilarNameTerms = 6
+)
+
+// Similar is a torrent similar to another one, with a similarity from 0 to 1.
+type Similar struct {
+	MetaData
+	Similarity float64
+}
+
+// SimilarTorrents recommends up to limit torrents similar to t. Candidates
+// sharing a name word with t are ranked by the cosine
+// similarity of their name words, file names and file sizes, weighted by
+// TF-IDF over the candidates.
+func SimilarTorrents(repo Repository, t Torrent, limit int) ([]Similar, error) {
+	q := similarQuery(t)
+	if q == "" {
+		return nil, nil
+	}
+	candidates, _, err := repo.Search(QueryKey, "", q, maxSimilarCandidates, 0, SearchFilters{SkipTotal: true})
+	if err != nil {
+		return nil, err
+	}
+
+	target := similarityFeatures(t)
+	features := make([]map[string]bool, len(candidates))
+	df := make(map[string]int)
+	for f := range target {
+		df[f]++
+	}
+	for i, md := range candidates {
+		features[i] = similarityFeatures(Torrent{Name: md.Name, Files: Files(md.Files)})
+		for f := range features[i] {
+			df[f]++
+		}
+	}
+	n := float64(len(candidates) + 1)
+	weight := func(f string) float64 {
+		return math.Log(1 + n/float64(df[f]))
+	}
+	norm := func(fs map[string]bool) float64 {
+		var sum float64
+		for f := range fs {
+			sum += weight(f) * weight(f)
+		}
+		return math.Sqrt(sum)
+	}
+
+	targetNorm := norm(target)
+	var res []Similar
+	for i, md := range candidates {
+		if md.InfoHash == t.InfoHash {
+			continue
+		}
+		var dot float64
+		for f := range features[i] {
+			if target[f] {
+				dot += weight(f) * weight(f)
+			}
+		}
+		if dot == 0 {
+			continue
+		}
+		res = append(res, Similar{MetaData: md, Similarity: min(1, dot/(targetNorm*norm(features[i])))})
+	}
+	slices.SortStableFunc(res, func(a, b Similar) int {
+		return cmp.Compare(b.Similarity, a.Similarity)
+	})
+	return res[:min(limit, len(res))], nil
+}
+
+// similarityFeatures returns the normalised name words, and the names and
+// sizes of the significant files of t.
+func similarityFeatures(t Torrent) map[string]bool {
+	features := make(map[string]bool)
+	for _, word := range strings.Fields(NormalizeName(t.Name)) {
+		features["n:"+word] = true
+	}
+	for _, f := range significantFiles(t.Files) {
+		features["f:"+strings.ToLower(path.Base(f.Path))] = true
+		if f.Size > 0 {
+			features["s:"+strconv.FormatInt(f.Size, 10)] = true
+		}
+	}
+	return features
+}
+
+// similarQuery returns a query for torrents sharing one of the longest name
+// words with t. File names are left out, matching them scans the file lists
+// of all torrents.
+func similarQuery(t Torrent) string {
+	var words []string
+	for _, word := range strings.Fields(NormalizeName(t.Name)) {
+		if utf8.RuneCountInString(word) >= 3 && !slices.Contains(words, word) {
+			words = append(words, word)
+		}
+	}
+	slices.SortStableFunc(words, func(a, b string) int {
+		return utf8.RuneCountInString(b) - utf8.RuneCountInString(a)
+	})
+	var terms []string
+	for _, word := range words[:min(maxSimilarNameTerms, len(words))] {
+		terms = append(terms, FieldName+`:"`+word+`"`)
+	}
+	return strings.Join(terms, " OR ")
+}
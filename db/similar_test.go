@@ -0,0 +1,44 @@
+package db
+
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"testing"
+)
+
+func TestSimilarTorrents(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	torrents := []dhtcclient.Metadata{
+		{InfoHash: []byte{1}, Name: "Nature Documentary Oceans 2020", Files: []dhtcclient.File{{Path: "oceans.mkv", Size: 3 << 30}}},
+		{InfoHash: []byte{2}, Name: "Nature Documentary Oceans 2020 1080p", Files: []dhtcclient.File{{Path: "oceans.mkv", Size: 3 << 30}}},
+		{InfoHash: []byte{3}, Name: "Nature Documentary Forests", Files: []dhtcclient.File{{Path: "forests.mkv", Size: 2 << 30}}},
+		{InfoHash: []byte{4}, Name: "Holiday pictures", Files: []dhtcclient.File{{Path: "oceans.mkv", Size: 1 << 20}}},
+		{InfoHash: []byte{5}, Name: "Debian 12", Files: []dhtcclient.File{{Path: "debian.iso", Size: 600 << 20}}},
+	}
+	for i, md := range torrents {
+		md.DiscoveredOn = int64(i + 1)
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		target, err := repo.GetTorrent("01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		similar, err := SimilarTorrents(repo, target, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hashes []string
+		for _, s := range similar {
+			hashes = append(hashes, s.InfoHash)
+		}
+		if len(similar) != 2 || hashes[0] != "02" || hashes[1] != "03" || similar[0].Similarity <= similar[1].Similarity || similar[0].Similarity > 1 {
+			t.Errorf("%s: expected the re-upload first and the other documentary second, got %v %+v", name, hashes, similar)
+		}
+		if _, err = repo.GetTorrent("ff"); err != ErrNotFound {
+			t.Errorf("%s: expected an unknown torrent not to be found, got %v", name, err)
+		}
+	}
+}
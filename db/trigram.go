@@ -0,0 +1,54 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// MatchFuzzy is the search type for typo tolerant name matching.
+const MatchFuzzy = "fuzzy"
+
+// FuzzyThreshold is the share of search trigrams a name needs to match fuzzily.
+const FuzzyThreshold = 0.4
+
+// trigrams returns the distinct trigrams of the words of s, like pg_trgm does:
+// words consist of letters and digits only, are lower cased and padded with two
+// spaces in front and one behind. Separators therefore do not matter, and
+// "the.matrix.1999" has the same trigrams as "The Matrix (1999)".
+func trigrams(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var res []string
+	for _, word := range words {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			res = append(res, string(runes[i:i+3]))
+		}
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// FuzzyScore returns the share of trigrams of searchInput which also occur in
+// name, from 0 to 1. Unlike a similarity of both strings, long names are not
+// penalized for words missing in searchInput.
+func FuzzyScore(name string, searchInput string) float64 {
+	wanted := trigrams(searchInput)
+	if len(wanted) == 0 {
+		return 0
+	}
+	have := trigrams(name)
+	var found int
+	for _, t := range wanted {
+		if _, ok := slices.BinarySearch(have, t); ok {
+			found++
+		}
+	}
+	return float64(found) / float64(len(wanted))
+}
+
+func MatchesFuzzy(name string, searchInput string) bool {
+	return FuzzyScore(name, searchInput) >= FuzzyThreshold
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		matches bool
+	}{
+		{"The Matrix (1999)", "the.matrix.1999", true},
+		{"The.Matrix.Reloaded.2003.1080p", "matirx reloaded", true},
+		{"the matrix", "matrix", true},
+		{"Matrix", "the godfather 1972", false},
+		{"Debian 12", "matrix", false},
+		{"anything", "...", false},
+	}
+	for _, test := range tests {
+		if MatchesFuzzy(test.name, test.input) != test.matches {
+			t.Errorf("%q ~ %q: expected %v, score %f", test.name, test.input, test.matches, FuzzyScore(test.name, test.input))
+		}
+	}
+	if FuzzyScore("the.matrix.1999", "The Matrix (1999)") != 1 {
+		t.Error("expected separators to be ignored")
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	for i, name := range []string{"The.Matrix.1999.1080p.BluRay", "The Matrix Reloaded", "Debian 12 netinst", "The Matrix (1999)"} {
+		md := dhtcclient.Metadata{InfoHash: []byte{byte(i)}, Name: name, DiscoveredOn: int64(i), Files: []dhtcclient.File{{Path: "a"}}}
+		clover.InsertMetadata(md)
+		gorm.InsertMetadata(md)
+	}
+	// Torrents inserted in bulk are indexed as well.
+	if _, err := gorm.MergeTorrents([]Torrent{{InfoHash: "04", Name: "the matrix 1999 remastered", DiscoveredOn: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	clover.MergeTorrents([]Torrent{{InfoHash: "04", Name: "the matrix 1999 remastered", DiscoveredOn: 5}})
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		results, total, err := repo.Search("Name", MatchFuzzy, "the matrx 1999", 10, 0, SearchFilters{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Name)
+		}
+		if total != 4 || !slices.Contains(names, "the matrix 1999 remastered") || names[3] != "The Matrix Reloaded" {
+			t.Errorf("%s: expected 4 similar names, the least similar last, got %v", name, names)
+			continue
+		}
+		if results[0].Relevance <= results[3].Relevance {
+			t.Errorf("%s: expected results ranked by similarity, got %+v", name, results)
+		}
+		if found := repo.FindBy("Name", MatchFuzzy, "debain"); len(found) != 1 {
+			t.Errorf("%s: expected a typo to match, got %v", name, found)
+		}
+	}
+}
+
+// TestPostgresFuzzySearch needs a PostgreSQL database with the pg_trgm
+// extension, e.g. DHTC_TEST_POSTGRES="host=localhost user=dhtc dbname=dhtc_test".
+func TestPostgresFuzzySearch(t *testing.T) {
+	dsn := os.Getenv("DHTC_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("DHTC_TEST_POSTGRES is not set")
+	}
+	repo, err := NewGormRepository(&config.Configuration{}, "postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	r := repo.(*GormRepository)
+	if !r.trigramsEnabled {
+		t.Fatal("expected pg_trgm to be enabled")
+	}
+	r.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{0xf0, 0x0d}, Name: "The.Matrix.Reloaded.2003.1080p"})
+
+	results, _, err := repo.Search("Name", MatchFuzzy, "matirx reloaded", 100, 0, SearchFilters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(results, func(md MetaData) bool { return md.InfoHash == "f00d" }) {
+		t.Errorf("expected a typo to match, got %v", results)
+	}
+
+	err = r.fuzzySession(MatchFuzzy, func(db *gorm.DB) error {
+		var threshold string
+		if err := db.Raw("SELECT current_setting('pg_trgm.word_similarity_threshold')").Scan(&threshold).Error; err != nil {
+			return err
+		}
+		if threshold != "0.4" {
+			t.Errorf("expected the threshold of the other backends, got %s", threshold)
+		}
+
+		// Without sequential scans, the plan falls back to a full scan only if
+		// the index can not be used at all.
+		if err := db.Exec("SET LOCAL enable_seqscan = off").Error; err != nil {
+			return err
+		}
+		query, err := r.searchQuery(db, "Name", MatchFuzzy, "matirx reloaded", SearchFilters{})
+		if err != nil {
+			return err
+		}
+		stmt := query.Session(&gorm.Session{DryRun: true}).Find(&[]GormTorrent{}).Statement
+		var plan string
+		err = db.Statement.ConnPool.QueryRowContext(context.Background(), "EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...).Scan(&plan)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(plan, "idx_name_trgm") {
+			t.Errorf("expected the fuzzy search to use the trigram index, got plan %s", plan)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
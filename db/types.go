@@ -1,6 +1,10 @@
 package db
 
-import "time"
+import (
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/hex"
+	"time"
+)
 
 type Stats struct {
 	Timestamp    time.Time `gorm:"primaryKey"`
@@ -11,7 +15,38 @@ type WatchEntry struct {
 	Id        string
 	Key       string
 	MatchType string
-	Content   string
+	// Content is matched against Key with MatchType. Without content only the
+	// rules below select torrents.
+	Content string
+	// MinSize and MaxSize limit the total size in bytes, 0 means no limit.
+	MinSize uint64
+	MaxSize uint64
+	// Categories selects torrents with any of the categories.
+	Categories []string
+	MinFiles   int
+	// Exclude lists terms which must not occur as words in the name or the
+	// file paths, e.g. "cam".
+	Exclude []string
+	// QuietStart and QuietEnd are the times of day ("15:04") between which
+	// matches are not notified. The quiet hours may span midnight.
+	QuietStart string
+	QuietEnd   string
+	// Notifiers are the names of the notifiers matches are sent to, all if empty.
+	Notifiers []string
+	// Downloader is the name of the downloader matches are sent to, none if
+	// empty. SavePath and Label are passed to the downloader.
+	Downloader string
+	SavePath   string
+	Label      string
+	// DailyCap limits the downloads per day, 0 means no limit.
+	DailyCap int
+	// FirstMatchOnly skips downloads of torrents with the same normalised name
+	// as a torrent the watch downloaded before, like re-uploads.
+	FirstMatchOnly bool
+	// Digest is one of the Digest constants. Batches are sent every
+	// DigestInterval minutes.
+	Digest         string
+	DigestInterval int
 }
 
 type BlacklistEntry struct {
@@ -25,6 +60,51 @@ type SearchFilters struct {
 	MaxSize   uint64
 	StartDate int64
 	EndDate   int64
+	// Since only selects torrents discovered strictly after this unix timestamp.
+	Since int64
+	// AfterSeq only selects torrents inserted after this change sequence
+	// number, see Change. It is only supported by ForEachTorrent.
+	AfterSeq int64
+	// Sort is one of the Sort constants. By default, results of a full text search
+	// are ranked by relevance and all other results by discovery date.
+	Sort          string
+	SortAscending bool
+	// Categories and Extensions (without dot) select torrents with any of the values.
+	Categories []string
+	Extensions []string
+	// Cursor continues a previous search after its last result and replaces the offset.
+	Cursor Cursor
+	// ApproximateTotal allows repositories to estimate the number of results
+	// instead of counting them.
+	ApproximateTotal bool
+	// SkipTotal leaves the total of a search at 0 for callers which only need
+	// the results.
+	SkipTotal bool
+	// Collapse returns only one torrent of every cluster of near-duplicates,
+	// with the number of matching torrents of the cluster in Variants.
+	Collapse bool
+	// Cluster selects the torrents of one cluster.
+	Cluster string
+}
+
+const (
+	SortRelevance  = "relevance"
+	SortDiscovered = "discovered"
+	SortSize       = "size"
+	SortFiles      = "files"
+)
+
+// SortField resolves the default of Sort. Relevance is only available for ranked searches.
+func (f SearchFilters) SortField(ranked bool) string {
+	switch f.Sort {
+	case SortDiscovered, SortSize, SortFiles:
+		return f.Sort
+	case "", SortRelevance:
+		if ranked {
+			return SortRelevance
+		}
+	}
+	return SortDiscovered
 }
 
 type MetaData struct {
@@ -34,4 +114,51 @@ type MetaData struct {
 	TotalSize    uint64
 	Files        []any
 	Categories   []string
+	Relevance    float64
+	// Cursor is the position after this result, see NextCursor.
+	Cursor Cursor `json:"-"`
+	// ClusterId is the info hash of the first torrent of the near-duplicates of
+	// this torrent, or empty if it was not clustered yet.
+	ClusterId string
+	// Variants is the number of torrents represented by a collapsed result.
+	Variants int
+}
+
+// Torrent is the lossless representation of a stored torrent, used when
+// moving data between repositories or out of dhtc.
+type Torrent struct {
+	InfoHash     string
+	Name         string
+	TotalSize    uint64
+	DiscoveredOn int64
+	Files        []dhtcclient.File
+	Categories   []string
+}
+
+// Change is an entry of the replication change feed. Seq increases with every
+// torrent inserted into the repository.
+type Change struct {
+	Seq int64
+	Torrent
+}
+
+func NewTorrent(md dhtcclient.Metadata) Torrent {
+	return Torrent{
+		InfoHash:     hex.EncodeToString(md.InfoHash),
+		Name:         md.Name,
+		TotalSize:    md.TotalSize,
+		DiscoveredOn: md.DiscoveredOn,
+		Files:        md.Files,
+	}
+}
+
+func (t Torrent) Metadata() dhtcclient.Metadata {
+	infoHash, _ := hex.DecodeString(t.InfoHash)
+	return dhtcclient.Metadata{
+		InfoHash:     infoHash,
+		Name:         t.Name,
+		TotalSize:    t.TotalSize,
+		DiscoveredOn: t.DiscoveredOn,
+		Files:        t.Files,
+	}
 }
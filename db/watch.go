@@ -1,30 +1,497 @@
 package db
 
 import (
+	"cmp"
 	"dhtc/config"
 	dhtcclient "dhtc/dhtc-client"
+	"dhtc/downloader"
 	"dhtc/notifier"
+	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
 )
 
-func CheckWatches(config *config.Configuration, database Repository, md dhtcclient.Metadata, nManager *notifier.Manager) {
-	if nManager == nil {
+// MatchRegex is the match type of watches for case-insensitive regular
+// expressions.
+const MatchRegex = "regex"
+
+// watchMatcher is a watch entry compiled for matching torrents in memory.
+type watchMatcher struct {
+	entry WatchEntry
+	match func(t Torrent) bool
+}
+
+// WatchEngine matches newly discovered torrents against the watch entries. The
+// entries are compiled once and have to be reloaded when they change.
+type WatchEngine struct {
+	database Repository
+	nManager *notifier.Manager
+	// publicURL is the URL of the web interface, linked by notifications.
+	publicURL string
+	// digestTime is the time of day ("15:04") of daily digests.
+	digestTime string
+	// newClient returns the client of a downloader.
+	newClient func(name string) (downloader.Client, error)
+
+	mu       sync.RWMutex
+	matchers []watchMatcher
+
+	// downloads holds the queued hits of the watches with a downloader, by
+	// watch id, see queueDownload.
+	downloadMu sync.Mutex
+	downloads  map[string]*downloadQueue
+	pending    sync.WaitGroup
+}
+
+// downloadQueue holds the hits of one watch waiting to be sent to its
+// downloader, in the order they were found.
+type downloadQueue struct {
+	hits    []func()
+	running bool
+}
+
+func NewWatchEngine(database Repository, nManager *notifier.Manager, cfg *config.Configuration) *WatchEngine {
+	e := &WatchEngine{
+		database:   database,
+		nManager:   nManager,
+		publicURL:  strings.TrimSuffix(cfg.PublicURL, "/"),
+		digestTime: cfg.DigestTime,
+		newClient: func(name string) (downloader.Client, error) {
+			return downloader.New(name, cfg)
+		},
+	}
+	if nManager != nil {
+		nManager.OnResult(e.recordDelivery)
+	}
+	e.Reload()
+	return e
+}
+
+// Reload compiles the watch entries of the repository. Entries which can not
+// be compiled, like invalid queries, are skipped.
+func (e *WatchEngine) Reload() {
+	var matchers []watchMatcher
+	for _, entry := range e.database.GetWatchEntries() {
+		match, err := compileWatch(entry)
+		if err != nil {
+			log.Warn().Err(err).Msgf("skipping watch '%s'", entry.Content)
+			continue
+		}
+		matchers = append(matchers, watchMatcher{entry: entry, match: match})
+	}
+
+	e.mu.Lock()
+	e.matchers = matchers
+	e.mu.Unlock()
+}
+
+// Match returns the watch entries matching md.
+func (e *WatchEngine) Match(md dhtcclient.Metadata) []WatchEntry {
+	return e.match(NewTorrent(md))
+}
+
+func (e *WatchEngine) match(t Torrent) []WatchEntry {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var res []WatchEntry
+	for _, m := range e.matchers {
+		if m.match(t) {
+			res = append(res, m.entry)
+		}
+	}
+	return res
+}
+
+// Check sends md to the downloader of every watch entry matching it and queues
+// a notification for the notifiers of the watch entry, unless it is in its
+// quiet hours or the watch sends digests. The hits are recorded with pending
+// deliveries, which are updated once they are delivered. Hits of watches with
+// a downloader are recorded and notified in the background, after sending
+// them.
+func (e *WatchEngine) Check(md dhtcclient.Metadata) {
+	now := time.Now()
+	t := NewTorrent(md)
+	for _, entry := range e.match(t) {
+		if entry.Downloader != "" {
+			e.queueDownload(entry.Id, func() { e.hit(t, entry, now) })
+			continue
+		}
+		e.hit(t, entry, now)
+	}
+}
+
+// queueDownload runs hit after the previously queued hits of the watch with
+// id. The hits of a watch are handled one at a time, so that its download
+// limits see the downloads before.
+func (e *WatchEngine) queueDownload(id string, hit func()) {
+	e.downloadMu.Lock()
+	defer e.downloadMu.Unlock()
+	if e.downloads == nil {
+		e.downloads = make(map[string]*downloadQueue)
+	}
+	q := e.downloads[id]
+	if q == nil {
+		q = &downloadQueue{}
+		e.downloads[id] = q
+	}
+	q.hits = append(q.hits, hit)
+	if !q.running {
+		q.running = true
+		e.pending.Add(1)
+		go e.runDownloads(id, q)
+	}
+}
+
+// runDownloads runs the hits of q until it is empty.
+func (e *WatchEngine) runDownloads(id string, q *downloadQueue) {
+	defer e.pending.Done()
+	for {
+		e.downloadMu.Lock()
+		if len(q.hits) == 0 {
+			delete(e.downloads, id)
+			e.downloadMu.Unlock()
+			return
+		}
+		hit := q.hits[0]
+		q.hits = q.hits[1:]
+		e.downloadMu.Unlock()
+		hit()
+	}
+}
+
+// hit sends t to the downloader of the watch entry, records the hit and
+// queues its notification.
+func (e *WatchEngine) hit(t Torrent, entry WatchEntry, now time.Time) {
+	hit := WatchHit{
+		WatchId:  entry.Id,
+		InfoHash: t.InfoHash,
+		Name:     t.Name,
+		Time:     now.Unix(),
+		Quiet:    entry.Quiet(now),
+	}
+	if entry.Downloader != "" {
+		e.download(entry, &hit, now)
+	}
+	// Matches of digest watches in the quiet hours wait for the next digest,
+	// which is sent after the quiet hours.
+	hit.Digest = entry.Digest != ""
+	notify := !hit.Quiet && !hit.Digest && e.nManager != nil
+	var event notifier.Event
+	if notify {
+		event = e.watchEvent(t, entry, hit)
+		hit.Deliveries = e.nManager.Pending(entry.Notifiers, event)
+	}
+	id, err := e.database.InsertWatchHit(hit)
+	if err != nil {
+		log.Error().Err(err).Msgf("could not record hit of watch '%s'", entry.Id)
+		if e.nManager != nil {
+			e.nManager.Alert(notifier.EventDatabase, notifier.SeverityError, "Database error: could not record watch hits: "+err.Error())
+		}
+	}
+	if notify {
+		e.nManager.Enqueue(entry.Notifiers, event, id)
+	}
+}
+
+// recordDelivery stores the result of the delivery of the notification about
+// the watch hit with id.
+func (e *WatchEngine) recordDelivery(id string, d notifier.Delivery) {
+	if id == "" {
 		return
 	}
+	if err := e.database.SetWatchHitDelivery(id, d); err != nil {
+		log.Error().Err(err).Msgf("could not record delivery of watch hit '%s'", id)
+	}
+}
+
+// watchEvent returns the notification about the hit of the watch entry for t.
+func (e *WatchEngine) watchEvent(t Torrent, entry WatchEntry, hit WatchHit) notifier.Event {
+	event := notifier.Event{
+		Title:      watchMessage(t.Name, entry),
+		Message:    downloadMessage(entry, hit),
+		Type:       notifier.EventWatch,
+		Severity:   notifier.SeverityInfo,
+		Name:       t.Name,
+		InfoHash:   t.InfoHash,
+		Size:       t.TotalSize,
+		Categories: torrentCategories(t),
+		Files:      len(t.Files),
+		Watch:      describeWatch(entry),
+		Magnet:     downloader.MagnetLink(t.InfoHash, t.Name),
+	}
+	if e.publicURL != "" {
+		event.URL = e.publicURL + "/torrent/" + t.InfoHash
+	}
+	return event
+}
 
-	all := database.GetWatchEntries()
-	for _, d := range all {
-		key := d.Key
-		matchType := d.MatchType
-		content := d.Content
-		if len(database.FindBy(key, matchType, content)) > 0 {
-			msg := ""
-			if matchType == "Files" {
-				msg = fmt.Sprintf("Match found: '%s' contains file which %s '%s'.", md.Name, matchType, content)
-			} else {
-				msg = fmt.Sprintf("Match found: '%s' %s '%s'", md.Name, matchType, content)
+// download sends the torrent of hit to the downloader of the watch entry,
+// unless the daily cap is reached or, in first match only mode, the watch
+// downloaded a torrent with the same normalised name before.
+func (e *WatchEngine) download(entry WatchEntry, hit *WatchHit, now time.Time) {
+	hit.Downloader = entry.Downloader
+	if entry.DailyCap > 0 || entry.FirstMatchOnly {
+		year, month, day := now.Date()
+		today := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Unix()
+		since := today
+		if entry.FirstMatchOnly {
+			since = 0
+		}
+		downloads, err := e.database.GetWatchDownloads(entry.Id, since)
+		if err != nil {
+			hit.DownloadStatus, hit.DownloadError = DownloadFailed, err.Error()
+			return
+		}
+		name := NormalizeName(hit.Name)
+		if entry.FirstMatchOnly && name != "" && slices.ContainsFunc(downloads, func(d WatchHit) bool { return NormalizeName(d.Name) == name }) {
+			hit.DownloadStatus = DownloadDuplicate
+			return
+		}
+		var downloadedToday int
+		for _, d := range downloads {
+			if d.Time >= today {
+				downloadedToday++
 			}
-			nManager.Notify(msg)
+		}
+		if entry.DailyCap > 0 && downloadedToday >= entry.DailyCap {
+			hit.DownloadStatus = DownloadCapped
+			return
+		}
+	}
+
+	client, err := e.newClient(entry.Downloader)
+	if err == nil {
+		err = client.AddMagnet(downloader.MagnetLink(hit.InfoHash, hit.Name), downloader.Options{SavePath: entry.SavePath, Label: entry.Label})
+	}
+	if err != nil {
+		hit.DownloadStatus, hit.DownloadError = DownloadFailed, err.Error()
+		return
+	}
+	hit.DownloadStatus = DownloadSent
+}
+
+// downloadMessage describes the download of hit, if any.
+func downloadMessage(entry WatchEntry, hit WatchHit) string {
+	switch hit.DownloadStatus {
+	case DownloadSent:
+		return fmt.Sprintf("Sent to %s.", hit.Downloader)
+	case DownloadFailed:
+		return fmt.Sprintf("Could not send it to %s: %s", hit.Downloader, hit.DownloadError)
+	case DownloadCapped:
+		return fmt.Sprintf("Not downloaded, the daily limit of %d downloads is reached.", entry.DailyCap)
+	case DownloadDuplicate:
+		return "Not downloaded, a torrent with the same name was downloaded before."
+	}
+	return ""
+}
+
+func watchMessage(name string, entry WatchEntry) string {
+	switch entry.Key {
+	case QueryKey:
+		return fmt.Sprintf("Match found: '%s' matches query '%s'", name, entry.Content)
+	case "Files":
+		if entry.Content == "" {
+			break
+		}
+		return fmt.Sprintf("Match found: '%s' contains file which %s '%s'.", name, entry.MatchType, entry.Content)
+	}
+	if entry.Content == "" {
+		return fmt.Sprintf("Match found: '%s'", name)
+	}
+	return fmt.Sprintf("Match found: '%s' %s '%s'", name, entry.MatchType, entry.Content)
+}
+
+// describeWatch returns a short description of what the watch entry matches.
+func describeWatch(entry WatchEntry) string {
+	switch {
+	case entry.Key == QueryKey:
+		return fmt.Sprintf("query '%s'", entry.Content)
+	case entry.Content == "":
+		return "rules only"
+	}
+	return fmt.Sprintf("%s %s '%s'", entry.Key, entry.MatchType, entry.Content)
+}
+
+// Validate reports whether the watch entry can be compiled and selects
+// torrents at all.
+func (w WatchEntry) Validate() error {
+	if w.Content == "" && w.MinSize == 0 && w.MaxSize == 0 && len(w.Categories) == 0 && w.MinFiles == 0 {
+		return errors.New("watch matches every torrent")
+	}
+	if w.MaxSize > 0 && w.MinSize > w.MaxSize {
+		return errors.New("min. size exceeds max. size")
+	}
+	if w.Downloader != "" && !slices.Contains(downloader.Names, w.Downloader) {
+		return fmt.Errorf("unknown downloader '%s'", w.Downloader)
+	}
+	if w.DailyCap < 0 || w.MinFiles < 0 {
+		return errors.New("limits must not be negative")
+	}
+	switch w.Digest {
+	case "", DigestDaily:
+	case DigestBatch:
+		if w.DigestInterval <= 0 {
+			return errors.New("batched digests need an interval")
+		}
+	default:
+		return fmt.Errorf("unknown digest mode '%s'", w.Digest)
+	}
+	if (w.QuietStart == "") != (w.QuietEnd == "") {
+		return errors.New("quiet hours need a start and an end")
+	}
+	for _, value := range []string{w.QuietStart, w.QuietEnd} {
+		if _, err := time.Parse("15:04", value); value != "" && err != nil {
+			return fmt.Errorf("invalid time of day '%s'", value)
+		}
+	}
+	_, err := compileWatch(w)
+	return err
+}
+
+// Quiet reports whether t is within the quiet hours of the watch entry.
+func (w WatchEntry) Quiet(t time.Time) bool {
+	start, err := time.Parse("15:04", w.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", w.QuietEnd)
+	if err != nil {
+		return false
+	}
+	minute := func(t time.Time) int { return t.Hour()*60 + t.Minute() }
+	now, from, to := minute(t), minute(start), minute(end)
+	if from <= to {
+		return from <= now && now < to
+	}
+	return now >= from || now < to
+}
+
+// compileWatch returns a function matching torrents against the content and
+// the rules of the watch entry.
+func compileWatch(entry WatchEntry) (func(t Torrent) bool, error) {
+	content := func(t Torrent) bool { return true }
+	if entry.Content != "" {
+		var err error
+		if content, err = compileWatchContent(entry); err != nil {
+			return nil, err
+		}
+	}
+	var exclude [][]string
+	for _, term := range entry.Exclude {
+		if words := nameWords(term); len(words) > 0 {
+			exclude = append(exclude, words)
+		}
+	}
+
+	return func(t Torrent) bool {
+		if entry.MinSize > 0 && t.TotalSize < entry.MinSize {
+			return false
+		}
+		if entry.MaxSize > 0 && t.TotalSize > entry.MaxSize {
+			return false
+		}
+		if len(t.Files) < entry.MinFiles {
+			return false
+		}
+		if len(entry.Categories) > 0 && !containsAny(torrentCategories(t), entry.Categories) {
+			return false
+		}
+		if !content(t) {
+			return false
+		}
+		for _, words := range exclude {
+			if containsWords(nameWords(t.Name), words) {
+				return false
+			}
+			for _, f := range t.Files {
+				if containsWords(nameWords(f.Path), words) {
+					return false
+				}
+			}
+		}
+		return true
+	}, nil
+}
+
+// MatchSearch returns a function matching torrents like a search for
+// searchInput by key with matchType would, e.g. to filter a stream of
+// torrents. An empty key searches names, an empty match type for substrings.
+func MatchSearch(key string, matchType string, searchInput string) (func(t Torrent) bool, error) {
+	return compileWatchContent(WatchEntry{Key: cmp.Or(key, "Name"), MatchType: cmp.Or(matchType, "contains"), Content: searchInput})
+}
+
+// compileWatchContent returns a function matching torrents like a search for
+// the content of the watch entry would.
+func compileWatchContent(entry WatchEntry) (func(t Torrent) bool, error) {
+	matchType, content := entry.MatchType, entry.Content
+	matchString := func(value string) bool {
+		return MatchString(matchType, value, content)
+	}
+	if matchType == MatchRegex {
+		re, err := regexp.Compile("(?i)" + content)
+		if err != nil {
+			return nil, err
+		}
+		matchString = re.MatchString
+	}
+
+	switch entry.Key {
+	case QueryKey:
+		q, err := ParseQuery(content)
+		if err != nil {
+			return nil, err
+		}
+		return q.Match, nil
+	case "Name":
+		return func(t Torrent) bool {
+			return matchString(t.Name)
+		}, nil
+	case "InfoHash":
+		return func(t Torrent) bool {
+			return matchString(t.InfoHash)
+		}, nil
+	case "Files", "Path":
+		return func(t Torrent) bool {
+			return slices.ContainsFunc(t.Files, func(f dhtcclient.File) bool { return matchString(f.Path) })
+		}, nil
+	case "All":
+		return func(t Torrent) bool {
+			return matchString(t.Name) || slices.ContainsFunc(t.Files, func(f dhtcclient.File) bool { return matchString(f.Path) })
+		}, nil
+	case "DiscoveredOn":
+		day, err := time.Parse("2006.01.02", content)
+		if err != nil {
+			return nil, err
+		}
+		return func(t Torrent) bool {
+			date := time.Unix(t.DiscoveredOn, 0)
+			return date.After(day) && date.Before(day.AddDate(0, 0, 1))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown watch key '%s'", entry.Key)
+}
+
+// nameWords returns the lower cased words of s, separated by anything but
+// letters and digits.
+func nameWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsWords reports whether words contains the consecutive words wanted.
+func containsWords(words []string, wanted []string) bool {
+	for i := 0; i+len(wanted) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(wanted)], wanted) {
+			return true
 		}
 	}
+	return false
 }
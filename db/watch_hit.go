@@ -0,0 +1,63 @@
+package db
+
+import (
+	"dhtc/notifier"
+	"encoding/json"
+)
+
+const WatchHitTable = "watch_hits"
+
+// Results of sending a watch hit to a downloader.
+const (
+	DownloadSent      = "sent"
+	DownloadFailed    = "failed"
+	DownloadCapped    = "capped"
+	DownloadDuplicate = "duplicate"
+)
+
+// WatchHit records a torrent matched by a watch and the result of notifying
+// about it.
+type WatchHit struct {
+	Id       string
+	WatchId  string
+	InfoHash string
+	Name     string
+	Time     int64
+	// Quiet is set if the hit was not notified because of the quiet hours,
+	// Digest if it is notified with the digest of the watch.
+	Quiet      bool
+	Digest     bool
+	Deliveries []notifier.Delivery
+	// Downloader is the downloader of the watch, if any, and DownloadStatus
+	// one of the Download constants.
+	Downloader     string
+	DownloadStatus string
+	DownloadError  string
+}
+
+// WatchHitStats summarises the hits of a watch.
+type WatchHitStats struct {
+	Count   int64
+	LastHit int64
+}
+
+// Failed reports whether any notifier could not be notified about the hit.
+func (h WatchHit) Failed() bool {
+	for _, d := range h.Deliveries {
+		if d.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeDeliveries(deliveries []notifier.Delivery) string {
+	b, _ := json.Marshal(deliveries)
+	return string(b)
+}
+
+func decodeDeliveries(s string) []notifier.Delivery {
+	var deliveries []notifier.Delivery
+	_ = json.Unmarshal([]byte(s), &deliveries)
+	return deliveries
+}
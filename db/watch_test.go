@@ -0,0 +1,361 @@
+package db
+
+import (
+	"dhtc/config"
+	dhtcclient "dhtc/dhtc-client"
+	"dhtc/downloader"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchEngine(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	// A torrent matching the watches is already known, which must not make
+	// unrelated torrents match.
+	repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "Ubuntu 22.04", DiscoveredOn: 1})
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu"})
+	repo.InsertWatchEntry(WatchEntry{Key: "Files", MatchType: "endswith", Content: ".iso"})
+	repo.InsertWatchEntry(WatchEntry{Key: QueryKey, Content: `name:"debian" cat:Software`})
+	repo.InsertWatchEntry(WatchEntry{Key: QueryKey, Content: `name:"unterminated`})
+
+	engine := NewWatchEngine(repo, nil, &config.Configuration{})
+	tests := []struct {
+		md       dhtcclient.Metadata
+		expected []string
+	}{
+		{dhtcclient.Metadata{Name: "Holiday pictures", Files: []dhtcclient.File{{Path: "beach.jpg"}}}, nil},
+		{dhtcclient.Metadata{Name: "ubuntu 24.04", Files: []dhtcclient.File{{Path: "ubuntu.iso"}}}, []string{"Name", "Files"}},
+		{dhtcclient.Metadata{Name: "Debian 12", Files: []dhtcclient.File{{Path: "setup.exe"}}}, []string{QueryKey}},
+	}
+	for _, test := range tests {
+		var keys []string
+		for _, entry := range engine.Match(test.md) {
+			keys = append(keys, entry.Key)
+		}
+		if len(keys) != len(test.expected) {
+			t.Errorf("%s: expected %v to match, got %v", test.md.Name, test.expected, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != test.expected[i] {
+				t.Errorf("%s: expected %v to match, got %v", test.md.Name, test.expected, keys)
+			}
+		}
+	}
+
+	holiday := dhtcclient.Metadata{Name: "Holiday pictures"}
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "startswith", Content: "holiday"})
+	if len(engine.Match(holiday)) != 0 {
+		t.Error("expected new watches to match only after a reload")
+	}
+	engine.Reload()
+	if len(engine.Match(holiday)) != 1 {
+		t.Error("expected the new watch to match after a reload")
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	entry := WatchEntry{
+		Key:        "Name",
+		MatchType:  MatchRegex,
+		Content:    `\b1080p\b`,
+		MinSize:    2 << 30,
+		Categories: []string{"Video"},
+		MinFiles:   1,
+		Exclude:    []string{"cam", "hd ts"},
+	}
+	match, err := compileWatch(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie := func(name string, size uint64) Torrent {
+		return Torrent{Name: name, TotalSize: size, Files: []dhtcclient.File{{Path: name + ".mkv", Size: int64(size)}}}
+	}
+	tests := []struct {
+		t        Torrent
+		expected bool
+	}{
+		{movie("Movie.2024.1080p.WEB", 4<<30), true},
+		{movie("Movie.2024.720p.WEB", 4<<30), false},
+		{movie("Movie.2024.1080p.WEB", 1<<30), false},
+		{movie("Movie.2024.1080p.CAM", 4<<30), false},
+		{movie("Movie.2024.1080p.HD-TS", 4<<30), false},
+		{movie("Movie.2024.1080p.Camera", 4<<30), true},
+		{Torrent{Name: "Movie.2024.1080p", TotalSize: 4 << 30, Files: []dhtcclient.File{{Path: "movie.iso"}}}, false},
+	}
+	for _, test := range tests {
+		if match(test.t) != test.expected {
+			t.Errorf("%s (%d bytes): expected match %v", test.t.Name, test.t.TotalSize, test.expected)
+		}
+	}
+
+	for _, invalid := range []WatchEntry{
+		{},
+		{Key: "Name", MatchType: MatchRegex, Content: "("},
+		{MinSize: 2, MaxSize: 1},
+		{Key: "Name", MatchType: "contains", Content: "x", QuietStart: "22:00"},
+		{Key: "Name", MatchType: "contains", Content: "x", QuietStart: "22:00", QuietEnd: "25:00"},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", invalid)
+		}
+	}
+	if err = entry.Validate(); err != nil {
+		t.Errorf("expected %+v to be valid, got %v", entry, err)
+	}
+}
+
+func TestWatchQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	overnight := WatchEntry{QuietStart: "22:00", QuietEnd: "07:00"}
+	daytime := WatchEntry{QuietStart: "09:00", QuietEnd: "17:30"}
+	tests := []struct {
+		entry    WatchEntry
+		clock    string
+		expected bool
+	}{
+		{overnight, "23:15", true},
+		{overnight, "06:59", true},
+		{overnight, "07:00", false},
+		{overnight, "12:00", false},
+		{daytime, "09:00", true},
+		{daytime, "17:30", false},
+		{daytime, "08:00", false},
+		{WatchEntry{}, "12:00", false},
+	}
+	for _, test := range tests {
+		if test.entry.Quiet(at(test.clock)) != test.expected {
+			t.Errorf("%s-%s at %s: expected quiet %v", test.entry.QuietStart, test.entry.QuietEnd, test.clock, test.expected)
+		}
+	}
+}
+
+func TestWatchEntryStorage(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	entry := WatchEntry{
+		Key:            "Name",
+		MatchType:      "contains",
+		Content:        "1080p",
+		MinSize:        2 << 30,
+		MaxSize:        8 << 30,
+		Categories:     []string{"Video"},
+		MinFiles:       2,
+		Exclude:        []string{"cam", "ts"},
+		QuietStart:     "22:00",
+		QuietEnd:       "07:00",
+		Notifiers:      []string{"telegram"},
+		Downloader:     "qbittorrent",
+		SavePath:       "/downloads/tv",
+		Label:          "tv",
+		DailyCap:       3,
+		FirstMatchOnly: true,
+	}
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		if !repo.InsertWatchEntry(entry) {
+			t.Fatalf("%s: could not insert watch", name)
+		}
+		entries := repo.GetWatchEntries()
+		if len(entries) != 1 {
+			t.Fatalf("%s: expected one watch, got %v", name, entries)
+		}
+		got := entries[0]
+		got.Id = ""
+		if !reflect.DeepEqual(got, entry) {
+			t.Errorf("%s: expected %+v, got %+v", name, entry, got)
+		}
+	}
+}
+
+func TestWatchHits(t *testing.T) {
+	clover, gorm := newTestRepositories(t)
+
+	for name, repo := range map[string]Repository{"clover": clover, "gorm": gorm} {
+		repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu"})
+		repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "debian"})
+		entries := repo.GetWatchEntries()
+		ubuntu, debian := entries[0].Id, entries[1].Id
+		if entries[0].Content != "ubuntu" {
+			ubuntu, debian = debian, ubuntu
+		}
+
+		engine := NewWatchEngine(repo, nil, &config.Configuration{})
+		engine.Check(dhtcclient.Metadata{InfoHash: []byte{1}, Name: "Ubuntu 22.04"})
+		engine.Check(dhtcclient.Metadata{InfoHash: []byte{2}, Name: "Ubuntu 24.04"})
+		engine.Check(dhtcclient.Metadata{InfoHash: []byte{3}, Name: "Holiday pictures"})
+		if _, err := repo.InsertWatchHit(WatchHit{WatchId: debian, InfoHash: "04", Name: "Debian 12", Time: 1, Quiet: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		hits, err := repo.GetWatchHits(ubuntu, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != 2 || hits[0].WatchId != ubuntu || hits[0].Time < hits[1].Time || hits[0].Quiet {
+			t.Errorf("%s: expected two hits of the ubuntu watch, got %+v", name, hits)
+		}
+		if all, _ := repo.GetWatchHits("", 10); len(all) != 3 || all[2].InfoHash != "04" || !all[2].Quiet {
+			t.Errorf("%s: expected three hits, the oldest quiet, got %+v", name, all)
+		}
+		stats, err := repo.GetWatchHitStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats[ubuntu].Count != 2 || stats[ubuntu].LastHit < hits[1].Time || stats[debian] != (WatchHitStats{Count: 1, LastHit: 1}) {
+			t.Errorf("%s: unexpected hit stats %+v", name, stats)
+		}
+
+		for _, id := range []string{"1=1", "abc", "999999"} {
+			if err = repo.DeleteWatchEntry(id); err != ErrNotFound {
+				t.Errorf("%s: expected unknown watch %q not to be found, got %v", name, id, err)
+			}
+		}
+		if len(repo.GetWatchEntries()) != 2 {
+			t.Errorf("%s: expected no watch to be deleted by an unknown id", name)
+		}
+		if err = repo.DeleteWatchEntry(ubuntu); err != nil {
+			t.Fatal(err)
+		}
+		if all, _ := repo.GetWatchHits("", 10); len(all) != 1 {
+			t.Errorf("%s: expected the hits of a deleted watch to be deleted, got %+v", name, all)
+		}
+	}
+}
+
+type fakeDownloader struct {
+	mu      sync.Mutex
+	magnets []string
+	options []downloader.Options
+	err     error
+	// block delays every download until it is closed, if set.
+	block chan struct{}
+}
+
+func (d *fakeDownloader) AddMagnet(magnet string, opts downloader.Options) error {
+	if d.block != nil {
+		<-d.block
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.magnets = append(d.magnets, magnet)
+	d.options = append(d.options, opts)
+	return nil
+}
+
+func TestWatchDownloads(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "startswith", Content: "the show",
+		Downloader: downloader.QBittorrent, SavePath: "/tv", Label: "tv", DailyCap: 2, FirstMatchOnly: true})
+	engine := NewWatchEngine(repo, nil, &config.Configuration{})
+	client := &fakeDownloader{}
+	var names []string
+	engine.newClient = func(name string) (downloader.Client, error) {
+		names = append(names, name)
+		return client, nil
+	}
+
+	for i, name := range []string{"The Show S01E01 1080p", "The Show S01E01 720p WEB", "The Show S01E02", "The Show S01E03", "Another Show"} {
+		engine.Check(dhtcclient.Metadata{InfoHash: []byte{byte(i + 1)}, Name: name})
+	}
+	engine.pending.Wait()
+	if len(client.magnets) != 2 || names[0] != downloader.QBittorrent || client.options[0] != (downloader.Options{SavePath: "/tv", Label: "tv"}) {
+		t.Errorf("expected two downloads with the downloader and options of the watch, got %v %v %v", names, client.magnets, client.options)
+	}
+
+	hits, _ := repo.GetWatchHits("", 10)
+	var statuses []string
+	for i := len(hits) - 1; i >= 0; i-- {
+		statuses = append(statuses, hits[i].DownloadStatus)
+	}
+	expected := []string{DownloadSent, DownloadDuplicate, DownloadSent, DownloadCapped}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected download statuses %v, got %v", expected, statuses)
+	}
+
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "linux", Downloader: downloader.Aria2})
+	engine.Reload()
+	client.err = errors.New("connection refused")
+	engine.Check(dhtcclient.Metadata{InfoHash: []byte{9}, Name: "Linux"})
+	engine.pending.Wait()
+	hits, _ = repo.GetWatchHits("", 1)
+	if len(hits) != 1 || hits[0].DownloadStatus != DownloadFailed || hits[0].DownloadError != "connection refused" {
+		t.Errorf("expected a failed download, got %+v", hits)
+	}
+}
+
+func TestWatchDownloadsInBackground(t *testing.T) {
+	repo := newTestGormRepository(t)
+
+	repo.InsertWatchEntry(WatchEntry{Key: "Name", MatchType: "contains", Content: "show", Downloader: downloader.Aria2, DailyCap: 2})
+	engine := NewWatchEngine(repo, nil, &config.Configuration{})
+	client := &fakeDownloader{block: make(chan struct{})}
+	engine.newClient = func(name string) (downloader.Client, error) {
+		return client, nil
+	}
+
+	// Checks from several goroutines return while the downloader hangs, and
+	// the daily cap still holds once it answers.
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Go(func() {
+			engine.Check(dhtcclient.Metadata{InfoHash: []byte{byte(i + 1)}, Name: "The Show"})
+		})
+	}
+	wg.Wait()
+	close(client.block)
+	engine.pending.Wait()
+
+	if len(client.magnets) != 2 {
+		t.Errorf("expected two downloads, got %v", client.magnets)
+	}
+	hits, _ := repo.GetWatchHits("", 10)
+	statuses := make(map[string]int)
+	for _, hit := range hits {
+		statuses[hit.DownloadStatus]++
+	}
+	if !reflect.DeepEqual(statuses, map[string]int{DownloadSent: 2, DownloadCapped: 3}) {
+		t.Errorf("expected 2 sent and 3 capped downloads, got %v", statuses)
+	}
+}
+
+func TestWatchEvent(t *testing.T) {
+	engine := &WatchEngine{publicURL: "https://dhtc.example.org"}
+	torrent := NewTorrent(dhtcclient.Metadata{
+		InfoHash:  []byte{0xab, 0xcd},
+		Name:      "Big Buck Bunny",
+		TotalSize: 1 << 30,
+		Files:     []dhtcclient.File{{Path: "bunny.mkv", Size: 1 << 30}},
+	})
+	entry := WatchEntry{Key: "Name", MatchType: "contains", Content: "bunny", DailyCap: 1}
+	hit := WatchHit{Downloader: downloader.Aria2, DownloadStatus: DownloadCapped}
+
+	event := engine.watchEvent(torrent, entry, hit)
+	if event.Title != "Match found: 'Big Buck Bunny' contains 'bunny'" || event.Watch != "Name contains 'bunny'" {
+		t.Errorf("unexpected title %q or watch %q", event.Title, event.Watch)
+	}
+	if event.Message != "Not downloaded, the daily limit of 1 downloads is reached." {
+		t.Errorf("unexpected message %q", event.Message)
+	}
+	if event.InfoHash != "abcd" || event.Size != 1<<30 || event.Files != 1 || !reflect.DeepEqual(event.Categories, []string{"Video"}) {
+		t.Errorf("unexpected torrent details %+v", event)
+	}
+	if event.URL != "https://dhtc.example.org/torrent/abcd" || event.Magnet != downloader.MagnetLink("abcd", "Big Buck Bunny") {
+		t.Errorf("unexpected links %q, %q", event.URL, event.Magnet)
+	}
+
+	engine.publicURL = ""
+	if event = engine.watchEvent(torrent, entry, WatchHit{}); event.URL != "" || event.Message != "" {
+		t.Errorf("expected no URL and no message, got %+v", event)
+	}
+}
@@ -2,15 +2,67 @@ package downloader
 
 import (
 	"bytes"
+	"dhtc/config"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// Names of the downloaders.
+const (
+	Transmission = "transmission"
+	Aria2        = "aria2"
+	Deluge       = "deluge"
+	QBittorrent  = "qbittorrent"
+)
+
+var Names = []string{Transmission, Aria2, Deluge, QBittorrent}
+
+// Options are applied to a magnet added to a downloader, if it supports them.
+type Options struct {
+	SavePath string
+	// Label is the label of Transmission and Deluge and the category of
+	// qBittorrent. Aria2 has no labels.
+	Label string
+}
+
 type Client interface {
-	AddMagnet(magnet string) error
+	AddMagnet(magnet string, opts Options) error
+}
+
+// New returns the client of the downloader with name, configured by cfg.
+func New(name string, cfg *config.Configuration) (Client, error) {
+	switch name {
+	case Transmission:
+		if cfg.TransmissionURL != "" {
+			return &TransmissionClient{URL: cfg.TransmissionURL, User: cfg.TransmissionUser, Pass: cfg.TransmissionPass}, nil
+		}
+	case Aria2:
+		if cfg.Aria2URL != "" {
+			return &Aria2Client{URL: cfg.Aria2URL, Token: cfg.Aria2Token}, nil
+		}
+	case Deluge:
+		if cfg.DelugeURL != "" {
+			return &DelugeClient{URL: cfg.DelugeURL, Pass: cfg.DelugePass}, nil
+		}
+	case QBittorrent:
+		if cfg.QBittorrentURL != "" {
+			return &QBittorrentClient{URL: cfg.QBittorrentURL, User: cfg.QBittorrentUser, Pass: cfg.QBittorrentPass}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown downloader '%s'", name)
+	}
+	return nil, fmt.Errorf("%s is not configured", name)
+}
+
+// MagnetLink returns the magnet link of a torrent.
+func MagnetLink(infoHash string, name string) string {
+	return "magnet:?xt=urn:btih:" + infoHash + "&dn=" + url.QueryEscape(name)
 }
 
 type TransmissionClient struct {
@@ -20,12 +72,19 @@ type TransmissionClient struct {
 	SessionID string
 }
 
-func (c *TransmissionClient) AddMagnet(magnet string) error {
+func (c *TransmissionClient) AddMagnet(magnet string, opts Options) error {
+	arguments := map[string]any{
+		"filename": magnet,
+	}
+	if opts.SavePath != "" {
+		arguments["download-dir"] = opts.SavePath
+	}
+	if opts.Label != "" {
+		arguments["labels"] = []string{opts.Label}
+	}
 	payload := map[string]any{
-		"method": "torrent-add",
-		"arguments": map[string]any{
-			"filename": magnet,
-		},
+		"method":    "torrent-add",
+		"arguments": arguments,
 	}
 
 	for range 2 {
@@ -81,12 +140,15 @@ type Aria2Client struct {
 	Token string
 }
 
-func (c *Aria2Client) AddMagnet(magnet string) error {
+func (c *Aria2Client) AddMagnet(magnet string, opts Options) error {
 	var params []any
 	if c.Token != "" {
 		params = append(params, "token:"+c.Token)
 	}
 	params = append(params, []string{magnet})
+	if opts.SavePath != "" {
+		params = append(params, map[string]string{"dir": opts.SavePath})
+	}
 
 	payload := map[string]any{
 		"jsonrpc": "2.0",
@@ -115,7 +177,7 @@ type DelugeClient struct {
 	Pass string
 }
 
-func (c *DelugeClient) AddMagnet(magnet string) error {
+func (c *DelugeClient) AddMagnet(magnet string, opts Options) error {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
@@ -145,13 +207,36 @@ func (c *DelugeClient) AddMagnet(magnet string) error {
 	}
 
 	// 2. Add magnet
-	addPayload := map[string]any{
-		"id":     2,
-		"method": "core.add_torrent_magnet",
-		"params": []any{magnet, map[string]any{}},
+	torrentOptions := map[string]any{}
+	if opts.SavePath != "" {
+		torrentOptions["download_location"] = opts.SavePath
 	}
-	addBody, _ := json.Marshal(addPayload)
-	req, err := http.NewRequest("POST", c.URL, bytes.NewBuffer(addBody))
+	var torrentId string
+	if err = c.call(client, cookies, 2, "core.add_torrent_magnet", []any{magnet, torrentOptions}, &torrentId); err != nil {
+		return fmt.Errorf("deluge add magnet failed: %w", err)
+	}
+
+	// 3. Label, which needs the label plugin. Adding an existing label fails,
+	// so only setting the label is checked.
+	if opts.Label != "" && torrentId != "" {
+		_ = c.call(client, cookies, 3, "label.add", []any{opts.Label}, nil)
+		if err = c.call(client, cookies, 4, "label.set_torrent", []any{torrentId, opts.Label}, nil); err != nil {
+			return fmt.Errorf("deluge set label failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// call calls a method of the Deluge JSON-RPC API and decodes its result into
+// result, unless it is nil.
+func (c *DelugeClient) call(client *http.Client, cookies []*http.Cookie, id int, method string, params []any, result any) error {
+	body, _ := json.Marshal(map[string]any{
+		"id":     id,
+		"method": method,
+		"params": params,
+	})
+	req, err := http.NewRequest("POST", c.URL, bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
@@ -160,16 +245,30 @@ func (c *DelugeClient) AddMagnet(magnet string) error {
 		req.AddCookie(cookie)
 	}
 
-	resp, err = client.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("deluge add magnet failed with status %d", resp.StatusCode)
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var res struct {
+		Result json.RawMessage
+		Error  *struct {
+			Message string
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return errors.New(res.Error.Message)
+	}
+	if result != nil && len(res.Result) > 0 {
+		return json.Unmarshal(res.Result, result)
 	}
-
 	return nil
 }
 
@@ -179,15 +278,15 @@ type QBittorrentClient struct {
 	Pass string
 }
 
-func (c *QBittorrentClient) AddMagnet(magnet string) error {
+func (c *QBittorrentClient) AddMagnet(magnet string, opts Options) error {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
 	// 1. Login
 	loginURL := fmt.Sprintf("%s/api/v2/auth/login", c.URL)
-	loginData := fmt.Sprintf("username=%s&password=%s", c.User, c.Pass)
-	resp, err := client.Post(loginURL, "application/x-www-form-urlencoded", bytes.NewBufferString(loginData))
+	loginData := url.Values{"username": {c.User}, "password": {c.Pass}}
+	resp, err := client.PostForm(loginURL, loginData)
 	if err != nil {
 		return err
 	}
@@ -206,8 +305,14 @@ func (c *QBittorrentClient) AddMagnet(magnet string) error {
 
 	// 2. Add magnet
 	addURL := fmt.Sprintf("%s/api/v2/torrents/add", c.URL)
-	addData := fmt.Sprintf("urls=%s", magnet)
-	req, err := http.NewRequest("POST", addURL, bytes.NewBufferString(addData))
+	addData := url.Values{"urls": {magnet}}
+	if opts.SavePath != "" {
+		addData.Set("savepath", opts.SavePath)
+	}
+	if opts.Label != "" {
+		addData.Set("category", opts.Label)
+	}
+	req, err := http.NewRequest("POST", addURL, strings.NewReader(addData.Encode()))
 	if err != nil {
 		return err
 	}
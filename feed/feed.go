@@ -0,0 +1,217 @@
+package feed
+
+import (
+	"crypto/subtle"
+	"dhtc/db"
+	"dhtc/downloader"
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	FormatRSS  = "rss"
+	FormatAtom = "atom"
+
+	DefaultLimit = 50
+	MaxLimit     = 200
+
+	torrentType = "application/x-bittorrent"
+)
+
+// Options describe a feed of search results.
+type Options struct {
+	Format string
+	Title  string
+	// Link is the URL of the feed itself.
+	Link string
+	// TorrentURL is a URL template of .torrent files, where "{infohash}" is
+	// replaced by the info hash. Items link to magnets if it is empty.
+	TorrentURL string
+}
+
+// Item is a torrent in a feed.
+type Item struct {
+	Title      string
+	InfoHash   string
+	Link       string
+	Size       uint64
+	Discovered time.Time
+	Categories []string
+}
+
+func ValidFormat(format string) bool {
+	return format == FormatRSS || format == FormatAtom
+}
+
+func ContentType(format string) string {
+	if format == FormatAtom {
+		return "application/atom+xml; charset=utf-8"
+	}
+	return "application/rss+xml; charset=utf-8"
+}
+
+// Authorized compares the token of a feed request with the token of the feed.
+func Authorized(got string, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Read returns the newest results of a saved search, up to limit.
+func Read(database db.Repository, s db.SavedSearch, limit int) ([]db.MetaData, error) {
+	if limit < 1 || limit > MaxLimit {
+		limit = DefaultLimit
+	}
+	filters := s.Filters
+	filters.Sort, filters.SortAscending = db.SortDiscovered, false
+	results, _, err := database.Search(s.Key, s.MatchType, s.SearchInput, limit, 0, filters)
+	return results, err
+}
+
+// Items converts search results to feed items.
+func Items(results []db.MetaData, torrentURL string) []Item {
+	items := make([]Item, len(results))
+	for i, md := range results {
+		discovered, _ := time.Parse(time.RFC822, md.DiscoveredOn)
+		link := downloader.MagnetLink(md.InfoHash, md.Name)
+		if torrentURL != "" {
+			link = strings.ReplaceAll(torrentURL, "{infohash}", strings.ToUpper(md.InfoHash))
+		}
+		items[i] = Item{
+			Title:      md.Name,
+			InfoHash:   md.InfoHash,
+			Link:       link,
+			Size:       md.TotalSize,
+			Discovered: discovered,
+		}
+		for _, c := range md.Categories {
+			if c != "" {
+				items[i].Categories = append(items[i].Categories, c)
+			}
+		}
+	}
+	return items
+}
+
+// Write writes items as RSS 2.0 or Atom feed.
+func Write(w io.Writer, items []Item, opts Options) error {
+	var v any
+	if opts.Format == FormatAtom {
+		v = newAtomFeed(items, opts)
+	} else {
+		v = newRSS(items, opts)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title      string       `xml:"title"`
+	Link       string       `xml:"link"`
+	GUID       rssGUID      `xml:"guid"`
+	PubDate    string       `xml:"pubDate"`
+	Categories []string     `xml:"category"`
+	Enclosure  rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length uint64 `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func newRSS(items []Item, opts Options) rss {
+	channel := rssChannel{
+		Title:         opts.Title,
+		Link:          opts.Link,
+		Description:   "dhtc search: " + opts.Title,
+		LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+	}
+	for _, item := range items {
+		channel.Items = append(channel.Items, rssItem{
+			Title:      item.Title,
+			Link:       item.Link,
+			GUID:       rssGUID{Value: item.InfoHash},
+			PubDate:    item.Discovered.UTC().Format(time.RFC1123Z),
+			Categories: item.Categories,
+			Enclosure:  rssEnclosure{URL: item.Link, Length: item.Size, Type: torrentType},
+		})
+	}
+	return rss{Version: "2.0", Channel: channel}
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length uint64 `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func newAtomFeed(items []Item, opts Options) atomFeed {
+	feed := atomFeed{
+		Title:   opts.Title,
+		ID:      opts.Link,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: opts.Link, Rel: "self"}},
+	}
+	for _, item := range items {
+		entry := atomEntry{
+			Title:   item.Title,
+			ID:      "urn:btih:" + item.InfoHash,
+			Updated: item.Discovered.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: item.Link},
+				{Href: item.Link, Rel: "enclosure", Type: torrentType, Length: item.Size},
+			},
+		}
+		for _, c := range item.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: c})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
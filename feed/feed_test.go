@@ -0,0 +1,72 @@
+package feed
+
+import (
+	"bytes"
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	for _, dbType := range []string{"clover", "sqlite"} {
+		repo := dbtest.NewRepository(t, dbType)
+
+		for i, size := range []uint64{10 << 20, 2 << 30, 3 << 30} {
+			repo.InsertMetadata(dhtcclient.Metadata{
+				InfoHash: []byte{byte(i)}, Name: "linux", TotalSize: size, DiscoveredOn: int64(i + 1),
+				Files: []dhtcclient.File{{Path: "linux.iso", Size: int64(size)}},
+			})
+		}
+		s, _ := db.NewSavedSearch("linux", "Name", "contains", "linux", db.SearchFilters{MinSize: 1 << 30, Sort: db.SortSize})
+		results, err := Read(repo, s, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].InfoHash != "02" || results[1].InfoHash != "01" {
+			t.Errorf("%s: expected the large torrents, newest first, got %+v", dbType, results)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	results := []db.MetaData{{Name: "linux & more", InfoHash: "ab", TotalSize: 42, DiscoveredOn: "02 Jan 26 15:04 UTC", Categories: []string{"Software", ""}}}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, Items(results, ""), Options{Format: FormatRSS, Title: "linux", Link: "http://dhtc/feeds/1"}); err != nil {
+		t.Fatal(err)
+	}
+	var channel rss
+	if err := xml.Unmarshal(buf.Bytes(), &channel); err != nil {
+		t.Fatal(err)
+	}
+	item := channel.Channel.Items[0]
+	if item.Title != "linux & more" || item.Link != "magnet:?xt=urn:btih:ab&dn=linux+%26+more" || item.GUID.Value != "ab" ||
+		item.PubDate != "Fri, 02 Jan 2026 15:04:00 +0000" || len(item.Categories) != 1 || item.Enclosure.Length != 42 {
+		t.Errorf("unexpected RSS item %+v", item)
+	}
+
+	buf.Reset()
+	if err := Write(&buf, Items(results, "https://cache/{infohash}.torrent"), Options{Format: FormatAtom, Title: "linux"}); err != nil {
+		t.Fatal(err)
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(buf.Bytes(), &atom); err != nil {
+		t.Fatal(err)
+	}
+	entry := atom.Entries[0]
+	if entry.ID != "urn:btih:ab" || entry.Links[0].Href != "https://cache/AB.torrent" || entry.Updated != "2026-01-02T15:04:00Z" {
+		t.Errorf("unexpected Atom entry %+v", entry)
+	}
+	if !strings.Contains(buf.String(), `xmlns="http://www.w3.org/2005/Atom"`) {
+		t.Errorf("expected an Atom namespace, got %s", buf.String())
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	if !Authorized("secret", "secret") || Authorized("wrong", "secret") || Authorized("", "") {
+		t.Error("expected only the feed token to be accepted")
+	}
+}
@@ -0,0 +1,44 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// AppriseNotifier posts events to the API of an Apprise server, which
+// forwards them to the services of a configuration key or of the tag.
+type AppriseNotifier struct {
+	// URL is the notify endpoint, e.g. http://localhost:8000/notify/dhtc.
+	URL       string
+	Tag       string
+	Templates *Templates
+}
+
+func (n *AppriseNotifier) Notify(event Event) error {
+	text, err := n.Templates.Render(Apprise, event)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"title":  "dhtc",
+		"body":   text,
+		"type":   "info",
+		"format": "text",
+	}
+	if event.InfoHash != "" {
+		payload["title"] = event.Name
+	}
+	if n.Tag != "" {
+		payload["tag"] = n.Tag
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := httpClient.Post(n.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return statusError("apprise", resp)
+	}
+	return nil
+}
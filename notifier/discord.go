@@ -3,29 +3,58 @@ package notifier
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"net/http"
+	"strconv"
+	"strings"
 )
 
 type DiscordNotifier struct {
 	WebhookURL string
+	Templates  *Templates
 }
 
-func (n *DiscordNotifier) Notify(message string) error {
+func (n *DiscordNotifier) Notify(event Event) error {
 	if n.WebhookURL == "" {
 		return nil
 	}
-	payload := map[string]string{
-		"content": message,
+	text, err := n.Templates.Render(Discord, event)
+	if err != nil {
+		return err
+	}
+	payload := map[string]any{
+		"content": truncate(text, 2000),
+	}
+	if event.InfoHash != "" {
+		fields := []map[string]any{
+			{"name": "Size", "value": formatSize(event.Size), "inline": true},
+			{"name": "Files", "value": strconv.Itoa(event.Files), "inline": true},
+		}
+		if len(event.Categories) > 0 {
+			fields = append(fields, map[string]any{"name": "Categories", "value": strings.Join(event.Categories, ", "), "inline": true})
+		}
+		if event.Watch != "" {
+			fields = append(fields, map[string]any{"name": "Watch", "value": event.Watch})
+		}
+		fields = append(fields, map[string]any{"name": "Magnet", "value": "`" + event.Magnet + "`"})
+		embed := map[string]any{
+			"title":       truncate(event.Name, 256),
+			"description": text,
+			"color":       0x570df8,
+			"fields":      fields,
+			"footer":      map[string]string{"text": event.InfoHash},
+		}
+		if event.URL != "" {
+			embed["url"] = event.URL
+		}
+		payload = map[string]any{"embeds": []any{embed}}
 	}
 	body, _ := json.Marshal(payload)
-	resp, err := http.Post(n.WebhookURL, "application/json", bytes.NewBuffer(body))
+	resp, err := httpClient.Post(n.WebhookURL, "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("discord returned status %d", resp.StatusCode)
+		return statusError("discord", resp)
 	}
 	return nil
 }
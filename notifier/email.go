@@ -0,0 +1,92 @@
+package notifier
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailNotifier sends events as plain text mails. The connection is upgraded
+// with STARTTLS if the server supports it.
+type EmailNotifier struct {
+	// Addr is the host and port of the SMTP server.
+	Addr      string
+	User      string
+	Pass      string
+	From      string
+	To        []string
+	Templates *Templates
+}
+
+func (n *EmailNotifier) Notify(event Event) error {
+	text, err := n.Templates.Render(Email, event)
+	if err != nil {
+		return err
+	}
+	subject := event.Title
+	if event.InfoHash != "" {
+		subject = "dhtc: " + event.Name
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(text)
+
+	return n.send(msg.Bytes())
+}
+
+// send sends msg like smtp.SendMail, but with a timeout.
+func (n *EmailNotifier) send(msg []byte) error {
+	conn, err := net.DialTimeout("tcp", n.Addr, httpClient.Timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(httpClient.Timeout))
+	host, _, _ := net.SplitHostPort(n.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", n.User, n.Pass, host)); err != nil {
+			return &PermanentError{Err: err}
+		}
+	}
+	if err = c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
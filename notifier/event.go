@@ -0,0 +1,140 @@
+package notifier
+
+import (
+	"bytes"
+	_ "embed"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/leekchan/gtf"
+)
+
+// Event is the subject of a notification. Events without an info hash are
+// plain messages, which only have a title.
+type Event struct {
+	// Title summarises the event, e.g. "Match found: ...".
+	Title string `json:"title"`
+	// Message holds further details, like the result of a download.
+	Message string `json:"message,omitempty"`
+	// Type and Severity are matched by the filters of notifiers.
+	Type     string `json:"type,omitempty"`
+	Severity string `json:"severity,omitempty"`
+
+	Name       string   `json:"name,omitempty"`
+	InfoHash   string   `json:"infoHash,omitempty"`
+	Size       uint64   `json:"size,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	Files      int      `json:"files,omitempty"`
+	// Watch describes the watch which matched the torrent.
+	Watch  string `json:"watch,omitempty"`
+	Magnet string `json:"magnet,omitempty"`
+	// URL links to the details of the torrent in the web interface, if the
+	// public URL of dhtc is configured.
+	URL string `json:"url,omitempty"`
+
+	// Digest summarises the matches of watches since the last digest.
+	Digest []DigestEntry `json:"digest,omitempty"`
+}
+
+// DigestEntry summarises the matches of one watch in a digest.
+type DigestEntry struct {
+	Watch string `json:"watch"`
+	Count int    `json:"count"`
+	// Items are the latest matches, More counts the others.
+	Items []DigestItem `json:"items"`
+	More  int          `json:"more,omitempty"`
+	// URL links to a search for the matches, if the watch can be searched
+	// and the public URL is configured.
+	URL string `json:"url,omitempty"`
+}
+
+type DigestItem struct {
+	Name     string `json:"name"`
+	InfoHash string `json:"infoHash"`
+	Magnet   string `json:"magnet"`
+	URL      string `json:"url,omitempty"`
+}
+
+//go:embed default.tmpl
+var defaultTemplateText string
+
+// Templates render the text of events. The template named after a notifier is
+// used for it, the "text" template otherwise.
+type Templates struct {
+	tpl *template.Template
+}
+
+var defaultTemplates = mustParseTemplates("")
+
+func newTemplate() *template.Template {
+	return template.New("notifier").Funcs(gtf.GtfTextFuncMap).Funcs(template.FuncMap{
+		"mrkdwn": mrkdwnEscaper.Replace,
+	})
+}
+
+func mustParseTemplates(text string) *Templates {
+	t, err := parseTemplates(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// parseTemplates parses text after the default templates, so that it can
+// redefine them.
+func parseTemplates(text string) (*Templates, error) {
+	tpl, err := newTemplate().Parse(defaultTemplateText)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tpl.Parse(text); err != nil {
+		return nil, err
+	}
+	return &Templates{tpl: tpl}, nil
+}
+
+// LoadTemplates reads templates overriding the default ones from path. The
+// default templates are returned if path is empty.
+func LoadTemplates(path string) (*Templates, error) {
+	if path == "" {
+		return defaultTemplates, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTemplates(string(b))
+}
+
+// Render returns the text of event for the notifier with name.
+func (t *Templates) Render(name string, event Event) (string, error) {
+	if t == nil {
+		t = defaultTemplates
+	}
+	tpl := t.tpl.Lookup(name)
+	if tpl == nil {
+		tpl = t.tpl.Lookup("text")
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// mrkdwnEscaper escapes the control characters of Slack messages.
+var mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// formatSize formats size like the filesizeformat template function.
+func formatSize(size uint64) string {
+	return gtf.GtfTextFuncMap["filesizeformat"].(func(any) string)(size)
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,183 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testEvent = Event{
+	Title:      "Match found: 'Big <Buck> Bunny'",
+	Message:    "Sent to aria2.",
+	Name:       "Big <Buck> Bunny",
+	InfoHash:   "0123456789abcdef0123456789abcdef01234567",
+	Size:       2 << 30,
+	Categories: []string{"video"},
+	Files:      3,
+	Watch:      "Name contains 'bunny'",
+	Magnet:     "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=Big",
+	URL:        "https://dhtc.example.org/torrent/0123456789abcdef0123456789abcdef01234567",
+}
+
+func TestTemplates_Render(t *testing.T) {
+	text, err := defaultTemplates.Render(Gotify, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{testEvent.Title, "2 GB", "files: 3", "categories: video", testEvent.Magnet, testEvent.Message} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected text to contain %q, got %q", want, text)
+		}
+	}
+
+	text, err = defaultTemplates.Render(Telegram, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(text, "<b>Match found: &#39;Big &lt;Buck&gt; Bunny&#39;</b>") {
+		t.Errorf("expected escaped HTML, got %q", text)
+	}
+
+	text, err = defaultTemplates.Render(Slack, Event{Title: "plain"})
+	if err != nil || text != "plain" {
+		t.Errorf("expected plain message, got %q (%v)", text, err)
+	}
+}
+
+func TestTemplates_RenderDigest(t *testing.T) {
+	event := Event{
+		Title: "Digest: 7 matches of 2 watches",
+		Digest: []DigestEntry{
+			{Watch: "Name contains 'bunny'", Count: 6, Items: []DigestItem{{Name: "Big <Buck> Bunny", URL: "https://dhtc.example.org/torrent/01"}}, More: 5, URL: "https://dhtc.example.org/search?search-input=bunny"},
+			{Watch: "rules only", Count: 1, Items: []DigestItem{{Name: "Sintel"}}},
+		},
+	}
+	text, err := defaultTemplates.Render(Gotify, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Digest: 7 matches of 2 watches
+
+Name contains 'bunny': 6 matches
+- Big <Buck> Bunny https://dhtc.example.org/torrent/01
+and 5 more
+All matches: https://dhtc.example.org/search?search-input=bunny
+
+rules only: 1 matches
+- Sintel`
+	if text != want {
+		t.Errorf("expected %q, got %q", want, text)
+	}
+
+	for _, name := range []string{Discord, Slack, Telegram, Matrix} {
+		text, err = defaultTemplates.Render(name, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, "Sintel") || !strings.Contains(text, "and 5 more") || strings.Contains(text, "<Buck>") && name != Discord {
+			t.Errorf("%s: unexpected digest %q", name, text)
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.tmpl")
+	custom := `{{ define "text" }}{{ .Name }} ({{ .Files }}){{ end }}{{ define "discord" }}**{{ .Name }}**{{ end }}`
+	if err := os.WriteFile(path, []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		Gotify:  "Big <Buck> Bunny (3)",
+		Discord: "**Big <Buck> Bunny**",
+	}
+	for name, want := range cases {
+		if text, err := templates.Render(name, testEvent); err != nil || text != want {
+			t.Errorf("%s: expected %q, got %q (%v)", name, want, text, err)
+		}
+	}
+	if text, _ := templates.Render(Telegram, testEvent); !strings.HasPrefix(text, "<b>") {
+		t.Errorf("expected the default telegram template, got %q", text)
+	}
+
+	if err = os.WriteFile(path, []byte(`{{ define "text" }}{{ .Unknown`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadTemplates(path); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+func TestDiscordNotifier_Embed(t *testing.T) {
+	var payload struct {
+		Content string
+		Embeds  []struct {
+			Title       string
+			URL         string
+			Description string
+			Fields      []struct{ Name, Value string }
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payload.Embeds = nil
+		_ = json.Unmarshal(body, &payload)
+	}))
+	defer srv.Close()
+
+	n := &DiscordNotifier{WebhookURL: srv.URL}
+	if err := n.Notify(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Embeds) != 1 {
+		t.Fatalf("expected one embed, got %+v", payload)
+	}
+	embed := payload.Embeds[0]
+	if embed.Title != testEvent.Name || embed.URL != testEvent.URL || !strings.Contains(embed.Description, "Sent to aria2.") {
+		t.Errorf("unexpected embed %+v", embed)
+	}
+	if len(embed.Fields) != 5 || embed.Fields[0].Value != "2 GB" {
+		t.Errorf("unexpected fields %+v", embed.Fields)
+	}
+
+	if err := n.Notify(Event{Title: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Content != "plain" || len(payload.Embeds) != 0 {
+		t.Errorf("expected a plain message, got %+v", payload)
+	}
+}
+
+func TestSlackNotifier_Blocks(t *testing.T) {
+	var payload struct {
+		Text   string
+		Blocks []map[string]any
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer srv.Close()
+
+	if err := (&SlackNotifier{WebhookURL: srv.URL}).Notify(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload.Text, "Big &lt;Buck&gt; Bunny") {
+		t.Errorf("expected escaped text, got %q", payload.Text)
+	}
+	var types []string
+	for _, b := range payload.Blocks {
+		types = append(types, b["type"].(string))
+	}
+	if strings.Join(types, ",") != "section,section,actions,context" {
+		t.Errorf("unexpected blocks %v", types)
+	}
+}
@@ -0,0 +1,86 @@
+package notifier
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Types of events, which notifiers can be limited to.
+const (
+	EventWatch    = "watch"
+	EventCrawler  = "crawler"
+	EventDatabase = "database"
+	EventTest     = "test"
+)
+
+// EventTypes are the types of events a filter can select.
+var EventTypes = []string{EventWatch, EventCrawler, EventDatabase}
+
+// Severities of events, in ascending order. Events without severity are
+// informational.
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+var severities = []string{SeverityInfo, SeverityWarning, SeverityError}
+
+// Filter selects the events sent to a notifier. The zero value selects all
+// events.
+type Filter struct {
+	MinSeverity string
+	Types       []string
+	// Digest combines the events into one message at most once per interval,
+	// instead of sending every event on its own.
+	Digest time.Duration
+}
+
+// Match reports whether the event passes the filter.
+func (f Filter) Match(event Event) bool {
+	if severityLevel(event.Severity) < severityLevel(f.MinSeverity) {
+		return false
+	}
+	return len(f.Types) == 0 || slices.Contains(f.Types, event.Type)
+}
+
+func severityLevel(severity string) int {
+	return max(slices.Index(severities, severity), 0)
+}
+
+// ParseFilters parses the filters of notifiers, one per line or separated by
+// spaces, like "discord?min-severity=warning", "phone?events=watch,crawler" or
+// "mail?digest=1h".
+func ParseFilters(value string) (map[string]Filter, error) {
+	filters := make(map[string]Filter)
+	for _, field := range strings.Fields(value) {
+		name, rawQuery, _ := strings.Cut(field, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter of %s: %w", name, err)
+		}
+		var f Filter
+		if f.MinSeverity = query.Get("min-severity"); f.MinSeverity != "" && !slices.Contains(severities, f.MinSeverity) {
+			return nil, fmt.Errorf("unknown severity '%s' in filter of %s", f.MinSeverity, name)
+		}
+		for _, t := range strings.Split(query.Get("events"), ",") {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			if !slices.Contains(EventTypes, t) {
+				return nil, fmt.Errorf("unknown event type '%s' in filter of %s", t, name)
+			}
+			f.Types = append(f.Types, t)
+		}
+		if digest := query.Get("digest"); digest != "" {
+			if f.Digest, err = time.ParseDuration(digest); err != nil || f.Digest <= 0 {
+				return nil, fmt.Errorf("invalid digest interval '%s' in filter of %s", digest, name)
+			}
+		}
+		filters[name] = f
+	}
+	return filters, nil
+}
@@ -0,0 +1,53 @@
+package notifier
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilters(t *testing.T) {
+	filters, err := ParseFilters("discord?min-severity=warning\nphone?events=watch,crawler slack mail?digest=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Filter{
+		"discord": {MinSeverity: SeverityWarning},
+		"phone":   {Types: []string{EventWatch, EventCrawler}},
+		"slack":   {},
+		"mail":    {Digest: time.Hour},
+	}
+	if !reflect.DeepEqual(filters, want) {
+		t.Errorf("expected %+v, got %+v", want, filters)
+	}
+
+	for _, invalid := range []string{"discord?min-severity=loud", "discord?events=watch,disk", "mail?digest=soon", "mail?digest=-1h"} {
+		if _, err = ParseFilters(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	hit := Event{Type: EventWatch, Severity: SeverityInfo}
+	down := Event{Type: EventCrawler, Severity: SeverityError}
+	plain := Event{Title: "hello"}
+	cases := []struct {
+		filter Filter
+		event  Event
+		want   bool
+	}{
+		{Filter{}, plain, true},
+		{Filter{MinSeverity: SeverityWarning}, hit, false},
+		{Filter{MinSeverity: SeverityWarning}, down, true},
+		{Filter{MinSeverity: SeverityWarning}, plain, false},
+		{Filter{Types: []string{EventWatch}}, hit, true},
+		{Filter{Types: []string{EventWatch}}, down, false},
+		{Filter{MinSeverity: SeverityError, Types: []string{EventCrawler, EventDatabase}}, down, true},
+	}
+	for i, c := range cases {
+		if got := c.filter.Match(c.event); got != c.want {
+			t.Errorf("case %d: expected %v, got %v", i, c.want, got)
+		}
+	}
+}
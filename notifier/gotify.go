@@ -4,32 +4,49 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 )
 
 type GotifyNotifier struct {
-	URL   string
-	Token string
+	URL       string
+	Token     string
+	Templates *Templates
 }
 
-func (n *GotifyNotifier) Notify(message string) error {
+func (n *GotifyNotifier) Notify(event Event) error {
 	if n.URL == "" || n.Token == "" {
 		return nil
 	}
+	text, err := n.Templates.Render(Gotify, event)
+	if err != nil {
+		return err
+	}
 	url := fmt.Sprintf("%s/message?token=%s", n.URL, n.Token)
 	payload := map[string]any{
-		"message":  message,
+		"message":  text,
 		"priority": 5,
 		"title":    "dhtc",
 	}
+	if event.InfoHash != "" {
+		// Opening the notification opens the details of the torrent, or its
+		// magnet link without a public URL.
+		click := event.URL
+		if click == "" {
+			click = event.Magnet
+		}
+		payload["title"] = event.Name
+		payload["extras"] = map[string]any{
+			"client::display":      map[string]string{"contentType": "text/plain"},
+			"client::notification": map[string]any{"click": map[string]string{"url": click}},
+		}
+	}
 	body, _ := json.Marshal(payload)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	resp, err := httpClient.Post(url, "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("gotify returned status %d", resp.StatusCode)
+		return statusError("gotify", resp)
 	}
 	return nil
 }
@@ -0,0 +1,58 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// MatrixNotifier sends events to a room with the client-server API.
+type MatrixNotifier struct {
+	Homeserver string
+	Room       string
+	// Token is the access token of the user sending the events, who has to
+	// be a member of the room.
+	Token     string
+	Templates *Templates
+}
+
+// matrixTxn makes the transaction ids of the messages unique.
+var matrixTxn atomic.Int64
+
+func (n *MatrixNotifier) Notify(event Event) error {
+	text, err := n.Templates.Render("text", event)
+	if err != nil {
+		return err
+	}
+	html, err := n.Templates.Render(Matrix, event)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"msgtype":        "m.text",
+		"body":           text,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": html,
+	})
+	txn := fmt.Sprintf("dhtc-%d-%d", time.Now().UnixNano(), matrixTxn.Add(1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", n.Homeserver, url.PathEscape(n.Room), txn)
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.Token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return statusError("matrix", resp)
+	}
+	return nil
+}
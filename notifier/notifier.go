@@ -2,63 +2,337 @@ package notifier
 
 import (
 	"dhtc/config"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of notifiers. The notifiers configured by flags are named after their
+// kind, the ones configured by URLs can have other names.
+const (
+	Telegram = "telegram"
+	Discord  = "discord"
+	Slack    = "slack"
+	Gotify   = "gotify"
+	Webhook  = "webhook"
+	Ntfy     = "ntfy"
+	Matrix   = "matrix"
+	Email    = "smtp"
+	Apprise  = "apprise"
 )
 
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// alertInterval is the min. time between two equal alerts.
+var alertInterval = 15 * time.Minute
+
+var ErrUnknownNotifier = errors.New("unknown notifier")
+
 type Notifier interface {
-	Notify(message string) error
+	Notify(event Event) error
 }
 
+type namedNotifier struct {
+	name   string
+	filter Filter
+	Notifier
+}
+
+// accepts reports whether event is sent to the notifier, if it is one of the
+// notifiers with the given names or names is empty.
+func (n namedNotifier) accepts(names []string, event Event) bool {
+	return (len(names) == 0 || slices.Contains(names, n.name)) && n.filter.Match(event)
+}
+
+// Manager queues notifications and delivers them in the background, with a
+// worker for every notifier.
 type Manager struct {
-	notifiers []Notifier
+	outbox   Outbox
+	interval time.Duration
+
+	notifiers []namedNotifier
+	workers   map[string]*worker
 	mu        sync.RWMutex
+	// setupMu serializes Setup and Close.
+	setupMu sync.Mutex
+
+	onResult func(ref string, d Delivery)
+	resultMu sync.RWMutex
+
+	// alerts holds the time every alert was sent last.
+	alerts  map[string]time.Time
+	alertMu sync.Mutex
 }
 
+// Delivery is the result of sending a message to one notifier. Error is empty
+// if the message was sent, Pending is set while it is queued.
+type Delivery struct {
+	Notifier string
+	Error    string `json:",omitempty"`
+	Pending  bool   `json:",omitempty"`
+}
+
+// Notify queues a plain message for all notifiers.
 func (m *Manager) Notify(message string) {
+	m.Enqueue(nil, Event{Title: message}, "")
+}
+
+// Alert queues a message about a problem of dhtc for all notifiers whose
+// filters accept it. Equal alerts are sent at most once per alertInterval.
+func (m *Manager) Alert(eventType string, severity string, message string) {
+	key := eventType + "\x00" + message
+	now := time.Now()
+	m.alertMu.Lock()
+	if last, ok := m.alerts[key]; ok && now.Sub(last) < alertInterval {
+		m.alertMu.Unlock()
+		return
+	}
+	m.alerts[key] = now
+	m.alertMu.Unlock()
+	m.Enqueue(nil, Event{Title: message, Type: eventType, Severity: severity}, "")
+}
+
+// Pending returns the pending deliveries of event for the notifiers with the
+// given names, or all notifiers if names is empty, whose filters accept it.
+func (m *Manager) Pending(names []string, event Event) []Delivery {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deliveries []Delivery
+	for _, n := range m.notifiers {
+		if n.accepts(names, event) {
+			deliveries = append(deliveries, Delivery{Notifier: n.name, Pending: true})
+		}
+	}
+	return deliveries
+}
+
+// Enqueue queues event for the notifiers with the given names, or all
+// notifiers if names is empty, whose filters accept it. The result of every delivery is passed to the
+// result handler with ref.
+func (m *Manager) Enqueue(names []string, event Event, ref string) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	now := time.Now()
 	for _, n := range m.notifiers {
-		_ = n.Notify(message)
+		if !n.accepts(names, event) {
+			continue
+		}
+		item := OutboxItem{Notifier: n.name, Event: event, Ref: ref, Created: now.Unix(), NextAttempt: now.UnixMilli()}
+		var err error
+		if item.Id, err = m.outbox.InsertOutboxItem(item); err != nil {
+			log.Error().Err(err).Msgf("could not store notification to %s, it is lost on restart", n.name)
+		}
+		m.workers[n.name].add(item)
+	}
+}
+
+// OnResult sets the handler of the final results of deliveries.
+func (m *Manager) OnResult(fn func(ref string, d Delivery)) {
+	m.resultMu.Lock()
+	defer m.resultMu.Unlock()
+	m.onResult = fn
+}
+
+func (m *Manager) report(ref string, d Delivery) {
+	m.resultMu.RLock()
+	defer m.resultMu.RUnlock()
+	if m.onResult != nil {
+		m.onResult(ref, d)
+	}
+}
+
+// Health returns the delivery status of every notifier.
+func (m *Manager) Health() []Health {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make([]Health, len(m.notifiers))
+	for i, n := range m.notifiers {
+		res[i] = m.workers[n.name].getHealth()
+	}
+	return res
+}
+
+// Test sends a test notification to the notifier with name right away,
+// bypassing its queue and filter, and returns the error of the delivery.
+func (m *Manager) Test(name string) error {
+	m.mu.RLock()
+	i := slices.IndexFunc(m.notifiers, func(n namedNotifier) bool { return n.name == name })
+	if i < 0 {
+		m.mu.RUnlock()
+		return ErrUnknownNotifier
 	}
+	n, w := m.notifiers[i], m.workers[name]
+	m.mu.RUnlock()
+
+	err := n.Notify(Event{Title: "Test notification from dhtc", Type: EventTest, Severity: SeverityInfo})
+	w.record(err)
+	return err
 }
 
+// Names returns the names of the configured notifiers.
+func (m *Manager) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, len(m.notifiers))
+	for i, n := range m.notifiers {
+		names[i] = n.name
+	}
+	return names
+}
+
+// Setup replaces the notifiers by the ones configured in cfg. Their queued
+// notifications are read from the outbox.
 func (m *Manager) Setup(cfg *config.Configuration) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.notifiers = nil
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+	var notifiers []namedNotifier
+
+	filters, err := ParseFilters(cfg.NotifyFilters)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse the notification filters, sending all events")
+	}
+
+	templates, err := LoadTemplates(cfg.NotifyTemplates)
+	if err != nil {
+		log.Error().Err(err).Msg("could not load notification templates, using the default ones")
+		templates = defaultTemplates
+	}
 
 	if cfg.TelegramToken != "" {
 		bot := SetupTelegramBot(cfg)
 		if bot != nil {
-			m.notifiers = append(m.notifiers, &TelegramNotifier{
-				config: cfg,
-				bot:    bot,
-			})
+			notifiers = append(notifiers, namedNotifier{name: Telegram, Notifier: &TelegramNotifier{
+				config:    cfg,
+				bot:       bot,
+				templates: templates,
+			}})
 		}
 	}
 
 	if cfg.DiscordWebhook != "" {
-		m.notifiers = append(m.notifiers, &DiscordNotifier{
+		notifiers = append(notifiers, namedNotifier{name: Discord, Notifier: &DiscordNotifier{
 			WebhookURL: cfg.DiscordWebhook,
-		})
+			Templates:  templates,
+		}})
 	}
 
 	if cfg.SlackWebhook != "" {
-		m.notifiers = append(m.notifiers, &SlackNotifier{
+		notifiers = append(notifiers, namedNotifier{name: Slack, Notifier: &SlackNotifier{
 			WebhookURL: cfg.SlackWebhook,
-		})
+			Templates:  templates,
+		}})
 	}
 
 	if cfg.GotifyURL != "" && cfg.GotifyToken != "" {
-		m.notifiers = append(m.notifiers, &GotifyNotifier{
-			URL:   cfg.GotifyURL,
-			Token: cfg.GotifyToken,
-		})
+		notifiers = append(notifiers, namedNotifier{name: Gotify, Notifier: &GotifyNotifier{
+			URL:       cfg.GotifyURL,
+			Token:     cfg.GotifyToken,
+			Templates: templates,
+		}})
+	}
+
+	for _, raw := range strings.Fields(cfg.NotifierURLs) {
+		name, n, err := ParseURL(raw, templates)
+		if err != nil {
+			log.Error().Err(err).Msg("skipping notifier")
+			continue
+		}
+		notifiers = append(notifiers, namedNotifier{name: uniqueName(notifiers, name), Notifier: n})
+	}
+	for i, n := range notifiers {
+		notifiers[i].filter = filters[n.name]
+	}
+	for name := range filters {
+		if !slices.ContainsFunc(notifiers, func(n namedNotifier) bool { return n.name == name }) {
+			log.Warn().Msgf("filter of unknown notifier '%s'", name)
+		}
+	}
+
+	// The old workers are stopped without holding the lock, notifications
+	// queued meanwhile wait in the new workers until they start.
+	m.mu.Lock()
+	old := m.workers
+	m.notifiers = notifiers
+	if cfg.NotifyInterval > 0 {
+		m.interval = cfg.NotifyInterval
 	}
+	m.workers = m.newWorkers()
+	m.mu.Unlock()
+	stopWorkers(old)
+	m.start()
 }
 
-func SetupNotifiers(cfg *config.Configuration) *Manager {
-	m := &Manager{}
-	m.Setup(cfg)
-	return m
+// newWorkers returns a worker for every notifier. The caller holds the lock.
+func (m *Manager) newWorkers() map[string]*worker {
+	workers := make(map[string]*worker, len(m.notifiers))
+	for _, n := range m.notifiers {
+		workers[n.name] = newWorker(n, m.outbox, m.interval, m.report)
+	}
+	return workers
+}
+
+// start queues the items of the outbox and starts the workers. The caller
+// holds setupMu, the workers of the last setup are stopped already.
+func (m *Manager) start() {
+	items, err := m.outbox.GetOutboxItems()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read the notification outbox")
+	}
+	// Notifications of notifiers which are not configured anymore are kept,
+	// in case they are configured again.
+	for _, item := range items {
+		if w, ok := m.workers[item.Notifier]; ok {
+			w.add(item)
+		}
+	}
+	for _, w := range m.workers {
+		go w.run()
+	}
+}
+
+// stopWorkers stops workers and waits for their current deliveries.
+func stopWorkers(workers map[string]*worker) {
+	for _, w := range workers {
+		close(w.stop)
+	}
+	for _, w := range workers {
+		<-w.done
+	}
+}
+
+// Close stops the delivery of notifications. Queued notifications remain in
+// the outbox.
+func (m *Manager) Close() {
+	m.setupMu.Lock()
+	defer m.setupMu.Unlock()
+	m.mu.Lock()
+	workers := m.workers
+	m.workers = nil
+	m.mu.Unlock()
+	stopWorkers(workers)
+}
+
+// uniqueName returns name, or name with a number if one of notifiers has this
+// name already.
+func uniqueName(notifiers []namedNotifier, name string) string {
+	unique := name
+	for i := 2; slices.ContainsFunc(notifiers, func(n namedNotifier) bool { return n.name == unique }); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// NewManager creates a manager without notifiers, which are added by Setup.
+// The outbox may be nil, then queued notifications are lost on restart.
+func NewManager(outbox Outbox) *Manager {
+	if outbox == nil {
+		outbox = newMemoryOutbox()
+	}
+	return &Manager{outbox: outbox, interval: time.Second, alerts: make(map[string]time.Time)}
 }
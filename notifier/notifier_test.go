@@ -1,32 +1,336 @@
 package notifier
 
 import (
+	"dhtc/config"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 type mockNotifier struct {
+	mu       sync.Mutex
 	messages []string
+	// errs are returned by the next calls, one each.
+	errs []error
 }
 
-func (m *mockNotifier) Notify(message string) error {
-	m.messages = append(m.messages, message)
-	return nil
+func (m *mockNotifier) Notify(event Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, event.Title)
+	if len(m.errs) == 0 {
+		return nil
+	}
+	err := m.errs[0]
+	m.errs = m.errs[1:]
+	return err
+}
+
+func (m *mockNotifier) received() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+type result struct {
+	ref string
+	Delivery
+}
+
+// startManager starts a manager with notifiers and returns the channel of its
+// delivery results.
+func startManager(t *testing.T, outbox Outbox, notifiers ...namedNotifier) (*Manager, chan result) {
+	m := NewManager(outbox)
+	m.interval = 0
+	results := make(chan result, 10)
+	m.OnResult(func(ref string, d Delivery) {
+		results <- result{ref, d}
+	})
+	m.notifiers = notifiers
+	m.workers = m.newWorkers()
+	m.start()
+	t.Cleanup(m.Close)
+	return m, results
+}
+
+func waitResult(t *testing.T, results chan result) result {
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery result")
+	}
+	return result{}
 }
 
 func TestManager_Notify(t *testing.T) {
 	n1 := &mockNotifier{}
 	n2 := &mockNotifier{}
-	m := &Manager{
-		notifiers: []Notifier{n1, n2},
-	}
+	m, results := startManager(t, nil, namedNotifier{name: Discord, Notifier: n1}, namedNotifier{name: Slack, Notifier: n2})
 
 	testMsg := "test message"
 	m.Notify(testMsg)
+	waitResult(t, results)
+	waitResult(t, results)
+
+	if msgs := n1.received(); len(msgs) != 1 || msgs[0] != testMsg {
+		t.Errorf("n1 did not receive correct message, got %v", msgs)
+	}
+	if msgs := n2.received(); len(msgs) != 1 || msgs[0] != testMsg {
+		t.Errorf("n2 did not receive correct message, got %v", msgs)
+	}
+}
+
+func TestManager_Enqueue(t *testing.T) {
+	n1 := &mockNotifier{}
+	n2 := &mockNotifier{}
+	m, results := startManager(t, nil, namedNotifier{name: Discord, Notifier: n1}, namedNotifier{name: Slack, Notifier: n2})
+
+	if pending := m.Pending([]string{Slack}, Event{}); len(pending) != 1 || pending[0] != (Delivery{Notifier: Slack, Pending: true}) {
+		t.Errorf("expected a pending delivery to slack, got %v", pending)
+	}
+	m.Enqueue([]string{Slack}, Event{Title: "only slack"}, "hit-1")
+	if r := waitResult(t, results); r != (result{"hit-1", Delivery{Notifier: Slack}}) {
+		t.Errorf("expected a successful delivery to slack, got %v", r)
+	}
+	if msgs := n1.received(); len(msgs) != 0 {
+		t.Errorf("n1 should not receive messages, got %v", msgs)
+	}
+	if msgs := n2.received(); len(msgs) != 1 || msgs[0] != "only slack" {
+		t.Errorf("n2 did not receive correct message, got %v", msgs)
+	}
+	if h := m.Health(); h[1].Delivered != 1 || h[1].Status() != "ok" || h[0].Status() != "unused" {
+		t.Errorf("unexpected health %+v", h)
+	}
+}
+
+func TestManager_Filters(t *testing.T) {
+	errorsOnly := &mockNotifier{}
+	watches := &mockNotifier{}
+	m, results := startManager(t, nil,
+		namedNotifier{name: Discord, filter: Filter{MinSeverity: SeverityError}, Notifier: errorsOnly},
+		namedNotifier{name: Slack, filter: Filter{Types: []string{EventWatch}}, Notifier: watches})
+
+	hit := Event{Title: "match", Type: EventWatch, Severity: SeverityInfo}
+	if pending := m.Pending(nil, hit); len(pending) != 1 || pending[0].Notifier != Slack {
+		t.Errorf("expected a pending delivery to slack only, got %v", pending)
+	}
+	m.Enqueue(nil, hit, "")
+	m.Alert(EventDatabase, SeverityError, "disk full")
+	m.Alert(EventDatabase, SeverityError, "disk full")
+	waitResult(t, results)
+	waitResult(t, results)
+	select {
+	case r := <-results:
+		t.Errorf("expected the second alert to be suppressed, got %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if msgs := errorsOnly.received(); len(msgs) != 1 || msgs[0] != "disk full" {
+		t.Errorf("expected only the alert, got %v", msgs)
+	}
+	if msgs := watches.received(); len(msgs) != 1 || msgs[0] != "match" {
+		t.Errorf("expected only the match, got %v", msgs)
+	}
+}
+
+func TestManager_Test(t *testing.T) {
+	failing := &mockNotifier{errs: []error{errors.New("invalid token")}}
+	m, _ := startManager(t, nil, namedNotifier{name: Gotify, filter: Filter{Types: []string{EventCrawler}}, Notifier: failing})
+
+	if err := m.Test(Gotify); err == nil || err.Error() != "invalid token" {
+		t.Errorf("expected the error of the notifier, got %v", err)
+	}
+	if h := m.Health()[0]; h.Status() != "failing" || h.LastError != "invalid token" {
+		t.Errorf("expected a failing notifier, got %+v", h)
+	}
+	if err := m.Test(Gotify); err != nil {
+		t.Error(err)
+	}
+	if msgs := failing.received(); len(msgs) != 2 {
+		t.Errorf("expected two test notifications despite the filter, got %v", msgs)
+	}
+	if h := m.Health()[0]; h.Status() != "ok" {
+		t.Errorf("expected a working notifier, got %+v", h)
+	}
+	if err := m.Test("pager"); !errors.Is(err, ErrUnknownNotifier) {
+		t.Errorf("expected an unknown notifier, got %v", err)
+	}
+}
+
+func TestManager_Retry(t *testing.T) {
+	defer func(base time.Duration) { retryBase = base }(retryBase)
+	retryBase = time.Millisecond
+
+	flaky := &mockNotifier{errs: []error{
+		errors.New("timeout"),
+		&RetryAfterError{After: 20 * time.Millisecond, Err: errors.New("too many requests")},
+		errors.New("timeout"),
+	}}
+	rejecting := &mockNotifier{errs: []error{&PermanentError{Err: errors.New("forbidden")}}}
+	outbox := newMemoryOutbox()
+	m, results := startManager(t, outbox, namedNotifier{name: Ntfy, Notifier: flaky}, namedNotifier{name: Webhook, Notifier: rejecting})
 
-	if len(n1.messages) != 1 || n1.messages[0] != testMsg {
-		t.Errorf("n1 did not receive correct message, got %v", n1.messages)
+	m.Enqueue([]string{Ntfy}, Event{Title: "flaky"}, "")
+	if r := waitResult(t, results); r.Error != "" || len(flaky.received()) != 4 {
+		t.Errorf("expected a delivery after 3 failures, got %v after %d attempts", r, len(flaky.received()))
+	}
+	if h := m.Health()[0]; h.Delivered != 1 || h.LastError != "timeout" || h.PausedUntil.IsZero() || h.Status() != "ok" {
+		t.Errorf("unexpected health %+v", h)
+	}
+
+	m.Enqueue([]string{Webhook}, Event{Title: "rejected"}, "")
+	if r := waitResult(t, results); r.Error != "forbidden" || len(rejecting.received()) != 1 {
+		t.Errorf("expected a permanent failure without retries, got %v", r)
+	}
+	if h := m.Health()[1]; h.Dropped != 1 || h.Status() != "failing" {
+		t.Errorf("unexpected health %+v", h)
+	}
+	if items, _ := outbox.GetOutboxItems(); len(items) != 0 {
+		t.Errorf("expected an empty outbox, got %v", items)
+	}
+}
+
+func TestManager_Outbox(t *testing.T) {
+	outbox := newMemoryOutbox()
+	_, _ = outbox.InsertOutboxItem(OutboxItem{Notifier: Gotify, Event: Event{Title: "from last run"}, Ref: "hit-1"})
+	_, _ = outbox.InsertOutboxItem(OutboxItem{Notifier: "removed", Event: Event{Title: "kept"}})
+
+	failing := &mockNotifier{errs: []error{errors.New("unreachable")}}
+	m, results := startManager(t, outbox, namedNotifier{name: Gotify, Notifier: &mockNotifier{}}, namedNotifier{name: Slack, Notifier: failing})
+	if r := waitResult(t, results); r.ref != "hit-1" || r.Error != "" {
+		t.Errorf("expected the queued notification to be delivered, got %v", r)
+	}
+
+	m.Enqueue([]string{Slack}, Event{Title: "retried later"}, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(failing.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Close()
+
+	items, _ := outbox.GetOutboxItems()
+	if len(items) != 2 || items[0].Event.Title != "kept" || items[1].Attempts != 1 || items[1].LastError != "unreachable" {
+		t.Errorf("expected the failed and the unknown notification in the outbox, got %+v", items)
+	}
+}
+
+func TestManager_Digest(t *testing.T) {
+	n := &mockNotifier{}
+	m, results := startManager(t, nil, namedNotifier{name: Slack, Notifier: n, filter: Filter{Digest: 500 * time.Millisecond}})
+
+	m.Notify("first")
+	m.Alert(EventCrawler, SeverityError, "second")
+	m.Enqueue(nil, Event{Title: "third", Type: EventWatch}, "hit-1")
+	for range 3 {
+		if r := waitResult(t, results); r.Error != "" {
+			t.Errorf("expected a delivery, got %v", r)
+		}
+	}
+	if msgs := n.received(); len(msgs) != 1 || msgs[0] != "3 notifications" {
+		t.Errorf("expected one digest, got %v", msgs)
+	}
+	if h := m.Health(); h[0].Delivered != 3 {
+		t.Errorf("expected 3 delivered notifications, got %+v", h)
+	}
+
+	event := digestEvent([]*OutboxItem{{Event: Event{Title: "a", Type: EventWatch}}, {Event: Event{Title: "b", Type: EventCrawler, Severity: SeverityError}}})
+	if event.Message != "- a\n- b" || event.Severity != SeverityError || event.Type != "" {
+		t.Errorf("unexpected digest %+v", event)
+	}
+}
+
+func TestManager_CloseDuringInterval(t *testing.T) {
+	n := &mockNotifier{}
+	m, results := startManager(t, nil)
+	m.interval = time.Hour
+	m.notifiers = []namedNotifier{{name: Slack, Notifier: n}}
+	m.workers = m.newWorkers()
+	m.start()
+
+	// The second notification wakes the worker while it waits for the
+	// interval after the first one.
+	m.Notify("first")
+	waitResult(t, results)
+	m.Notify("second")
+
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the interval")
+	}
+	if msgs := n.received(); len(msgs) != 1 {
+		t.Errorf("expected only the first notification to be sent, got %v", msgs)
+	}
+}
+
+// blockingNotifier blocks every notification until release is closed.
+type blockingNotifier struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (n *blockingNotifier) Notify(event Event) error {
+	n.started <- struct{}{}
+	<-n.release
+	return nil
+}
+
+func TestManager_SetupDuringDelivery(t *testing.T) {
+	n := &blockingNotifier{started: make(chan struct{}, 1), release: make(chan struct{})}
+	m, results := startManager(t, nil, namedNotifier{name: Slack, Notifier: n})
+	m.Notify("slow")
+	<-n.started
+
+	setup := make(chan struct{})
+	go func() {
+		m.Setup(&config.Configuration{})
+		close(setup)
+	}()
+	// The manager stays usable while Setup waits for the delivery.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.Names()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Notify("during setup")
+	if h := m.Health(); len(h) != 0 {
+		t.Errorf("expected no notifiers after the setup, got %+v", h)
+	}
+
+	close(n.release)
+	<-setup
+	if r := waitResult(t, results); r.Notifier != Slack || r.Error != "" {
+		t.Errorf("expected the slow delivery to finish, got %v", r)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	status, header := http.StatusTooManyRequests, "2"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", header)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	n := &SlackNotifier{WebhookURL: srv.URL}
+
+	var rateLimited *RetryAfterError
+	if err := n.Notify(Event{Title: "x"}); !errors.As(err, &rateLimited) || rateLimited.After != 2*time.Second {
+		t.Errorf("expected to retry after 2s, got %v", err)
+	}
+	status = http.StatusNotFound
+	var permanent *PermanentError
+	if err := n.Notify(Event{Title: "x"}); !errors.As(err, &permanent) {
+		t.Errorf("expected a permanent error, got %v", err)
 	}
-	if len(n2.messages) != 1 || n2.messages[0] != testMsg {
-		t.Errorf("n2 did not receive correct message, got %v", n2.messages)
+	status = http.StatusBadGateway
+	if err := n.Notify(Event{Title: "x"}); err == nil || errors.As(err, &permanent) || errors.As(err, &rateLimited) {
+		t.Errorf("expected a temporary error, got %v", err)
 	}
 }
@@ -0,0 +1,58 @@
+package notifier
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NtfyNotifier publishes events to a topic of an ntfy server.
+type NtfyNotifier struct {
+	// URL is the URL of the topic, e.g. https://ntfy.sh/dhtc.
+	URL       string
+	Token     string
+	Priority  int
+	Tags      string
+	Templates *Templates
+}
+
+func (n *NtfyNotifier) Notify(event Event) error {
+	text, err := n.Templates.Render(Ntfy, event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, strings.NewReader(text))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", "dhtc")
+	if event.InfoHash != "" {
+		req.Header.Set("Title", event.Name)
+		click := event.URL
+		if click == "" {
+			click = event.Magnet
+		}
+		req.Header.Set("Click", click)
+	}
+	if event.URL != "" {
+		req.Header.Set("Actions", "view, Details, "+event.URL)
+	}
+	if n.Priority > 0 {
+		req.Header.Set("Priority", strconv.Itoa(n.Priority))
+	}
+	if n.Tags != "" {
+		req.Header.Set("Tags", n.Tags)
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return statusError("ntfy", resp)
+	}
+	return nil
+}
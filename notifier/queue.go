@@ -0,0 +1,418 @@
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxAttempts is the number of failed attempts after which a notification is
+// dropped. Attempts which were rate limited do not count.
+const maxAttempts = 8
+
+var (
+	retryBase = 5 * time.Second
+	retryMax  = time.Hour
+)
+
+// OutboxItem is a notification waiting for its delivery to one notifier.
+type OutboxItem struct {
+	Id       string
+	Notifier string
+	Event    Event
+	// Ref is passed to the result handler of the manager, e.g. the id of the
+	// watch hit the notification is about.
+	Ref     string
+	Created int64
+	// Attempts counts the failed attempts, NextAttempt is a unix timestamp in
+	// milliseconds.
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+}
+
+// Outbox stores the notifications which are not delivered yet, so that they
+// survive restarts.
+type Outbox interface {
+	InsertOutboxItem(item OutboxItem) (string, error)
+	// GetOutboxItems returns all items, oldest first.
+	GetOutboxItems() ([]OutboxItem, error)
+	UpdateOutboxItem(item OutboxItem) error
+	DeleteOutboxItem(id string) error
+}
+
+// RetryAfterError is returned by notifiers which are rate limited, e.g. with
+// status 429. The notifier is paused for After.
+type RetryAfterError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", e.Err, e.After)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError is returned for notifications which would fail again, like
+// rejected requests. They are not retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// statusError returns the error of an unsuccessful response of service.
+func statusError(service string, resp *http.Response) error {
+	err := fmt.Errorf("%s returned status %d", service, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RetryAfterError{After: retryAfter(resp.Header.Get("Retry-After")), Err: err}
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout:
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or a date. It defaults to a minute.
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return time.Minute
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// failed attempts.
+func backoff(attempts int) time.Duration {
+	d := retryBase << (attempts - 1)
+	if d <= 0 || d > retryMax {
+		return retryMax
+	}
+	return d
+}
+
+// Health is the delivery status of a notifier.
+type Health struct {
+	Name      string
+	Queued    int
+	Delivered int64
+	// Dropped counts the notifications which failed permanently or too often.
+	Dropped       int64
+	LastSuccess   time.Time
+	LastError     string
+	LastErrorTime time.Time
+	// PausedUntil is set while the notifier is rate limited.
+	PausedUntil time.Time
+}
+
+// Status summarises the health: "ok", "failing", "rate limited" or "unused".
+func (h Health) Status() string {
+	switch {
+	case h.PausedUntil.After(time.Now()):
+		return "rate limited"
+	case h.LastErrorTime.After(h.LastSuccess):
+		return "failing"
+	case h.LastSuccess.IsZero():
+		return "unused"
+	}
+	return "ok"
+}
+
+// worker delivers the notifications of one notifier, one at a time and at most
+// one per interval. With a digest interval, the notifications due are combined
+// into one message at most once per digest interval.
+type worker struct {
+	name     string
+	notifier Notifier
+	outbox   Outbox
+	interval time.Duration
+	digest   time.Duration
+	report   func(ref string, d Delivery)
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	items  []*OutboxItem
+	health Health
+	// lastDelivery is the time of the last delivery, or of the start of the
+	// worker.
+	lastDelivery time.Time
+}
+
+func newWorker(n namedNotifier, outbox Outbox, interval time.Duration, report func(ref string, d Delivery)) *worker {
+	return &worker{
+		name:     n.name,
+		notifier: n.Notifier,
+		outbox:   outbox,
+		interval: interval,
+		digest:   n.filter.Digest,
+		report:   report,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		health:   Health{Name: n.name},
+
+		lastDelivery: time.Now(),
+	}
+}
+
+// add queues item, unless an item with its id is queued already, like the
+// items queued before the worker was started, which are read from the outbox
+// again.
+func (w *worker) add(item OutboxItem) {
+	w.mu.Lock()
+	if item.Id != "" && slices.ContainsFunc(w.items, func(o *OutboxItem) bool { return o.Id == item.Id }) {
+		w.mu.Unlock()
+		return
+	}
+	w.items = append(w.items, &item)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the due item with the earliest attempt, or all due items with
+// a digest interval, or the time to wait for them.
+func (w *worker) next(now time.Time) ([]*OutboxItem, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wait := w.health.PausedUntil.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	if len(w.items) == 0 {
+		return nil, time.Hour
+	}
+	if wait := w.lastDelivery.Add(w.digest).Sub(now); wait > 0 {
+		return nil, wait
+	}
+	next := w.items[0]
+	var due []*OutboxItem
+	for _, item := range w.items {
+		if item.NextAttempt < next.NextAttempt {
+			next = item
+		}
+		if item.NextAttempt <= now.UnixMilli() {
+			due = append(due, item)
+		}
+	}
+	if wait := time.UnixMilli(next.NextAttempt).Sub(now); wait > 0 {
+		return nil, wait
+	}
+	if w.digest > 0 {
+		return due, 0
+	}
+	return []*OutboxItem{next}, 0
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for {
+		items, wait := w.next(time.Now())
+		if items != nil {
+			w.deliver(items)
+			wait = w.interval
+		}
+		timer := time.NewTimer(wait)
+		wake := w.wake
+		if items != nil {
+			// New items wait for the interval after a delivery, too.
+			wake = nil
+		}
+		select {
+		case <-w.stop:
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliver sends items to the notifier, several items as one digest. Failed
+// items are scheduled again, unless they failed permanently or too often.
+func (w *worker) deliver(items []*OutboxItem) {
+	event := items[0].Event
+	if len(items) > 1 {
+		event = digestEvent(items)
+	}
+	err := w.notifier.Notify(event)
+	now := time.Now()
+
+	w.mu.Lock()
+	w.lastDelivery = now
+	var rateLimited *RetryAfterError
+	var permanent *PermanentError
+	isRateLimited, isPermanent := errors.As(err, &rateLimited), errors.As(err, &permanent)
+	switch {
+	case err == nil:
+		w.health.Delivered += int64(len(items))
+		w.health.LastSuccess = now
+	case isRateLimited:
+		w.health.PausedUntil = now.Add(rateLimited.After)
+	}
+	if err != nil {
+		w.health.LastError, w.health.LastErrorTime = err.Error(), now
+	}
+	retry := make(map[*OutboxItem]bool, len(items))
+	for _, item := range items {
+		switch {
+		case err == nil:
+		case isRateLimited:
+			item.NextAttempt = w.health.PausedUntil.UnixMilli()
+			retry[item] = true
+		case isPermanent || item.Attempts+1 >= maxAttempts:
+			w.health.Dropped++
+			log.Warn().Err(err).Msgf("dropping notification to %s after %d attempts", w.name, item.Attempts+1)
+		default:
+			item.Attempts++
+			item.NextAttempt = now.Add(backoff(item.Attempts)).UnixMilli()
+			retry[item] = true
+		}
+		if err != nil {
+			item.LastError = err.Error()
+		}
+	}
+	w.items = slices.DeleteFunc(w.items, func(o *OutboxItem) bool { return slices.Contains(items, o) && !retry[o] })
+	stored := make([]OutboxItem, len(items))
+	for i, item := range items {
+		stored[i] = *item
+	}
+	w.mu.Unlock()
+
+	for i, item := range stored {
+		if retry[items[i]] {
+			w.store(item, w.outbox.UpdateOutboxItem)
+			continue
+		}
+		w.store(item, func(item OutboxItem) error { return w.outbox.DeleteOutboxItem(item.Id) })
+		d := Delivery{Notifier: w.name}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		w.report(item.Ref, d)
+	}
+}
+
+// digestEvent combines the events of items into one notification listing
+// their titles, with the highest severity of the events and their type if
+// they share one. Digests of watches keep their entries.
+func digestEvent(items []*OutboxItem) Event {
+	event := Event{Title: fmt.Sprintf("%d notifications", len(items)), Type: items[0].Event.Type}
+	titles := make([]string, len(items))
+	for i, item := range items {
+		titles[i] = "- " + item.Event.Title
+		if severityLevel(item.Event.Severity) > severityLevel(event.Severity) {
+			event.Severity = item.Event.Severity
+		}
+		if item.Event.Type != event.Type {
+			event.Type = ""
+		}
+		event.Digest = append(event.Digest, item.Event.Digest...)
+	}
+	event.Message = strings.Join(titles, "\n")
+	return event
+}
+
+// store applies fn to the outbox, unless item could not be stored in it.
+func (w *worker) store(item OutboxItem, fn func(item OutboxItem) error) {
+	if item.Id == "" {
+		return
+	}
+	if err := fn(item); err != nil {
+		log.Error().Err(err).Msgf("could not update the outbox of %s", w.name)
+	}
+}
+
+// record updates the health with the result of a delivery outside of the
+// queue.
+func (w *worker) record(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.health.LastError, w.health.LastErrorTime = err.Error(), time.Now()
+		return
+	}
+	w.health.LastSuccess = time.Now()
+}
+
+func (w *worker) getHealth() Health {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	h := w.health
+	h.Queued = len(w.items)
+	return h
+}
+
+// memoryOutbox is the outbox of managers without persistent outbox.
+type memoryOutbox struct {
+	mu     sync.Mutex
+	lastId int
+	items  map[string]OutboxItem
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{items: make(map[string]OutboxItem)}
+}
+
+func (o *memoryOutbox) InsertOutboxItem(item OutboxItem) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastId++
+	item.Id = strconv.Itoa(o.lastId)
+	o.items[item.Id] = item
+	return item.Id, nil
+}
+
+func (o *memoryOutbox) GetOutboxItems() ([]OutboxItem, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make([]OutboxItem, 0, len(o.items))
+	for _, item := range o.items {
+		res = append(res, item)
+	}
+	slices.SortFunc(res, func(a, b OutboxItem) int {
+		ia, _ := strconv.Atoi(a.Id)
+		ib, _ := strconv.Atoi(b.Id)
+		return ia - ib
+	})
+	return res, nil
+}
+
+func (o *memoryOutbox) UpdateOutboxItem(item OutboxItem) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.items[item.Id] = item
+	return nil
+}
+
+func (o *memoryOutbox) DeleteOutboxItem(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.items, id)
+	return nil
+}
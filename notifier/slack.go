@@ -3,29 +3,73 @@ package notifier
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"net/http"
+	"strconv"
+	"strings"
 )
 
 type SlackNotifier struct {
 	WebhookURL string
+	Templates  *Templates
 }
 
-func (n *SlackNotifier) Notify(message string) error {
+func (n *SlackNotifier) Notify(event Event) error {
 	if n.WebhookURL == "" {
 		return nil
 	}
-	payload := map[string]string{
-		"text": message,
+	text, err := n.Templates.Render(Slack, event)
+	if err != nil {
+		return err
+	}
+	payload := map[string]any{
+		"text": text,
+	}
+	if event.InfoHash != "" {
+		payload["blocks"] = slackBlocks(text, event)
 	}
 	body, _ := json.Marshal(payload)
-	resp, err := http.Post(n.WebhookURL, "application/json", bytes.NewBuffer(body))
+	resp, err := httpClient.Post(n.WebhookURL, "application/json", bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("slack returned status %d", resp.StatusCode)
+		return statusError("slack", resp)
 	}
 	return nil
 }
+
+// slackBlocks returns the Block Kit layout of a torrent event.
+func slackBlocks(text string, event Event) []any {
+	mrkdwn := func(s string) map[string]string {
+		return map[string]string{"type": "mrkdwn", "text": s}
+	}
+	fields := []any{
+		mrkdwn("*Size*\n" + formatSize(event.Size)),
+		mrkdwn("*Files*\n" + strconv.Itoa(event.Files)),
+	}
+	if len(event.Categories) > 0 {
+		fields = append(fields, mrkdwn("*Categories*\n"+strings.Join(event.Categories, ", ")))
+	}
+	if event.Watch != "" {
+		fields = append(fields, mrkdwn("*Watch*\n"+mrkdwnEscaper.Replace(event.Watch)))
+	}
+
+	blocks := []any{
+		map[string]any{"type": "section", "text": mrkdwn(text)},
+		map[string]any{"type": "section", "fields": fields},
+	}
+	if event.URL != "" {
+		blocks = append(blocks, map[string]any{
+			"type": "actions",
+			"elements": []any{map[string]any{
+				"type": "button",
+				"text": map[string]string{"type": "plain_text", "text": "Details"},
+				"url":  event.URL,
+			}},
+		})
+	}
+	return append(blocks, map[string]any{
+		"type":     "context",
+		"elements": []any{mrkdwn("`" + event.Magnet + "`")},
+	})
+}
@@ -2,7 +2,9 @@ package notifier
 
 import (
 	"dhtc/config"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	telegram "gopkg.in/telebot.v3"
@@ -25,27 +27,50 @@ func SetupTelegramBot(config *config.Configuration) *telegram.Bot {
 	return rVal
 }
 
-func NotifyTelegram(config *config.Configuration, bot *telegram.Bot, message string) {
-	if bot != nil {
-		chat, err := bot.ChatByUsername(config.TelegramUsername)
-		if err == nil {
-			fmt.Println("Sending telegram notification.")
-			_, err := bot.Send(chat, message)
-			if err != nil {
-				fmt.Printf("Could not send message '%s' to user '%s'.", message, config.TelegramUsername)
-			}
-		} else {
-			fmt.Printf("Could not find chat by username '%s'\n", config.TelegramUsername)
-		}
-	}
+type TelegramNotifier struct {
+	config    *config.Configuration
+	bot       *telegram.Bot
+	templates *Templates
 }
 
-type TelegramNotifier struct {
-	config *config.Configuration
-	bot    *telegram.Bot
+// Notify sends event as HTML, with a button to the details of the torrent if
+// the public URL of dhtc is configured.
+func (n *TelegramNotifier) Notify(event Event) error {
+	if n.bot == nil {
+		return nil
+	}
+	text, err := n.templates.Render(Telegram, event)
+	if err != nil {
+		return err
+	}
+	chat, err := n.recipient()
+	if err != nil {
+		return err
+	}
+	opts := &telegram.SendOptions{ParseMode: telegram.ModeHTML, DisableWebPagePreview: true}
+	if event.URL != "" {
+		opts.ReplyMarkup = &telegram.ReplyMarkup{InlineKeyboard: [][]telegram.InlineButton{{
+			{Text: "Details", URL: event.URL},
+		}}}
+	}
+	_, err = n.bot.Send(chat, text, opts)
+	var flood telegram.FloodError
+	if errors.As(err, &flood) {
+		return &RetryAfterError{After: time.Duration(flood.RetryAfter) * time.Second, Err: err}
+	}
+	return err
 }
 
-func (n *TelegramNotifier) Notify(message string) error {
-	NotifyTelegram(n.config, n.bot, message)
-	return nil
+// recipient returns the chat to send notifications to. Chat ids are used as
+// they are, since users without public username can not be found by name.
+func (n *TelegramNotifier) recipient() (telegram.Recipient, error) {
+	target := n.config.TelegramUsername
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return &telegram.Chat{ID: id}, nil
+	}
+	chat, err := n.bot.ChatByUsername(target)
+	if err != nil {
+		return nil, fmt.Errorf("could not find chat by username '%s': %w", target, err)
+	}
+	return chat, nil
 }
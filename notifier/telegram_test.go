@@ -0,0 +1,37 @@
+package notifier
+
+import (
+	"dhtc/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	telegram "gopkg.in/telebot.v3"
+)
+
+func TestTelegramNotifier_ChatID(t *testing.T) {
+	var methods []string
+	var chatId any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		methods = append(methods, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		chatId = payload["chat_id"]
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":-100123}}}`))
+	}))
+	defer srv.Close()
+	bot, err := telegram.NewBot(telegram.Settings{Token: "token", URL: srv.URL, Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &TelegramNotifier{config: &config.Configuration{TelegramUsername: "-100123"}, bot: bot}
+	if err = n.Notify(Event{Title: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 1 || methods[0] != "sendMessage" || chatId != "-100123" {
+		t.Errorf("expected a message to the chat id without lookup, got %v to %v", methods, chatId)
+	}
+}
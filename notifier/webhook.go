@@ -0,0 +1,60 @@
+package notifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the body of webhooks, as
+// "sha256=<hex>", if the webhook has a secret.
+const SignatureHeader = "X-Dhtc-Signature"
+
+// WebhookNotifier posts events as JSON, with the rendered text in "text".
+type WebhookNotifier struct {
+	URL       string
+	Headers   map[string]string
+	Secret    string
+	Templates *Templates
+}
+
+func (n *WebhookNotifier) Notify(event Event) error {
+	text, err := n.Templates.Render(Webhook, event)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]any{
+		"text":  text,
+		"event": event,
+	})
+	req, err := http.NewRequest("POST", n.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.Headers {
+		req.Header.Set(key, value)
+	}
+	if n.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.Secret, body))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return statusError("webhook", resp)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
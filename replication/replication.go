@@ -0,0 +1,141 @@
+package replication
+
+import (
+	"crypto/subtle"
+	"dhtc/db"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FeedPath     = "/api/replication/feed"
+	DefaultLimit = 500
+	MaxLimit     = 5000
+	MaxWait      = 60 * time.Second
+
+	retryInterval = 30 * time.Second
+)
+
+// Feed is a page of the change feed. Cursor is the sequence number to continue from.
+type Feed struct {
+	Changes []db.Change
+	Cursor  int64
+}
+
+func ReadFeed(database db.Repository, after int64, limit int) (Feed, error) {
+	if limit < 1 || limit > MaxLimit {
+		limit = DefaultLimit
+	}
+	changes, err := database.GetChanges(after, limit)
+	if err != nil {
+		return Feed{}, err
+	}
+	feed := Feed{Changes: changes, Cursor: after}
+	if len(changes) > 0 {
+		feed.Cursor = changes[len(changes)-1].Seq
+	}
+	return feed, nil
+}
+
+// Authorized checks the "Authorization: Bearer TOKEN" header of a feed request.
+// Without a configured token the feed is disabled.
+func Authorized(header string, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Subscriber follows the change feed of a peer. Its cursor is stored in the
+// key value store of the local repository, so it survives restarts.
+type Subscriber struct {
+	Peer     string
+	token    string
+	database db.Repository
+	client   *http.Client
+	cursor   int64
+}
+
+func NewSubscriber(peer string, token string, database db.Repository) (*Subscriber, error) {
+	s := &Subscriber{
+		Peer:     strings.TrimSuffix(peer, "/"),
+		token:    token,
+		database: database,
+		client:   &http.Client{Timeout: MaxWait + 30*time.Second},
+	}
+	value, err := database.GetValue(s.cursorKey())
+	if err != nil {
+		return nil, err
+	}
+	s.cursor, _ = strconv.ParseInt(value, 10, 64)
+	return s, nil
+}
+
+func (s *Subscriber) cursorKey() string {
+	return "replication.cursor." + s.Peer
+}
+
+// Poll fetches the next page of the feed and passes every torrent to handle.
+// If there are no new torrents, the peer holds the request for up to wait.
+func (s *Subscriber) Poll(wait time.Duration, handle func(md dhtcclient.Metadata)) (int, error) {
+	params := url.Values{}
+	params.Set("after", strconv.FormatInt(s.cursor, 10))
+	params.Set("limit", strconv.Itoa(DefaultLimit))
+	params.Set("wait", strconv.Itoa(int(wait.Seconds())))
+
+	req, err := http.NewRequest(http.MethodGet, s.Peer+FeedPath+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("peer responded with status %d", resp.StatusCode)
+	}
+
+	var feed Feed
+	if err = json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return 0, err
+	}
+	for _, change := range feed.Changes {
+		handle(change.Metadata())
+	}
+
+	if feed.Cursor != s.cursor {
+		s.cursor = feed.Cursor
+		if err = s.database.SetValue(s.cursorKey(), strconv.FormatInt(s.cursor, 10)); err != nil {
+			return len(feed.Changes), err
+		}
+	}
+	return len(feed.Changes), nil
+}
+
+// Run polls the peer forever and retries after errors.
+func (s *Subscriber) Run(handle func(md dhtcclient.Metadata)) {
+	log.Info().Msgf("replicating from %s starting at %d", s.Peer, s.cursor)
+	for {
+		n, err := s.Poll(MaxWait, handle)
+		if err != nil {
+			log.Warn().Err(err).Msgf("could not replicate from %s", s.Peer)
+			time.Sleep(retryInterval)
+			continue
+		}
+		if n > 0 {
+			log.Debug().Msgf("replicated %d torrents from %s", n, s.Peer)
+		}
+	}
+}
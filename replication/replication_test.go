@@ -0,0 +1,89 @@
+package replication
+
+import (
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newFeedServer(t *testing.T, database db.Repository, token string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Authorized(r.Header.Get("Authorization"), token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		feed, err := ReadFeed(database, after, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(feed)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSubscriberReplicatesFeed(t *testing.T) {
+	for _, dbType := range []string{"clover", "sqlite"} {
+		t.Run(dbType, func(t *testing.T) {
+			source := dbtest.NewRepository(t, dbType)
+			target := dbtest.NewRepository(t, "clover")
+			srv := newFeedServer(t, source, "secret")
+
+			for i, name := range []string{"ubuntu.iso", "debian.iso"} {
+				source.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{byte(i), 1}, Name: name, DiscoveredOn: int64(100 + i)})
+			}
+
+			subscriber, err := NewSubscriber(srv.URL, "secret", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			insert := func(md dhtcclient.Metadata) { target.InsertMetadata(md) }
+			if n, err := subscriber.Poll(0, insert); err != nil || n != 2 {
+				t.Fatalf("expected 2 changes, got %d (%v)", n, err)
+			}
+
+			source.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{2, 1}, Name: "arch.iso", DiscoveredOn: 50})
+
+			// A new subscriber continues at the stored cursor.
+			subscriber, err = NewSubscriber(srv.URL, "secret", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := subscriber.Poll(0, insert); err != nil || n != 1 {
+				t.Fatalf("expected 1 change, got %d (%v)", n, err)
+			}
+
+			var replicated []db.Torrent
+			_ = target.ForEachTorrent(db.SearchFilters{}, func(c db.Change) error {
+				replicated = append(replicated, c.Torrent)
+				return nil
+			})
+			if len(replicated) != 3 || replicated[2].Name != "arch.iso" || replicated[2].DiscoveredOn != 50 {
+				t.Errorf("unexpected replicated torrents %+v", replicated)
+			}
+		})
+	}
+}
+
+func TestSubscriberRejectsInvalidToken(t *testing.T) {
+	srv := newFeedServer(t, dbtest.NewRepository(t, "clover"), "secret")
+	subscriber, err := NewSubscriber(srv.URL, "wrong", dbtest.NewRepository(t, "clover"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = subscriber.Poll(0, func(dhtcclient.Metadata) {}); err == nil {
+		t.Error("expected an error for an invalid token")
+	}
+	if Authorized("Bearer ", "") {
+		t.Error("expected the feed to be disabled without a token")
+	}
+}
@@ -0,0 +1,417 @@
+package torznab
+
+import (
+	"crypto/subtle"
+	"dhtc/db"
+	"dhtc/downloader"
+	"dhtc/feed"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Path = "/torznab/api"
+
+	DefaultLimit = 50
+	MaxLimit     = 100
+
+	FunctionCaps     = "caps"
+	FunctionSearch   = "search"
+	FunctionTVSearch = "tvsearch"
+	FunctionMovie    = "movie"
+)
+
+// Error codes of the Newznab API.
+const (
+	ErrorCredentials      = 100
+	ErrorMissingParameter = 200
+	ErrorParameter        = 201
+	ErrorFunction         = 202
+	ErrorUnknown          = 900
+)
+
+// Category is a Newznab category and the dhtc categories it corresponds to.
+type Category struct {
+	ID      int
+	Name    string
+	Matches []string
+	Subcats []Category
+}
+
+// Categories maps the Newznab categories to the categories of db.Categorize.
+// Subcategories match the same torrents as their parent.
+var Categories = []Category{
+	{ID: 2000, Name: "Movies", Matches: []string{"Video"}, Subcats: []Category{
+		{ID: 2030, Name: "Movies/SD"}, {ID: 2040, Name: "Movies/HD"}, {ID: 2045, Name: "Movies/UHD"},
+	}},
+	{ID: 3000, Name: "Audio", Matches: []string{"Audio"}, Subcats: []Category{
+		{ID: 3010, Name: "Audio/MP3"}, {ID: 3040, Name: "Audio/Lossless"},
+	}},
+	{ID: 4000, Name: "PC", Matches: []string{"Software"}, Subcats: []Category{
+		{ID: 4020, Name: "PC/ISO"},
+	}},
+	{ID: 5000, Name: "TV", Matches: []string{"Video"}, Subcats: []Category{
+		{ID: 5030, Name: "TV/SD"}, {ID: 5040, Name: "TV/HD"}, {ID: 5045, Name: "TV/UHD"},
+	}},
+	{ID: 7000, Name: "Books", Matches: []string{"Document"}, Subcats: []Category{
+		{ID: 7020, Name: "Books/EBook"},
+	}},
+	{ID: 8000, Name: "Other", Matches: []string{"Picture", "Archive", "Other", "Unknown"}},
+}
+
+// Error is a failed request, written as Newznab error response.
+type Error struct {
+	Code        int
+	Description string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("torznab error %d: %s", e.Code, e.Description)
+}
+
+// Request is a parsed search request.
+type Request struct {
+	Function   string
+	Query      string
+	Season     string
+	Episode    string
+	Categories []int
+	Limit      int
+	Offset     int
+}
+
+// Authorized compares the apikey parameter with the configured key. Without a
+// key the API is disabled.
+func Authorized(apiKey string, key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1
+}
+
+func ParseRequest(query url.Values) (Request, error) {
+	req := Request{
+		Function: query.Get("t"),
+		Query:    strings.TrimSpace(query.Get("q")),
+		Season:   query.Get("season"),
+		Episode:  query.Get("ep"),
+		Limit:    DefaultLimit,
+	}
+	switch req.Function {
+	case "":
+		return req, &Error{ErrorMissingParameter, "missing parameter t"}
+	case FunctionCaps, FunctionSearch, FunctionTVSearch, FunctionMovie:
+	default:
+		return req, &Error{ErrorFunction, "no such function " + req.Function}
+	}
+
+	for _, cat := range strings.Split(query.Get("cat"), ",") {
+		if cat = strings.TrimSpace(cat); cat == "" {
+			continue
+		}
+		id, err := strconv.Atoi(cat)
+		if err != nil {
+			return req, &Error{ErrorParameter, "invalid category " + cat}
+		}
+		req.Categories = append(req.Categories, id)
+	}
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		if req.Limit, err = strconv.Atoi(limit); err != nil || req.Limit < 1 {
+			return req, &Error{ErrorParameter, "invalid limit"}
+		}
+		req.Limit = min(req.Limit, MaxLimit)
+	}
+	if offset := query.Get("offset"); offset != "" {
+		if req.Offset, err = strconv.Atoi(offset); err != nil || req.Offset < 0 {
+			return req, &Error{ErrorParameter, "invalid offset"}
+		}
+	}
+	return req, nil
+}
+
+// dhtcCategories returns the dhtc categories of Newznab category ids.
+func dhtcCategories(ids []int) []string {
+	var res []string
+	for _, id := range ids {
+		for _, c := range Categories {
+			if c.ID == id/1000*1000 {
+				for _, m := range c.Matches {
+					if !slices.Contains(res, m) {
+						res = append(res, m)
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// newznabCategories returns the Newznab categories of a torrent. Video is
+// TV if the name contains an episode number, otherwise a movie.
+func newznabCategories(name string, categories []string) []int {
+	var res []int
+	for _, category := range categories {
+		switch category {
+		case "Video":
+			if isEpisode(name) {
+				res = append(res, 5000)
+			} else {
+				res = append(res, 2000)
+			}
+		case "Audio":
+			res = append(res, 3000)
+		case "Software":
+			res = append(res, 4000)
+		case "Document":
+			res = append(res, 7000)
+		default:
+			res = append(res, 8000)
+		}
+	}
+	if len(res) == 0 {
+		res = append(res, 8000)
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+func isEpisode(name string) bool {
+	name = strings.ToLower(name)
+	for i := 0; i+3 < len(name); i++ {
+		if name[i] == 's' && isDigit(name[i+1]) && (i == 0 || !isLetter(name[i-1])) {
+			j := i + 1
+			for j < len(name) && isDigit(name[j]) {
+				j++
+			}
+			if j+1 < len(name) && name[j] == 'e' && isDigit(name[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isLetter(b byte) bool {
+	return b >= 'a' && b <= 'z'
+}
+
+// searchQuery builds a query of the query language, in which every word of
+// the request has to be part of the name.
+func searchQuery(req Request) string {
+	words := strings.Fields(req.Query)
+	if season, err := strconv.Atoi(req.Season); err == nil {
+		episode := fmt.Sprintf("s%02d", season)
+		if ep, err := strconv.Atoi(req.Episode); err == nil {
+			episode += fmt.Sprintf("e%02d", ep)
+		}
+		words = append(words, episode)
+	}
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.Trim(strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`"*?`, r) {
+				return -1
+			}
+			return r
+		}, word), ".,:;")
+		if word != "" {
+			terms = append(terms, db.FieldName+`:"`+word+`"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// Search returns the newest torrents matching a search request. Requests
+// without query return the newest torrents of the requested categories.
+func Search(database db.Repository, req Request) ([]db.MetaData, int64, error) {
+	filters := db.SearchFilters{
+		Categories:    dhtcCategories(req.Categories),
+		Sort:          db.SortDiscovered,
+		SortAscending: false,
+	}
+	q := searchQuery(req)
+	if q == "" {
+		return database.GetLatest(req.Limit, req.Offset, filters)
+	}
+	results, total, err := database.Search(db.QueryKey, "", q, req.Limit, req.Offset, filters)
+	if errors.Is(err, db.ErrInvalidQuery) {
+		return nil, 0, &Error{ErrorParameter, err.Error()}
+	}
+	return results, total, err
+}
+
+type caps struct {
+	XMLName    xml.Name       `xml:"caps"`
+	Server     capsServer     `xml:"server"`
+	Limits     capsLimits     `xml:"limits"`
+	Searching  capsSearching  `xml:"searching"`
+	Categories []capsCategory `xml:"categories>category"`
+}
+
+type capsServer struct {
+	Title string `xml:"title,attr"`
+}
+
+type capsLimits struct {
+	Max     int `xml:"max,attr"`
+	Default int `xml:"default,attr"`
+}
+
+type capsSearching struct {
+	Search      capsSearch `xml:"search"`
+	TVSearch    capsSearch `xml:"tv-search"`
+	MovieSearch capsSearch `xml:"movie-search"`
+}
+
+type capsSearch struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type capsCategory struct {
+	ID      int            `xml:"id,attr"`
+	Name    string         `xml:"name,attr"`
+	Subcats []capsCategory `xml:"subcat"`
+}
+
+// WriteCaps writes the capabilities of the indexer.
+func WriteCaps(w io.Writer) error {
+	c := caps{
+		Server: capsServer{Title: "dhtc"},
+		Limits: capsLimits{Max: MaxLimit, Default: DefaultLimit},
+		Searching: capsSearching{
+			Search:      capsSearch{Available: "yes", SupportedParams: "q"},
+			TVSearch:    capsSearch{Available: "yes", SupportedParams: "q,season,ep"},
+			MovieSearch: capsSearch{Available: "yes", SupportedParams: "q"},
+		},
+	}
+	for _, category := range Categories {
+		cc := capsCategory{ID: category.ID, Name: category.Name}
+		for _, sub := range category.Subcats {
+			cc.Subcats = append(cc.Subcats, capsCategory{ID: sub.ID, Name: sub.Name})
+		}
+		c.Categories = append(c.Categories, cc)
+	}
+	return writeXML(w, c)
+}
+
+type errorResponse struct {
+	XMLName     xml.Name `xml:"error"`
+	Code        int      `xml:"code,attr"`
+	Description string   `xml:"description,attr"`
+}
+
+// WriteError writes err as Newznab error response. Errors other than *Error
+// are unknown errors.
+func WriteError(w io.Writer, err error) error {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{ErrorUnknown, err.Error()}
+	}
+	return writeXML(w, errorResponse{Code: e.Code, Description: e.Description})
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Torznab string     `xml:"xmlns:torznab,attr"`
+	Newznab string     `xml:"xmlns:newznab,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title    string          `xml:"title"`
+	Link     string          `xml:"link"`
+	Response newznabResponse `xml:"newznab:response"`
+	Items    []rssItem       `xml:"item"`
+}
+
+type newznabResponse struct {
+	Offset int   `xml:"offset,attr"`
+	Total  int64 `xml:"total,attr"`
+}
+
+type rssItem struct {
+	Title      string        `xml:"title"`
+	GUID       string        `xml:"guid"`
+	Link       string        `xml:"link"`
+	PubDate    string        `xml:"pubDate"`
+	Size       uint64        `xml:"size"`
+	Categories []int         `xml:"category"`
+	Enclosure  *rssEnclosure `xml:"enclosure"`
+	Attrs      []attr        `xml:"torznab:attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length uint64 `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type attr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// WriteResults writes search results as Torznab feed. Items link to torrentURL
+// if it is set, see feed.Options. Only .torrent files are enclosed, magnets are
+// in the magneturl attribute.
+func WriteResults(w io.Writer, results []db.MetaData, offset int, total int64, torrentURL string) error {
+	res := rss{
+		Version: "2.0",
+		Torznab: "http://torznab.com/schemas/2015/feed",
+		Newznab: "http://www.newznab.com/DTD/2010/feeds/attributes/",
+		Channel: rssChannel{
+			Title:    "dhtc",
+			Link:     Path,
+			Response: newznabResponse{Offset: offset, Total: total},
+		},
+	}
+	for i, item := range feed.Items(results, torrentURL) {
+		categories := newznabCategories(item.Title, results[i].Categories)
+		magnet := downloader.MagnetLink(item.InfoHash, item.Title)
+		attrs := []attr{
+			{"size", strconv.FormatUint(item.Size, 10)},
+			{"infohash", item.InfoHash},
+			{"magneturl", magnet},
+		}
+		for _, c := range categories {
+			attrs = append(attrs, attr{"category", strconv.Itoa(c)})
+		}
+		if files := len(results[i].Files); files > 0 {
+			attrs = append(attrs, attr{"files", strconv.Itoa(files)})
+		}
+		rssItem := rssItem{
+			Title:      item.Title,
+			GUID:       item.InfoHash,
+			Link:       item.Link,
+			PubDate:    item.Discovered.UTC().Format(time.RFC1123Z),
+			Size:       item.Size,
+			Categories: categories,
+			Attrs:      attrs,
+		}
+		if torrentURL != "" {
+			rssItem.Enclosure = &rssEnclosure{URL: item.Link, Length: item.Size, Type: "application/x-bittorrent"}
+		}
+		res.Channel.Items = append(res.Channel.Items, rssItem)
+	}
+	return writeXML(w, res)
+}
+
+func writeXML(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,128 @@
+package torznab
+
+import (
+	"bytes"
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	req, err := ParseRequest(url.Values{"t": {"tvsearch"}, "q": {"show"}, "cat": {"5000,5040"}, "limit": {"500"}, "offset": {"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Function != FunctionTVSearch || !slices.Equal(req.Categories, []int{5000, 5040}) || req.Limit != MaxLimit || req.Offset != 10 {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	for query, code := range map[string]int{"": ErrorMissingParameter, "t=book": ErrorFunction, "t=search&cat=tv": ErrorParameter, "t=search&limit=0": ErrorParameter} {
+		values, _ := url.ParseQuery(query)
+		_, err := ParseRequest(values)
+		var e *Error
+		if !errors.As(err, &e) || e.Code != code {
+			t.Errorf("%q: expected error %d, got %v", query, code, err)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		req      Request
+		expected string
+	}{
+		{Request{Query: `The "Show"`, Season: "1", Episode: "2"}, `name:"The" name:"Show" name:"s01e02"`},
+		{Request{Query: "movie 2024", Season: "3"}, `name:"movie" name:"2024" name:"s03"`},
+		{Request{Query: "*"}, ``},
+	}
+	for _, test := range tests {
+		if actual := searchQuery(test.req); actual != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.req, test.expected, actual)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	for _, dbType := range []string{"clover", "sqlite"} {
+		repo := dbtest.NewRepository(t, dbType)
+
+		torrents := []dhtcclient.Metadata{
+			{InfoHash: []byte{1}, Name: "The.Show.S01E02.1080p", DiscoveredOn: 1, Files: []dhtcclient.File{{Path: "show.mkv", Size: 1 << 30}}},
+			{InfoHash: []byte{2}, Name: "The.Show.S01E03.1080p", DiscoveredOn: 2, Files: []dhtcclient.File{{Path: "show.mkv", Size: 1 << 30}}},
+			{InfoHash: []byte{3}, Name: "The Show soundtrack", DiscoveredOn: 3, Files: []dhtcclient.File{{Path: "01.flac", Size: 1 << 20}}},
+		}
+		for _, md := range torrents {
+			repo.InsertMetadata(md)
+		}
+
+		results, total, err := Search(repo, Request{Query: "the show", Season: "1", Episode: "2", Categories: []int{5040}, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 || len(results) != 1 || results[0].InfoHash != "01" {
+			t.Errorf("%s: expected the episode, got %+v", dbType, results)
+		}
+		results, total, _ = Search(repo, Request{Query: "show", Categories: []int{3000}, Limit: 10})
+		if total != 1 || len(results) != 1 || results[0].InfoHash != "03" {
+			t.Errorf("%s: expected the soundtrack, got %+v", dbType, results)
+		}
+		results, total, _ = Search(repo, Request{Categories: []int{5000}, Limit: 1})
+		if total != 2 || len(results) != 1 || results[0].InfoHash != "02" {
+			t.Errorf("%s: expected the newest video without query, got %d %+v", dbType, total, results)
+		}
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	results := []db.MetaData{{Name: "The.Show.S01E02", InfoHash: "ab", TotalSize: 42, DiscoveredOn: "02 Jan 26 15:04 UTC",
+		Categories: []string{"Video"}, Files: []any{map[string]any{"Path": "a.mkv"}}}}
+	var buf bytes.Buffer
+	if err := WriteResults(&buf, results, 0, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		`xmlns:torznab="http://torznab.com/schemas/2015/feed"`,
+		`<newznab:response offset="0" total="1"></newznab:response>`,
+		`<pubDate>Fri, 02 Jan 2026 15:04:00 +0000</pubDate>`,
+		`<torznab:attr name="infohash" value="ab"></torznab:attr>`,
+		`<torznab:attr name="magneturl" value="magnet:?xt=urn:btih:ab&amp;dn=The.Show.S01E02"></torznab:attr>`,
+		`<torznab:attr name="category" value="5000"></torznab:attr>`,
+		`<size>42</size>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %s in %s", expected, out)
+		}
+	}
+	if strings.Contains(out, "<enclosure") {
+		t.Errorf("expected no enclosure without .torrent files in %s", out)
+	}
+
+	buf.Reset()
+	if err := WriteResults(&buf, results, 0, 1, "https://cache.example.org/{infohash}.torrent"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<enclosure url="https://cache.example.org/AB.torrent" length="42" type="application/x-bittorrent"></enclosure>`; !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected %s in %s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteCaps(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<tv-search available="yes" supportedParams="q,season,ep">`) ||
+		!strings.Contains(buf.String(), `<subcat id="5040" name="TV/HD"></subcat>`) {
+		t.Errorf("unexpected caps %s", buf.String())
+	}
+
+	buf.Reset()
+	_ = WriteError(&buf, &Error{ErrorCredentials, "incorrect API key"})
+	if !strings.Contains(buf.String(), `<error code="100" description="incorrect API key"></error>`) {
+		t.Errorf("unexpected error %s", buf.String())
+	}
+}
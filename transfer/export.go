@@ -0,0 +1,258 @@
+package transfer
+
+import (
+	"compress/gzip"
+	"dhtc/db"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+const progressInterval = 10000
+
+type ExportOptions struct {
+	Format string
+	// Files includes the file list of every torrent.
+	Files bool
+	// Gzip compresses JSONL and CSV output. Parquet is always compressed.
+	Gzip    bool
+	Filters db.SearchFilters
+	// Key, MatchType and SearchInput restrict the export to the results of a
+	// search, see db.MatchSearch. Without SearchInput all torrents matching
+	// Filters are exported.
+	Key         string
+	MatchType   string
+	SearchInput string
+}
+
+type ExportResult struct {
+	Count int
+	// Cursor is the change sequence number of the last exported torrent.
+	// Pass it as Filters.AfterSeq to continue with an incremental export.
+	Cursor int64
+}
+
+type RecordFile struct {
+	Path string `json:"path" parquet:"path"`
+	Size int64  `json:"size" parquet:"size"`
+}
+
+// Record is a single exported torrent.
+type Record struct {
+	InfoHash     string       `json:"infoHash" parquet:"info_hash"`
+	Name         string       `json:"name" parquet:"name"`
+	TotalSize    uint64       `json:"totalSize" parquet:"total_size"`
+	DiscoveredOn int64        `json:"discoveredOn" parquet:"discovered_on"`
+	Categories   []string     `json:"categories" parquet:"categories,list"`
+	FileCount    int          `json:"fileCount" parquet:"file_count"`
+	Files        []RecordFile `json:"files,omitempty" parquet:"files,list"`
+}
+
+func NewRecord(t db.Torrent, withFiles bool) Record {
+	r := Record{
+		InfoHash:     t.InfoHash,
+		Name:         t.Name,
+		TotalSize:    t.TotalSize,
+		DiscoveredOn: t.DiscoveredOn,
+		Categories:   t.Categories,
+		FileCount:    len(t.Files),
+	}
+	if withFiles {
+		r.Files = make([]RecordFile, len(t.Files))
+		for i, f := range t.Files {
+			r.Files[i] = RecordFile{Path: f.Path, Size: f.Size}
+		}
+	}
+	return r
+}
+
+func ValidFormat(format string) bool {
+	return format == FormatJSONL || format == FormatCSV || format == FormatParquet
+}
+
+func FileExtension(opts ExportOptions) string {
+	ext := "." + opts.Format
+	if opts.Gzip && opts.Format != FormatParquet {
+		ext += ".gz"
+	}
+	return ext
+}
+
+func ContentType(opts ExportOptions) string {
+	switch {
+	case opts.Format == FormatParquet:
+		return "application/vnd.apache.parquet"
+	case opts.Gzip:
+		return "application/gzip"
+	case opts.Format == FormatCSV:
+		return "text/csv"
+	default:
+		return "application/x-ndjson"
+	}
+}
+
+// exportMatcher returns the search of opts, or a function matching all
+// torrents without search.
+func exportMatcher(opts ExportOptions) (func(t db.Torrent) bool, error) {
+	if opts.SearchInput == "" {
+		return func(db.Torrent) bool { return true }, nil
+	}
+	return db.MatchSearch(opts.Key, opts.MatchType, opts.SearchInput)
+}
+
+// Export streams all torrents matching the search and filters of opts from
+// database to w.
+func Export(database db.Repository, w io.Writer, opts ExportOptions) (ExportResult, error) {
+	res := ExportResult{Cursor: opts.Filters.AfterSeq}
+	if !ValidFormat(opts.Format) {
+		return res, fmt.Errorf("unsupported export format: %s", opts.Format)
+	}
+	match, err := exportMatcher(opts)
+	if err != nil {
+		return res, err
+	}
+
+	var gz *gzip.Writer
+	if opts.Gzip && opts.Format != FormatParquet {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	rw := newRecordWriter(opts, w)
+	err = database.ForEachTorrent(opts.Filters, func(c db.Change) error {
+		if !match(c.Torrent) {
+			return nil
+		}
+		if err := rw.Write(NewRecord(c.Torrent, opts.Files)); err != nil {
+			return err
+		}
+		res.Count++
+		res.Cursor = c.Seq
+		if res.Count%progressInterval == 0 {
+			log.Info().Msgf("exported %d torrents", res.Count)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	if err = rw.Close(); err != nil {
+		return res, err
+	}
+	if gz != nil {
+		err = gz.Close()
+	}
+	return res, err
+}
+
+type recordWriter interface {
+	Write(r Record) error
+	Close() error
+}
+
+func newRecordWriter(opts ExportOptions, w io.Writer) recordWriter {
+	switch opts.Format {
+	case FormatCSV:
+		return newCSVWriter(w, opts.Files)
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[Record](w, parquet.Compression(&parquet.Zstd))}
+	default:
+		return &jsonlWriter{enc: json.NewEncoder(w)}
+	}
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(r Record) error {
+	return w.enc.Encode(r)
+}
+
+func (w *jsonlWriter) Close() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	files  bool
+	header bool
+}
+
+func newCSVWriter(w io.Writer, files bool) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w), files: files}
+}
+
+func (w *csvWriter) Write(r Record) error {
+	if !w.header {
+		w.header = true
+		header := []string{"info_hash", "name", "total_size", "discovered_on", "categories", "file_count"}
+		if w.files {
+			header = append(header, "files")
+		}
+		if err := w.w.Write(header); err != nil {
+			return err
+		}
+	}
+
+	row := []string{
+		r.InfoHash,
+		r.Name,
+		strconv.FormatUint(r.TotalSize, 10),
+		strconv.FormatInt(r.DiscoveredOn, 10),
+		strings.Join(r.Categories, ","),
+		strconv.Itoa(r.FileCount),
+	}
+	if w.files {
+		files, err := json.Marshal(r.Files)
+		if err != nil {
+			return err
+		}
+		row = append(row, string(files))
+	}
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type parquetWriter struct {
+	w   *parquet.GenericWriter[Record]
+	buf []Record
+}
+
+func (w *parquetWriter) Write(r Record) error {
+	w.buf = append(w.buf, r)
+	if len(w.buf) < 1000 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *parquetWriter) flush() error {
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *parquetWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func insertTestTorrents(t *testing.T, repo db.Repository) {
+	t.Helper()
+	for i, name := range []string{"ubuntu-24.04.iso", "debian-12.iso", "arch.iso"} {
+		repo.InsertMetadata(dhtcclient.Metadata{
+			InfoHash:     []byte{byte(i), 1, 2, 3},
+			Name:         name,
+			TotalSize:    uint64(1000 * (i + 1)),
+			DiscoveredOn: int64(100 + i),
+			Files:        []dhtcclient.File{{Path: name, Size: int64(1000 * (i + 1))}},
+		})
+	}
+}
+
+func TestExportJSONL(t *testing.T) {
+	repo := dbtest.NewRepository(t, "clover")
+	insertTestTorrents(t, repo)
+
+	var buf bytes.Buffer
+	res, err := Export(repo, &buf, ExportOptions{Format: FormatJSONL, Files: true, Gzip: true, Filters: db.SearchFilters{AfterSeq: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 2 || res.Cursor != 3 {
+		t.Errorf("expected 2 torrents and cursor 3, got %+v", res)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []Record
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var r Record
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].Name != "debian-12.iso" || len(records[0].Files) != 1 {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
+
+func TestExportIncremental(t *testing.T) {
+	for _, dbType := range []string{"clover", "sqlite"} {
+		t.Run(dbType, func(t *testing.T) {
+			repo := dbtest.NewRepository(t, dbType)
+			insertTestTorrents(t, repo)
+			res, err := Export(repo, &bytes.Buffer{}, ExportOptions{Format: FormatJSONL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Torrents inserted later in the same second or with an older discovery
+			// date, like imported ones, belong to the next export.
+			repo.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{7}, Name: "same-second.iso", DiscoveredOn: 102})
+			_, _ = repo.MergeTorrents([]db.Torrent{{InfoHash: "08", Name: "imported.iso", DiscoveredOn: 10}})
+
+			var buf bytes.Buffer
+			res, err = Export(repo, &buf, ExportOptions{Format: FormatJSONL, Filters: db.SearchFilters{AfterSeq: res.Cursor}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Count != 2 || res.Cursor != 5 {
+				t.Errorf("expected 2 torrents and cursor 5, got %+v", res)
+			}
+			if out := buf.String(); !strings.Contains(out, "same-second.iso") || !strings.Contains(out, "imported.iso") {
+				t.Errorf("unexpected export %s", out)
+			}
+		})
+	}
+}
+
+func TestExportSearch(t *testing.T) {
+	repo := dbtest.NewRepository(t, "sqlite")
+	insertTestTorrents(t, repo)
+
+	var buf bytes.Buffer
+	res, err := Export(repo, &buf, ExportOptions{Format: FormatJSONL, Key: db.QueryKey, SearchInput: "iso -arch", Filters: db.SearchFilters{MinSize: 2000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); res.Count != 1 || !strings.Contains(out, "debian-12.iso") {
+		t.Errorf("expected only the matching torrent, got %+v %s", res, out)
+	}
+	if _, err = Export(repo, &bytes.Buffer{}, ExportOptions{Format: FormatJSONL, MatchType: db.MatchRegex, SearchInput: "("}); err == nil {
+		t.Error("expected an invalid search to fail")
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	repo := dbtest.NewRepository(t, "sqlite")
+	insertTestTorrents(t, repo)
+
+	var buf bytes.Buffer
+	if _, err := Export(repo, &buf, ExportOptions{Format: FormatCSV, Filters: db.SearchFilters{MinSize: 2000}}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "info_hash" || rows[1][1] != "debian-12.iso" {
+		t.Errorf("unexpected csv %v", rows)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	repo := dbtest.NewRepository(t, "clover")
+	insertTestTorrents(t, repo)
+
+	var buf bytes.Buffer
+	if _, err := Export(repo, &buf, ExportOptions{Format: FormatParquet, Files: true}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := parquet.Read[Record](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].Name != "arch.iso" || records[2].Files[0].Size != 3000 {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
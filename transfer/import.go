@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"dhtc/db"
+	dhtcclient "dhtc/dhtc-client"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // magnetico dumps are SQLite databases
+	"github.com/rs/zerolog/log"
+)
+
+const FormatMagnetico = "magnetico"
+
+type ImportOptions struct {
+	// Format is jsonl, magnetico or empty to guess it from the file extension.
+	Format    string
+	BatchSize int
+}
+
+type ImportResult struct {
+	Read int
+	db.MergeResult
+}
+
+// importer collects torrents into batches and merges them into the repository.
+// Torrents are written straight into the repository, so importing never
+// triggers watch notifications.
+type importer struct {
+	database  db.Repository
+	batchSize int
+	batch     []db.Torrent
+	res       ImportResult
+}
+
+func newImporter(database db.Repository, batchSize int) *importer {
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+	return &importer{database: database, batchSize: batchSize}
+}
+
+func (i *importer) add(t db.Torrent) error {
+	i.res.Read++
+	if _, err := hex.DecodeString(t.InfoHash); err != nil || t.InfoHash == "" {
+		i.res.Skipped++
+		return nil
+	}
+	i.batch = append(i.batch, t)
+	if len(i.batch) < i.batchSize {
+		return nil
+	}
+	return i.flush()
+}
+
+func (i *importer) flush() error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+	res, err := i.database.MergeTorrents(i.batch)
+	i.batch = i.batch[:0]
+	i.res.Add(res)
+	log.Info().Msgf("read %d torrents: %d new, %d merged, %d skipped", i.res.Read, i.res.Inserted, i.res.Merged, i.res.Skipped)
+	return err
+}
+
+// ImportFile imports a dhtc JSONL export (optionally gzipped) or a magnetico database.
+func ImportFile(database db.Repository, path string, opts ImportOptions) (ImportResult, error) {
+	format := opts.Format
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".sqlite", ".sqlite3", ".db":
+			format = FormatMagnetico
+		default:
+			format = FormatJSONL
+		}
+	}
+
+	switch format {
+	case FormatMagnetico:
+		return ImportMagnetico(database, path, opts.BatchSize)
+	case FormatJSONL:
+		file, err := os.Open(path)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		defer file.Close()
+		return ImportJSONL(database, file, opts.BatchSize)
+	}
+	return ImportResult{}, fmt.Errorf("unsupported import format: %s", format)
+}
+
+func ImportJSONL(database db.Repository, r io.Reader, batchSize int) (ImportResult, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	imp := newImporter(database, batchSize)
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imp.res, err
+		}
+		if err = imp.add(rec.Torrent()); err != nil {
+			return imp.res, err
+		}
+	}
+	return imp.res, imp.flush()
+}
+
+func (r Record) Torrent() db.Torrent {
+	files := make([]dhtcclient.File, len(r.Files))
+	for i, f := range r.Files {
+		files[i] = dhtcclient.File{Path: f.Path, Size: f.Size}
+	}
+	return db.Torrent{
+		InfoHash:     strings.ToLower(r.InfoHash),
+		Name:         r.Name,
+		TotalSize:    r.TotalSize,
+		DiscoveredOn: r.DiscoveredOn,
+		Files:        files,
+		Categories:   r.Categories,
+	}
+}
+
+// ImportMagnetico imports the torrents and files tables of a magnetico SQLite database.
+func ImportMagnetico(database db.Repository, path string, batchSize int) (ImportResult, error) {
+	source, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer source.Close()
+
+	imp := newImporter(database, batchSize)
+	var lastId int64
+	for {
+		torrents, ids, err := readMagneticoTorrents(source, lastId, imp.batchSize)
+		if err != nil {
+			return imp.res, err
+		}
+		if len(torrents) == 0 {
+			break
+		}
+		if err = readMagneticoFiles(source, ids, torrents); err != nil {
+			return imp.res, err
+		}
+		for _, id := range ids {
+			if err = imp.add(*torrents[id]); err != nil {
+				return imp.res, err
+			}
+		}
+		lastId = ids[len(ids)-1]
+	}
+	return imp.res, imp.flush()
+}
+
+func readMagneticoTorrents(source *sql.DB, afterId int64, limit int) (map[int64]*db.Torrent, []int64, error) {
+	rows, err := source.Query("SELECT id, info_hash, name, total_size, discovered_on FROM torrents WHERE id > ? ORDER BY id LIMIT ?", afterId, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	torrents := make(map[int64]*db.Torrent)
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var infoHash []byte
+		var t db.Torrent
+		if err = rows.Scan(&id, &infoHash, &t.Name, &t.TotalSize, &t.DiscoveredOn); err != nil {
+			return nil, nil, err
+		}
+		t.InfoHash = hex.EncodeToString(infoHash)
+		torrents[id] = &t
+		ids = append(ids, id)
+	}
+	return torrents, ids, rows.Err()
+}
+
+func readMagneticoFiles(source *sql.DB, ids []int64, torrents map[int64]*db.Torrent) error {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := source.Query("SELECT torrent_id, size, path FROM files WHERE torrent_id IN ("+placeholders+")", args...) //nolint:gosec // only placeholders are concatenated
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var torrentId int64
+		var f dhtcclient.File
+		if err = rows.Scan(&torrentId, &f.Size, &f.Path); err != nil {
+			return err
+		}
+		if t, ok := torrents[torrentId]; ok {
+			t.Files = append(t.Files, f)
+		}
+	}
+	return rows.Err()
+}
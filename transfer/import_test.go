@@ -0,0 +1,85 @@
+package transfer
+
+import (
+	"bytes"
+	"database/sql"
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportJSONLMergesDuplicates(t *testing.T) {
+	source := dbtest.NewRepository(t, "clover")
+	insertTestTorrents(t, source)
+	var buf bytes.Buffer
+	if _, err := Export(source, &buf, ExportOptions{Format: FormatJSONL, Files: true, Gzip: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	target := dbtest.NewRepository(t, "sqlite")
+	_, _ = target.MergeTorrents([]db.Torrent{{
+		InfoHash:     "00010203",
+		Name:         "ubuntu-24.04.iso",
+		DiscoveredOn: 500,
+		Files:        nil,
+	}})
+
+	res, err := ImportJSONL(target, &buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Read != 3 || res.Inserted != 2 || res.Merged != 1 {
+		t.Errorf("unexpected import result %+v", res)
+	}
+
+	var merged db.Torrent
+	_ = target.ForEachTorrent(db.SearchFilters{}, func(c db.Change) error {
+		if c.InfoHash == "00010203" {
+			merged = c.Torrent
+		}
+		return nil
+	})
+	if merged.DiscoveredOn != 100 || len(merged.Files) != 1 {
+		t.Errorf("expected earliest discovery date and merged files, got %+v", merged)
+	}
+}
+
+func TestImportMagnetico(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.sqlite3")
+	magnetico, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"CREATE TABLE torrents (id INTEGER PRIMARY KEY, info_hash BLOB NOT NULL UNIQUE, name TEXT NOT NULL, total_size INTEGER NOT NULL, discovered_on INTEGER NOT NULL)",
+		"CREATE TABLE files (id INTEGER PRIMARY KEY, torrent_id INTEGER REFERENCES torrents, size INTEGER NOT NULL, path TEXT NOT NULL)",
+		"INSERT INTO torrents VALUES (1, x'aabb', 'Some Show S01', 300, 1000), (2, x'ccdd', 'debian.iso', 100, 2000)",
+		"INSERT INTO files VALUES (1, 1, 100, 'e01.mkv'), (2, 1, 200, 'e02.mkv'), (3, 2, 100, 'debian.iso')",
+	}
+	for _, stmt := range statements {
+		if _, err = magnetico.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = magnetico.Close()
+
+	target := dbtest.NewRepository(t, "clover")
+	res, err := ImportFile(target, path, ImportOptions{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Inserted != 2 {
+		t.Errorf("expected 2 inserted torrents, got %+v", res)
+	}
+
+	var imported []db.Torrent
+	_ = target.ForEachTorrent(db.SearchFilters{}, func(c db.Change) error {
+		imported = append(imported, c.Torrent)
+		return nil
+	})
+	if len(imported) != 2 || imported[0].InfoHash != "aabb" || len(imported[0].Files) != 2 || !strings.Contains(strings.Join(imported[0].Categories, ","), "Video") {
+		t.Errorf("unexpected imported torrents %+v", imported)
+	}
+}
@@ -0,0 +1,361 @@
+package transfer
+
+import (
+	"dhtc/db"
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+type MigrateOptions struct {
+	// Checkpoint names the migration in the key value store of the target
+	// repository, so that an interrupted migration can be resumed.
+	Checkpoint string
+	// Restart ignores a stored checkpoint and copies all torrents again.
+	Restart   bool
+	BatchSize int
+}
+
+type MigrateResult struct {
+	Torrents      db.MergeResult
+	Watches       int
+	WatchHits     int
+	Blacklist     int
+	Stats         int
+	SavedSearches int
+}
+
+type VerifyCount struct {
+	Table  string
+	Source int
+	Target int
+	// Missing is the number of source entries which are not in the target.
+	Missing int
+}
+
+// Ok reports whether the target contains every entry of the source.
+func (v VerifyCount) Ok() bool {
+	return v.Missing == 0
+}
+
+// Migrate copies watches and their hits, blacklist entries, stats, saved searches and torrents from
+// source to target. Torrents are streamed in the order they were inserted and the progress is
+// checkpointed in the target after every batch. Entries which already exist in the target are not
+// duplicated.
+func Migrate(source db.Repository, target db.Repository, opts MigrateOptions) (MigrateResult, error) {
+	var res MigrateResult
+	var err error
+
+	watchIds := make(map[string]string)
+	if res.Watches, watchIds, err = migrateWatches(source, target); err != nil {
+		return res, err
+	}
+	if res.WatchHits, err = migrateWatchHits(source, target, watchIds); err != nil {
+		return res, err
+	}
+	if res.Blacklist, err = migrateBlacklist(source, target); err != nil {
+		return res, err
+	}
+	if res.Stats, err = migrateStats(source, target); err != nil {
+		return res, err
+	}
+	if res.SavedSearches, err = migrateSavedSearches(source, target); err != nil {
+		return res, err
+	}
+	res.Torrents, err = migrateTorrents(source, target, opts)
+	return res, err
+}
+
+// watchKey identifies a watch entry across repositories. Watch entries contain
+// lists, so they are compared by their formatting.
+func watchKey(w db.WatchEntry) string {
+	w.Id = ""
+	return fmt.Sprintf("%+v", w)
+}
+
+// migrateWatches copies the watch entries and returns the ids of the source
+// entries in the target.
+func migrateWatches(source db.Repository, target db.Repository) (int, map[string]string, error) {
+	existing := make(map[string]bool)
+	for _, w := range target.GetWatchEntries() {
+		existing[watchKey(w)] = true
+	}
+
+	n := 0
+	entries := source.GetWatchEntries()
+	for _, w := range entries {
+		if existing[watchKey(w)] {
+			continue
+		}
+		if target.InsertWatchEntry(w) {
+			n++
+		}
+	}
+
+	targetIds := make(map[string]string)
+	for _, w := range target.GetWatchEntries() {
+		targetIds[watchKey(w)] = w.Id
+	}
+	ids := make(map[string]string, len(entries))
+	for _, w := range entries {
+		if id, ok := targetIds[watchKey(w)]; ok {
+			ids[w.Id] = id
+		}
+	}
+	return n, ids, nil
+}
+
+// watchHitKey identifies a hit of a watch across repositories.
+func watchHitKey(h db.WatchHit) string {
+	return h.InfoHash + ":" + strconv.FormatInt(h.Time, 10)
+}
+
+// migrateWatchHits copies the hits of the watches, whose ids in the target are
+// given by the ids of the source.
+func migrateWatchHits(source db.Repository, target db.Repository, ids map[string]string) (int, error) {
+	n := 0
+	for sourceId, targetId := range ids {
+		hits, err := source.GetWatchHitsSince(sourceId, 0)
+		if err != nil {
+			return n, err
+		}
+		existing, err := target.GetWatchHitsSince(targetId, 0)
+		if err != nil {
+			return n, err
+		}
+		seen := make(map[string]bool, len(existing))
+		for _, h := range existing {
+			seen[watchHitKey(h)] = true
+		}
+		for _, h := range hits {
+			if seen[watchHitKey(h)] {
+				continue
+			}
+			h.Id, h.WatchId = "", targetId
+			if _, err = target.InsertWatchHit(h); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// migrateSavedSearches copies the saved searches with their feed tokens, which
+// identify them across repositories.
+func migrateSavedSearches(source db.Repository, target db.Repository) (int, error) {
+	existing, err := target.GetSavedSearches()
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool, len(existing))
+	for _, s := range existing {
+		seen[s.Token] = true
+	}
+
+	searches, err := source.GetSavedSearches()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range searches {
+		if seen[s.Token] {
+			continue
+		}
+		s.Id = ""
+		if _, err = target.InsertSavedSearch(s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func migrateBlacklist(source db.Repository, target db.Repository) (int, error) {
+	before := len(target.GetBlacklistEntries())
+	for _, e := range source.GetBlacklistEntries() {
+		target.AddToBlacklist([]string{e.Filter}, db.GetBlacklistStrIntFromType(e.Type))
+	}
+	return len(target.GetBlacklistEntries()) - before, nil
+}
+
+func migrateStats(source db.Repository, target db.Repository) (int, error) {
+	existing, err := target.GetStats()
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[int64]bool, len(existing))
+	for _, s := range existing {
+		seen[s.Timestamp.Unix()] = true
+	}
+
+	stats, err := source.GetStats()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range stats {
+		if seen[s.Timestamp.Unix()] {
+			continue
+		}
+		if err = target.InsertStats(s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func migrateTorrents(source db.Repository, target db.Repository, opts MigrateOptions) (db.MergeResult, error) {
+	var res db.MergeResult
+	batchSize := opts.BatchSize
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+
+	// The checkpoint is the change sequence number of the source torrent last
+	// copied, so torrents added to the source in the meantime are copied too.
+	cursorKey := "migrate." + opts.Checkpoint + ".seq"
+	var after int64
+	if !opts.Restart {
+		value, err := target.GetValue(cursorKey)
+		if err != nil {
+			return res, err
+		}
+		after, _ = strconv.ParseInt(value, 10, 64)
+		if after > 0 {
+			log.Info().Msgf("resuming migration after torrent %d of the source", after)
+		}
+	}
+
+	batch := make([]db.Change, 0, batchSize)
+	read := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		torrents := make([]db.Torrent, len(batch))
+		for i, c := range batch {
+			torrents[i] = c.Torrent
+		}
+		merged, err := target.MergeTorrents(torrents)
+		res.Add(merged)
+		if err != nil {
+			return err
+		}
+		cursor := batch[len(batch)-1].Seq
+		batch = batch[:0]
+		log.Info().Msgf("migrated %d torrents: %d new, %d merged, %d skipped", read, res.Inserted, res.Merged, res.Skipped)
+		return target.SetValue(cursorKey, strconv.FormatInt(cursor, 10))
+	}
+
+	err := source.ForEachTorrent(db.SearchFilters{AfterSeq: after}, func(c db.Change) error {
+		read++
+		batch = append(batch, c)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, flush()
+}
+
+// Verify compares the entries of source and target by their keys: torrents by
+// info hash, watches by their rules, watch hits by their watch, torrent and
+// time, blacklist entries by filter, stats by timestamp and saved searches by
+// feed token.
+func Verify(source db.Repository, target db.Repository) ([]VerifyCount, error) {
+	sourceHashes, err := source.GetAllInfoHashes()
+	if err != nil {
+		return nil, err
+	}
+	targetHashes, err := target.GetAllInfoHashes()
+	if err != nil {
+		return nil, err
+	}
+	sourceStats, err := source.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	targetStats, err := target.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	sourceHits, err := allWatchHitKeys(source)
+	if err != nil {
+		return nil, err
+	}
+	targetHits, err := allWatchHitKeys(target)
+	if err != nil {
+		return nil, err
+	}
+	sourceSearches, err := source.GetSavedSearches()
+	if err != nil {
+		return nil, err
+	}
+	targetSearches, err := target.GetSavedSearches()
+	if err != nil {
+		return nil, err
+	}
+
+	blacklistKey := func(e db.BlacklistEntry) string {
+		return e.Type + ":" + e.Filter
+	}
+	statsKey := func(s db.Stats) string {
+		return strconv.FormatInt(s.Timestamp.Unix(), 10)
+	}
+	savedSearchKey := func(s db.SavedSearch) string {
+		return s.Token
+	}
+	return []VerifyCount{
+		verifyKeys("torrents", sourceHashes, targetHashes),
+		verifyKeys("watches", keys(source.GetWatchEntries(), watchKey), keys(target.GetWatchEntries(), watchKey)),
+		verifyKeys("watch hits", sourceHits, targetHits),
+		verifyKeys("blacklist", keys(source.GetBlacklistEntries(), blacklistKey), keys(target.GetBlacklistEntries(), blacklistKey)),
+		verifyKeys("stats", keys(sourceStats, statsKey), keys(targetStats, statsKey)),
+		verifyKeys("saved searches", keys(sourceSearches, savedSearchKey), keys(targetSearches, savedSearchKey)),
+	}, nil
+}
+
+// allWatchHitKeys returns the keys of the hits of all watches of repo, made of
+// the key of their watch and watchHitKey.
+func allWatchHitKeys(repo db.Repository) ([]string, error) {
+	var res []string
+	for _, w := range repo.GetWatchEntries() {
+		hits, err := repo.GetWatchHitsSince(w.Id, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hits {
+			res = append(res, watchKey(w)+"/"+watchHitKey(h))
+		}
+	}
+	return res, nil
+}
+
+func keys[T any](entries []T, key func(T) string) []string {
+	res := make([]string, len(entries))
+	for i, e := range entries {
+		res[i] = key(e)
+	}
+	return res
+}
+
+// verifyKeys counts the keys of source which are missing in target.
+func verifyKeys(table string, source []string, target []string) VerifyCount {
+	existing := make(map[string]bool, len(target))
+	for _, k := range target {
+		existing[k] = true
+	}
+	v := VerifyCount{Table: table, Source: len(source), Target: len(target)}
+	for _, k := range source {
+		if !existing[k] {
+			v.Missing++
+		}
+	}
+	return v
+}
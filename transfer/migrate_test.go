@@ -0,0 +1,85 @@
+package transfer
+
+import (
+	"dhtc/db"
+	"dhtc/db/dbtest"
+	dhtcclient "dhtc/dhtc-client"
+	"testing"
+	"time"
+)
+
+func TestMigrateResumesAndVerifies(t *testing.T) {
+	source := dbtest.NewRepository(t, "clover")
+	insertTestTorrents(t, source)
+	source.InsertWatchEntry(db.WatchEntry{Key: "Name", MatchType: "contains", Content: "ubuntu", Categories: []string{"Software"}})
+	source.AddToBlacklist([]string{"spam"}, "0")
+	if err := source.InsertStats(db.Stats{Timestamp: time.Unix(1000, 0), TorrentCount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	watch := source.GetWatchEntries()[0]
+	if _, err := source.InsertWatchHit(db.WatchHit{WatchId: watch.Id, InfoHash: "00010203", Name: "ubuntu-24.04.iso", Time: 100}); err != nil {
+		t.Fatal(err)
+	}
+	search, err := db.NewSavedSearch("linux", "Name", "contains", "linux", db.SearchFilters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = source.InsertSavedSearch(search); err != nil {
+		t.Fatal(err)
+	}
+
+	target := dbtest.NewRepository(t, "sqlite")
+	opts := MigrateOptions{Checkpoint: "clover:test", BatchSize: 2}
+	res, err := Migrate(source, target, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Torrents.Inserted != 3 || res.Watches != 1 || res.WatchHits != 1 || res.Blacklist != 1 || res.Stats != 1 || res.SavedSearches != 1 {
+		t.Errorf("unexpected migration result %+v", res)
+	}
+
+	// A second run resumes from the checkpoint, copies the torrents added in
+	// the meantime, even with an older discovery date, and does not duplicate
+	// anything.
+	source.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{9}, Name: "old.iso", DiscoveredOn: 10})
+	res, err = Migrate(source, target, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Torrents.Inserted != 1 || res.Torrents.Merged != 0 || res.Watches != 0 || res.WatchHits != 0 || res.Blacklist != 0 || res.Stats != 0 || res.SavedSearches != 0 {
+		t.Errorf("expected resumed migration to copy only the new torrent, got %+v", res)
+	}
+
+	counts, err := Verify(source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range counts {
+		if c.Source != c.Target || !c.Ok() {
+			t.Errorf("%s: %d in source, %d in target, %d missing", c.Table, c.Source, c.Target, c.Missing)
+		}
+	}
+	if searches, _ := target.GetSavedSearches(); len(searches) != 1 || searches[0].Token != search.Token {
+		t.Errorf("expected the saved search to keep its feed token, got %+v", searches)
+	}
+}
+
+func TestVerifyReportsMissingTorrents(t *testing.T) {
+	source := dbtest.NewRepository(t, "clover")
+	insertTestTorrents(t, source)
+
+	// The target has more torrents than the source, but not all of them.
+	target := dbtest.NewRepository(t, "sqlite")
+	for i := range 4 {
+		target.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{byte(i), 1, 2, 4}, Name: "other.iso"})
+	}
+	target.InsertMetadata(dhtcclient.Metadata{InfoHash: []byte{0, 1, 2, 3}, Name: "ubuntu-24.04.iso"})
+
+	counts, err := Verify(source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[0].Table != "torrents" || counts[0].Missing != 2 || counts[0].Ok() {
+		t.Errorf("expected 2 missing torrents, got %+v", counts[0])
+	}
+}
@@ -1,27 +1,49 @@
 package ui
 
 import (
+	"dhtc/db"
+	"dhtc/transfer"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 )
 
 func (c *Controller) APISearch(ctx *gin.Context) {
 	params := c.parseSearchParams(ctx)
+	if !parseCursor(ctx, &params.Filters) {
+		return
+	}
 
 	results, total, err := c.Database.Search(params.Key, params.MatchType, params.SearchInput, params.Limit, params.Offset, params.Filters)
+	if errors.Is(err, db.ErrInvalidQuery) || errors.Is(err, db.ErrInvalidCursor) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	ctx.JSON(http.StatusOK, gin.H{
+	res := gin.H{
 		"results":     results,
 		"total":       total,
+		"next":        db.NextCursor(results, params.Limit),
 		"currentPage": params.Page,
 		"totalPages":  (total + int64(params.Limit) - 1) / int64(params.Limit),
-	})
+	}
+	// Facets count all results, so they are only computed on request and never
+	// for the following pages of a cursor.
+	if ctx.Query("facets") == "1" && params.Filters.Cursor.IsZero() {
+		facets, err := c.Database.Facets(params.Key, params.MatchType, params.SearchInput, params.Filters)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res["facets"] = facets
+	}
+	ctx.JSON(http.StatusOK, res)
 }
 
 func (c *Controller) APIStats(ctx *gin.Context) {
@@ -51,8 +73,16 @@ func (c *Controller) APICategories(ctx *gin.Context) {
 
 func (c *Controller) APILatest(ctx *gin.Context) {
 	page, limit, offset := c.parsePagination(ctx)
+	filters := c.parseSearchParams(ctx).Filters
+	if !parseCursor(ctx, &filters) {
+		return
+	}
 
-	results, total, err := c.Database.GetLatest(limit, offset)
+	results, total, err := c.Database.GetLatest(limit, offset, filters)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -61,7 +91,49 @@ func (c *Controller) APILatest(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{
 		"results":     results,
 		"total":       total,
+		"next":        db.NextCursor(results, limit),
 		"currentPage": page,
 		"totalPages":  (total + int64(limit) - 1) / int64(limit),
 	})
 }
+
+// APIExport streams an export. The response is sent before the export ends,
+// so failures are reported by the X-Export-Error trailer, and X-Export-Count
+// and X-Export-Cursor are only set for complete exports.
+func (c *Controller) APIExport(ctx *gin.Context) {
+	params := c.parseSearchParams(ctx)
+	opts := transfer.ExportOptions{
+		Format:      ctx.DefaultQuery("format", transfer.FormatJSONL),
+		Files:       ctx.Query("files") == "true",
+		Gzip:        ctx.DefaultQuery("gzip", "true") == "true",
+		Filters:     params.Filters,
+		Key:         params.Key,
+		MatchType:   params.MatchType,
+		SearchInput: params.SearchInput,
+	}
+	opts.Filters.AfterSeq, _ = strconv.ParseInt(ctx.Query("after"), 10, 64)
+	if !transfer.ValidFormat(opts.Format) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of jsonl, csv or parquet"})
+		return
+	}
+	if opts.SearchInput != "" {
+		if _, err := db.MatchSearch(opts.Key, opts.MatchType, opts.SearchInput); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx.Header("Content-Type", transfer.ContentType(opts))
+	ctx.Header("Content-Disposition", `attachment; filename="dhtc-export`+transfer.FileExtension(opts)+`"`)
+	ctx.Header("Trailer", "X-Export-Count, X-Export-Cursor, X-Export-Error")
+	ctx.Status(http.StatusOK)
+
+	res, err := transfer.Export(c.Database, ctx.Writer, opts)
+	if err != nil {
+		log.Error().Err(err).Msg("export failed")
+		ctx.Writer.Header().Set("X-Export-Error", err.Error())
+		return
+	}
+	ctx.Writer.Header().Set("X-Export-Count", strconv.Itoa(res.Count))
+	ctx.Writer.Header().Set("X-Export-Cursor", strconv.FormatInt(res.Cursor, 10))
+}
@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"dhtc/db"
 	"net/http"
 	"strconv"
 
@@ -18,7 +19,9 @@ func (c *Controller) DiscoverGet(ctx *gin.Context) {
 	}
 	offset := (page - 1) * limit
 
-	results, total, _ := c.Database.GetLatest(limit, offset)
+	// Near-duplicates are grouped, unless the variants of one cluster are shown.
+	cluster := ctx.Query("cluster")
+	results, total, _ := c.Database.GetLatest(limit, offset, db.SearchFilters{Collapse: cluster == "", Cluster: cluster})
 
 	h := c.getCommonH(ctx)
 	h["results"] = results
@@ -26,6 +29,7 @@ func (c *Controller) DiscoverGet(ctx *gin.Context) {
 	h["totalPages"] = (total + int64(limit) - 1) / int64(limit)
 	h["limit"] = limit
 	h["total"] = total
+	h["cluster"] = cluster
 
 	ctx.HTML(http.StatusOK, "discover", h)
 }
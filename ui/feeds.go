@@ -0,0 +1,146 @@
+package ui
+
+import (
+	"dhtc/db"
+	"dhtc/feed"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// FeedGet serves a saved search as RSS or Atom feed. Torrent clients can not
+// always send headers, so the token is accepted as query parameter as well.
+func (c *Controller) FeedGet(ctx *gin.Context) {
+	token := ctx.Query("token")
+	if bearer, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	s, err := c.Database.GetSavedSearch(ctx.Param("id"))
+	if errors.Is(err, db.ErrNotFound) {
+		// The ids change when the database is migrated to another backend, so
+		// the feeds subscribed before are found by their token.
+		s, err = savedSearchByToken(c.Database, token)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		ctx.String(http.StatusNotFound, "feed not found")
+		return
+	}
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !feed.Authorized(token, s.Token) {
+		ctx.String(http.StatusUnauthorized, "invalid feed token")
+		return
+	}
+
+	format := ctx.DefaultQuery("format", feed.FormatRSS)
+	if !feed.ValidFormat(format) {
+		ctx.String(http.StatusBadRequest, "format must be rss or atom")
+		return
+	}
+	limit, _ := strconv.Atoi(ctx.Query("limit"))
+	results, err := feed.Read(c.Database, s, limit)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Header("Content-Type", feed.ContentType(format))
+	ctx.Status(http.StatusOK)
+	err = feed.Write(ctx.Writer, feed.Items(results, c.Configuration.FeedTorrentURL), feed.Options{
+		Format: format,
+		Title:  s.Name,
+		Link:   baseURL(ctx) + "/feeds/" + s.Id,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("could not write feed")
+	}
+}
+
+func (c *Controller) FeedsGet(ctx *gin.Context) {
+	c.renderFeeds(ctx, "", false)
+}
+
+func (c *Controller) FeedsPost(ctx *gin.Context) {
+	opOk := false
+	op := ctx.PostForm("op")
+	if op == "add" {
+		query, _ := url.ParseQuery(ctx.PostForm("query"))
+		params := searchParamsOf(query)
+		name := strings.TrimSpace(ctx.PostForm("name"))
+		if name == "" {
+			name = params.SearchInput
+		}
+		if params.SearchInput != "" {
+			s, err := db.NewSavedSearch(name, params.Key, params.MatchType, params.SearchInput, params.Filters)
+			if err == nil {
+				_, err = c.Database.InsertSavedSearch(s)
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("could not save search")
+			}
+			opOk = err == nil
+		}
+	} else if op == "delete" {
+		opOk = c.Database.DeleteSavedSearch(ctx.PostForm("id")) == nil
+	}
+	c.renderFeeds(ctx, op, opOk)
+}
+
+// savedFeed is a saved search with the URLs of its feeds.
+type savedFeed struct {
+	db.SavedSearch
+	RSS  string
+	Atom string
+}
+
+func (c *Controller) renderFeeds(ctx *gin.Context, op string, opOk bool) {
+	searches, err := c.Database.GetSavedSearches()
+	if err != nil {
+		log.Error().Err(err).Msg("could not load saved searches")
+	}
+	feeds := make([]savedFeed, len(searches))
+	for i, s := range searches {
+		link := baseURL(ctx) + "/feeds/" + s.Id + "?token=" + s.Token
+		feeds[i] = savedFeed{SavedSearch: s, RSS: link, Atom: link + "&format=" + feed.FormatAtom}
+	}
+
+	h := c.getCommonH(ctx)
+	h["op"] = op
+	h["opOk"] = opOk
+	h["results"] = feeds
+	ctx.HTML(http.StatusOK, "feeds", h)
+}
+
+// baseURL returns the scheme and host the request was sent to.
+func baseURL(ctx *gin.Context) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil || ctx.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host
+}
+
+// savedSearchByToken returns the saved search with the feed token, or
+// db.ErrNotFound.
+func savedSearchByToken(database db.Repository, token string) (db.SavedSearch, error) {
+	if token == "" {
+		return db.SavedSearch{}, db.ErrNotFound
+	}
+	searches, err := database.GetSavedSearches()
+	if err != nil {
+		return db.SavedSearch{}, err
+	}
+	for _, s := range searches {
+		if feed.Authorized(token, s.Token) {
+			return s, nil
+		}
+	}
+	return db.SavedSearch{}, db.ErrNotFound
+}
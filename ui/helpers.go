@@ -4,6 +4,7 @@ import (
 	"dhtc/db"
 	"dhtc/downloader"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -37,58 +38,86 @@ func (c *Controller) parsePagination(ctx *gin.Context) (page, limit, offset int)
 }
 
 func (c *Controller) parseSearchParams(ctx *gin.Context) SearchParams {
-	key := ctx.Query("key")
-	matchType := ctx.Query("match-type")
-	searchInput := ctx.Query("search-input")
-	page, limit, offset := c.parsePagination(ctx)
+	params := searchParamsOf(ctx.Request.URL.Query())
+	params.Page, params.Limit, params.Offset = c.parsePagination(ctx)
+	return params
+}
+
+// searchParamsOf parses the search of a query string, without pagination.
+func searchParamsOf(query url.Values) SearchParams {
+	key := query.Get("key")
+	matchType := query.Get("match-type")
+	searchInput := query.Get("search-input")
 
-	minSize, _ := strconv.ParseUint(ctx.DefaultQuery("min-size", "0"), 10, 64)
-	maxSize, _ := strconv.ParseUint(ctx.DefaultQuery("max-size", "0"), 10, 64)
+	minSize, _ := strconv.ParseUint(query.Get("min-size"), 10, 64)
+	maxSize, _ := strconv.ParseUint(query.Get("max-size"), 10, 64)
 
-	startDateVal := ctx.Query("start-date-val")
-	endDateVal := ctx.Query("end-date-val")
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+
+	startDateVal := query.Get("start-date-val")
+	endDateVal := query.Get("end-date-val")
 
 	var startDate, endDate int64
 	if startDateVal != "" {
 		t, _ := time.Parse("2006-01-02", startDateVal)
 		startDate = t.Unix()
 	} else {
-		startDate, _ = strconv.ParseInt(ctx.DefaultQuery("start-date", "0"), 10, 64)
+		startDate, _ = strconv.ParseInt(query.Get("start-date"), 10, 64)
 	}
 
 	if endDateVal != "" {
 		t, _ := time.Parse("2006-01-02", endDateVal)
 		endDate = t.Unix()
 	} else {
-		endDate, _ = strconv.ParseInt(ctx.DefaultQuery("end-date", "0"), 10, 64)
+		endDate, _ = strconv.ParseInt(query.Get("end-date"), 10, 64)
 	}
 
 	return SearchParams{
 		Key:          key,
 		MatchType:    matchType,
 		SearchInput:  searchInput,
-		Page:         page,
-		Limit:        limit,
-		Offset:       offset,
 		StartDateVal: startDateVal,
 		EndDateVal:   endDateVal,
 		Filters: db.SearchFilters{
-			MinSize:   minSize,
-			MaxSize:   maxSize,
-			StartDate: startDate,
-			EndDate:   endDate,
+			MinSize:          minSize,
+			MaxSize:          maxSize,
+			StartDate:        startDate,
+			EndDate:          endDate,
+			Since:            since,
+			Categories:       query["category"],
+			Extensions:       query["ext"],
+			Sort:             query.Get("sort"),
+			SortAscending:    query.Get("order") == "asc",
+			ApproximateTotal: query.Get("approximate-total") == "true",
+			Collapse:         query.Get("collapse") == "true",
+			Cluster:          query.Get("cluster"),
 		},
 	}
 }
 
-func (c *Controller) handleDownload(ctx *gin.Context, client downloader.Client, name string) {
+// parseCursor sets the cursor of filters from the request, or responds with an
+// error and returns false if the cursor is invalid.
+func parseCursor(ctx *gin.Context, filters *db.SearchFilters) bool {
+	cursor, err := db.ParseCursor(ctx.Query("cursor"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	filters.Cursor = cursor
+	return true
+}
+
+func (c *Controller) handleDownload(ctx *gin.Context, name string) {
 	magnet := ctx.Query("magnet")
 	if magnet == "" {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "magnet is required"})
 		return
 	}
 
-	err := client.AddMagnet(magnet)
+	client, err := downloader.New(name, c.Configuration)
+	if err == nil {
+		err = client.AddMagnet(magnet, downloader.Options{})
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
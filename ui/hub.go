@@ -24,6 +24,10 @@ type Hub struct {
 	register   chan *websocket.Conn
 	unregister chan *websocket.Conn
 	mu         sync.Mutex
+
+	// changed is closed and replaced whenever new metadata is broadcast.
+	changed   chan struct{}
+	changedMu sync.Mutex
 }
 
 func NewHub() *Hub {
@@ -32,6 +36,7 @@ func NewHub() *Hub {
 		broadcast:  make(chan []byte),
 		register:   make(chan *websocket.Conn),
 		unregister: make(chan *websocket.Conn),
+		changed:    make(chan struct{}),
 	}
 }
 
@@ -83,6 +88,18 @@ func (h *Hub) BroadcastMetadata(md dhtcclient.Metadata) {
 		Categories:   db.Categorize(md),
 	}
 	h.Broadcast(msg)
+
+	h.changedMu.Lock()
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.changedMu.Unlock()
+}
+
+// Changed returns a channel which is closed as soon as the next metadata is broadcast.
+func (h *Hub) Changed() <-chan struct{} {
+	h.changedMu.Lock()
+	defer h.changedMu.Unlock()
+	return h.changed
 }
 
 func (h *Hub) Broadcast(v any) {
@@ -0,0 +1,42 @@
+package ui
+
+import (
+	"dhtc/replication"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIReplicationFeed serves the torrents inserted after the cursor "after". If
+// there are none, the request is held until the next torrent is discovered or
+// "wait" seconds have passed.
+func (c *Controller) APIReplicationFeed(ctx *gin.Context) {
+	if !replication.Authorized(ctx.GetHeader("Authorization"), c.Configuration.ReplicationToken) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid replication token"})
+		return
+	}
+
+	after, _ := strconv.ParseInt(ctx.DefaultQuery("after", "0"), 10, 64)
+	limit, _ := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(replication.DefaultLimit)))
+	waitSeconds, _ := strconv.Atoi(ctx.DefaultQuery("wait", "0"))
+	wait := min(time.Duration(waitSeconds)*time.Second, replication.MaxWait)
+
+	changed := c.Hub.Changed()
+	feed, err := replication.ReadFeed(c.Database, after, limit)
+	if err == nil && len(feed.Changes) == 0 && wait > 0 {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-ctx.Request.Context().Done():
+			return
+		}
+		feed, err = replication.ReadFeed(c.Database, after, limit)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, feed)
+}
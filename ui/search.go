@@ -1,23 +1,32 @@
 package ui
 
 import (
+	"dhtc/db"
+	"errors"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 func (c *Controller) SearchGet(ctx *gin.Context) {
 	params := c.parseSearchParams(ctx)
+	// Unlike the API, the search page groups near-duplicates by default.
+	params.Filters.Collapse = ctx.DefaultQuery("collapse", "true") == "true"
 
 	if params.SearchInput == "" {
 		ctx.HTML(http.StatusOK, "search", c.getCommonH(ctx))
 		return
 	}
 
-	results, total, _ := c.Database.Search(params.Key, params.MatchType, params.SearchInput, params.Limit, params.Offset, params.Filters)
+	results, total, err := c.Database.Search(params.Key, params.MatchType, params.SearchInput, params.Limit, params.Offset, params.Filters)
 
 	h := c.getCommonH(ctx)
+	if errors.Is(err, db.ErrInvalidQuery) {
+		h["queryError"] = err.Error()
+	}
 	h["results"] = results
 	h["currentPage"] = params.Page
 	h["totalPages"] = (total + int64(params.Limit) - 1) / int64(params.Limit)
@@ -30,10 +39,96 @@ func (c *Controller) SearchGet(ctx *gin.Context) {
 	h["maxSize"] = params.Filters.MaxSize
 	h["startDateVal"] = params.StartDateVal
 	h["endDateVal"] = params.EndDateVal
+	h["sort"] = params.Filters.Sort
+	h["categories"] = params.Filters.Categories
+	h["extensions"] = params.Filters.Extensions
+	h["collapse"] = params.Filters.Collapse
+	h["query"] = ctx.Request.URL.RawQuery
+	if err == nil {
+		if facets, err := c.Database.Facets(params.Key, params.MatchType, params.SearchInput, params.Filters); err == nil {
+			h["facets"] = facetGroups(ctx.Request.URL.Query(), params.Filters, facets)
+		}
+	}
 
 	ctx.HTML(http.StatusOK, "search", h)
 }
 
+type facetGroup struct {
+	Title string
+	Links []facetLink
+}
+
+// facetLink narrows the search to a facet value, or removes it again if Active.
+type facetLink struct {
+	Value  string
+	Count  int64
+	URL    string
+	Active bool
+}
+
+// facetGroups builds the links of the search page facets from the current search query.
+func facetGroups(query url.Values, filters db.SearchFilters, facets db.Facets) []facetGroup {
+	link := func(value string, count int64, active bool, change func(q url.Values)) facetLink {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = slices.Clone(v)
+		}
+		q.Del("page")
+		change(q)
+		return facetLink{Value: value, Count: count, URL: "/search?" + q.Encode(), Active: active}
+	}
+	toggle := func(param string, selected []string, counts []db.FacetCount) []facetLink {
+		var links []facetLink
+		for _, f := range counts {
+			active := slices.Contains(selected, f.Value)
+			links = append(links, link(f.Value, f.Count, active, func(q url.Values) {
+				if active {
+					q[param] = slices.DeleteFunc(q[param], func(v string) bool { return v == f.Value })
+				} else {
+					q.Add(param, f.Value)
+				}
+			}))
+		}
+		return links
+	}
+	setRange := func(minParam string, maxParam string, f db.FacetCount, active bool) func(q url.Values) {
+		return func(q url.Values) {
+			q.Del(minParam)
+			q.Del(maxParam)
+			if active {
+				return
+			}
+			if f.Min > 0 {
+				q.Set(minParam, strconv.FormatInt(f.Min, 10))
+			}
+			if f.Max > 0 {
+				q.Set(maxParam, strconv.FormatInt(f.Max, 10))
+			}
+		}
+	}
+
+	var sizes, discovered []facetLink
+	for _, f := range facets.Sizes {
+		active := filters.MinSize == uint64(f.Min) && filters.MaxSize == uint64(f.Max) //nolint:gosec // bucket bounds are positive
+		sizes = append(sizes, link(f.Value, f.Count, active, setRange("min-size", "max-size", f, active)))
+	}
+	for _, f := range facets.Discovered {
+		active := filters.StartDate == f.Min && filters.EndDate == f.Max
+		discovered = append(discovered, link(f.Value, f.Count, active, func(q url.Values) {
+			q.Del("start-date-val")
+			q.Del("end-date-val")
+			setRange("start-date", "end-date", f, active)(q)
+		}))
+	}
+
+	return []facetGroup{
+		{Title: "Category", Links: toggle("category", filters.Categories, facets.Categories)},
+		{Title: "Extension", Links: toggle("ext", filters.Extensions, facets.Extensions)},
+		{Title: "Size", Links: sizes},
+		{Title: "Discovered", Links: discovered},
+	}
+}
+
 func (c *Controller) SearchPost(ctx *gin.Context) {
 	key := ctx.PostForm("key")
 	matchType := ctx.PostForm("match-type")
@@ -42,6 +137,9 @@ func (c *Controller) SearchPost(ctx *gin.Context) {
 	maxSize := ctx.PostForm("max-size")
 	startDateVal := ctx.PostForm("start-date-val")
 	endDateVal := ctx.PostForm("end-date-val")
+	sort := ctx.PostForm("sort")
+	categories := ctx.PostFormArray("category")
+	extensions := ctx.PostFormArray("ext")
 
 	params := url.Values{}
 	params.Add("key", key)
@@ -59,6 +157,18 @@ func (c *Controller) SearchPost(ctx *gin.Context) {
 	if endDateVal != "" {
 		params.Add("end-date-val", endDateVal)
 	}
+	if sort != "" {
+		params.Add("sort", sort)
+	}
+	for _, category := range categories {
+		params.Add("category", category)
+	}
+	for _, ext := range extensions {
+		params.Add("ext", ext)
+	}
+	if ctx.PostForm("collapse") != "true" {
+		params.Add("collapse", "false")
+	}
 
 	ctx.Redirect(http.StatusSeeOther, "/search?"+params.Encode())
 }
@@ -1,18 +1,53 @@
 package ui
 
 import (
+	"dhtc/notifier"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// healthView is the delivery status of a notifier on the settings page.
+type healthView struct {
+	notifier.Health
+	Status      string
+	LastSuccess string
+	LastFailure string
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC822)
+}
+
+func (c *Controller) settingsH(ctx *gin.Context) gin.H {
+	h := c.getCommonH(ctx)
+	if c.Notifier != nil {
+		var health []healthView
+		for _, n := range c.Notifier.Health() {
+			health = append(health, healthView{
+				Health:      n,
+				Status:      n.Status(),
+				LastSuccess: formatTime(n.LastSuccess),
+				LastFailure: formatTime(n.LastErrorTime),
+			})
+		}
+		h["health"] = health
+	}
+	return h
+}
+
 func (c *Controller) SettingsGet(ctx *gin.Context) {
-	ctx.HTML(http.StatusOK, "settings", c.getCommonH(ctx))
+	ctx.HTML(http.StatusOK, "settings", c.settingsH(ctx))
 }
 
 func (c *Controller) SettingsPost(ctx *gin.Context) {
 	if err := ctx.ShouldBind(c.Configuration); err != nil {
-		h := c.getCommonH(ctx)
+		h := c.settingsH(ctx)
 		h["error"] = err.Error()
 		ctx.HTML(http.StatusBadRequest, "settings", h)
 		return
@@ -20,7 +55,43 @@ func (c *Controller) SettingsPost(ctx *gin.Context) {
 	if c.Notifier != nil {
 		c.Notifier.Setup(c.Configuration)
 	}
-	h := c.getCommonH(ctx)
+	h := c.settingsH(ctx)
 	h["saved"] = true
 	ctx.HTML(http.StatusOK, "settings", h)
 }
+
+// SettingsTestPost sends a test notification to a notifier and shows the
+// result on the settings page.
+func (c *Controller) SettingsTestPost(ctx *gin.Context) {
+	name := ctx.PostForm("test-notifier")
+	err := errors.New("notifications are disabled")
+	if c.Notifier != nil {
+		err = c.Notifier.Test(name)
+	}
+	// The health of the notifier includes the test.
+	h := c.settingsH(ctx)
+	if err != nil {
+		h["error"] = "Test notification to " + name + " failed: " + err.Error()
+	} else {
+		h["tested"] = name
+	}
+	ctx.HTML(http.StatusOK, "settings", h)
+}
+
+// APITestNotifier sends a test notification to a notifier and returns the
+// error of the delivery.
+func (c *Controller) APITestNotifier(ctx *gin.Context) {
+	if c.Notifier == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "notifications are disabled"})
+		return
+	}
+	err := c.Notifier.Test(ctx.Param("name"))
+	switch {
+	case errors.Is(err, notifier.ErrUnknownNotifier):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
@@ -0,0 +1,115 @@
+package ui
+
+import (
+	"cmp"
+	"dhtc/db"
+	dhtcclient "dhtc/dhtc-client"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const similarLimit = 10
+
+// FileNode is a directory or file of the file tree of a torrent. The size of a
+// directory is the size of its content.
+type FileNode struct {
+	Name     string      `json:"name"`
+	Size     int64       `json:"size"`
+	Children []*FileNode `json:"children,omitempty"`
+}
+
+// fileTree builds the file tree of a torrent, directories first and by name.
+func fileTree(files []dhtcclient.File) []*FileNode {
+	root := &FileNode{}
+	for _, f := range files {
+		node := root
+		parts := strings.Split(strings.Trim(f.Path, "/"), "/")
+		for i, part := range parts {
+			node.Size += f.Size
+			if i == len(parts)-1 {
+				node.Children = append(node.Children, &FileNode{Name: part, Size: f.Size})
+				break
+			}
+			j := slices.IndexFunc(node.Children, func(n *FileNode) bool { return n.Name == part && n.Children != nil })
+			if j < 0 {
+				node.Children = append(node.Children, &FileNode{Name: part, Children: []*FileNode{}})
+				j = len(node.Children) - 1
+			}
+			node = node.Children[j]
+		}
+	}
+	sortFileTree(root.Children)
+	return root.Children
+}
+
+func sortFileTree(nodes []*FileNode) {
+	slices.SortFunc(nodes, func(a, b *FileNode) int {
+		if (a.Children != nil) != (b.Children != nil) {
+			if a.Children != nil {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	for _, n := range nodes {
+		sortFileTree(n.Children)
+	}
+}
+
+// loadTorrent returns a torrent, the tree of its files and similar torrents,
+// or responds with an error and returns false.
+func (c *Controller) loadTorrent(ctx *gin.Context, respond func(status int, err error)) (db.Torrent, []*FileNode, []db.Similar, bool) {
+	t, err := c.Database.GetTorrent(strings.ToLower(ctx.Param("infohash")))
+	if errors.Is(err, db.ErrNotFound) {
+		respond(http.StatusNotFound, err)
+		return t, nil, nil, false
+	}
+	if err != nil {
+		respond(http.StatusInternalServerError, err)
+		return t, nil, nil, false
+	}
+	similar, err := db.SimilarTorrents(c.Database, t, similarLimit)
+	if err != nil {
+		respond(http.StatusInternalServerError, err)
+		return t, nil, nil, false
+	}
+	return t, fileTree(t.Files), similar, true
+}
+
+func (c *Controller) TorrentGet(ctx *gin.Context) {
+	t, tree, similar, ok := c.loadTorrent(ctx, func(status int, err error) {
+		h := c.getCommonH(ctx)
+		h["error"] = err.Error()
+		ctx.HTML(status, "torrent", h)
+	})
+	if !ok {
+		return
+	}
+
+	h := c.getCommonH(ctx)
+	h["torrent"] = t
+	h["discoveredOn"] = time.Unix(t.DiscoveredOn, 0).Format(time.RFC822)
+	h["tree"] = tree
+	h["similar"] = similar
+	ctx.HTML(http.StatusOK, "torrent", h)
+}
+
+func (c *Controller) APITorrent(ctx *gin.Context) {
+	t, tree, similar, ok := c.loadTorrent(ctx, func(status int, err error) {
+		ctx.JSON(status, gin.H{"error": err.Error()})
+	})
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"torrent": t,
+		"tree":    tree,
+		"similar": similar,
+	})
+}
@@ -0,0 +1,52 @@
+package ui
+
+import (
+	"dhtc/torznab"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// TorznabAPI serves the Torznab indexer API for Sonarr, Radarr and Prowlarr.
+func (c *Controller) TorznabAPI(ctx *gin.Context) {
+	ctx.Header("Content-Type", "application/xml; charset=utf-8")
+	if !torznab.Authorized(ctx.Query("apikey"), c.Configuration.TorznabAPIKey) {
+		c.torznabError(ctx, http.StatusUnauthorized, &torznab.Error{Code: torznab.ErrorCredentials, Description: "incorrect API key"})
+		return
+	}
+	req, err := torznab.ParseRequest(ctx.Request.URL.Query())
+	if err != nil {
+		c.torznabError(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Function == torznab.FunctionCaps {
+		ctx.Status(http.StatusOK)
+		err = torznab.WriteCaps(ctx.Writer)
+	} else {
+		results, total, searchErr := torznab.Search(c.Database, req)
+		if searchErr != nil {
+			status := http.StatusInternalServerError
+			var torznabErr *torznab.Error
+			if errors.As(searchErr, &torznabErr) {
+				status = http.StatusBadRequest
+			}
+			c.torznabError(ctx, status, searchErr)
+			return
+		}
+		ctx.Status(http.StatusOK)
+		err = torznab.WriteResults(ctx.Writer, results, req.Offset, total, c.Configuration.FeedTorrentURL)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("could not write torznab response")
+	}
+}
+
+func (c *Controller) torznabError(ctx *gin.Context, status int, err error) {
+	ctx.Status(status)
+	if err = torznab.WriteError(ctx.Writer, err); err != nil {
+		log.Error().Err(err).Msg("could not write torznab response")
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"dhtc/config"
 	"dhtc/db"
 	"dhtc/notifier"
+	"dhtc/replication"
+	"dhtc/torznab"
 	"html/template"
 	"io/fs"
+	"math"
 	"net/http"
 	"strings"
 
@@ -21,6 +24,7 @@ type Controller struct {
 	Configuration *config.Configuration
 	Hub           *Hub
 	Notifier      *notifier.Manager
+	Watches       *db.WatchEngine
 }
 
 func loadTemplates() multitemplate.Render {
@@ -30,6 +34,9 @@ func loadTemplates() multitemplate.Render {
 		"add": func(a, b int) int {
 			return a + b
 		},
+		"percent": func(f float64) int {
+			return int(math.Round(f * 100))
+		},
 	}
 
 	viewDirectory, _ := templates.ReadDir("templates/view")
@@ -59,7 +66,7 @@ func (c *Controller) getCommonH(ctx *gin.Context) gin.H {
 	}
 }
 
-func RunWebServer(configuration *config.Configuration, database db.Repository, hub *Hub, nManager *notifier.Manager) {
+func RunWebServer(configuration *config.Configuration, database db.Repository, hub *Hub, nManager *notifier.Manager, watches *db.WatchEngine) {
 	// gin.SetMode(gin.ReleaseMode)
 
 	srv := gin.Default()
@@ -69,17 +76,26 @@ func RunWebServer(configuration *config.Configuration, database db.Repository, h
 	store := cookie.NewStore([]byte(configuration.SessionSecret))
 	srv.Use(sessions.Sessions("dhtc-session", store))
 
-	if configuration.AuthUser != "" && configuration.AuthPass != "" {
-		srv.Use(gin.BasicAuth(gin.Accounts{
-			configuration.AuthUser: configuration.AuthPass,
-		}))
-	}
-
 	uiCtrl := Controller{
 		Database:      database,
 		Configuration: configuration,
 		Hub:           hub,
 		Notifier:      nManager,
+		Watches:       watches,
+	}
+
+	// Peers authenticate with the replication token instead of basic auth, so
+	// the feed is registered before the basic auth middleware.
+	srv.GET(replication.FeedPath, uiCtrl.APIReplicationFeed)
+	// Feed readers authenticate with the token of the saved search.
+	srv.GET("/feeds/:id", uiCtrl.FeedGet)
+	// Torznab clients authenticate with the API key.
+	srv.GET(torznab.Path, uiCtrl.TorznabAPI)
+
+	if configuration.AuthUser != "" && configuration.AuthPass != "" {
+		srv.Use(gin.BasicAuth(gin.Accounts{
+			configuration.AuthUser: configuration.AuthPass,
+		}))
 	}
 
 	srv.GET("", uiCtrl.Dashboard)
@@ -88,12 +104,16 @@ func RunWebServer(configuration *config.Configuration, database db.Repository, h
 	srv.POST("/search", uiCtrl.SearchPost)
 	srv.GET("/discover", uiCtrl.DiscoverGet)
 	srv.POST("/discover", uiCtrl.DiscoverPost)
+	srv.GET("/torrent/:infohash", uiCtrl.TorrentGet)
 	srv.GET("/watches", uiCtrl.WatchGet)
 	srv.POST("/watches", uiCtrl.WatchPost)
+	srv.GET("/feeds", uiCtrl.FeedsGet)
+	srv.POST("/feeds", uiCtrl.FeedsPost)
 	srv.GET("/blacklist", uiCtrl.BlacklistGet)
 	srv.POST("/blacklist", uiCtrl.BlacklistPost)
 	srv.GET("/settings", uiCtrl.SettingsGet)
 	srv.POST("/settings", uiCtrl.SettingsPost)
+	srv.POST("/settings/test", uiCtrl.SettingsTestPost)
 	srv.GET("/trawl", uiCtrl.Trawl)
 	srv.GET("/ws/trawl", func(c *gin.Context) {
 		uiCtrl.HandleWebSocket(c.Writer, c.Request)
@@ -114,6 +134,10 @@ func RunWebServer(configuration *config.Configuration, database db.Repository, h
 		api.GET("/stats", uiCtrl.APIStats)
 		api.GET("/categories", uiCtrl.APICategories)
 		api.GET("/latest", uiCtrl.APILatest)
+		api.GET("/torrent/:infohash", uiCtrl.APITorrent)
+		api.GET("/watches/:id/hits", uiCtrl.APIWatchHits)
+		api.POST("/notifiers/:name/test", uiCtrl.APITestNotifier)
+		api.GET("/export", uiCtrl.APIExport)
 	}
 
 	css, _ := fs.Sub(static, "static/css")
@@ -1,34 +1,190 @@
 package ui
 
 import (
+	"dhtc/db"
+	"dhtc/downloader"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 )
 
+// watchCategories are the categories a watch can be limited to.
+var watchCategories = []string{"Video", "Audio", "Software", "Document", "Picture", "Archive", "Other", "Unknown"}
+
 func (c *Controller) WatchGet(ctx *gin.Context) {
-	ctx.HTML(http.StatusOK, "watches", gin.H{
-		"path":    ctx.FullPath(),
-		"results": c.Database.GetWatchEntries(),
-	})
+	c.renderWatches(ctx, "", false, nil)
 }
 
 func (c *Controller) WatchPost(ctx *gin.Context) {
 	opOk := false
+	var err error
 	op := ctx.PostForm("op")
 	if op == "add" {
-		opOk = c.Database.InsertWatchEntry(
-			ctx.PostForm("key"),
-			ctx.PostForm("match-type"),
-			ctx.PostForm("search-input"))
+		var entry db.WatchEntry
+		if entry, err = parseWatchEntry(ctx); err == nil {
+			err = entry.Validate()
+		}
+		if err == nil {
+			opOk = c.Database.InsertWatchEntry(entry)
+		}
 	} else if op == "delete" {
 		opOk = c.Database.DeleteWatchEntry(ctx.PostForm("id")) == nil
 	}
+	if opOk {
+		c.Watches.Reload()
+	}
+	c.renderWatches(ctx, op, opOk, err)
+}
+
+// parseWatchEntry reads a watch entry from the posted form. Sizes may have a
+// unit like "2GB", lists are comma separated.
+func parseWatchEntry(ctx *gin.Context) (db.WatchEntry, error) {
+	entry := db.WatchEntry{
+		Key:            ctx.PostForm("key"),
+		MatchType:      ctx.PostForm("match-type"),
+		Content:        strings.TrimSpace(ctx.PostForm("search-input")),
+		Categories:     ctx.PostFormArray("category"),
+		Exclude:        splitTerms(ctx.PostForm("exclude")),
+		QuietStart:     ctx.PostForm("quiet-start"),
+		QuietEnd:       ctx.PostForm("quiet-end"),
+		Notifiers:      ctx.PostFormArray("notifier"),
+		Downloader:     ctx.PostForm("downloader"),
+		SavePath:       strings.TrimSpace(ctx.PostForm("save-path")),
+		Label:          strings.TrimSpace(ctx.PostForm("label")),
+		FirstMatchOnly: ctx.PostForm("first-match-only") == "on",
+		Digest:         ctx.PostForm("digest"),
+	}
+	var err error
+	if value := ctx.PostForm("min-size"); value != "" {
+		if entry.MinSize, err = db.ParseSize(value); err != nil {
+			return entry, err
+		}
+	}
+	if value := ctx.PostForm("max-size"); value != "" {
+		if entry.MaxSize, err = db.ParseSize(value); err != nil {
+			return entry, err
+		}
+	}
+	if value := ctx.PostForm("min-files"); value != "" {
+		if entry.MinFiles, err = strconv.Atoi(value); err != nil {
+			return entry, err
+		}
+	}
+	if value := ctx.PostForm("daily-cap"); value != "" {
+		if entry.DailyCap, err = strconv.Atoi(value); err != nil {
+			return entry, err
+		}
+	}
+	if value := ctx.PostForm("digest-interval"); value != "" && entry.Digest == db.DigestBatch {
+		if entry.DigestInterval, err = strconv.Atoi(value); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+func splitTerms(value string) []string {
+	var terms []string
+	for _, term := range strings.Split(value, ",") {
+		if term = strings.TrimSpace(term); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// latestHits is the number of hits listed on the watches page.
+const latestHits = 20
+
+// watchView is a watch entry with the statistics of its hits.
+type watchView struct {
+	db.WatchEntry
+	Hits    int64
+	LastHit string
+}
 
-	ctx.HTML(http.StatusOK, "watches", gin.H{
-		"path":    ctx.FullPath(),
-		"op":      op,
-		"opOk":    opOk,
-		"results": c.Database.GetWatchEntries(),
+// hitView is a hit with a description of its watch.
+type hitView struct {
+	db.WatchHit
+	Watch string
+	Date  string
+}
+
+func (c *Controller) renderWatches(ctx *gin.Context, op string, opOk bool, err error) {
+	stats, statsErr := c.Database.GetWatchHitStats()
+	if statsErr != nil {
+		log.Error().Err(statsErr).Msg("could not load watch hit statistics")
+	}
+	hits, hitsErr := c.Database.GetWatchHits("", latestHits)
+	if hitsErr != nil {
+		log.Error().Err(hitsErr).Msg("could not load watch hits")
+	}
+
+	entries := c.Database.GetWatchEntries()
+	watches := make([]watchView, len(entries))
+	descriptions := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		watches[i] = watchView{WatchEntry: entry, Hits: stats[entry.Id].Count}
+		if last := stats[entry.Id].LastHit; last > 0 {
+			watches[i].LastHit = time.Unix(last, 0).Format(time.RFC822)
+		}
+		descriptions[entry.Id] = strings.TrimSpace(entry.Key + " " + entry.MatchType + " " + entry.Content)
+	}
+	latest := make([]hitView, len(hits))
+	for i, hit := range hits {
+		latest[i] = hitView{WatchHit: hit, Watch: descriptions[hit.WatchId], Date: time.Unix(hit.Time, 0).Format(time.RFC822)}
+	}
+
+	var notifiers []string
+	if c.Notifier != nil {
+		notifiers = c.Notifier.Names()
+	}
+	h := gin.H{
+		"path":        ctx.FullPath(),
+		"op":          op,
+		"opOk":        opOk,
+		"results":     watches,
+		"hits":        latest,
+		"categories":  watchCategories,
+		"notifiers":   notifiers,
+		"downloaders": downloader.Names,
+	}
+	if err != nil {
+		h["error"] = err.Error()
+	}
+	ctx.HTML(http.StatusOK, "watches", h)
+}
+
+// APIWatchHits returns the latest hits of a watch.
+func (c *Controller) APIWatchHits(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if !slices.ContainsFunc(c.Database.GetWatchEntries(), func(e db.WatchEntry) bool { return e.Id == id }) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": db.ErrNotFound.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+	hits, err := c.Database.GetWatchHits(id, limit)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats, err := c.Database.GetWatchHitStats()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"hits":    hits,
+		"total":   stats[id].Count,
+		"lastHit": stats[id].LastHit,
 	})
 }